@@ -0,0 +1,68 @@
+// Command createadmin gives a new installation its first admin, or promotes
+// an existing user to admin:
+//
+//	go run ./cmd/createadmin -username alice -email alice@example.com
+//
+// The password is read from CINEMA_ADMIN_PASSWORD or, failing that, from the
+// first line of standard input, so it never shows up in the process list.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/accounts"
+	"github.com/JoeDkhar/cinema-booking-system/internal/config"
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+)
+
+func main() {
+	dbPath := flag.String("db", "cinema.db", "path to the SQLite database")
+	username := flag.String("username", "", "username of the admin")
+	email := flag.String("email", "", "email address, needed when creating a new user")
+	flag.Parse()
+
+	if *username == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	password := config.String("CINEMA_ADMIN_PASSWORD", "")
+	if password == "" {
+		fmt.Fprint(os.Stderr, "Password (leave empty to keep an existing user's password): ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			log.Fatalf("Error reading password: %v", err)
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+
+	accounts.MinPasswordLength = config.Int("CINEMA_PASSWORD_MIN_LENGTH", accounts.MinPasswordLength)
+	if password != "" {
+		if err := accounts.CheckPassword(password, models.User{Username: *username, Email: *email}); err != nil {
+			log.Fatalf("Invalid password: %v", err)
+		}
+	}
+
+	if err := database.Initialize(*dbPath); err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+
+	user, created, err := database.BootstrapAdmin(*username, *email, password)
+	if err != nil {
+		log.Fatalf("Failed to create admin: %v", err)
+	}
+
+	if created {
+		fmt.Printf("Created admin %s <%s>\n", user.Username, user.Email)
+	} else {
+		fmt.Printf("Made %s an admin\n", user.Username)
+	}
+}
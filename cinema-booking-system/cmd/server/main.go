@@ -2,16 +2,26 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"log"
 	"net/http"
+	"net/mail"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/JoeDkhar/cinema-booking-system/internal/accounts"
+	"github.com/JoeDkhar/cinema-booking-system/internal/apikeys"
+	"github.com/JoeDkhar/cinema-booking-system/internal/config"
 	"github.com/JoeDkhar/cinema-booking-system/internal/database"
 	"github.com/JoeDkhar/cinema-booking-system/internal/handlers"
 	"github.com/JoeDkhar/cinema-booking-system/internal/middleware"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/money"
+	"github.com/JoeDkhar/cinema-booking-system/internal/notifications"
+	"github.com/JoeDkhar/cinema-booking-system/internal/sessions"
 	"github.com/gorilla/mux"
 )
 
@@ -23,6 +33,12 @@ func main() {
 	ensureDir("static/images")
 	ensureDir("templates")
 
+	// Configure how amounts are charged and shown, before the database
+	// migration converts old float amounts to the default currency
+	money.DefaultCurrency = config.String("CINEMA_CURRENCY", money.DefaultCurrency)
+	money.DefaultLocale = config.String("CINEMA_LOCALE", money.DefaultLocale)
+	handlers.PriceRules.TaxPercent = config.Float("CINEMA_TAX_PERCENT", handlers.PriceRules.TaxPercent)
+
 	// Initialize database
 	dbPath := "cinema.db"
 	err := database.Initialize(dbPath)
@@ -39,6 +55,100 @@ func main() {
 	// Initialize handlers
 	handlers.Initialize()
 
+	// Configure booking rules
+	handlers.MaxSeatsPerBooking = config.Int("CINEMA_MAX_SEATS_PER_BOOKING", handlers.MaxSeatsPerBooking)
+	handlers.HoldDuration = config.Duration("CINEMA_HOLD_DURATION", handlers.HoldDuration)
+	handlers.WaitlistClaimWindow = config.Duration("CINEMA_WAITLIST_CLAIM_WINDOW", handlers.WaitlistClaimWindow)
+
+	// Configure how long logins last
+	sessions.IdleTimeout = config.Duration("CINEMA_SESSION_IDLE_TIMEOUT", sessions.IdleTimeout)
+	sessions.MaxAge = config.Duration("CINEMA_SESSION_MAX_AGE", sessions.MaxAge)
+	handlers.ClaimLinkValidity = config.Duration("CINEMA_CLAIM_LINK_VALIDITY", handlers.ClaimLinkValidity)
+
+	// Configure password rules and the links emailed to verify addresses
+	// and reset passwords
+	accounts.MinPasswordLength = config.Int("CINEMA_PASSWORD_MIN_LENGTH", accounts.MinPasswordLength)
+	accounts.VerifyLinkValidity = config.Duration("CINEMA_VERIFY_LINK_VALIDITY", accounts.VerifyLinkValidity)
+	accounts.ResetLinkValidity = config.Duration("CINEMA_RESET_LINK_VALIDITY", accounts.ResetLinkValidity)
+
+	// Configure how failed logins are slowed down and locked out
+	accounts.FreeLoginAttempts = config.Int("CINEMA_LOGIN_FREE_ATTEMPTS", accounts.FreeLoginAttempts)
+	accounts.LoginDelay = config.Duration("CINEMA_LOGIN_DELAY", accounts.LoginDelay)
+	accounts.MaxLoginDelay = config.Duration("CINEMA_LOGIN_MAX_DELAY", accounts.MaxLoginDelay)
+	accounts.LockoutThreshold = config.Int("CINEMA_LOCKOUT_THRESHOLD", accounts.LockoutThreshold)
+	accounts.LockoutDuration = config.Duration("CINEMA_LOCKOUT_DURATION", accounts.LockoutDuration)
+	accounts.IPLockoutThreshold = config.Int("CINEMA_IP_LOCKOUT_THRESHOLD", accounts.IPLockoutThreshold)
+
+	// Configure two-factor authentication
+	accounts.TwoFactorIssuer = config.String("CINEMA_TOTP_ISSUER", accounts.TwoFactorIssuer)
+	accounts.TwoFactorLoginValidity = config.Duration("CINEMA_TWO_FACTOR_LOGIN_VALIDITY", accounts.TwoFactorLoginValidity)
+
+	// Configure partners' API keys
+	apikeys.DefaultRateLimit = config.Int("CINEMA_API_KEY_RATE_LIMIT", apikeys.DefaultRateLimit)
+	apikeys.AnonymousRateLimit = config.Int("CINEMA_API_ANONYMOUS_RATE_LIMIT", apikeys.AnonymousRateLimit)
+
+	// Configure cookies and which other sites may call the site from a browser
+	sessions.SecureCookies = config.Bool("CINEMA_SECURE_COOKIES", sessions.SecureCookies)
+	switch sameSite := config.String("CINEMA_COOKIE_SAMESITE", "lax"); strings.ToLower(sameSite) {
+	case "lax":
+		sessions.SameSite = http.SameSiteLaxMode
+	case "strict":
+		sessions.SameSite = http.SameSiteStrictMode
+	case "none":
+		if !sessions.SecureCookies {
+			log.Printf("CINEMA_COOKIE_SAMESITE=none needs CINEMA_SECURE_COOKIES; browsers will ignore the cookies")
+		}
+		sessions.SameSite = http.SameSiteNoneMode
+	default:
+		log.Printf("Ignoring invalid CINEMA_COOKIE_SAMESITE=%q", sameSite)
+	}
+	middleware.AllowedOrigins = config.List("CINEMA_ALLOWED_ORIGINS", middleware.AllowedOrigins)
+	handlers.RefundPolicy = models.CancellationPolicy{
+		FullRefundBefore:     config.Duration("CINEMA_FULL_REFUND_BEFORE", models.DefaultCancellationPolicy.FullRefundBefore),
+		PartialRefundPercent: config.Int("CINEMA_PARTIAL_REFUND_PERCENT", models.DefaultCancellationPolicy.PartialRefundPercent),
+	}
+
+	// Configure payments; the sandbox provider is the only one built in
+	handlers.PaymentTimeout = config.Duration("CINEMA_PAYMENT_TIMEOUT", handlers.PaymentTimeout)
+
+	// Configure ticket signing. A random secret invalidates printed tickets
+	// on every restart, so production must set one.
+	if secret := config.String("CINEMA_TICKET_SECRET", ""); secret != "" {
+		handlers.TicketSecret = []byte(secret)
+	} else {
+		log.Printf("CINEMA_TICKET_SECRET is not set; tickets issued now stop verifying after a restart")
+		handlers.TicketSecret = make([]byte, 32)
+		if _, err := rand.Read(handlers.TicketSecret); err != nil {
+			log.Fatalf("Failed to create ticket secret: %v", err)
+		}
+	}
+	handlers.CheckInOpensBefore = config.Duration("CINEMA_CHECKIN_OPENS_BEFORE", handlers.CheckInOpensBefore)
+	handlers.AttachTickets = config.Bool("CINEMA_MAIL_ATTACH_TICKETS", handlers.AttachTickets)
+
+	// Configure customer emails; without an SMTP host they are only logged
+	var transport notifications.Transport = notifications.LogTransport{}
+	if host := config.String("CINEMA_SMTP_HOST", ""); host != "" {
+		transport = &notifications.SMTPTransport{
+			Host:     host,
+			Port:     config.Int("CINEMA_SMTP_PORT", 587),
+			Username: config.String("CINEMA_SMTP_USERNAME", ""),
+			Password: config.String("CINEMA_SMTP_PASSWORD", ""),
+			From: mail.Address{
+				Name:    config.String("CINEMA_MAIL_FROM_NAME", "Cinema Booking"),
+				Address: config.String("CINEMA_MAIL_FROM", "bookings@localhost"),
+			},
+		}
+	}
+	handlers.BaseURL = strings.TrimSuffix(config.String("CINEMA_BASE_URL", handlers.BaseURL), "/")
+	outbox := notifications.NewOutbox(transport)
+	outbox.BaseURL = handlers.BaseURL
+	outbox.MaxAttempts = config.Int("CINEMA_MAIL_MAX_ATTEMPTS", outbox.MaxAttempts)
+	outbox.RetryDelay = config.Duration("CINEMA_MAIL_RETRY_DELAY", outbox.RetryDelay)
+	handlers.Outbox = outbox
+	handlers.ReminderBefore = config.Duration("CINEMA_REMINDER_BEFORE", handlers.ReminderBefore)
+	outbox.Start()
+	defer outbox.Stop()
+
 	// Start the booking processor
 	handlers.StartBookingProcessor()
 
@@ -52,42 +162,121 @@ func main() {
 	r.Use(middleware.LoggingMiddleware)
 	r.Use(middleware.RecoveryMiddleware)
 	r.Use(middleware.CORSMiddleware)
+	r.Use(middleware.CSRFMiddleware)
 
-	// API routes with version prefix
+	// API routes with version prefix. Partners call them with an API key,
+	// which may only be used for the routes its scopes allow. Every route
+	// names its scope. Anyone may call the routes with public scopes without
+	// a key; the site calls the others without one too.
 	api := r.PathPrefix("/api/v1").Subrouter()
+	api.Use(middleware.APIKeyMiddleware)
+	scope := func(needed models.APIScope, handler http.HandlerFunc) http.Handler {
+		return middleware.RequireAPIScope(needed)(handler)
+	}
 
 	// Public routes
 	r.HandleFunc("/", handlers.HomeHandler).Methods("GET")
 	r.HandleFunc("/movies", handlers.MoviesHandler).Methods("GET")
 	r.HandleFunc("/movies/{id:[0-9]+}", handlers.MovieDetailHandler).Methods("GET")
+	r.HandleFunc("/movies/{id:[0-9]+}/shows.ics", handlers.MovieCalendarHandler).Methods("GET")
 	r.HandleFunc("/shows/{id:[0-9]+}", handlers.ShowDetailHandler).Methods("GET")
+	r.HandleFunc("/shows/{id:[0-9]+}/group", handlers.CreateGroupSessionHandler).Methods("POST")
+	r.HandleFunc("/shows/{id:[0-9]+}/group/{code}", handlers.GroupSessionHandler).Methods("GET")
+	r.HandleFunc("/shows/{id:[0-9]+}/group/{code}/ws", handlers.GroupSocketHandler).Methods("GET")
+	r.HandleFunc("/shows/{id:[0-9]+}/waitlist", handlers.JoinWaitlistHandler).Methods("POST")
+	r.HandleFunc("/waitlist/{token}", handlers.WaitlistHandler).Methods("GET")
+	r.HandleFunc("/waitlist/{token}/claim", handlers.ClaimWaitlistHandler).Methods("GET")
+	r.HandleFunc("/waitlist/{token}/leave", handlers.LeaveWaitlistHandler).Methods("POST")
 	r.HandleFunc("/booking", handlers.BookingHandler).Methods("POST")
-	r.HandleFunc("/booking/confirmation/{id:[0-9]+}", handlers.BookingConfirmationHandler).Methods("GET")
+	r.HandleFunc("/booking/find", handlers.FindBookingHandler).Methods("GET", "POST")
+	r.HandleFunc("/booking/cancel", handlers.CancelBookingFormHandler).Methods("GET", "POST")
+	r.HandleFunc("/booking/checkout/{reference}", handlers.CheckoutHandler).Methods("GET")
+	r.HandleFunc("/booking/confirmation/{reference}", handlers.BookingConfirmationHandler).Methods("GET")
+	r.HandleFunc("/booking/confirmation/{reference}/tickets.pdf", handlers.TicketsPDFHandler).Methods("GET")
+	r.HandleFunc("/booking/confirmation/{reference}/booking.ics", handlers.BookingCalendarHandler).Methods("GET")
+	r.HandleFunc("/booking/{reference}/confirm", handlers.ConfirmHoldHandler).Methods("POST")
+	r.HandleFunc("/booking/{reference}/extend", handlers.ExtendHoldHandler).Methods("POST")
+	r.HandleFunc("/booking/{reference}/release", handlers.ReleaseHoldHandler).Methods("POST")
+	r.HandleFunc("/booking/{reference}/cancel", handlers.CancelBookingHandler).Methods("POST")
 
 	// User authentication routes
 	r.HandleFunc("/register", handlers.RegisterHandler).Methods("GET", "POST")
 	r.HandleFunc("/login", handlers.LoginHandler).Methods("GET", "POST")
+	r.HandleFunc("/login/two-factor", handlers.TwoFactorLoginHandler).Methods("GET", "POST")
 	r.HandleFunc("/logout", handlers.LogoutHandler).Methods("POST")
+	r.HandleFunc("/verify-email/{token}", handlers.VerifyEmailHandler).Methods("GET")
+	r.HandleFunc("/forgot-password", handlers.ForgotPasswordHandler).Methods("GET", "POST")
+	r.HandleFunc("/reset-password/{token}", handlers.ResetPasswordHandler).Methods("GET", "POST")
+
+	// Account routes (protected)
+	account := r.PathPrefix("/account").Subrouter()
+	account.Use(middleware.AuthMiddleware)
+	account.HandleFunc("/sessions", handlers.AccountSessionsHandler).Methods("GET")
+	account.HandleFunc("/sessions/{id:[0-9]+}/revoke", handlers.RevokeSessionHandler).Methods("POST")
+	account.HandleFunc("/sessions/revoke-all", handlers.LogoutEverywhereHandler).Methods("POST")
+	account.HandleFunc("/password", handlers.ChangePasswordHandler).Methods("GET", "POST")
+	account.HandleFunc("/two-factor", handlers.TwoFactorHandler).Methods("GET")
+	account.HandleFunc("/two-factor/start", handlers.StartTwoFactorHandler).Methods("POST")
+	account.HandleFunc("/two-factor/enable", handlers.EnableTwoFactorHandler).Methods("POST")
+	account.HandleFunc("/two-factor/recovery-codes", handlers.RecoveryCodesHandler).Methods("POST")
+	account.HandleFunc("/two-factor/disable", handlers.DisableTwoFactorHandler).Methods("POST")
+	account.HandleFunc("/verify-email", handlers.ResendVerificationHandler).Methods("POST")
+	account.HandleFunc("/bookings", handlers.MyBookingsHandler).Methods("GET")
+	account.HandleFunc("/bookings/claim", handlers.RequestBookingClaimHandler).Methods("POST")
+	account.HandleFunc("/bookings/claim/{token}", handlers.ClaimBookingsHandler).Methods("GET")
 
 	// API routes
-	api.HandleFunc("/shows/{id:[0-9]+}/seats", handlers.GetAvailableSeatsHandler).Methods("GET")
-	api.HandleFunc("/health", handlers.HealthCheckHandler).Methods("GET")
-	api.HandleFunc("/movies", handlers.APIMoviesHandler).Methods("GET")
-	api.HandleFunc("/movies/{id:[0-9]+}", handlers.APIMovieDetailHandler).Methods("GET")
+	api.Handle("/shows/{id:[0-9]+}/seats", scope(models.ScopeReadCatalog, handlers.GetAvailableSeatsHandler)).Methods("GET")
+	api.Handle("/shows/{id:[0-9]+}/seats/stream", scope(models.ScopeReadCatalog, handlers.SeatStreamHandler)).Methods("GET")
+	api.Handle("/shows/{id:[0-9]+}/groups", scope(models.ScopeCreateBookings, handlers.APICreateGroupSessionHandler)).Methods("POST")
+	api.Handle("/shows/{id:[0-9]+}/waitlist", scope(models.ScopeJoinWaitlists, handlers.APIJoinWaitlistHandler)).Methods("POST")
+	api.Handle("/waitlist/{token}", scope(models.ScopeJoinWaitlists, handlers.APIWaitlistDetailHandler)).Methods("GET")
+	api.Handle("/waitlist/{token}", scope(models.ScopeJoinWaitlists, handlers.APILeaveWaitlistHandler)).Methods("DELETE")
+	api.Handle("/health", scope(models.ScopeReadCatalog, handlers.HealthCheckHandler)).Methods("GET")
+	api.Handle("/movies", scope(models.ScopeReadCatalog, handlers.APIMoviesHandler)).Methods("GET")
+	api.Handle("/movies/{id:[0-9]+}", scope(models.ScopeReadCatalog, handlers.APIMovieDetailHandler)).Methods("GET")
+	api.Handle("/halls/{id:[0-9]+}", scope(models.ScopeReadCatalog, handlers.APIHallDetailHandler)).Methods("GET")
+	api.Handle("/bookings", scope(models.ScopeCreateBookings, handlers.APICreateBookingHandler)).Methods("POST")
+	api.Handle("/bookings/{reference}", scope(models.ScopeCreateBookings, handlers.APIBookingDetailHandler)).Methods("GET")
+	api.Handle("/bookings/{reference}", scope(models.ScopeCancelBookings, handlers.APICancelBookingHandler)).Methods("DELETE")
 
-	// Admin routes (protected)
+	// Routes for the user logged in to the site, which keys may not call
+	signedIn := middleware.RequireAPIScope(models.ScopeAccount)
+	api.Handle("/me/bookings", signedIn(middleware.RequireAPIUser(http.HandlerFunc(handlers.APIMyBookingsHandler)))).Methods("GET")
+	api.Handle("/checkin", signedIn(middleware.RequireAPIPermission(models.PermCheckIn)(http.HandlerFunc(handlers.APICheckInHandler)))).Methods("POST")
+
+	// Admin routes (protected). Every route names the permission it needs.
 	admin := r.PathPrefix("/admin").Subrouter()
 	admin.Use(middleware.AuthMiddleware)
-	admin.HandleFunc("/dashboard", handlers.AdminDashboardHandler).Methods("GET")
-	admin.HandleFunc("/movies/new", handlers.AdminNewMovieHandler).Methods("GET", "POST")
-	admin.HandleFunc("/movies/{id:[0-9]+}/edit", handlers.AdminEditMovieHandler).Methods("GET", "POST")
-	admin.HandleFunc("/shows/new", handlers.AdminNewShowHandler).Methods("GET", "POST")
-	admin.HandleFunc("/bookings", handlers.AdminBookingsHandler).Methods("GET")
+	can := func(permission models.Permission, handler http.HandlerFunc) http.Handler {
+		return middleware.RequirePermission(permission)(handler)
+	}
+	admin.Handle("/dashboard", can(models.PermViewDashboard, handlers.AdminDashboardHandler)).Methods("GET")
+	admin.Handle("/movies/new", can(models.PermManageSchedule, handlers.AdminNewMovieHandler)).Methods("GET", "POST")
+	admin.Handle("/movies/{id:[0-9]+}/edit", can(models.PermManageSchedule, handlers.AdminEditMovieHandler)).Methods("GET", "POST")
+	admin.Handle("/shows/new", can(models.PermManageSchedule, handlers.AdminNewShowHandler)).Methods("GET", "POST")
+	admin.Handle("/shows/{id:[0-9]+}/reschedule", can(models.PermManageSchedule, handlers.AdminRescheduleShowHandler)).Methods("GET", "POST")
+	admin.Handle("/halls", can(models.PermManageHalls, handlers.AdminHallsHandler)).Methods("GET")
+	admin.Handle("/halls/new", can(models.PermManageHalls, handlers.AdminNewHallHandler)).Methods("GET", "POST")
+	admin.Handle("/halls/{id:[0-9]+}/edit", can(models.PermManageHalls, handlers.AdminEditHallHandler)).Methods("GET", "POST")
+	admin.Handle("/promo-codes", can(models.PermManagePromos, handlers.AdminPromoCodesHandler)).Methods("GET")
+	admin.Handle("/promo-codes/new", can(models.PermManagePromos, handlers.AdminNewPromoCodeHandler)).Methods("GET", "POST")
+	admin.Handle("/promo-codes/{id:[0-9]+}/edit", can(models.PermManagePromos, handlers.AdminEditPromoCodeHandler)).Methods("GET", "POST")
+	admin.Handle("/bookings", can(models.PermManageBookings, handlers.AdminBookingsHandler)).Methods("GET")
+	admin.Handle("/checkins", can(models.PermCheckIn, handlers.AdminCheckInsHandler)).Methods("GET")
+	admin.Handle("/bookings/{id:[0-9]+}/cancel", can(models.PermManageBookings, handlers.AdminCancelBookingHandler)).Methods("POST")
+	admin.Handle("/users", can(models.PermManageUsers, handlers.AdminUsersHandler)).Methods("GET")
+	admin.Handle("/users/{id:[0-9]+}/role", can(models.PermManageUsers, handlers.AdminUpdateUserRoleHandler)).Methods("POST")
+	admin.Handle("/users/{id:[0-9]+}/unlock", can(models.PermManageUsers, handlers.AdminUnlockUserHandler)).Methods("POST")
+	admin.Handle("/api-keys", can(models.PermManageAPIKeys, handlers.AdminAPIKeysHandler)).Methods("GET")
+	admin.Handle("/api-keys", can(models.PermManageAPIKeys, handlers.AdminCreateAPIKeyHandler)).Methods("POST")
+	admin.Handle("/api-keys/{id:[0-9]+}/revoke", can(models.PermManageAPIKeys, handlers.AdminRevokeAPIKeyHandler)).Methods("POST")
 
 	// Serve static files
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 
-	// Create server with timeouts
+	// Create server with timeouts. Handlers that call the payment provider or
+	// stream events extend their own write deadline.
 	server := &http.Server{
 		Addr:         ":8080",
 		Handler:      r,
@@ -95,6 +284,7 @@ func main() {
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
 	}
+	server.RegisterOnShutdown(handlers.CloseSeatStreams)
 
 	// Start server in a goroutine
 	go func() {
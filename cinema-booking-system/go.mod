@@ -7,7 +7,10 @@ toolchain go1.23.5
 replace github.com/JoeDkhar/cinema-booking-system => ./
 
 require (
+	github.com/go-pdf/fpdf v0.9.0
 	github.com/gorilla/mux v1.8.1
+	github.com/gorilla/websocket v1.5.3
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	golang.org/x/crypto v0.36.0
 	gorm.io/driver/sqlite v1.5.7
 	gorm.io/gorm v1.25.12
@@ -0,0 +1,207 @@
+// Package accounts manages user passwords, two-factor authentication,
+// lockouts after failed logins and the single-use links emailed to users to
+// verify their address or reset a forgotten password.
+package accounts
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/sessions"
+	"github.com/JoeDkhar/cinema-booking-system/internal/utils"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+var (
+	// MinPasswordLength is the fewest characters a password may have
+	MinPasswordLength = 10
+
+	// VerifyLinkValidity is how long a link to verify an email address works
+	VerifyLinkValidity = 48 * time.Hour
+	// ResetLinkValidity is how long a link to reset a password works
+	ResetLinkValidity = time.Hour
+)
+
+// maxPasswordBytes is the most bcrypt hashes; longer passwords are refused
+// rather than silently cut short
+const maxPasswordBytes = 72
+
+// commonPasswords are refused however well they meet the other rules
+var commonPasswords = map[string]bool{
+	"password1": true, "password12": true, "password123": true, "password1234": true,
+	"passw0rd123": true, "qwerty123": true, "qwerty1234": true, "qwertyuiop1": true,
+	"1q2w3e4r5t": true, "1qaz2wsx3edc": true, "abc1234567": true, "abcd123456": true,
+	"iloveyou123": true, "letmein123": true, "welcome123": true, "admin12345": true,
+	"football123": true, "monkey12345": true, "sunshine123": true, "princess123": true,
+	"trustno1234": true, "changeme123": true, "cinema12345": true, "movies12345": true,
+}
+
+var (
+	// ErrInvalidToken is returned for links that do not exist, have expired
+	// or were already used
+	ErrInvalidToken = errors.New("this link is invalid, has expired or was already used")
+	// ErrEmailChanged is returned for verification links sent to an address
+	// the user no longer has
+	ErrEmailChanged = errors.New("this link was sent to an address that is no longer on the account")
+)
+
+// CheckPassword returns why a password is too weak for a user, or nil if it
+// is strong enough
+func CheckPassword(password string, user models.User) error {
+	if utf8.RuneCountInString(password) < MinPasswordLength {
+		return fmt.Errorf("password must be at least %d characters long", MinPasswordLength)
+	}
+	if len(password) > maxPasswordBytes {
+		return fmt.Errorf("password must be at most %d characters long", maxPasswordBytes)
+	}
+
+	hasLetter, hasOther := false, false
+	for _, r := range password {
+		if unicode.IsLetter(r) {
+			hasLetter = true
+		} else if !unicode.IsSpace(r) {
+			hasOther = true
+		}
+	}
+	if !hasLetter || !hasOther {
+		return errors.New("password must contain letters and at least one number or symbol")
+	}
+
+	lower := strings.ToLower(password)
+	if commonPasswords[lower] {
+		return errors.New("password is too common")
+	}
+
+	localPart, _, _ := strings.Cut(user.Email, "@")
+	for _, personal := range []string{user.Username, localPart} {
+		if len(personal) >= 3 && strings.Contains(lower, strings.ToLower(personal)) {
+			return errors.New("password must not contain your username or email address")
+		}
+	}
+	return nil
+}
+
+// HashPassword returns the hash a password is stored as
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// SetPassword changes a user's password and logs them out everywhere, so a
+// stolen session does not outlive the password it was made with. Links to
+// reset the old password stop working.
+func SetPassword(user models.User, password string, now time.Time) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.User{}).Where("id = ?", user.ID).UpdateColumn("password_hash", hash).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.AccountToken{}).
+			Where("user_id = ? AND purpose = ? AND used_at IS NULL", user.ID, models.TokenResetPassword).
+			UpdateColumn("used_at", now).Error
+	})
+	if err != nil {
+		return err
+	}
+	return sessions.RevokeAll(user.ID)
+}
+
+// IssueToken creates a token for a user, such as for a link to email them,
+// returning the token to put in it
+func IssueToken(user models.User, purpose models.TokenPurpose, now time.Time) (string, models.AccountToken, error) {
+	validity := VerifyLinkValidity
+	switch purpose {
+	case models.TokenResetPassword:
+		validity = ResetLinkValidity
+	case models.TokenTwoFactorLogin:
+		validity = TwoFactorLoginValidity
+	}
+
+	token := utils.GenerateSessionToken()
+	accountToken := models.AccountToken{
+		UserID:    user.ID,
+		Purpose:   purpose,
+		Email:     user.Email,
+		TokenHash: sessions.HashToken(token),
+		ExpiresAt: now.Add(validity),
+	}
+	if err := database.DB.Create(&accountToken).Error; err != nil {
+		return "", accountToken, err
+	}
+	return token, accountToken, nil
+}
+
+// LookupToken returns a link's unused, unexpired token and its user, without
+// using it up
+func LookupToken(token string, purpose models.TokenPurpose, now time.Time) (models.AccountToken, error) {
+	var accountToken models.AccountToken
+	err := database.DB.Preload("User").
+		Where("token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?", sessions.HashToken(token), purpose, now).
+		First(&accountToken).Error
+	if err != nil || accountToken.User == nil {
+		return models.AccountToken{}, ErrInvalidToken
+	}
+	return accountToken, nil
+}
+
+// UseToken uses up a link's token, returning it with its user. Of several
+// requests racing to use the same link, only one succeeds.
+func UseToken(token string, purpose models.TokenPurpose, now time.Time) (models.AccountToken, error) {
+	accountToken, err := LookupToken(token, purpose, now)
+	if err != nil {
+		return accountToken, err
+	}
+
+	result := database.DB.Model(&models.AccountToken{}).
+		Where("id = ? AND used_at IS NULL", accountToken.ID).
+		UpdateColumn("used_at", now)
+	if result.Error != nil {
+		return models.AccountToken{}, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return models.AccountToken{}, ErrInvalidToken
+	}
+	return accountToken, nil
+}
+
+// VerifyEmail follows a verification link, marking the address it was sent
+// to as the user's own
+func VerifyEmail(token string, now time.Time) (models.User, error) {
+	accountToken, err := UseToken(token, models.TokenVerifyEmail, now)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	user := *accountToken.User
+	if !strings.EqualFold(user.Email, accountToken.Email) {
+		return user, ErrEmailChanged
+	}
+	if err := MarkEmailVerified(&user, now); err != nil {
+		return user, err
+	}
+	return user, nil
+}
+
+// MarkEmailVerified records that a user proved they receive email at their
+// address, such as by following a link sent there
+func MarkEmailVerified(user *models.User, now time.Time) error {
+	if user.EmailVerified() {
+		return nil
+	}
+	if err := database.DB.Model(&models.User{}).Where("id = ?", user.ID).UpdateColumn("email_verified_at", now).Error; err != nil {
+		return err
+	}
+	user.EmailVerifiedAt = &now
+	return nil
+}
@@ -0,0 +1,215 @@
+package accounts
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+var (
+	// FreeLoginAttempts is how many wrong passwords in a row an account may
+	// have before each further login is delayed
+	FreeLoginAttempts = 3
+	// LoginDelay is the wait after the first delayed login. It doubles with
+	// each further wrong password, up to MaxLoginDelay.
+	LoginDelay    = 2 * time.Second
+	MaxLoginDelay = time.Minute
+
+	// LockoutThreshold wrong passwords lock an account for LockoutDuration.
+	// Wrong passwords stop counting once LockoutDuration has passed.
+	LockoutThreshold = 10
+	LockoutDuration  = 30 * time.Minute
+	// IPLockoutThreshold wrong passwords from one address, for any accounts,
+	// lock the address out for LockoutDuration
+	IPLockoutThreshold = 50
+)
+
+// ErrInvalidLogin is returned for an unknown username or a wrong password,
+// which are not told apart
+var ErrInvalidLogin = errors.New("invalid username or password")
+
+// LoginBlock says until when logins are refused, and whether because the
+// account or address is locked out rather than only delayed
+type LoginBlock struct {
+	Until  time.Time
+	Locked bool
+}
+
+// Blocked reports whether logins are still refused at a time
+func (b LoginBlock) Blocked(now time.Time) bool {
+	return b.Until.After(now)
+}
+
+// dummyHash is compared against for unknown usernames, so they take as long
+// to refuse as wrong passwords
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// Authenticate returns the user with a username and password. Unknown
+// usernames and wrong passwords take the same time and give the same error.
+func Authenticate(username, password string) (models.User, error) {
+	var user models.User
+	if err := database.DB.Where("username = ?", username).First(&user).Error; err != nil {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return models.User{}, ErrInvalidLogin
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return models.User{}, ErrInvalidLogin
+	}
+	return user, nil
+}
+
+// loginLock serializes the login attempts sharing a username or address
+type loginLock struct {
+	sync.Mutex
+	users int
+}
+
+var (
+	loginLocksMutex sync.Mutex
+	loginLocks      = make(map[string]*loginLock)
+)
+
+// LockLogin waits until no other login to a username or from an address is
+// in progress and returns a function to call once this one is done.
+// Checking, verifying and recording a failure while holding it stops
+// parallel attempts from all getting past CheckLogin before any failure is
+// recorded.
+func LockLogin(username, ip string) (unlock func()) {
+	// Accounts are always locked before addresses, so two logins never wait
+	// on each other
+	keys := []string{"user:" + username}
+	if ip != "" {
+		keys = append(keys, "ip:"+ip)
+	}
+
+	locks := make([]*loginLock, len(keys))
+	for i, key := range keys {
+		loginLocksMutex.Lock()
+		lock, exists := loginLocks[key]
+		if !exists {
+			lock = &loginLock{}
+			loginLocks[key] = lock
+		}
+		lock.users++
+		loginLocksMutex.Unlock()
+
+		lock.Lock()
+		locks[i] = lock
+	}
+
+	return func() {
+		for i := len(keys) - 1; i >= 0; i-- {
+			locks[i].Unlock()
+
+			// Locks nobody is waiting for are dropped, so they do not pile up
+			loginLocksMutex.Lock()
+			if locks[i].users--; locks[i].users == 0 {
+				delete(loginLocks, keys[i])
+			}
+			loginLocksMutex.Unlock()
+		}
+	}
+}
+
+// CheckLogin returns until when logins to a username from an address are
+// refused because of recent wrong passwords
+func CheckLogin(username, ip string, now time.Time) LoginBlock {
+	since := now.Add(-LockoutDuration)
+	block := LoginBlock{}
+
+	// Account failures cleared by a login or an admin no longer count
+	count, latest := recentFailures(func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("username = ? AND cleared_at IS NULL", username)
+	}, since)
+	switch {
+	case count >= int64(LockoutThreshold):
+		block = LoginBlock{Until: latest.Add(LockoutDuration), Locked: true}
+	case count >= int64(FreeLoginAttempts):
+		delay := MaxLoginDelay
+		if shift := count - int64(FreeLoginAttempts); shift < 16 && LoginDelay<<shift < MaxLoginDelay {
+			delay = LoginDelay << shift
+		}
+		block = LoginBlock{Until: latest.Add(delay)}
+	}
+
+	if ip != "" {
+		count, latest := recentFailures(func(tx *gorm.DB) *gorm.DB {
+			return tx.Where("ip_address = ?", ip)
+		}, since)
+		if until := latest.Add(LockoutDuration); count >= int64(IPLockoutThreshold) && until.After(block.Until) {
+			block = LoginBlock{Until: until, Locked: true}
+		}
+	}
+	return block
+}
+
+// recentFailures counts the failures matched by a scope since a time and
+// returns when the latest of them was
+func recentFailures(scope func(*gorm.DB) *gorm.DB, since time.Time) (int64, time.Time) {
+	var count int64
+	database.DB.Model(&models.LoginFailure{}).Scopes(scope).Where("created_at > ?", since).Count(&count)
+	if count == 0 {
+		return 0, time.Time{}
+	}
+
+	var latest models.LoginFailure
+	database.DB.Scopes(scope).Where("created_at > ?", since).Order("created_at DESC").First(&latest)
+	return count, latest.CreatedAt
+}
+
+// RecordLoginFailure counts a wrong password for a username from an address
+func RecordLoginFailure(username, ip string, now time.Time) error {
+	// Failures too old to count are of no further use
+	database.DB.Unscoped().Where("created_at <= ?", now.Add(-LockoutDuration)).Delete(&models.LoginFailure{})
+
+	return database.DB.Create(&models.LoginFailure{
+		Model:     gorm.Model{CreatedAt: now},
+		Username:  username,
+		IPAddress: ip,
+	}).Error
+}
+
+// ClearLoginFailures stops an account's wrong passwords from counting
+// against it, such as after a successful login or when an admin unlocks it.
+// They still count against the addresses they came from.
+func ClearLoginFailures(username string, now time.Time) error {
+	return database.DB.Model(&models.LoginFailure{}).
+		Where("username = ? AND cleared_at IS NULL", username).
+		UpdateColumn("cleared_at", now).Error
+}
+
+// LockedAccounts returns the users locked out by wrong passwords and until when
+func LockedAccounts(now time.Time) (map[uint]time.Time, error) {
+	var usernames []string
+	err := database.DB.Model(&models.LoginFailure{}).
+		Where("cleared_at IS NULL AND created_at > ?", now.Add(-LockoutDuration)).
+		Group("username").Having("COUNT(*) >= ?", LockoutThreshold).
+		Pluck("username", &usernames).Error
+	if err != nil || len(usernames) == 0 {
+		return nil, err
+	}
+
+	var users []models.User
+	if err := database.DB.Where("username IN ?", usernames).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	locked := make(map[uint]time.Time, len(users))
+	for _, user := range users {
+		if block := CheckLogin(user.Username, "", now); block.Locked && block.Blocked(now) {
+			locked[user.ID] = block.Until
+		}
+	}
+	return locked, nil
+}
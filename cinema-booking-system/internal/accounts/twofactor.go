@@ -0,0 +1,204 @@
+package accounts
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/sessions"
+	"github.com/JoeDkhar/cinema-booking-system/internal/totp"
+	"gorm.io/gorm"
+)
+
+var (
+	// TwoFactorIssuer names the site in users' authenticator apps
+	TwoFactorIssuer = "CineTickets"
+	// TwoFactorLoginValidity is how long a user has to enter their code
+	// after their password
+	TwoFactorLoginValidity = 5 * time.Minute
+	// RecoveryCodeCount is how many recovery codes a user gets at a time
+	RecoveryCodeCount = 10
+)
+
+// codeSkew is how many periods either side of now a code is accepted, for
+// phones whose clocks are slightly off
+const codeSkew = 1
+
+// ErrInvalidCode is returned for two-factor codes that are wrong, expired or
+// already used
+var ErrInvalidCode = errors.New("invalid or already used code")
+
+// totpCodePattern matches codes from an authenticator app rather than
+// recovery codes
+var totpCodePattern = regexp.MustCompile(`^[0-9]{6}$`)
+
+// recoveryEncoding writes recovery codes in lowercase letters and digits
+var recoveryEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// StartTwoFactor gives a user without two-factor authentication a secret to
+// add to their authenticator app. Two-factor authentication is not on until
+// EnableTwoFactor checks a code made with it.
+func StartTwoFactor(user *models.User) error {
+	if user.TOTPSecret != "" {
+		return nil
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return err
+	}
+	if err := database.DB.Model(&models.User{}).Where("id = ?", user.ID).UpdateColumn("totp_secret", secret).Error; err != nil {
+		return err
+	}
+	user.TOTPSecret = secret
+	return nil
+}
+
+// TwoFactorURI returns the link to put in the QR code a user scans to add
+// their account to an authenticator app
+func TwoFactorURI(user models.User) string {
+	return totp.URI(TwoFactorIssuer, user.Username, user.TOTPSecret)
+}
+
+// EnableTwoFactor turns on two-factor authentication once the user proves
+// their app makes the right codes. It returns their recovery codes.
+func EnableTwoFactor(user *models.User, code string, now time.Time) ([]string, error) {
+	if user.TwoFactorEnabled() || user.TOTPSecret == "" {
+		return nil, errors.New("two-factor authentication is already on or was not started")
+	}
+
+	step, ok := totp.Validate(user.TOTPSecret, code, now, codeSkew)
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+
+	var codes []string
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.User{}).Where("id = ?", user.ID).
+			UpdateColumns(map[string]interface{}{"totp_enabled_at": now, "totp_last_step": step}).Error
+		if err != nil {
+			return err
+		}
+		codes, err = replaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	user.TOTPEnabledAt = &now
+	user.TOTPLastStep = step
+	return codes, nil
+}
+
+// DisableTwoFactor turns off two-factor authentication and forgets the
+// user's secret and recovery codes
+func DisableTwoFactor(user *models.User) error {
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.User{}).Where("id = ?", user.ID).
+			UpdateColumns(map[string]interface{}{"totp_secret": "", "totp_enabled_at": nil, "totp_last_step": 0}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Unscoped().Where("user_id = ?", user.ID).Delete(&models.RecoveryCode{}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	user.TOTPSecret = ""
+	user.TOTPEnabledAt = nil
+	user.TOTPLastStep = 0
+	return nil
+}
+
+// CheckSecondFactor checks a code from the user's authenticator app or one
+// of their recovery codes, using it up. Of several requests racing to use
+// the same code, only one succeeds.
+func CheckSecondFactor(user models.User, code string, now time.Time) error {
+	if !user.TwoFactorEnabled() {
+		return ErrInvalidCode
+	}
+
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if totpCodePattern.MatchString(code) {
+		step, ok := totp.Validate(user.TOTPSecret, code, now, codeSkew)
+		if !ok {
+			return ErrInvalidCode
+		}
+
+		// Codes only work for later periods than the last one used
+		result := database.DB.Model(&models.User{}).
+			Where("id = ? AND totp_last_step < ?", user.ID, step).
+			UpdateColumn("totp_last_step", step)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvalidCode
+		}
+		return nil
+	}
+
+	result := database.DB.Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, hashRecoveryCode(code)).
+		UpdateColumn("used_at", now)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces a user's recovery codes with new ones
+func RegenerateRecoveryCodes(user models.User) ([]string, error) {
+	var codes []string
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		codes, err = replaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	return codes, err
+}
+
+// RemainingRecoveryCodes counts a user's unused recovery codes
+func RemainingRecoveryCodes(user models.User) int64 {
+	var count int64
+	database.DB.Model(&models.RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", user.ID).Count(&count)
+	return count
+}
+
+// replaceRecoveryCodes deletes a user's recovery codes and creates new ones,
+// returning them as the user should write them down
+func replaceRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Unscoped().Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		random := make([]byte, 5)
+		if _, err := rand.Read(random); err != nil {
+			return nil, err
+		}
+		encoded := recoveryEncoding.EncodeToString(random)
+		codes[i] = encoded[:4] + "-" + encoded[4:]
+
+		if err := tx.Create(&models.RecoveryCode{UserID: userID, CodeHash: hashRecoveryCode(codes[i])}).Error; err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// hashRecoveryCode hashes a recovery code, ignoring case and dashes
+func hashRecoveryCode(code string) string {
+	return sessions.HashToken(strings.ToLower(strings.ReplaceAll(code, "-", "")))
+}
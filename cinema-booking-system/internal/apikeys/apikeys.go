@@ -0,0 +1,114 @@
+// Package apikeys issues the keys partners, such as ticket resellers, use to
+// call the API from their own servers, and limits how often each key, and
+// each address calling without one, may be used.
+package apikeys
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/sessions"
+	"github.com/JoeDkhar/cinema-booking-system/internal/utils"
+)
+
+// DefaultRateLimit is how many requests a minute keys without a limit of
+// their own may make
+var DefaultRateLimit = 60
+
+const (
+	// keyPrefix starts every key, so leaked keys are easy to search for
+	keyPrefix = "cbk_"
+	// shownLength is how much of a key is kept to tell keys apart
+	shownLength = len(keyPrefix) + 8
+	// touchInterval is how often a key's last use is written to the database
+	touchInterval = time.Minute
+)
+
+var (
+	// ErrInvalidKey is returned for keys that do not exist or were revoked
+	ErrInvalidKey = errors.New("invalid or revoked API key")
+	// ErrNotFound is returned when revoking a key that does not exist or was
+	// already revoked
+	ErrNotFound = errors.New("API key not found")
+)
+
+// Issue creates a key with scopes and a rate limit, 0 for the default,
+// returning the key to give the partner. It cannot be shown again.
+func Issue(name string, scopes []models.APIScope, rateLimit int, createdBy models.User) (string, models.APIKey, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", models.APIKey{}, errors.New("name the partner the key is for")
+	}
+	if len(scopes) == 0 {
+		return "", models.APIKey{}, errors.New("choose at least one scope")
+	}
+	for _, scope := range scopes {
+		if !scope.Valid() {
+			return "", models.APIKey{}, errors.New("unknown scope " + string(scope))
+		}
+	}
+	if rateLimit < 0 {
+		return "", models.APIKey{}, errors.New("rate limit must not be negative")
+	}
+
+	token := keyPrefix + utils.GenerateSessionToken()
+	key := models.APIKey{
+		Name:      name,
+		Prefix:    token[:shownLength],
+		KeyHash:   sessions.HashToken(token),
+		Scopes:    scopes,
+		RateLimit: rateLimit,
+	}
+	if createdBy.ID != 0 {
+		key.CreatedByID = &createdBy.ID
+	}
+	if err := database.DB.Create(&key).Error; err != nil {
+		return "", key, err
+	}
+	return token, key, nil
+}
+
+// Lookup returns the unrevoked key for a token, recording that it was used
+// from an address
+func Lookup(token, ip string, now time.Time) (models.APIKey, error) {
+	if !strings.HasPrefix(token, keyPrefix) {
+		return models.APIKey{}, ErrInvalidKey
+	}
+
+	var key models.APIKey
+	if err := database.DB.Where("key_hash = ? AND revoked_at IS NULL", sessions.HashToken(token)).First(&key).Error; err != nil {
+		return models.APIKey{}, ErrInvalidKey
+	}
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= touchInterval || key.LastUsedIP != ip {
+		key.LastUsedAt = &now
+		key.LastUsedIP = ip
+		database.DB.Model(&models.APIKey{}).Where("id = ?", key.ID).
+			UpdateColumns(map[string]interface{}{"last_used_at": now, "last_used_ip": ip})
+	}
+	return key, nil
+}
+
+// Revoke stops a key from working
+func Revoke(id uint, now time.Time) error {
+	result := database.DB.Model(&models.APIKey{}).
+		Where("id = ? AND revoked_at IS NULL", id).
+		UpdateColumn("revoked_at", now)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// List returns every key, newest first, with the user who issued it
+func List() []models.APIKey {
+	var keys []models.APIKey
+	database.DB.Preload("CreatedBy").Order("created_at DESC").Find(&keys)
+	return keys
+}
@@ -0,0 +1,89 @@
+package apikeys
+
+import (
+	"sync"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+)
+
+// RateWindow is the period each key's rate limit counts requests over
+const RateWindow = time.Minute
+
+// AnonymousRateLimit is how many requests a minute each address may make
+// without a key. Keyless calls can do less than a key, so they never get more
+// requests than DefaultRateLimit gives keys: a higher setting is capped to it.
+var AnonymousRateLimit = 30
+
+// window counts the requests a key or address made since the window started
+type window struct {
+	start time.Time
+	count int
+}
+
+// windows holds each key's current window by its hash, and each address's
+// by the address. Limits are counted in memory, so each server process
+// allows a key its full limit.
+var (
+	windows      = make(map[string]*window)
+	windowsMutex sync.Mutex
+)
+
+// Limit returns how many requests a minute a key may make
+func Limit(key models.APIKey) int {
+	if key.RateLimit > 0 {
+		return key.RateLimit
+	}
+	return DefaultRateLimit
+}
+
+// AddressLimit returns how many requests a minute each address may make
+// without a key
+func AddressLimit() int {
+	return min(AnonymousRateLimit, DefaultRateLimit)
+}
+
+// Allow counts a request made with a key, reporting whether it is within the
+// key's rate limit, how many more requests the key may make in the current
+// window and how long until the window ends
+func Allow(key models.APIKey, now time.Time) (bool, int, time.Duration) {
+	return allow("key:"+key.KeyHash, Limit(key), now)
+}
+
+// AllowAddress is Allow for a request made without a key, counted against
+// the address it came from
+func AllowAddress(ip string, now time.Time) (bool, int, time.Duration) {
+	return allow("ip:"+ip, AddressLimit(), now)
+}
+
+// allow counts a request in the window of a key or address
+func allow(id string, limit int, now time.Time) (bool, int, time.Duration) {
+	windowsMutex.Lock()
+	defer windowsMutex.Unlock()
+
+	current, ok := windows[id]
+	if !ok || now.Sub(current.start) >= RateWindow {
+		current = &window{start: now}
+		windows[id] = current
+	}
+	reset := current.start.Add(RateWindow).Sub(now)
+
+	if current.count >= limit {
+		return false, 0, reset
+	}
+	current.count++
+	return true, limit - current.count, reset
+}
+
+// PruneWindows forgets the windows that have ended, so keys and addresses
+// that stopped calling the API do not take up memory
+func PruneWindows(now time.Time) {
+	windowsMutex.Lock()
+	defer windowsMutex.Unlock()
+
+	for id, current := range windows {
+		if now.Sub(current.start) >= RateWindow {
+			delete(windows, id)
+		}
+	}
+}
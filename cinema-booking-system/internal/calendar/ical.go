@@ -0,0 +1,141 @@
+// Package calendar writes iCalendar (RFC 5545) files of bookings and show
+// schedules.
+package calendar
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// productID identifies this application in every calendar it writes
+const productID = "-//Cinema Booking//Calendar//EN"
+
+// maxLineOctets is the longest line allowed before it must be folded
+const maxLineOctets = 75
+
+// Event statuses
+const (
+	StatusConfirmed = "CONFIRMED"
+	StatusCancelled = "CANCELLED"
+)
+
+// Event is a single calendar entry. UID must stay the same for the same
+// booking or show, so calendar apps update the entry instead of adding
+// another one.
+type Event struct {
+	UID          string
+	Start        time.Time
+	End          time.Time
+	Summary      string
+	Location     string
+	Description  string
+	URL          string
+	Status       string
+	LastModified time.Time
+}
+
+// Calendar is a collection of events. Name is shown by calendar apps that
+// subscribe to it.
+type Calendar struct {
+	Name   string
+	Events []Event
+}
+
+// Write writes the calendar in iCalendar format, stamping every event with
+// the time it was written
+func (c Calendar) Write(w io.Writer, now time.Time) error {
+	out := &writer{w: bufio.NewWriter(w)}
+
+	out.line("BEGIN", "VCALENDAR")
+	out.line("VERSION", "2.0")
+	out.line("PRODID", productID)
+	out.line("CALSCALE", "GREGORIAN")
+	out.line("METHOD", "PUBLISH")
+	if c.Name != "" {
+		out.line("X-WR-CALNAME", escapeText(c.Name))
+	}
+
+	for _, event := range c.Events {
+		out.line("BEGIN", "VEVENT")
+		out.line("UID", event.UID)
+		out.line("DTSTAMP", formatTime(now))
+		out.line("DTSTART", formatTime(event.Start))
+		out.line("DTEND", formatTime(event.End))
+		out.line("SUMMARY", escapeText(event.Summary))
+		if event.Location != "" {
+			out.line("LOCATION", escapeText(event.Location))
+		}
+		if event.Description != "" {
+			out.line("DESCRIPTION", escapeText(event.Description))
+		}
+		if event.URL != "" {
+			out.line("URL", event.URL)
+		}
+		if event.Status != "" {
+			out.line("STATUS", event.Status)
+		}
+		if !event.LastModified.IsZero() {
+			out.line("LAST-MODIFIED", formatTime(event.LastModified))
+		}
+		out.line("END", "VEVENT")
+	}
+
+	out.line("END", "VCALENDAR")
+	if out.err != nil {
+		return out.err
+	}
+	return out.w.Flush()
+}
+
+// writer writes folded content lines, keeping the first error
+type writer struct {
+	w   *bufio.Writer
+	err error
+}
+
+// line writes a property, folding it onto continuation lines that start
+// with a space so that no line is longer than 75 octets
+func (w *writer) line(name, value string) {
+	if w.err != nil {
+		return
+	}
+
+	content := name + ":" + value
+	limit := maxLineOctets
+	for len(content) > limit {
+		// Never split a multi-byte character across lines
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(content[cut]) {
+			cut--
+		}
+		_, w.err = w.w.WriteString(content[:cut] + "\r\n ")
+		if w.err != nil {
+			return
+		}
+		content = content[cut:]
+		limit = maxLineOctets - 1
+	}
+	_, w.err = w.w.WriteString(content + "\r\n")
+}
+
+// formatTime formats a time in UTC, which every calendar app understands
+func formatTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// textEscaper escapes the characters with a meaning in TEXT values
+var textEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	";", `\;`,
+	",", `\,`,
+	"\r\n", `\n`,
+	"\n", `\n`,
+)
+
+// escapeText escapes a value for a TEXT property
+func escapeText(value string) string {
+	return textEscaper.Replace(value)
+}
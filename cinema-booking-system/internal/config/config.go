@@ -0,0 +1,98 @@
+package config
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// String returns the environment variable key, or fallback if it is unset
+func String(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Int returns the environment variable key parsed as an integer, or fallback
+// if it is unset or invalid
+func Int(key string, fallback int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, value, err)
+		return fallback
+	}
+	return parsed
+}
+
+// Float returns the environment variable key parsed as a decimal number, or
+// fallback if it is unset or invalid
+func Float(key string, fallback float64) float64 {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, value, err)
+		return fallback
+	}
+	return parsed
+}
+
+// Duration returns the environment variable key parsed as a duration such as
+// "15m" or "24h", or fallback if it is unset or invalid
+func Duration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, value, err)
+		return fallback
+	}
+	return parsed
+}
+
+// Bool returns the environment variable key parsed as a boolean, or fallback
+// if it is unset or invalid
+func Bool(key string, fallback bool) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, value, err)
+		return fallback
+	}
+	return parsed
+}
+
+// List returns the environment variable key split on commas, such as
+// "https://a.example, https://b.example", or fallback if it is unset
+func List(key string, fallback []string) []string {
+	value, ok := os.LookupEnv(key)
+	if !ok || strings.TrimSpace(value) == "" {
+		return fallback
+	}
+
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -1,10 +1,17 @@
 package database
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"math"
+	"strings"
 	"time"
 
 	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/money"
+	"github.com/JoeDkhar/cinema-booking-system/internal/utils"
+	"golang.org/x/crypto/bcrypt"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
@@ -27,15 +34,61 @@ func Initialize(dbPath string) error {
 
 	// Migrate the schema
 	err = DB.AutoMigrate(
+		&models.Hall{},
 		&models.Movie{},
 		&models.Show{},
 		&models.Booking{},
+		&models.Cancellation{},
+		&models.Payment{},
+		&models.PromoCode{},
+		&models.PromoRedemption{},
+		&models.Notification{},
+		&models.Ticket{},
+		&models.WaitlistEntry{},
 		&models.User{},
+		&models.Session{},
+		&models.BookingClaim{},
+		&models.AccountToken{},
+		&models.LoginFailure{},
+		&models.RecoveryCode{},
+		&models.APIKey{},
 	)
 	if err != nil {
 		return err
 	}
 
+	// Attach shows created before halls existed to a hall
+	if err := migrateLegacyShowHalls(); err != nil {
+		return err
+	}
+
+	// Give bookings created before holds existed a status
+	if err := migrateBookingStatuses(); err != nil {
+		return err
+	}
+
+	// Give bookings created before references existed a reference
+	if err := migrateBookingReferences(); err != nil {
+		return err
+	}
+
+	// Move amounts stored as floats into minor units
+	if err := migrateMoneyColumns(); err != nil {
+		return err
+	}
+
+	// Turn the admin and staff flags into roles
+	if err := migrateUserRoles(); err != nil {
+		return err
+	}
+
+	// Sessions moved to their own table; old ones are simply logged out
+	if DB.Migrator().HasColumn(&models.User{}, "session_token") {
+		if err := DB.Migrator().DropColumn(&models.User{}, "session_token"); err != nil {
+			return err
+		}
+	}
+
 	log.Println("Database initialized successfully")
 	return nil
 }
@@ -49,7 +102,33 @@ func SeedInitialData() error {
 		return nil // data already exists
 	}
 
-	// Create sample movies
+	// Create sample halls
+	halls := []models.Hall{
+		{Number: 1, Name: "Hall 1", Layout: seedLayout(8, 12, []int{3, 9})},
+		{Number: 2, Name: "Hall 2", Layout: seedLayout(10, 14, []int{4, 10})},
+		{Number: 3, Name: "Studio 3", Layout: seedLayout(6, 10, []int{5})},
+	}
+
+	// The studio has recliners throughout and leaves room for wheelchair
+	// spaces at the ends of the back row, next to companion seats
+	for i := range halls[2].Layout.Rows {
+		halls[2].Layout.Rows[i].Category = models.SeatRecliner
+	}
+	studioBackRow := &halls[2].Layout.Rows[len(halls[2].Layout.Rows)-1]
+	studioBackRow.Missing = []int{1, 10}
+	studioBackRow.SeatCategories = map[int]models.SeatCategory{
+		2: models.SeatWheelchairCompanion,
+		9: models.SeatWheelchairCompanion,
+	}
+
+	for i := range halls {
+		if err := DB.Create(&halls[i]).Error; err != nil {
+			return err
+		}
+	}
+
+	// Create sample movies, the last one opening this week
+	opening := time.Now().Truncate(24 * time.Hour)
 	movies := []models.Movie{
 		{
 			Title:       "Inception",
@@ -71,6 +150,7 @@ func SeedInitialData() error {
 			Duration:    169,
 			Genre:       "Sci-Fi",
 			ImageURL:    "/static/images/interstellar.jpg",
+			ReleaseDate: &opening,
 		},
 	}
 
@@ -84,23 +164,20 @@ func SeedInitialData() error {
 			{
 				MovieID:     movies[i].ID,
 				DateTime:    time.Now().AddDate(0, 0, 1).Truncate(24 * time.Hour).Add(15 * time.Hour),
-				HallNumber:  i + 1,
-				TotalSeats:  100,
-				TicketPrice: 12.50,
+				HallID:      halls[i].ID,
+				TicketPrice: money.New(1250, money.DefaultCurrency),
 			},
 			{
 				MovieID:     movies[i].ID,
 				DateTime:    time.Now().AddDate(0, 0, 1).Truncate(24 * time.Hour).Add(19 * time.Hour),
-				HallNumber:  i + 1,
-				TotalSeats:  100,
-				TicketPrice: 15.00,
+				HallID:      halls[i].ID,
+				TicketPrice: money.New(1500, money.DefaultCurrency),
 			},
 			{
 				MovieID:     movies[i].ID,
 				DateTime:    time.Now().AddDate(0, 0, 2).Truncate(24 * time.Hour).Add(17 * time.Hour),
-				HallNumber:  i + 1,
-				TotalSeats:  100,
-				TicketPrice: 12.50,
+				HallID:      halls[i].ID,
+				TicketPrice: money.New(1250, money.DefaultCurrency),
 			},
 		}
 
@@ -114,3 +191,263 @@ func SeedInitialData() error {
 	log.Println("Initial data seeded successfully")
 	return nil
 }
+
+// BootstrapAdmin gives the site its first admin. An existing user with the
+// username is promoted, taking the new password if one is given; otherwise
+// a new admin is created. It reports whether a user was created.
+func BootstrapAdmin(username, email, password string) (models.User, bool, error) {
+	username = strings.TrimSpace(username)
+	email = strings.TrimSpace(email)
+	if username == "" {
+		return models.User{}, false, errors.New("a username is required")
+	}
+
+	var user models.User
+	err := DB.Where("username = ?", username).First(&user).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return user, false, err
+	}
+	created := err != nil
+
+	if created {
+		if !utils.ValidateEmail(email) {
+			return user, false, errors.New("a valid email address is required for a new user")
+		}
+		if password == "" {
+			return user, false, errors.New("a password is required for a new user")
+		}
+		user = models.User{Username: username, Email: email}
+	}
+
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return user, false, err
+		}
+		user.PasswordHash = string(hash)
+	}
+	user.Role = models.RoleAdmin
+
+	if err := DB.Save(&user).Error; err != nil {
+		return user, false, err
+	}
+	return user, created, nil
+}
+
+// seedLayout builds a sample layout with staggered front rows and the given aisles
+func seedLayout(rows, seatsPerRow int, aisles []int) models.SeatLayout {
+	layout := models.UniformLayout(rowLabels(rows), seatsPerRow)
+	for i := range layout.Rows {
+		layout.Rows[i].Aisles = aisles
+	}
+
+	// The first row is two seats narrower and centred on the screen
+	layout.Rows[0].Seats = seatsPerRow - 2
+	layout.Rows[0].Offset = 1
+	layout.Rows[0].Aisles = nil
+
+	// The two back rows have the best view
+	for i := len(layout.Rows) - 2; i < len(layout.Rows); i++ {
+		layout.Rows[i].Category = models.SeatPremium
+	}
+
+	return layout
+}
+
+// rowLabels returns count row labels starting from "A"
+func rowLabels(count int) []string {
+	labels := make([]string, count)
+	for i := range labels {
+		labels[i] = string(rune('A' + i))
+	}
+	return labels
+}
+
+// migrateLegacyShowHalls creates halls for shows that still only carry the
+// old hall_number and total_seats columns, then drops the columns. The
+// generated layout matches the grid the booking page used to draw for those
+// shows, so existing bookings keep pointing at real seats.
+func migrateLegacyShowHalls() error {
+	if !DB.Migrator().HasColumn(&models.Show{}, "hall_number") {
+		return nil
+	}
+
+	var legacyShows []struct {
+		ID         uint
+		HallNumber int
+		TotalSeats int
+	}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Raw("SELECT id, hall_number, total_seats FROM shows WHERE hall_id IS NULL OR hall_id = 0").
+			Scan(&legacyShows).Error
+		if err != nil {
+			return err
+		}
+
+		for _, legacy := range legacyShows {
+			var hall models.Hall
+			err := tx.Where("number = ?", legacy.HallNumber).First(&hall).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				hall = models.Hall{Number: legacy.HallNumber, Layout: legacyLayout(legacy.TotalSeats)}
+				err = tx.Create(&hall).Error
+			}
+			if err != nil {
+				return err
+			}
+
+			if err := tx.Model(&models.Show{}).Where("id = ?", legacy.ID).Update("hall_id", hall.ID).Error; err != nil {
+				return err
+			}
+		}
+
+		// The hall is the only record of a show's seats from now on
+		for _, column := range []string{"hall_number", "total_seats"} {
+			if tx.Migrator().HasColumn(&models.Show{}, column) {
+				if err := tx.Migrator().DropColumn(&models.Show{}, column); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("migrating shows.hall_number: %w", err)
+	}
+
+	if len(legacyShows) > 0 {
+		log.Printf("Attached %d legacy shows to halls", len(legacyShows))
+	}
+	return nil
+}
+
+// legacyLayout reproduces the grid the booking page derived from a show's
+// total seat count before halls had their own layouts
+func legacyLayout(totalSeats int) models.SeatLayout {
+	totalSeats = max(totalSeats, 1)
+
+	rows := 8
+	switch {
+	case totalSeats <= 60:
+		rows = 5
+	case totalSeats <= 90:
+		rows = 6
+	case totalSeats > 120:
+		rows = 8 + min((totalSeats-120+15)/16, 8)
+	}
+
+	seatsPerRow := (totalSeats + rows - 1) / rows
+	layout := models.UniformLayout(rowLabels(rows), seatsPerRow)
+
+	// The last row only holds the seats left over
+	last := &layout.Rows[rows-1]
+	last.Seats = max(totalSeats-seatsPerRow*(rows-1), 1)
+
+	return layout
+}
+
+// migrateBookingStatuses derives a status for bookings saved before the
+// status column existed. Unconfirmed bookings were never shown to anyone as
+// a hold, so they are treated as expired.
+func migrateBookingStatuses() error {
+	err := DB.Exec("UPDATE bookings SET status = ? WHERE (status IS NULL OR status = '') AND confirmed = ?",
+		models.BookingConfirmed, true).Error
+	if err != nil {
+		return err
+	}
+
+	return DB.Exec("UPDATE bookings SET status = ? WHERE (status IS NULL OR status = '') AND confirmed = ?",
+		models.BookingExpired, false).Error
+}
+
+// migrateBookingReferences assigns a public reference to bookings saved
+// before references were persisted
+func migrateBookingReferences() error {
+	var ids []uint
+	if err := DB.Model(&models.Booking{}).Where("reference IS NULL OR reference = ''").Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		err := DB.Model(&models.Booking{}).Where("id = ?", id).
+			UpdateColumn("reference", utils.GenerateBookingReference()).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// legacyMoneyColumns lists the float columns that held amounts in major
+// units before amounts carried a currency. Each is replaced by a pair of
+// <column>_amount and <column>_currency columns.
+var legacyMoneyColumns = []struct {
+	model  interface{}
+	table  string
+	column string
+}{
+	{&models.Show{}, "shows", "ticket_price"},
+	{&models.Booking{}, "bookings", "total_amount"},
+	{&models.Booking{}, "bookings", "refunded_amount"},
+	{&models.Cancellation{}, "cancellations", "refund_amount"},
+	{&models.Payment{}, "payments", "amount"},
+	{&models.Payment{}, "payments", "refunded_amount"},
+}
+
+// migrateMoneyColumns converts float amounts to minor units of the default
+// currency and drops the float columns
+func migrateMoneyColumns() error {
+	scale := math.Pow10(money.Lookup(money.DefaultCurrency).Exponent)
+
+	for _, legacy := range legacyMoneyColumns {
+		if !DB.Migrator().HasColumn(legacy.model, legacy.column) {
+			continue
+		}
+
+		err := DB.Transaction(func(tx *gorm.DB) error {
+			// Round rather than truncate, so 12.499999... becomes 1250 cents
+			query := fmt.Sprintf("UPDATE %s SET %s_amount = CAST(ROUND(%s * ?) AS INTEGER), %s_currency = ? WHERE %s IS NOT NULL",
+				legacy.table, legacy.column, legacy.column, legacy.column, legacy.column)
+			if err := tx.Exec(query, scale, money.DefaultCurrency).Error; err != nil {
+				return err
+			}
+			return tx.Migrator().DropColumn(legacy.model, legacy.column)
+		})
+		if err != nil {
+			return fmt.Errorf("migrating %s.%s: %w", legacy.table, legacy.column, err)
+		}
+	}
+	return nil
+}
+
+// legacyRoleFlags lists the boolean user columns that granted back office
+// access before users had roles, strongest first so an admin who was also
+// door staff stays an admin
+var legacyRoleFlags = []struct {
+	column string
+	role   models.Role
+}{
+	{"is_admin", models.RoleAdmin},
+	{"is_staff", models.RoleBoxOffice},
+}
+
+// migrateUserRoles gives users flagged as admins or door staff the matching
+// role and drops the flags
+func migrateUserRoles() error {
+	for _, legacy := range legacyRoleFlags {
+		if !DB.Migrator().HasColumn(&models.User{}, legacy.column) {
+			continue
+		}
+
+		err := DB.Transaction(func(tx *gorm.DB) error {
+			query := fmt.Sprintf("UPDATE users SET role = ? WHERE %s AND (role IS NULL OR role = '' OR role = ?)", legacy.column)
+			if err := tx.Exec(query, legacy.role, models.RoleCustomer).Error; err != nil {
+				return err
+			}
+			return tx.Migrator().DropColumn(&models.User{}, legacy.column)
+		})
+		if err != nil {
+			return fmt.Errorf("migrating users.%s: %w", legacy.column, err)
+		}
+	}
+	return nil
+}
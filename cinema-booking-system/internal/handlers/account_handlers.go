@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/sessions"
+	"github.com/gorilla/mux"
+)
+
+// AccountSessionsHandler lists the devices the user is logged in on
+func AccountSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	var currentID uint
+	if current, err := sessions.FromRequest(r); err == nil {
+		currentID = current.ID
+	}
+
+	data := struct {
+		Sessions    []models.Session
+		CurrentID   uint
+		IdleMinutes int
+		User        models.User
+	}{
+		Sessions:    sessions.List(user.ID, time.Now()),
+		CurrentID:   currentID,
+		IdleMinutes: int(sessions.IdleTimeout.Minutes()),
+		User:        user,
+	}
+
+	templates.ExecuteTemplate(w, r, "account_sessions.html", data)
+}
+
+// RevokeSessionHandler logs the user out of one of their devices
+func RevokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid session ID", http.StatusBadRequest)
+		return
+	}
+
+	current, _ := sessions.FromRequest(r)
+	if err := sessions.RevokeID(user.ID, uint(id)); err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	// Ending the session in use is the same as logging out
+	if current.ID == uint(id) {
+		sessions.ClearCookie(w)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	http.Redirect(w, r, "/account/sessions", http.StatusSeeOther)
+}
+
+// LogoutEverywhereHandler ends every session of the user, including this one
+func LogoutEverywhereHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	if err := sessions.RevokeAll(user.ID); err != nil {
+		http.Error(w, "Error logging out: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s logged out everywhere", user.Username)
+
+	sessions.ClearCookie(w)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
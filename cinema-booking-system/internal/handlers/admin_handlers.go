@@ -1,12 +1,16 @@
 package handlers
 
 import (
+	"encoding/json"
+	"log"
 	"net/http"
 	"strconv"
 	"time"
 
+	"github.com/JoeDkhar/cinema-booking-system/internal/accounts"
 	"github.com/JoeDkhar/cinema-booking-system/internal/database"
 	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/money"
 	"github.com/gorilla/mux"
 )
 
@@ -40,13 +44,13 @@ func AdminDashboardHandler(w http.ResponseWriter, r *http.Request) {
 		User:           r.Context().Value("user").(models.User),
 	}
 
-	templates.ExecuteTemplate(w, "admin_dashboard.html", data)
+	templates.ExecuteTemplate(w, r, "admin_dashboard.html", data)
 }
 
 // AdminNewMovieHandler handles creation of new movies
 func AdminNewMovieHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
-		templates.ExecuteTemplate(w, "admin_movie_form.html", map[string]interface{}{
+		templates.ExecuteTemplate(w, r, "admin_movie_form.html", map[string]interface{}{
 			"Action": "Create",
 			"User":   r.Context().Value("user").(models.User),
 		})
@@ -65,10 +69,11 @@ func AdminNewMovieHandler(w http.ResponseWriter, r *http.Request) {
 	genre := r.FormValue("genre")
 	durationStr := r.FormValue("duration")
 	imageURL := r.FormValue("image_url")
+	releaseDateStr := r.FormValue("release_date")
 
 	// Validate input
 	if title == "" || description == "" || genre == "" || durationStr == "" {
-		templates.ExecuteTemplate(w, "admin_movie_form.html", map[string]interface{}{
+		templates.ExecuteTemplate(w, r, "admin_movie_form.html", map[string]interface{}{
 			"Action": "Create",
 			"Error":  "All fields are required",
 			"User":   r.Context().Value("user").(models.User),
@@ -78,7 +83,7 @@ func AdminNewMovieHandler(w http.ResponseWriter, r *http.Request) {
 
 	duration, err := strconv.Atoi(durationStr)
 	if err != nil || duration <= 0 {
-		templates.ExecuteTemplate(w, "admin_movie_form.html", map[string]interface{}{
+		templates.ExecuteTemplate(w, r, "admin_movie_form.html", map[string]interface{}{
 			"Action": "Create",
 			"Error":  "Duration must be a positive number",
 			"User":   r.Context().Value("user").(models.User),
@@ -86,6 +91,16 @@ func AdminNewMovieHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	releaseDate, err := parseReleaseDate(releaseDateStr)
+	if err != nil {
+		templates.ExecuteTemplate(w, r, "admin_movie_form.html", map[string]interface{}{
+			"Action": "Create",
+			"Error":  "Invalid release date format",
+			"User":   r.Context().Value("user").(models.User),
+		})
+		return
+	}
+
 	// Create movie
 	movie := models.Movie{
 		Title:       title,
@@ -93,10 +108,11 @@ func AdminNewMovieHandler(w http.ResponseWriter, r *http.Request) {
 		Genre:       genre,
 		Duration:    duration,
 		ImageURL:    imageURL,
+		ReleaseDate: releaseDate,
 	}
 
 	if err := database.DB.Create(&movie).Error; err != nil {
-		templates.ExecuteTemplate(w, "admin_movie_form.html", map[string]interface{}{
+		templates.ExecuteTemplate(w, r, "admin_movie_form.html", map[string]interface{}{
 			"Action": "Create",
 			"Error":  "Error creating movie: " + err.Error(),
 			"User":   r.Context().Value("user").(models.User),
@@ -124,7 +140,7 @@ func AdminEditMovieHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method == http.MethodGet {
-		templates.ExecuteTemplate(w, "admin_movie_form.html", map[string]interface{}{
+		templates.ExecuteTemplate(w, r, "admin_movie_form.html", map[string]interface{}{
 			"Action": "Edit",
 			"Movie":  movie,
 			"User":   r.Context().Value("user").(models.User),
@@ -144,10 +160,11 @@ func AdminEditMovieHandler(w http.ResponseWriter, r *http.Request) {
 	genre := r.FormValue("genre")
 	durationStr := r.FormValue("duration")
 	imageURL := r.FormValue("image_url")
+	releaseDateStr := r.FormValue("release_date")
 
 	// Validate input
 	if title == "" || description == "" || genre == "" || durationStr == "" {
-		templates.ExecuteTemplate(w, "admin_movie_form.html", map[string]interface{}{
+		templates.ExecuteTemplate(w, r, "admin_movie_form.html", map[string]interface{}{
 			"Action": "Edit",
 			"Movie":  movie,
 			"Error":  "All fields are required",
@@ -158,7 +175,7 @@ func AdminEditMovieHandler(w http.ResponseWriter, r *http.Request) {
 
 	duration, err := strconv.Atoi(durationStr)
 	if err != nil || duration <= 0 {
-		templates.ExecuteTemplate(w, "admin_movie_form.html", map[string]interface{}{
+		templates.ExecuteTemplate(w, r, "admin_movie_form.html", map[string]interface{}{
 			"Action": "Edit",
 			"Movie":  movie,
 			"Error":  "Duration must be a positive number",
@@ -167,15 +184,27 @@ func AdminEditMovieHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	releaseDate, err := parseReleaseDate(releaseDateStr)
+	if err != nil {
+		templates.ExecuteTemplate(w, r, "admin_movie_form.html", map[string]interface{}{
+			"Action": "Edit",
+			"Movie":  movie,
+			"Error":  "Invalid release date format",
+			"User":   r.Context().Value("user").(models.User),
+		})
+		return
+	}
+
 	// Update movie
 	movie.Title = title
 	movie.Description = description
 	movie.Genre = genre
 	movie.Duration = duration
 	movie.ImageURL = imageURL
+	movie.ReleaseDate = releaseDate
 
 	if err := database.DB.Save(&movie).Error; err != nil {
-		templates.ExecuteTemplate(w, "admin_movie_form.html", map[string]interface{}{
+		templates.ExecuteTemplate(w, r, "admin_movie_form.html", map[string]interface{}{
 			"Action": "Edit",
 			"Movie":  movie,
 			"Error":  "Error updating movie: " + err.Error(),
@@ -194,9 +223,13 @@ func AdminNewShowHandler(w http.ResponseWriter, r *http.Request) {
 		var movies []models.Movie
 		database.DB.Find(&movies)
 
-		templates.ExecuteTemplate(w, "admin_show_form.html", map[string]interface{}{
+		var halls []models.Hall
+		database.DB.Order("number").Find(&halls)
+
+		templates.ExecuteTemplate(w, r, "admin_show_form.html", map[string]interface{}{
 			"Action": "Create",
 			"Movies": movies,
+			"Halls":  halls,
 			"User":   r.Context().Value("user").(models.User),
 		})
 		return
@@ -212,18 +245,21 @@ func AdminNewShowHandler(w http.ResponseWriter, r *http.Request) {
 	movieIDStr := r.FormValue("movie_id")
 	dateStr := r.FormValue("date")
 	timeStr := r.FormValue("time")
-	hallNumberStr := r.FormValue("hall_number")
-	totalSeatsStr := r.FormValue("total_seats")
+	hallIDStr := r.FormValue("hall_id")
 	ticketPriceStr := r.FormValue("ticket_price")
 
 	// Validate input
-	if movieIDStr == "" || dateStr == "" || timeStr == "" || hallNumberStr == "" || totalSeatsStr == "" || ticketPriceStr == "" {
+	if movieIDStr == "" || dateStr == "" || timeStr == "" || hallIDStr == "" || ticketPriceStr == "" {
 		var movies []models.Movie
 		database.DB.Find(&movies)
 
-		templates.ExecuteTemplate(w, "admin_show_form.html", map[string]interface{}{
+		var halls []models.Hall
+		database.DB.Order("number").Find(&halls)
+
+		templates.ExecuteTemplate(w, r, "admin_show_form.html", map[string]interface{}{
 			"Action": "Create",
 			"Movies": movies,
+			"Halls":  halls,
 			"Error":  "All fields are required",
 			"User":   r.Context().Value("user").(models.User),
 		})
@@ -244,20 +280,20 @@ func AdminNewShowHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	hallNumber, err := strconv.Atoi(hallNumberStr)
-	if err != nil || hallNumber <= 0 {
-		http.Error(w, "Invalid hall number", http.StatusBadRequest)
+	hallID, err := strconv.Atoi(hallIDStr)
+	if err != nil {
+		http.Error(w, "Invalid hall ID", http.StatusBadRequest)
 		return
 	}
 
-	totalSeats, err := strconv.Atoi(totalSeatsStr)
-	if err != nil || totalSeats <= 0 {
-		http.Error(w, "Invalid total seats", http.StatusBadRequest)
+	var hall models.Hall
+	if err := database.DB.First(&hall, hallID).Error; err != nil {
+		http.Error(w, "Hall not found", http.StatusBadRequest)
 		return
 	}
 
-	ticketPrice, err := strconv.ParseFloat(ticketPriceStr, 64)
-	if err != nil || ticketPrice <= 0 {
+	ticketPrice, err := money.Parse(ticketPriceStr, money.DefaultCurrency)
+	if err != nil || !ticketPrice.IsPositive() {
 		http.Error(w, "Invalid ticket price", http.StatusBadRequest)
 		return
 	}
@@ -266,8 +302,7 @@ func AdminNewShowHandler(w http.ResponseWriter, r *http.Request) {
 	show := models.Show{
 		MovieID:     uint(movieID),
 		DateTime:    dateTime,
-		HallNumber:  hallNumber,
-		TotalSeats:  totalSeats,
+		HallID:      hall.ID,
 		TicketPrice: ticketPrice,
 	}
 
@@ -293,5 +328,274 @@ func AdminBookingsHandler(w http.ResponseWriter, r *http.Request) {
 		User:     r.Context().Value("user").(models.User),
 	}
 
-	templates.ExecuteTemplate(w, "admin_bookings.html", data)
+	templates.ExecuteTemplate(w, r, "admin_bookings.html", data)
+}
+
+// AdminHallsHandler lists all halls
+func AdminHallsHandler(w http.ResponseWriter, r *http.Request) {
+	var halls []models.Hall
+	database.DB.Order("number").Find(&halls)
+
+	data := struct {
+		Halls []models.Hall
+		User  models.User
+	}{
+		Halls: halls,
+		User:  r.Context().Value("user").(models.User),
+	}
+
+	templates.ExecuteTemplate(w, r, "admin_halls.html", data)
+}
+
+// AdminNewHallHandler handles creation of new halls
+func AdminNewHallHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		templates.ExecuteTemplate(w, r, "admin_hall_form.html", map[string]interface{}{
+			"Action": "Create",
+			"User":   r.Context().Value("user").(models.User),
+		})
+		return
+	}
+
+	hall, errMsg := parseHallForm(r, models.Hall{})
+	if errMsg == "" {
+		if err := database.DB.Create(&hall).Error; err != nil {
+			errMsg = "Error creating hall: " + err.Error()
+		}
+	}
+
+	if errMsg != "" {
+		templates.ExecuteTemplate(w, r, "admin_hall_form.html", map[string]interface{}{
+			"Action": "Create",
+			"Hall":   hall,
+			"Layout": r.FormValue("layout"),
+			"Error":  errMsg,
+			"User":   r.Context().Value("user").(models.User),
+		})
+		return
+	}
+
+	// Redirect to admin halls page
+	http.Redirect(w, r, "/admin/halls", http.StatusSeeOther)
+}
+
+// AdminEditHallHandler handles editing of existing halls
+func AdminEditHallHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid hall ID", http.StatusBadRequest)
+		return
+	}
+
+	var hall models.Hall
+	if err := database.DB.First(&hall, id).Error; err != nil {
+		http.Error(w, "Hall not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		templates.ExecuteTemplate(w, r, "admin_hall_form.html", map[string]interface{}{
+			"Action": "Edit",
+			"Hall":   hall,
+			"Layout": hall.LayoutJSON,
+			"User":   r.Context().Value("user").(models.User),
+		})
+		return
+	}
+
+	hall, errMsg := parseHallForm(r, hall)
+	if errMsg == "" {
+		errMsg = checkLayoutKeepsBookedSeats(hall)
+	}
+	if errMsg == "" {
+		if err := database.DB.Save(&hall).Error; err != nil {
+			errMsg = "Error updating hall: " + err.Error()
+		}
+	}
+
+	if errMsg != "" {
+		templates.ExecuteTemplate(w, r, "admin_hall_form.html", map[string]interface{}{
+			"Action": "Edit",
+			"Hall":   hall,
+			"Layout": r.FormValue("layout"),
+			"Error":  errMsg,
+			"User":   r.Context().Value("user").(models.User),
+		})
+		return
+	}
+
+	// Cached movies embed their shows' halls
+	movieCache.Clear()
+
+	// Redirect to admin halls page
+	http.Redirect(w, r, "/admin/halls", http.StatusSeeOther)
+}
+
+// parseHallForm applies the submitted hall form to hall and returns an error
+// message if the input is invalid
+func parseHallForm(r *http.Request, hall models.Hall) (models.Hall, string) {
+	if err := r.ParseForm(); err != nil {
+		return hall, "Error parsing form"
+	}
+
+	numberStr := r.FormValue("number")
+	layoutJSON := r.FormValue("layout")
+
+	if numberStr == "" || layoutJSON == "" {
+		return hall, "Hall number and layout are required"
+	}
+
+	number, err := strconv.Atoi(numberStr)
+	if err != nil || number <= 0 {
+		return hall, "Hall number must be a positive number"
+	}
+
+	var layout models.SeatLayout
+	if err := json.Unmarshal([]byte(layoutJSON), &layout); err != nil {
+		return hall, "Layout is not valid JSON: " + err.Error()
+	}
+	if err := layout.Validate(); err != nil {
+		return hall, "Invalid layout: " + err.Error()
+	}
+
+	hall.Number = number
+	hall.Name = r.FormValue("name")
+	hall.Layout = layout
+	return hall, ""
+}
+
+// checkLayoutKeepsBookedSeats makes sure a changed layout still contains every
+// seat booked for the hall's upcoming shows
+func checkLayoutKeepsBookedSeats(hall models.Hall) string {
+	var showIDs []uint
+	database.DB.Model(&models.Show{}).Where("hall_id = ? AND date_time > ?", hall.ID, time.Now()).Pluck("id", &showIDs)
+	if len(showIDs) == 0 {
+		return ""
+	}
+
+	var bookings []models.Booking
+	database.DB.Where("show_id IN ? AND status IN ?", showIDs,
+		[]models.BookingStatus{models.BookingConfirmed, models.BookingHeld}).Find(&bookings)
+
+	for _, booking := range bookings {
+		for _, seat := range booking.Seats {
+			if !hall.Layout.HasSeat(seat) {
+				return "Seat " + seat.String() + " is booked for an upcoming show and cannot be removed"
+			}
+		}
+	}
+	return ""
+}
+
+// parseReleaseDate parses an optional release date from a form
+func parseReleaseDate(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	releaseDate, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return nil, err
+	}
+	return &releaseDate, nil
+}
+
+// AdminUsersHandler lists users, the roles they hold and whether they are
+// locked out after too many failed logins
+func AdminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	renderAdminUsers(w, r, "")
+}
+
+// renderAdminUsers renders the user list with an optional error message
+func renderAdminUsers(w http.ResponseWriter, r *http.Request, errMsg string) {
+	var users []models.User
+	database.DB.Order("username").Find(&users)
+
+	locked, err := accounts.LockedAccounts(time.Now())
+	if err != nil {
+		log.Printf("Error finding locked accounts: %v", err)
+	}
+
+	data := struct {
+		Users  []models.User
+		Roles  []models.Role
+		Locked map[uint]time.Time
+		Error  string
+		User   models.User
+	}{
+		Users:  users,
+		Roles:  models.Roles,
+		Locked: locked,
+		Error:  errMsg,
+		User:   r.Context().Value("user").(models.User),
+	}
+
+	if errMsg != "" {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	templates.ExecuteTemplate(w, r, "admin_users.html", data)
+}
+
+// AdminUpdateUserRoleHandler assigns a user a new role. Admins cannot change
+// their own role, so the site is never left without one.
+func AdminUpdateUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var user models.User
+	if err := database.DB.First(&user, id).Error; err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	role := models.Role(r.FormValue("role"))
+	if !role.Valid() {
+		renderAdminUsers(w, r, "Unknown role "+string(role))
+		return
+	}
+
+	admin := r.Context().Value("user").(models.User)
+	if user.ID == admin.ID && role != user.Role {
+		renderAdminUsers(w, r, "You cannot change your own role")
+		return
+	}
+
+	if err := database.DB.Model(&user).Update("role", role).Error; err != nil {
+		renderAdminUsers(w, r, "Error updating role: "+err.Error())
+		return
+	}
+	log.Printf("User %s changed the role of %s from %s to %s", admin.Username, user.Username, user.Role, role)
+
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// AdminUnlockUserHandler lets a user locked out after too many failed logins
+// try again straight away
+func AdminUnlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var user models.User
+	if err := database.DB.First(&user, id).Error; err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if err := accounts.ClearLoginFailures(user.Username, time.Now()); err != nil {
+		renderAdminUsers(w, r, "Error unlocking user: "+err.Error())
+		return
+	}
+	admin := r.Context().Value("user").(models.User)
+	log.Printf("User %s unlocked the login of %s", admin.Username, user.Username)
+
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
 }
@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/utils"
+	"github.com/gorilla/mux"
+)
+
+// apiBookingRequest is the JSON body accepted by APICreateBookingHandler
+type apiBookingRequest struct {
+	ShowID       uint         `json:"show_id"`
+	CustomerName string       `json:"customer_name"`
+	Email        string       `json:"email"`
+	Seats        models.Seats `json:"seats"`
+	PaymentToken string       `json:"payment_token"`
+	PromoCode    string       `json:"promo_code"`
+}
+
+// APICreateBookingHandler books and pays for seats from a JSON request. An
+// Idempotency-Key header makes retried requests return the first booking
+// instead of charging again.
+func APICreateBookingHandler(w http.ResponseWriter, r *http.Request) {
+	var body apiBookingRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Invalid JSON body",
+		})
+		return
+	}
+
+	body.CustomerName = strings.TrimSpace(body.CustomerName)
+	body.Email = strings.TrimSpace(body.Email)
+
+	// Validate input
+	if body.ShowID == 0 || body.CustomerName == "" || body.Email == "" {
+		sendJSONResponse(w, http.StatusUnprocessableEntity, APIResponse{
+			Success: false,
+			Error:   "show_id, customer_name and email are required",
+		})
+		return
+	}
+
+	if !utils.ValidateEmail(body.Email) {
+		sendJSONResponse(w, http.StatusUnprocessableEntity, APIResponse{
+			Success: false,
+			Error:   "Invalid email address",
+		})
+		return
+	}
+
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		idempotencyKey = utils.GenerateSessionToken()
+	}
+
+	// A retried request gets the outcome of the first one
+	var payment models.Payment
+	if database.DB.Where("idempotency_key = ?", idempotencyKey).First(&payment).Error == nil {
+		booking, err := loadBooking(payment.BookingID)
+		if err != nil || booking.ShowID != body.ShowID || booking.Email != body.Email {
+			sendJSONResponse(w, http.StatusUnprocessableEntity, APIResponse{
+				Success: false,
+				Error:   "The idempotency key was already used for another booking",
+			})
+			return
+		}
+		if response := replayPayment(payment, booking); !response.Success {
+			sendBookingError(w, response)
+			return
+		}
+		sendCreatedBooking(w, booking)
+		return
+	}
+
+	// Hold the seats while the payment goes through
+	hold := submitBookingRequest(BookingRequest{
+		Action:       ActionHold,
+		ShowID:       body.ShowID,
+		CustomerName: body.CustomerName,
+		Email:        body.Email,
+		Seats:        body.Seats,
+		PromoCode:    body.PromoCode,
+		UserID:       currentUserID(r),
+		APIKeyID:     currentAPIKeyID(r),
+	})
+
+	if !hold.Success {
+		sendBookingError(w, hold)
+		return
+	}
+
+	booking, err := loadBooking(hold.BookingID)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to retrieve booking",
+		})
+		return
+	}
+
+	allowPaymentTime(w)
+	response := checkoutHold(r.Context(), booking, body.PaymentToken, idempotencyKey)
+	if !response.Success {
+		// Give the seats back unless another request is still paying for them
+		if response.Error == nil || response.Error.Code != ErrCodePaymentInProgress {
+			submitBookingRequest(BookingRequest{Action: ActionRelease, BookingID: booking.ID})
+		}
+		sendBookingError(w, response)
+		return
+	}
+
+	booking, err = loadBooking(booking.ID)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to retrieve booking",
+		})
+		return
+	}
+
+	sendCreatedBooking(w, booking)
+}
+
+// sendCreatedBooking sends a newly created booking with its location
+func sendCreatedBooking(w http.ResponseWriter, booking models.Booking) {
+	w.Header().Set("Location", "/api/v1/bookings/"+booking.Reference)
+	sendJSONResponse(w, http.StatusCreated, APIResponse{
+		Success: true,
+		Data:    booking,
+	})
+}
+
+// APIBookingDetailHandler returns a booking in JSON format. Partners may
+// only look up the bookings made with their key; anyone else must give the
+// booking's email as a query parameter unless logged in as its owner.
+func APIBookingDetailHandler(w http.ResponseWriter, r *http.Request) {
+	user, loggedIn := currentUser(r)
+	key, usingKey := currentAPIKey(r)
+	booking, err := loadBookingByReference(mux.Vars(r)["reference"])
+	allowed := canManageBooking(booking, r.URL.Query().Get("email"), user, loggedIn)
+	if usingKey {
+		allowed = booking.APIKeyID != nil && *booking.APIKeyID == key.ID
+	}
+	if err != nil || !allowed {
+		sendJSONResponse(w, http.StatusNotFound, APIResponse{
+			Success: false,
+			Error:   "Booking not found",
+		})
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    booking,
+	})
+}
+
+// apiCancelRequest is the optional JSON body accepted by APICancelBookingHandler
+type apiCancelRequest struct {
+	Seats  models.Seats `json:"seats"`
+	Reason string       `json:"reason"`
+}
+
+// APICancelBookingHandler cancels a whole booking, or only the seats listed
+// in the request body. The booking's email must be given as a query parameter
+// unless the caller is logged in as its owner or uses the API key the booking
+// was made with.
+func APICancelBookingHandler(w http.ResponseWriter, r *http.Request) {
+	var body apiCancelRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			sendJSONResponse(w, http.StatusBadRequest, APIResponse{
+				Success: false,
+				Error:   "Invalid JSON body",
+			})
+			return
+		}
+	}
+
+	user, loggedIn := currentUser(r)
+	key, usingKey := currentAPIKey(r)
+	booking, err := loadBookingByReference(mux.Vars(r)["reference"])
+	madeWithKey := usingKey && booking.APIKeyID != nil && *booking.APIKeyID == key.ID
+	if err != nil || !(madeWithKey || canManageBooking(booking, r.URL.Query().Get("email"), user, loggedIn)) {
+		sendJSONResponse(w, http.StatusNotFound, APIResponse{
+			Success: false,
+			Error:   "Booking not found",
+		})
+		return
+	}
+
+	request := BookingRequest{
+		BookingID:   booking.ID,
+		Seats:       body.Seats,
+		CancelledBy: models.CancelledByCustomer,
+		Reason:      body.Reason,
+	}
+	if loggedIn {
+		request.UserID = &user.ID
+	}
+	if usingKey {
+		request.APIKeyID = &key.ID
+		request.CancelledBy = models.CancelledByPartner
+	}
+
+	allowPaymentTime(w)
+	response := cancelAndRefund(r.Context(), request)
+	if !response.Success {
+		sendBookingError(w, response)
+		return
+	}
+
+	booking, err = loadBooking(response.BookingID)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to retrieve booking",
+		})
+		return
+	}
+
+	data := map[string]interface{}{
+		"booking": booking,
+	}
+	if response.CancellationID != 0 {
+		var cancellation models.Cancellation
+		database.DB.First(&cancellation, response.CancellationID)
+		data["cancellation"] = cancellation
+	}
+
+	sendJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    data,
+	})
+}
+
+// loadBooking retrieves a booking together with its show, movie and hall
+func loadBooking(id uint) (models.Booking, error) {
+	var booking models.Booking
+	err := database.DB.Preload("Show").Preload("Show.Movie").Preload("Show.Hall").First(&booking, id).Error
+	return booking, err
+}
+
+// loadBookingByReference retrieves a booking by its public reference together
+// with its show, movie and hall
+func loadBookingByReference(reference string) (models.Booking, error) {
+	var booking models.Booking
+	err := database.DB.Preload("Show").Preload("Show.Movie").Preload("Show.Hall").
+		Where("reference = ?", utils.NormalizeBookingReference(reference)).First(&booking).Error
+	return booking, err
+}
+
+// sendBookingError sends a rejected booking request as a JSON error response
+func sendBookingError(w http.ResponseWriter, response BookingResponse) {
+	sendJSONResponse(w, bookingErrorStatus(response.Error), APIResponse{
+		Success: false,
+		Error:   response.ErrorMessage,
+		Details: response.Error,
+	})
+}
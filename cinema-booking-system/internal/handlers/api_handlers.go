@@ -16,6 +16,7 @@ type APIResponse struct {
 	Success bool        `json:"success"`
 	Data    interface{} `json:"data,omitempty"`
 	Error   string      `json:"error,omitempty"`
+	Details interface{} `json:"details,omitempty"`
 }
 
 // HealthCheckHandler returns health status of the service
@@ -94,6 +95,33 @@ func APIMovieDetailHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// APIHallDetailHandler returns a hall and its seat layout in JSON format
+func APIHallDetailHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Invalid hall ID",
+		})
+		return
+	}
+
+	var hall models.Hall
+	if err := database.DB.First(&hall, id).Error; err != nil {
+		sendJSONResponse(w, http.StatusNotFound, APIResponse{
+			Success: false,
+			Error:   "Hall not found",
+		})
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    hall,
+	})
+}
+
 // sendJSONResponse sends a structured JSON response
 func sendJSONResponse(w http.ResponseWriter, statusCode int, response APIResponse) {
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/apikeys"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/gorilla/mux"
+)
+
+// currentAPIKey returns the partner's API key a request was made with, as
+// found by APIKeyMiddleware
+func currentAPIKey(r *http.Request) (models.APIKey, bool) {
+	key, ok := r.Context().Value("api_key").(models.APIKey)
+	return key, ok
+}
+
+// currentAPIKeyID returns the ID of the request's API key, or nil if it was
+// made without one
+func currentAPIKeyID(r *http.Request) *uint {
+	key, ok := currentAPIKey(r)
+	if !ok {
+		return nil
+	}
+	return &key.ID
+}
+
+// AdminAPIKeysHandler lists partners' API keys with a form to issue a new one
+func AdminAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	renderAdminAPIKeys(w, r, "", "")
+}
+
+// AdminCreateAPIKeyHandler issues an API key, showing it once
+func AdminCreateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var scopes []models.APIScope
+	for _, scope := range r.Form["scopes"] {
+		scopes = append(scopes, models.APIScope(scope))
+	}
+	rateLimit := 0
+	if limit := strings.TrimSpace(r.FormValue("rate_limit")); limit != "" {
+		var err error
+		if rateLimit, err = strconv.Atoi(limit); err != nil {
+			renderAdminAPIKeys(w, r, "", "Rate limit must be a whole number")
+			return
+		}
+	}
+
+	admin := r.Context().Value("user").(models.User)
+	token, key, err := apikeys.Issue(r.FormValue("name"), scopes, rateLimit, admin)
+	if err != nil {
+		renderAdminAPIKeys(w, r, "", "Error creating API key: "+err.Error())
+		return
+	}
+	log.Printf("User %s issued API key %s for %s", admin.Username, key.Prefix, key.Name)
+
+	renderAdminAPIKeys(w, r, token, "")
+}
+
+// AdminRevokeAPIKeyHandler stops an API key from working
+func AdminRevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid API key ID", http.StatusBadRequest)
+		return
+	}
+
+	err = apikeys.Revoke(uint(id), time.Now())
+	if errors.Is(err, apikeys.ErrNotFound) {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		renderAdminAPIKeys(w, r, "", "Error revoking API key: "+err.Error())
+		return
+	}
+	admin := r.Context().Value("user").(models.User)
+	log.Printf("User %s revoked API key %d", admin.Username, id)
+
+	http.Redirect(w, r, "/admin/api-keys", http.StatusSeeOther)
+}
+
+// renderAdminAPIKeys renders the API keys page, with a key that was just
+// issued and an optional error message
+func renderAdminAPIKeys(w http.ResponseWriter, r *http.Request, newKey, errMsg string) {
+	data := struct {
+		Keys             []models.APIKey
+		Scopes           []models.APIScope
+		DefaultRateLimit int
+		NewKey           string
+		Error            string
+	}{
+		Keys:             apikeys.List(),
+		Scopes:           models.APIScopes,
+		DefaultRateLimit: apikeys.DefaultRateLimit,
+		NewKey:           newKey,
+		Error:            errMsg,
+	}
+
+	if errMsg != "" {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	templates.ExecuteTemplate(w, r, "admin_api_keys.html", data)
+}
@@ -1,20 +1,28 @@
 package handlers
 
 import (
+	"fmt"
+	"log"
+	"math"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/JoeDkhar/cinema-booking-system/internal/accounts"
 	"github.com/JoeDkhar/cinema-booking-system/internal/database"
 	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/notifications"
+	"github.com/JoeDkhar/cinema-booking-system/internal/sessions"
 	"github.com/JoeDkhar/cinema-booking-system/internal/utils"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // RegisterHandler handles user registration
 func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
 		// Render registration form
-		templates.ExecuteTemplate(w, "register.html", nil)
+		templates.ExecuteTemplate(w, r, "register.html", nil)
 		return
 	}
 
@@ -32,38 +40,45 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Validate input
 	if username == "" || email == "" || password == "" {
-		templates.ExecuteTemplate(w, "register.html", map[string]interface{}{
+		templates.ExecuteTemplate(w, r, "register.html", map[string]interface{}{
 			"Error": "All fields are required",
 		})
 		return
 	}
 
 	if password != passwordConfirm {
-		templates.ExecuteTemplate(w, "register.html", map[string]interface{}{
+		templates.ExecuteTemplate(w, r, "register.html", map[string]interface{}{
 			"Error": "Passwords do not match",
 		})
 		return
 	}
 
 	if !utils.ValidateEmail(email) {
-		templates.ExecuteTemplate(w, "register.html", map[string]interface{}{
+		templates.ExecuteTemplate(w, r, "register.html", map[string]interface{}{
 			"Error": "Invalid email address",
 		})
 		return
 	}
 
+	if err := accounts.CheckPassword(password, models.User{Username: username, Email: email}); err != nil {
+		templates.ExecuteTemplate(w, r, "register.html", map[string]interface{}{
+			"Error": "Invalid password: " + err.Error(),
+		})
+		return
+	}
+
 	// Check if username or email already exists
 	var count int64
 	database.DB.Model(&models.User{}).Where("username = ? OR email = ?", username, email).Count(&count)
 	if count > 0 {
-		templates.ExecuteTemplate(w, "register.html", map[string]interface{}{
+		templates.ExecuteTemplate(w, r, "register.html", map[string]interface{}{
 			"Error": "Username or email already exists",
 		})
 		return
 	}
 
 	// Hash password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hashedPassword, err := accounts.HashPassword(password)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
@@ -73,7 +88,7 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	user := models.User{
 		Username:     username,
 		Email:        email,
-		PasswordHash: string(hashedPassword),
+		PasswordHash: hashedPassword,
 	}
 
 	if err := database.DB.Create(&user).Error; err != nil {
@@ -81,6 +96,11 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Ask the user to confirm the address is theirs
+	if err := sendAccountLink(user, models.TokenVerifyEmail, notifications.VerifyEmail, "/verify-email/"); err != nil {
+		log.Printf("Error sending verification email to %s: %v", user.Username, err)
+	}
+
 	// Redirect to login page
 	http.Redirect(w, r, "/login?registered=true", http.StatusSeeOther)
 }
@@ -89,8 +109,10 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
 		// Render login form
-		templates.ExecuteTemplate(w, "login.html", map[string]interface{}{
-			"Registered": r.URL.Query().Get("registered") == "true",
+		templates.ExecuteTemplate(w, r, "login.html", map[string]interface{}{
+			"Registered":    r.URL.Query().Get("registered") == "true",
+			"Verified":      r.URL.Query().Get("verified") == "true",
+			"PasswordReset": r.URL.Query().Get("reset") == "true",
 		})
 		return
 	}
@@ -104,67 +126,148 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 
 	username := r.FormValue("username")
 	password := r.FormValue("password")
-	redirect := r.FormValue("redirect")
-
-	if redirect == "" {
-		redirect = "/"
-	}
+	redirect := localRedirect(r.FormValue("redirect"))
 
 	// Validate input
 	if username == "" || password == "" {
-		templates.ExecuteTemplate(w, "login.html", map[string]interface{}{
+		templates.ExecuteTemplate(w, r, "login.html", map[string]interface{}{
 			"Error": "Username and password are required",
 		})
 		return
 	}
 
-	// Find user
-	var user models.User
-	if err := database.DB.Where("username = ?", username).First(&user).Error; err != nil {
-		templates.ExecuteTemplate(w, "login.html", map[string]interface{}{
-			"Error": "Invalid username or password",
-		})
+	// Refuse logins after too many wrong passwords, without checking this one
+	ip := sessions.ClientIP(r)
+	defer accounts.LockLogin(username, ip)()
+	now := time.Now()
+	if block := accounts.CheckLogin(username, ip, now); block.Blocked(now) {
+		renderLoginBlocked(w, r, "login.html", nil, block, now)
 		return
 	}
 
-	// Check password
-	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
-		templates.ExecuteTemplate(w, "login.html", map[string]interface{}{
+	// Unknown usernames and wrong passwords look the same, down to how long
+	// they take
+	user, err := accounts.Authenticate(username, password)
+	if err != nil {
+		if err := accounts.RecordLoginFailure(username, ip, now); err != nil {
+			log.Printf("Error recording failed login for %s: %v", username, err)
+		}
+		templates.ExecuteTemplate(w, r, "login.html", map[string]interface{}{
 			"Error": "Invalid username or password",
 		})
 		return
 	}
 
-	// Generate session token
-	sessionToken := utils.GenerateSessionToken()
+	// Users with two-factor authentication finish logging in with a code
+	if user.TwoFactorEnabled() {
+		token, challenge, err := accounts.IssueToken(user, models.TokenTwoFactorLogin, now)
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		http.SetCookie(w, sessions.NewCookie(twoFactorCookieName, token, "/login", challenge.ExpiresAt))
+		http.Redirect(w, r, "/login/two-factor?redirect="+url.QueryEscape(redirect), http.StatusSeeOther)
+		return
+	}
 
-	// Update user with session token
-	database.DB.Model(&user).Update("session_token", sessionToken)
+	logIn(w, r, user, redirect, now)
+}
 
-	// Set session cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session",
-		Value:    sessionToken,
-		Path:     "/",
-		Expires:  time.Now().Add(24 * time.Hour),
-		HttpOnly: true,
-	})
+// logIn starts a session for this device, leaving any others logged in, and
+// goes on to the page the user asked for
+func logIn(w http.ResponseWriter, r *http.Request, user models.User, redirect string, now time.Time) {
+	// Only a complete login clears the wrong passwords and codes before it
+	if err := accounts.ClearLoginFailures(user.Username, now); err != nil {
+		log.Printf("Error clearing failed logins for %s: %v", user.Username, err)
+	}
+
+	token, session, err := sessions.Create(user, r, now)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	sessions.SetCookie(w, token, session)
 
 	// Redirect to requested page
 	http.Redirect(w, r, redirect, http.StatusSeeOther)
 }
 
-// LogoutHandler handles user logout
+// localRedirect returns the page to go to after logging in, falling back
+// to the home page for anything but a path on this site, so links cannot
+// send users elsewhere. Browsers read "//" and "/\" as the start of
+// another site's address, and ignore tabs and newlines in it.
+func localRedirect(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") ||
+		strings.ContainsAny(target, "\t\r\n") {
+		return "/"
+	}
+	return target
+}
+
+// renderLoginBlocked refuses a login after too many failures, saying how
+// long to wait
+func renderLoginBlocked(w http.ResponseWriter, r *http.Request, page string, data map[string]interface{}, block accounts.LoginBlock, now time.Time) {
+	wait := block.Until.Sub(now)
+	errMsg := "Too many failed logins. Try again in " + waitText(wait) + "."
+	if block.Locked {
+		errMsg = "Too many failed logins. Logging in is locked for " + waitText(wait) + ", unless you reset your password."
+	}
+
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	data["Error"] = errMsg
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+	templates.ExecuteTemplate(w, r, page, data)
+}
+
+// LogoutHandler handles user logout, ending the session on this device
 func LogoutHandler(w http.ResponseWriter, r *http.Request) {
-	// Clear session cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session",
-		Value:    "",
-		Path:     "/",
-		Expires:  time.Now().Add(-1 * time.Hour),
-		HttpOnly: true,
-	})
+	if cookie, err := r.Cookie(sessions.CookieName); err == nil && cookie.Value != "" {
+		if err := sessions.Revoke(cookie.Value); err != nil {
+			log.Printf("Error ending session: %v", err)
+		}
+	}
+	sessions.ClearCookie(w)
 
 	// Redirect to home page
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
+
+// currentUser returns the logged-in user making the request, if any
+func currentUser(r *http.Request) (models.User, bool) {
+	// Protected routes already have the user from AuthMiddleware
+	if user, ok := r.Context().Value("user").(models.User); ok {
+		return user, true
+	}
+
+	session, err := sessions.FromRequest(r)
+	if err != nil {
+		return models.User{}, false
+	}
+	return *session.User, true
+}
+
+// currentUserID returns the ID of the logged-in user making the request, or
+// nil for guests
+func currentUserID(r *http.Request) *uint {
+	user, ok := currentUser(r)
+	if !ok {
+		return nil
+	}
+	return &user.ID
+}
+
+// waitText describes a wait in whole seconds or minutes, rounded up
+func waitText(wait time.Duration) string {
+	if wait > time.Minute {
+		return fmt.Sprintf("%d minutes", int(math.Ceil(wait.Minutes())))
+	}
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds == 1 {
+		return "1 second"
+	}
+	return fmt.Sprintf("%d seconds", seconds)
+}
@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/notifications"
+	"github.com/gorilla/mux"
+)
+
+var (
+	// Outbox queues emails to customers; emails are not sent when it is nil
+	Outbox *notifications.Outbox
+
+	// ReminderBefore is how long before a show customers are reminded of it
+	ReminderBefore = 24 * time.Hour
+)
+
+// notifyBooking queues an email about a booking. A failure to queue the
+// email is logged rather than failing the booking.
+func notifyBooking(kind notifications.Kind, bookingID uint, email notifications.BookingEmail) {
+	if Outbox == nil {
+		return
+	}
+
+	booking, err := loadBooking(bookingID)
+	if err != nil {
+		log.Printf("Error loading booking %d for %s email: %v", bookingID, kind, err)
+		return
+	}
+	email.Booking = booking
+
+	// Tickets show the show time, so a rescheduled show gets new ones
+	if kind == notifications.BookingConfirmed || kind == notifications.ShowRescheduled {
+		email.Attachments = ticketAttachments(booking)
+	}
+
+	if err := Outbox.Enqueue(kind, email); err != nil {
+		log.Printf("Error queueing %s email for booking %d: %v", kind, bookingID, err)
+	}
+}
+
+// SendShowReminders queues reminders for confirmed bookings of shows starting
+// within ReminderBefore of now. Bookings made after the reminder window opened
+// are skipped, as their confirmation is recent enough.
+func SendShowReminders(now time.Time) {
+	if Outbox == nil {
+		return
+	}
+
+	var bookings []models.Booking
+	database.DB.Joins("JOIN shows ON shows.id = bookings.show_id").
+		Where("bookings.status = ? AND shows.date_time > ? AND shows.date_time <= ?",
+			models.BookingConfirmed, now, now.Add(ReminderBefore)).
+		Preload("Show").Find(&bookings)
+
+	for _, booking := range bookings {
+		if booking.BookingTime.After(booking.Show.DateTime.Add(-ReminderBefore)) {
+			continue
+		}
+		notifyBooking(notifications.ShowReminder, booking.ID, notifications.BookingEmail{})
+	}
+}
+
+// AdminRescheduleShowHandler moves a show to a new time and tells everyone
+// with a confirmed booking for it
+func AdminRescheduleShowHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid show ID", http.StatusBadRequest)
+		return
+	}
+
+	show, err := loadShow(uint(id))
+	if err != nil {
+		http.Error(w, "Show not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		renderRescheduleForm(w, r, show, "")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		renderRescheduleForm(w, r, show, "Error parsing form")
+		return
+	}
+
+	dateTime, err := time.Parse("2006-01-02 15:04", r.FormValue("date")+" "+r.FormValue("time"))
+	if err != nil {
+		renderRescheduleForm(w, r, show, "Invalid date or time format")
+		return
+	}
+	if !dateTime.After(time.Now()) {
+		renderRescheduleForm(w, r, show, "The new time must be in the future")
+		return
+	}
+
+	previousTime, bookingIDs, err := rescheduleShow(show.ID, dateTime)
+	if err != nil {
+		renderRescheduleForm(w, r, show, "Error rescheduling show: "+err.Error())
+		return
+	}
+
+	for _, bookingID := range bookingIDs {
+		notifyBooking(notifications.ShowRescheduled, bookingID, notifications.BookingEmail{PreviousTime: previousTime})
+	}
+
+	// Redirect to admin bookings page
+	http.Redirect(w, r, "/admin/bookings", http.StatusSeeOther)
+}
+
+// rescheduleShow moves a show to a new time under the show's mutex, so no
+// booking is taken for the old time meanwhile. It returns the previous time
+// and the confirmed bookings affected.
+func rescheduleShow(showID uint, dateTime time.Time) (time.Time, []uint, error) {
+	mutex := getShowMutex(showID)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var show models.Show
+	if err := database.DB.First(&show, showID).Error; err != nil {
+		return time.Time{}, nil, err
+	}
+	previousTime := show.DateTime
+
+	if err := database.DB.Model(&show).Update("date_time", dateTime).Error; err != nil {
+		return time.Time{}, nil, err
+	}
+
+	// Cached movies embed their shows
+	movieCache.Clear()
+	showCache.Clear()
+
+	var bookingIDs []uint
+	database.DB.Model(&models.Booking{}).Where("show_id = ? AND status = ?", showID, models.BookingConfirmed).
+		Order("id").Pluck("id", &bookingIDs)
+
+	return previousTime, bookingIDs, nil
+}
+
+// renderRescheduleForm shows the reschedule form with an optional error message
+func renderRescheduleForm(w http.ResponseWriter, r *http.Request, show models.Show, errMsg string) {
+	var confirmed int64
+	database.DB.Model(&models.Booking{}).Where("show_id = ? AND status = ?", show.ID, models.BookingConfirmed).Count(&confirmed)
+
+	templates.ExecuteTemplate(w, r, "admin_show_reschedule.html", map[string]interface{}{
+		"Show":      show,
+		"Confirmed": confirmed,
+		"Error":     errMsg,
+		"User":      r.Context().Value("user").(models.User),
+	})
+}
@@ -1,30 +1,123 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"net/http"
 	"time"
 
+	"github.com/JoeDkhar/cinema-booking-system/internal/apikeys"
 	"github.com/JoeDkhar/cinema-booking-system/internal/database"
 	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/money"
+	"github.com/JoeDkhar/cinema-booking-system/internal/notifications"
+	"github.com/JoeDkhar/cinema-booking-system/internal/pricing"
+	"github.com/JoeDkhar/cinema-booking-system/internal/sessions"
+	"gorm.io/gorm"
 )
 
-// BookingRequest represents a seat booking request
+// BookingAction identifies what a booking request should do
+type BookingAction string
+
+const (
+	// ActionBook books the seats immediately
+	ActionBook BookingAction = ""
+	// ActionHold reserves the seats for HoldDuration pending checkout
+	ActionHold BookingAction = "hold"
+	// ActionExtend pushes back the expiry of an existing hold
+	ActionExtend BookingAction = "extend"
+	// ActionRelease gives up an existing hold
+	ActionRelease BookingAction = "release"
+	// ActionConfirm converts an existing hold into a confirmed booking
+	ActionConfirm BookingAction = "confirm"
+	// ActionCancel calls off an existing hold or confirmed booking
+	ActionCancel BookingAction = "cancel"
+)
+
+// BookingRequest represents a seat booking request. Requests acting on an
+// existing booking only need Action and BookingID; cancellations may also
+// name the seats to give back.
 type BookingRequest struct {
+	Action       BookingAction
+	BookingID    uint
 	ShowID       uint
 	CustomerName string
 	Email        string
 	Seats        models.Seats
+	PromoCode    string
 	ResponseChan chan BookingResponse
+
+	// UserID is the logged-in user making the request. New bookings belong
+	// to them and cancellations record who made them.
+	UserID *uint
+	// APIKeyID is the partner's key the request was made with, recorded the
+	// same way
+	APIKeyID *uint
+
+	// Cancellation details
+	CancelledBy string
+	Reason      string
 }
 
 // BookingResponse represents the result of a booking request
 type BookingResponse struct {
-	Success      bool
-	BookingID    uint
-	ErrorMessage string
+	Success        bool
+	BookingID      uint
+	Reference      string
+	CancellationID uint
+	ErrorMessage   string
+	Error          *BookingError
+}
+
+// BookingErrorCode identifies why a booking request was rejected
+type BookingErrorCode string
+
+const (
+	ErrCodeShowNotFound     BookingErrorCode = "show_not_found"
+	ErrCodeNoSeats          BookingErrorCode = "no_seats"
+	ErrCodeTooManySeats     BookingErrorCode = "too_many_seats"
+	ErrCodeDuplicateSeats   BookingErrorCode = "duplicate_seats"
+	ErrCodeInvalidSeats     BookingErrorCode = "invalid_seats"
+	ErrCodeInvalidTicket    BookingErrorCode = "invalid_ticket_type"
+	ErrCodeSeatsUnavailable BookingErrorCode = "seats_unavailable"
+	ErrCodeBookingNotFound  BookingErrorCode = "booking_not_found"
+	ErrCodeNotHeld          BookingErrorCode = "not_held"
+	ErrCodeHoldExpired      BookingErrorCode = "hold_expired"
+	ErrCodeExtensionLimit   BookingErrorCode = "extension_limit"
+	ErrCodeNotCancellable   BookingErrorCode = "not_cancellable"
+	ErrCodeCurrencyMismatch BookingErrorCode = "currency_mismatch"
+	ErrCodeInternal         BookingErrorCode = "internal_error"
+)
+
+// BookingError describes why a booking request was rejected
+type BookingError struct {
+	Code    BookingErrorCode `json:"code"`
+	Message string           `json:"message"`
+	Seats   models.Seats     `json:"seats,omitempty"` // Seats that caused the rejection
 }
 
+// Error implements the error interface
+func (e *BookingError) Error() string {
+	return e.Message
+}
+
+var (
+	// MaxSeatsPerBooking limits how many seats a single booking may contain
+	MaxSeatsPerBooking = 10
+
+	// HoldDuration is how long held seats stay reserved without checkout
+	HoldDuration = 10 * time.Minute
+
+	// MaxHoldExtensions limits how often a customer may extend a hold
+	MaxHoldExtensions = 2
+
+	// RefundPolicy decides how much of a cancelled booking is refunded
+	RefundPolicy = models.DefaultCancellationPolicy
+
+	// PriceRules decides what each seat costs
+	PriceRules = pricing.DefaultRules
+)
+
 var (
 	// Channel for booking requests
 	bookingRequests = make(chan BookingRequest, 100)
@@ -35,6 +128,7 @@ var (
 
 // StartBookingProcessor initializes the booking processor goroutine
 func StartBookingProcessor() {
+	scheduleActiveHolds()
 	go processBookings()
 	go periodicCleanup()
 }
@@ -43,6 +137,7 @@ func StartBookingProcessor() {
 func StopBookingProcessor() {
 	cleanupSignal <- true
 	close(bookingRequests)
+	stopHoldTimers()
 }
 
 // ProcessBookingAsync submits a booking request to be processed asynchronously
@@ -50,6 +145,18 @@ func ProcessBookingAsync(request BookingRequest) {
 	bookingRequests <- request
 }
 
+// submitBookingRequest sends a request to the booking processor and waits for the result
+func submitBookingRequest(request BookingRequest) BookingResponse {
+	responseChan := make(chan BookingResponse)
+	request.ResponseChan = responseChan
+
+	ProcessBookingAsync(request)
+
+	response := <-responseChan
+	close(responseChan)
+	return response
+}
+
 // processBookings handles booking requests in a separate goroutine
 func processBookings() {
 	for request := range bookingRequests {
@@ -61,86 +168,523 @@ func processBookings() {
 	}
 }
 
-// processBooking handles a single booking request with proper locking
+// processBooking handles a single booking request
 func processBooking(request BookingRequest) BookingResponse {
+	switch request.Action {
+	case ActionBook:
+		return reserveSeats(request, models.BookingConfirmed)
+	case ActionHold:
+		return reserveSeats(request, models.BookingHeld)
+	case ActionExtend, ActionRelease, ActionConfirm:
+		return updateHold(request)
+	case ActionCancel:
+		return cancelBooking(request)
+	default:
+		return failedBooking(&BookingError{Code: ErrCodeInternal, Message: "Unknown booking action " + string(request.Action)})
+	}
+}
+
+// reserveSeats books or holds new seats with proper locking
+func reserveSeats(request BookingRequest, status models.BookingStatus) BookingResponse {
 	// Get the mutex for this show
 	mutex := getShowMutex(request.ShowID)
 	mutex.Lock()
 	defer mutex.Unlock()
 
 	// Get show details
-	var show models.Show
-	if err := database.DB.First(&show, request.ShowID).Error; err != nil {
-		return BookingResponse{
-			Success:      false,
-			ErrorMessage: "Show not found",
-		}
+	show, err := loadShow(request.ShowID)
+	if err != nil {
+		return failedBooking(&BookingError{Code: ErrCodeShowNotFound, Message: "Show not found"})
 	}
 
-	// Check if seats are already booked
-	var existingBookings []models.Booking
-	database.DB.Where("show_id = ? AND confirmed = ?", request.ShowID, true).Find(&existingBookings)
+	// Check that the requested seats exist in the hall
+	if bookingErr := validateSeats(show.Hall.Layout, request.Seats); bookingErr != nil {
+		return failedBooking(bookingErr)
+	}
 
-	// Create a map of already booked seats
-	bookedSeats := make(map[string]bool)
-	for _, booking := range existingBookings {
-		for _, seat := range booking.Seats {
-			key := fmt.Sprintf("%s%d", seat.Row, seat.Number)
-			bookedSeats[key] = true
+	// Check if any of the selected seats are already booked or held
+	takenSeats := takenSeatKeys(request.ShowID, time.Now())
+	var unavailable models.Seats
+	for _, seat := range request.Seats {
+		if _, taken := takenSeats[seat.String()]; taken {
+			unavailable = append(unavailable, seat)
 		}
 	}
+	if len(unavailable) > 0 {
+		return failedBooking(&BookingError{
+			Code:    ErrCodeSeatsUnavailable,
+			Message: "Some selected seats are already booked: " + unavailable.String(),
+			Seats:   unavailable,
+		})
+	}
 
-	// Check if any of the selected seats are already booked
-	for _, seat := range request.Seats {
-		key := fmt.Sprintf("%s%d", seat.Row, seat.Number)
-		if bookedSeats[key] {
-			return BookingResponse{
-				Success:      false,
-				ErrorMessage: "Some selected seats are already booked",
-			}
+	prices, err := PriceRules.Price(show, request.Seats)
+	if err != nil {
+		return failedBooking(&BookingError{Code: ErrCodeInvalidTicket, Message: err.Error()})
+	}
+
+	// Take any promo code discount off the seat prices
+	now := time.Now()
+	var promo *models.PromoCode
+	var discount money.Money
+	if request.PromoCode != "" {
+		var bookingErr *BookingError
+		if promo, bookingErr = loadPromoCode(request.PromoCode, show, len(request.Seats), now); bookingErr != nil {
+			return failedBooking(bookingErr)
 		}
+		discount = promo.Discount(prices.Total())
+		prices = pricing.ApplyDiscount(prices, "Promo code "+promo.Code, discount)
 	}
+	prices = PriceRules.ApplyTax(prices)
 
 	// Create booking
 	booking := models.Booking{
-		ShowID:       request.ShowID,
-		CustomerName: request.CustomerName,
-		Email:        request.Email,
-		Seats:        request.Seats,
-		BookingTime:  time.Now(),
-		TotalAmount:  float64(len(request.Seats)) * show.TicketPrice,
-		Confirmed:    true,
+		ShowID:         request.ShowID,
+		CustomerName:   request.CustomerName,
+		Email:          request.Email,
+		UserID:         request.UserID,
+		APIKeyID:       request.APIKeyID,
+		Seats:          request.Seats,
+		BookingTime:    now,
+		TotalAmount:    prices.Total(),
+		RefundedAmount: money.New(0, show.TicketPrice.Currency),
+		Prices:         prices,
+		Status:         status,
+	}
+	if promo != nil {
+		booking.PromoCode = promo.Code
+	}
+	if status == models.BookingHeld {
+		expiresAt := now.Add(HoldDuration)
+		booking.ExpiresAt = &expiresAt
 	}
 
-	// Save booking to database
-	if err := database.DB.Create(&booking).Error; err != nil {
-		return BookingResponse{
-			Success:      false,
-			ErrorMessage: "Error saving booking: " + err.Error(),
+	// Save booking to database, together with the promo code use
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&booking).Error; err != nil {
+			return err
 		}
+		if promo != nil {
+			if err := redeemPromoCode(tx, promo, booking, discount); err != nil {
+				return err
+			}
+		}
+		if booking.Status == models.BookingConfirmed {
+			return issueTickets(tx, booking)
+		}
+		return nil
+	})
+	if err != nil {
+		var bookingErr *BookingError
+		if errors.As(err, &bookingErr) {
+			return failedBooking(bookingErr)
+		}
+		return failedBooking(&BookingError{Code: ErrCodeInternal, Message: "Error saving booking: " + err.Error()})
+	}
+
+	if booking.ExpiresAt != nil {
+		scheduleHoldExpiry(booking.ID, *booking.ExpiresAt)
+		publishSeats(SeatsHeld, booking.ShowID, booking.Seats)
+	} else {
+		notifyBooking(notifications.BookingConfirmed, booking.ID, notifications.BookingEmail{})
+		publishSeats(SeatsBooked, booking.ShowID, booking.Seats)
 	}
 
 	return BookingResponse{
 		Success:   true,
 		BookingID: booking.ID,
+		Reference: booking.Reference,
 	}
 }
 
-// periodicCleanup runs booking cleanup tasks periodically
+// updateHold extends, releases or confirms an existing hold with proper locking
+func updateHold(request BookingRequest) BookingResponse {
+	// Look up the show first so the right mutex can be taken
+	var showID uint
+	err := database.DB.Model(&models.Booking{}).Where("id = ?", request.BookingID).Pluck("show_id", &showID).Error
+	if err != nil || showID == 0 {
+		return failedBooking(&BookingError{Code: ErrCodeBookingNotFound, Message: "Booking not found"})
+	}
+
+	mutex := getShowMutex(showID)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var booking models.Booking
+	if err := database.DB.First(&booking, request.BookingID).Error; err != nil {
+		return failedBooking(&BookingError{Code: ErrCodeBookingNotFound, Message: "Booking not found"})
+	}
+
+	now := time.Now()
+	if booking.Status != models.BookingHeld {
+		return failedBooking(&BookingError{Code: ErrCodeNotHeld, Message: "Booking is not on hold"})
+	}
+	if !booking.IsActiveHold(now) {
+		// The expiry timer has not caught up yet
+		expireBooking(&booking)
+		return failedBooking(&BookingError{Code: ErrCodeHoldExpired, Message: "The hold on these seats has expired"})
+	}
+
+	switch request.Action {
+	case ActionExtend:
+		if booking.HoldExtensions >= MaxHoldExtensions {
+			return failedBooking(&BookingError{
+				Code:    ErrCodeExtensionLimit,
+				Message: fmt.Sprintf("A hold can be extended at most %d times", MaxHoldExtensions),
+			})
+		}
+		expiresAt := now.Add(HoldDuration)
+		booking.ExpiresAt = &expiresAt
+		booking.HoldExtensions++
+
+	case ActionRelease:
+		booking.Status = models.BookingReleased
+		booking.ExpiresAt = nil
+
+	case ActionConfirm:
+		booking.Status = models.BookingConfirmed
+		booking.ExpiresAt = nil
+		booking.BookingTime = now
+	}
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&booking).Error; err != nil {
+			return err
+		}
+		if booking.Status == models.BookingConfirmed {
+			return issueTickets(tx, booking)
+		}
+		return nil
+	})
+	if err != nil {
+		return failedBooking(&BookingError{Code: ErrCodeInternal, Message: "Error updating booking: " + err.Error()})
+	}
+
+	if booking.ExpiresAt != nil {
+		scheduleHoldExpiry(booking.ID, *booking.ExpiresAt)
+	} else {
+		cancelHoldExpiry(booking.ID)
+	}
+	switch booking.Status {
+	case models.BookingReleased:
+		releasePromoCode(booking.ID)
+		publishSeats(SeatsReleased, booking.ShowID, booking.Seats)
+		seatsReleased(booking)
+	case models.BookingConfirmed:
+		settleWaitlistOffer(booking.ID, models.WaitlistClaimed)
+		notifyBooking(notifications.BookingConfirmed, booking.ID, notifications.BookingEmail{})
+		publishSeats(SeatsBooked, booking.ShowID, booking.Seats)
+	}
+
+	return BookingResponse{
+		Success:   true,
+		BookingID: booking.ID,
+		Reference: booking.Reference,
+	}
+}
+
+// cancelBooking releases a hold or cancels some or all seats of a confirmed
+// booking with proper locking, recording the refund owed
+func cancelBooking(request BookingRequest) BookingResponse {
+	// Look up the show first so the right mutex can be taken
+	var showID uint
+	err := database.DB.Model(&models.Booking{}).Where("id = ?", request.BookingID).Pluck("show_id", &showID).Error
+	if err != nil || showID == 0 {
+		return failedBooking(&BookingError{Code: ErrCodeBookingNotFound, Message: "Booking not found"})
+	}
+
+	mutex := getShowMutex(showID)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var booking models.Booking
+	if err := database.DB.Preload("Show").First(&booking, request.BookingID).Error; err != nil {
+		return failedBooking(&BookingError{Code: ErrCodeBookingNotFound, Message: "Booking not found"})
+	}
+
+	// Holds have not been paid for, so giving them up needs no record
+	if booking.Status == models.BookingHeld && len(request.Seats) == 0 {
+		booking.Status = models.BookingReleased
+		booking.ExpiresAt = nil
+		if err := database.DB.Omit("Show").Save(&booking).Error; err != nil {
+			return failedBooking(&BookingError{Code: ErrCodeInternal, Message: "Error updating booking: " + err.Error()})
+		}
+		cancelHoldExpiry(booking.ID)
+		releasePromoCode(booking.ID)
+		publishSeats(SeatsReleased, booking.ShowID, booking.Seats)
+		seatsReleased(booking)
+
+		return BookingResponse{
+			Success:   true,
+			BookingID: booking.ID,
+			Reference: booking.Reference,
+		}
+	}
+
+	if booking.Status != models.BookingConfirmed {
+		return failedBooking(&BookingError{
+			Code:    ErrCodeNotCancellable,
+			Message: "Booking is " + string(booking.Status) + " and cannot be cancelled",
+		})
+	}
+
+	now := time.Now()
+	if request.CancelledBy != models.CancelledByAdmin && !now.Before(booking.Show.DateTime) {
+		return failedBooking(&BookingError{
+			Code:    ErrCodeNotCancellable,
+			Message: "The show has already started",
+		})
+	}
+
+	// Work out which seats are being given back
+	cancelledSeats, remainingSeats, bookingErr := splitSeats(booking.Seats, request.Seats)
+	if bookingErr != nil {
+		return failedBooking(bookingErr)
+	}
+
+	cancelledAmount, remainingPrices := splitPrices(booking, cancelledSeats)
+	// Bookings stored before the site's currency changed may read their seat
+	// prices in the new currency; they are refused rather than mixed up
+	if err := money.CheckCurrency(booking.TotalAmount, booking.RefundedAmount, cancelledAmount); err != nil {
+		return failedBooking(&BookingError{Code: ErrCodeCurrencyMismatch, Message: "Error cancelling booking: " + err.Error()})
+	}
+	cancellation := models.Cancellation{
+		BookingID:     booking.ID,
+		Seats:         cancelledSeats,
+		RefundAmount:  RefundPolicy.Refund(cancelledAmount, booking.Show.DateTime, now),
+		RefundPercent: RefundPolicy.RefundPercent(booking.Show.DateTime, now),
+		CancelledBy:   request.CancelledBy,
+		UserID:        request.UserID,
+		APIKeyID:      request.APIKeyID,
+		Reason:        request.Reason,
+	}
+	if cancellation.CancelledBy == "" {
+		cancellation.CancelledBy = models.CancelledByCustomer
+	}
+
+	// A booking keeps its seats on record once nothing is left to cancel
+	if len(remainingSeats) == 0 {
+		booking.Status = models.BookingCancelled
+	} else {
+		booking.Seats = remainingSeats
+		booking.Prices = remainingPrices
+		booking.TotalAmount = booking.TotalAmount.Sub(cancelledAmount)
+	}
+	booking.RefundedAmount = booking.RefundedAmount.Add(cancellation.RefundAmount)
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Show").Save(&booking).Error; err != nil {
+			return err
+		}
+		if err := voidTickets(tx, booking.ID, cancelledSeats); err != nil {
+			return err
+		}
+		return tx.Create(&cancellation).Error
+	})
+	if err != nil {
+		return failedBooking(&BookingError{Code: ErrCodeInternal, Message: "Error cancelling booking: " + err.Error()})
+	}
+
+	notifyBooking(notifications.BookingCancelled, booking.ID, notifications.BookingEmail{Cancellation: &cancellation})
+	publishSeats(SeatsReleased, booking.ShowID, cancelledSeats)
+	seatsReleased(booking)
+
+	return BookingResponse{
+		Success:        true,
+		BookingID:      booking.ID,
+		Reference:      booking.Reference,
+		CancellationID: cancellation.ID,
+	}
+}
+
+// splitSeats divides a booking's seats into those requested for cancellation
+// and those kept. An empty request cancels every seat.
+func splitSeats(booked, requested models.Seats) (cancelled, remaining models.Seats, bookingErr *BookingError) {
+	if len(requested) == 0 {
+		return booked, nil, nil
+	}
+
+	wanted := make(map[string]bool)
+	for _, seat := range requested {
+		wanted[seat.String()] = true
+	}
+
+	for _, seat := range booked {
+		if wanted[seat.String()] {
+			cancelled = append(cancelled, seat)
+			delete(wanted, seat.String())
+		} else {
+			remaining = append(remaining, seat)
+		}
+	}
+
+	if len(wanted) > 0 {
+		var notBooked models.Seats
+		for _, seat := range requested {
+			if wanted[seat.String()] {
+				notBooked = append(notBooked, seat)
+			}
+		}
+		return nil, nil, &BookingError{
+			Code:    ErrCodeInvalidSeats,
+			Message: "Seats are not part of this booking: " + notBooked.String(),
+			Seats:   notBooked,
+		}
+	}
+
+	return cancelled, remaining, nil
+}
+
+// splitPrices returns what the cancelled seats cost and the price breakdown
+// of the seats kept. Bookings made before seat pricing charged every seat the
+// same, so their cancelled share is proportional to the number of seats.
+func splitPrices(booking models.Booking, cancelled models.Seats) (money.Money, models.SeatPrices) {
+	if len(booking.Prices) == 0 {
+		shares := booking.TotalAmount.Allocate(int64(len(cancelled)), int64(len(booking.Seats)-len(cancelled)))
+		return shares[0], nil
+	}
+
+	isCancelled := make(map[string]bool)
+	for _, seat := range cancelled {
+		isCancelled[seat.String()] = true
+	}
+
+	var cancelledPrices, remaining models.SeatPrices
+	for _, price := range booking.Prices {
+		if isCancelled[price.Seat.String()] {
+			cancelledPrices = append(cancelledPrices, price)
+		} else {
+			remaining = append(remaining, price)
+		}
+	}
+	return cancelledPrices.Total(), remaining
+}
+
+// validateSeats checks a seat selection against the hall layout and the
+// per-booking limit, reporting every offending seat
+func validateSeats(layout models.SeatLayout, seats models.Seats) *BookingError {
+	if len(seats) == 0 {
+		return &BookingError{Code: ErrCodeNoSeats, Message: "No seats selected"}
+	}
+
+	if len(seats) > MaxSeatsPerBooking {
+		return &BookingError{
+			Code:    ErrCodeTooManySeats,
+			Message: fmt.Sprintf("A booking may contain at most %d seats", MaxSeatsPerBooking),
+		}
+	}
+
+	// Detect seats requested more than once
+	seen := make(map[string]bool)
+	var duplicates models.Seats
+	for _, seat := range seats {
+		key := seat.String()
+		if seen[key] {
+			duplicates = append(duplicates, seat)
+		}
+		seen[key] = true
+	}
+	if len(duplicates) > 0 {
+		return &BookingError{
+			Code:    ErrCodeDuplicateSeats,
+			Message: "Seats selected more than once: " + duplicates.String(),
+			Seats:   duplicates,
+		}
+	}
+
+	// Detect seats that do not exist in the hall
+	var invalid models.Seats
+	for _, seat := range seats {
+		if !layout.HasSeat(seat) {
+			invalid = append(invalid, seat)
+		}
+	}
+	if len(invalid) > 0 {
+		return &BookingError{
+			Code:    ErrCodeInvalidSeats,
+			Message: "Seats do not exist in this hall: " + invalid.String(),
+			Seats:   invalid,
+		}
+	}
+
+	return nil
+}
+
+// failedBooking builds the response for a rejected booking request
+func failedBooking(err *BookingError) BookingResponse {
+	return BookingResponse{
+		Success:      false,
+		ErrorMessage: err.Message,
+		Error:        err,
+	}
+}
+
+// bookingErrorStatus maps a booking error to an HTTP status code
+func bookingErrorStatus(err *BookingError) int {
+	if err == nil {
+		return http.StatusInternalServerError
+	}
+
+	switch err.Code {
+	case ErrCodeShowNotFound:
+		return http.StatusNotFound
+	case ErrCodeBookingNotFound:
+		return http.StatusNotFound
+	case ErrCodeSeatsUnavailable, ErrCodeNotHeld, ErrCodeHoldExpired, ErrCodeExtensionLimit, ErrCodeNotCancellable, ErrCodeCurrencyMismatch:
+		return http.StatusConflict
+	case ErrCodeNoSeats, ErrCodeTooManySeats, ErrCodeDuplicateSeats, ErrCodeInvalidSeats, ErrCodeInvalidTicket:
+		return http.StatusUnprocessableEntity
+	case ErrCodeInvalidPromo:
+		return http.StatusUnprocessableEntity
+	case ErrCodePromoUsedUp:
+		return http.StatusConflict
+	case ErrCodePaymentRequired, ErrCodeIdempotencyKey:
+		return http.StatusUnprocessableEntity
+	case ErrCodePaymentDeclined:
+		return http.StatusPaymentRequired
+	case ErrCodePaymentInProgress:
+		return http.StatusConflict
+	case ErrCodePaymentFailed:
+		return http.StatusBadGateway
+	case ErrCodeTicketInvalid:
+		return http.StatusUnprocessableEntity
+	case ErrCodeTicketVoid, ErrCodeAlreadyAdmitted, ErrCodeShowNotCurrent:
+		return http.StatusConflict
+	case ErrCodeGroupEnded:
+		return http.StatusGone
+	case ErrCodeNotOrganizer:
+		return http.StatusForbidden
+	case ErrCodeCustomerRequired:
+		return http.StatusUnprocessableEntity
+	case ErrCodeSeatsAvailable, ErrCodeAlreadyWaitlisted:
+		return http.StatusConflict
+	case ErrCodeWaitlistNotFound:
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// periodicCleanup runs booking cleanup tasks periodically. Holds are expired
+// by their own timers; this only catches holds whose timer was lost. Show
+// reminders are queued and ended login sessions deleted here too.
 func periodicCleanup() {
-	ticker := time.NewTicker(1 * time.Hour)
+	ticker := time.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			// Cancel expired provisional bookings (not confirmed within 15 minutes)
-			expiredTime := time.Now().Add(-15 * time.Minute)
-			result := database.DB.Where("confirmed = ? AND booking_time < ?", false, expiredTime).Delete(&models.Booking{})
-			if result.Error == nil && result.RowsAffected > 0 {
-				log.Printf("Cleaned up %d expired bookings", result.RowsAffected)
+			var lapsed []models.Booking
+			database.DB.Where("status = ? AND expires_at <= ?", models.BookingHeld, time.Now()).Find(&lapsed)
+			for _, booking := range lapsed {
+				expireHold(booking.ID)
 			}
 
+			SendShowReminders(time.Now())
+			sessions.DeleteExpired(time.Now())
+			apikeys.PruneWindows(time.Now())
+
 		case <-cleanupSignal:
 			return
 		}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/calendar"
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/tickets"
+	"github.com/JoeDkhar/cinema-booking-system/internal/utils"
+	"github.com/gorilla/mux"
+)
+
+// BaseURL is the address customers reach the site on, used for links that
+// leave the site such as those in calendar events
+var BaseURL = "http://localhost:8080"
+
+// calendarDomain returns the domain that makes calendar event UIDs unique
+func calendarDomain() string {
+	if parsed, err := url.Parse(BaseURL); err == nil && parsed.Hostname() != "" {
+		return parsed.Hostname()
+	}
+	return "cinema-booking"
+}
+
+// showEnd returns when a show's movie finishes
+func showEnd(show models.Show) time.Time {
+	if show.Movie == nil {
+		return show.DateTime
+	}
+	return show.DateTime.Add(time.Duration(show.Movie.Duration) * time.Minute)
+}
+
+// bookingEvent returns the calendar event of a booking loaded with its show,
+// movie and hall
+func bookingEvent(booking models.Booking) calendar.Event {
+	show := *booking.Show
+	return calendar.Event{
+		UID:      "booking-" + booking.Reference + "@" + calendarDomain(),
+		Start:    show.DateTime,
+		End:      showEnd(show),
+		Summary:  show.Movie.Title,
+		Location: tickets.HallName(show.Hall),
+		Description: "Booking reference: " + booking.Reference + "\n" +
+			"Seats: " + booking.Seats.String(),
+		URL:          BaseURL + "/booking/confirmation/" + booking.Reference,
+		Status:       calendar.StatusConfirmed,
+		LastModified: booking.UpdatedAt,
+	}
+}
+
+// showEvent returns the calendar event of a show of a movie
+func showEvent(movie models.Movie, show models.Show) calendar.Event {
+	show.Movie = &movie
+	return calendar.Event{
+		UID:          "show-" + strconv.FormatUint(uint64(show.ID), 10) + "@" + calendarDomain(),
+		Start:        show.DateTime,
+		End:          showEnd(show),
+		Summary:      movie.Title,
+		Location:     tickets.HallName(show.Hall),
+		Description:  "Tickets from " + utils.FormatCurrency(show.TicketPrice),
+		URL:          BaseURL + "/shows/" + strconv.FormatUint(uint64(show.ID), 10),
+		Status:       calendar.StatusConfirmed,
+		LastModified: show.UpdatedAt,
+	}
+}
+
+// sendCalendar writes a calendar as an .ics download
+func sendCalendar(w http.ResponseWriter, cal calendar.Calendar, filename, cacheControl string) {
+	var buf bytes.Buffer
+	if err := cal.Write(&buf, time.Now()); err != nil {
+		log.Printf("Error writing calendar %s: %v", filename, err)
+		http.Error(w, "Error creating calendar", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Write(buf.Bytes())
+}
+
+// BookingCalendarHandler serves a confirmed booking as a calendar event
+func BookingCalendarHandler(w http.ResponseWriter, r *http.Request) {
+	booking, err := loadBookingByReference(mux.Vars(r)["reference"])
+	if err != nil || booking.Status != models.BookingConfirmed || booking.Show.Movie == nil {
+		http.Error(w, "Booking not found", http.StatusNotFound)
+		return
+	}
+
+	sendCalendar(w, calendar.Calendar{Events: []calendar.Event{bookingEvent(booking)}},
+		"booking-"+booking.Reference+".ics", "private, no-store")
+}
+
+// MovieCalendarHandler serves the upcoming shows of a movie as a calendar
+// that can be subscribed to
+func MovieCalendarHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid movie ID", http.StatusBadRequest)
+		return
+	}
+
+	var movie models.Movie
+	if err := database.DB.First(&movie, id).Error; err != nil {
+		http.Error(w, "Movie not found", http.StatusNotFound)
+		return
+	}
+
+	var shows []models.Show
+	database.DB.Preload("Hall").Where("movie_id = ? AND date_time > ?", movie.ID, time.Now()).
+		Order("date_time").Find(&shows)
+
+	cal := calendar.Calendar{Name: movie.Title, Events: make([]calendar.Event, 0, len(shows))}
+	for _, show := range shows {
+		cal.Events = append(cal.Events, showEvent(movie, show))
+	}
+
+	sendCalendar(w, cal, "movie-"+strconv.Itoa(id)+".ics", "public, max-age=300")
+}
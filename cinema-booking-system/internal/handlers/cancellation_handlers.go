@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/money"
+	"github.com/gorilla/mux"
+)
+
+// FindBookingHandler lets customers open their booking with its reference and email
+func FindBookingHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		templates.ExecuteTemplate(w, r, "find_booking.html", map[string]interface{}{
+			"Reference": r.FormValue("reference"),
+		})
+		return
+	}
+
+	reference := r.FormValue("reference")
+	email := r.FormValue("email")
+
+	booking, err := loadBookingByReference(reference)
+	if err != nil || email == "" || !strings.EqualFold(strings.TrimSpace(email), booking.Email) {
+		templates.ExecuteTemplate(w, r, "find_booking.html", map[string]interface{}{
+			"Reference": reference,
+			"Email":     email,
+			"Error":     "No booking matches that reference and email address",
+		})
+		return
+	}
+
+	if booking.Status == models.BookingHeld {
+		http.Redirect(w, r, "/booking/checkout/"+booking.Reference, http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/booking/confirmation/"+booking.Reference, http.StatusSeeOther)
+}
+
+// CancelBookingFormHandler lets customers look up a booking by reference and
+// email and choose the seats to cancel
+func CancelBookingFormHandler(w http.ResponseWriter, r *http.Request) {
+	reference := r.FormValue("reference")
+	email := r.FormValue("email")
+	user, loggedIn := currentUser(r)
+
+	if r.Method == http.MethodGet && (reference == "" || (email == "" && !loggedIn)) {
+		templates.ExecuteTemplate(w, r, "cancel_booking.html", map[string]interface{}{
+			"Reference": reference,
+			"Email":     email,
+		})
+		return
+	}
+
+	booking, err := loadBookingByReference(reference)
+	if err != nil || !canManageBooking(booking, email, user, loggedIn) {
+		templates.ExecuteTemplate(w, r, "cancel_booking.html", map[string]interface{}{
+			"Reference": reference,
+			"Email":     email,
+			"Error":     "No booking matches that reference and email address",
+		})
+		return
+	}
+
+	renderCancelBooking(w, r, booking, email, "")
+}
+
+// CancelBookingHandler cancels the selected seats of a customer's booking
+func CancelBookingHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	email := r.FormValue("email")
+	user, loggedIn := currentUser(r)
+
+	booking, err := loadBookingByReference(mux.Vars(r)["reference"])
+	if err != nil || !canManageBooking(booking, email, user, loggedIn) {
+		http.Error(w, "Booking not found", http.StatusNotFound)
+		return
+	}
+
+	seats, err := parseSeatLabels(r.Form["seats"])
+	if err != nil || len(seats) == 0 {
+		renderCancelBooking(w, r, booking, email, "Select the seats you want to cancel")
+		return
+	}
+
+	request := BookingRequest{
+		BookingID:   booking.ID,
+		Seats:       seats,
+		CancelledBy: models.CancelledByCustomer,
+		Reason:      r.FormValue("reason"),
+	}
+	if loggedIn {
+		request.UserID = &user.ID
+	}
+
+	allowPaymentTime(w)
+	response := cancelAndRefund(r.Context(), request)
+	if !response.Success {
+		renderCancelBooking(w, r, booking, email, response.ErrorMessage)
+		return
+	}
+
+	var cancellation models.Cancellation
+	database.DB.First(&cancellation, response.CancellationID)
+	booking, _ = loadBooking(booking.ID)
+
+	templates.ExecuteTemplate(w, r, "cancellation_complete.html", map[string]interface{}{
+		"Booking":      booking,
+		"Cancellation": cancellation,
+	})
+}
+
+// AdminCancelBookingHandler cancels some or all seats of any booking
+func AdminCancelBookingHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid booking ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	// No seats selected cancels the whole booking
+	seats, err := parseSeatLabels(r.Form["seats"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user := r.Context().Value("user").(models.User)
+	allowPaymentTime(w)
+	response := cancelAndRefund(r.Context(), BookingRequest{
+		BookingID:   uint(id),
+		Seats:       seats,
+		CancelledBy: models.CancelledByAdmin,
+		UserID:      &user.ID,
+		Reason:      r.FormValue("reason"),
+	})
+
+	if !response.Success {
+		http.Error(w, response.ErrorMessage, bookingErrorStatus(response.Error))
+		return
+	}
+
+	http.Redirect(w, r, "/admin/bookings", http.StatusSeeOther)
+}
+
+// renderCancelBooking shows a booking's seats with the refund each would earn
+func renderCancelBooking(w http.ResponseWriter, r *http.Request, booking models.Booking, email, errMsg string) {
+	now := time.Now()
+
+	// Work out what cancelling each seat would refund
+	seatRefunds := make(map[string]money.Money)
+	for _, seat := range booking.Seats {
+		paid, _ := splitPrices(booking, models.Seats{seat})
+		seatRefunds[seat.String()] = RefundPolicy.Refund(paid, booking.Show.DateTime, now)
+	}
+
+	templates.ExecuteTemplate(w, r, "cancel_booking.html", map[string]interface{}{
+		"Booking":       booking,
+		"Email":         email,
+		"Cancellable":   booking.Status == models.BookingConfirmed && now.Before(booking.Show.DateTime),
+		"RefundPercent": RefundPolicy.RefundPercent(booking.Show.DateTime, now),
+		"SeatRefunds":   seatRefunds,
+		"Error":         errMsg,
+	})
+}
+
+// canManageBooking reports whether the customer may change the booking,
+// either by knowing its email address or by being logged in as its owner or
+// as a user who verified the booking's email address
+func canManageBooking(booking models.Booking, email string, user models.User, loggedIn bool) bool {
+	if email != "" && strings.EqualFold(strings.TrimSpace(email), booking.Email) {
+		return true
+	}
+	if !loggedIn {
+		return false
+	}
+	if booking.UserID != nil && *booking.UserID == user.ID {
+		return true
+	}
+	return user.Can(models.PermManageBookings) || (user.EmailVerified() && strings.EqualFold(user.Email, booking.Email))
+}
+
+// parseSeatLabels converts seat labels such as "A12" into seats
+func parseSeatLabels(labels []string) (models.Seats, error) {
+	seats := make(models.Seats, 0, len(labels))
+	for _, label := range labels {
+		seat, err := models.ParseSeat(label)
+		if err != nil {
+			return nil, err
+		}
+		seats = append(seats, seat)
+	}
+	return seats, nil
+}
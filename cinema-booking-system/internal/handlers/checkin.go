@@ -0,0 +1,262 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/tickets"
+	"github.com/JoeDkhar/cinema-booking-system/internal/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Check-in error codes
+const (
+	ErrCodeTicketInvalid   BookingErrorCode = "ticket_invalid"
+	ErrCodeTicketVoid      BookingErrorCode = "ticket_void"
+	ErrCodeAlreadyAdmitted BookingErrorCode = "already_admitted"
+	ErrCodeShowNotCurrent  BookingErrorCode = "show_not_current"
+)
+
+// CheckInOpensBefore is how long before a show starts its tickets are accepted
+// at the door. Tickets are accepted until the movie ends.
+var CheckInOpensBefore = time.Hour
+
+// issueTickets creates a ticket for every seat of a booking that has just
+// been confirmed, within the transaction confirming it
+func issueTickets(tx *gorm.DB, booking models.Booking) error {
+	if len(booking.Seats) == 0 {
+		return nil
+	}
+
+	issued := make([]models.Ticket, 0, len(booking.Seats))
+	for _, seat := range booking.Seats {
+		issued = append(issued, models.Ticket{
+			BookingID: booking.ID,
+			ShowID:    booking.ShowID,
+			Seat:      seat.String(),
+			Token:     tickets.Token(TicketSecret, booking, seat),
+			Status:    models.TicketIssued,
+		})
+	}
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&issued).Error
+}
+
+// voidTickets invalidates the tickets of cancelled seats within the
+// transaction cancelling them
+func voidTickets(tx *gorm.DB, bookingID uint, seats models.Seats) error {
+	labels := make([]string, 0, len(seats))
+	for _, seat := range seats {
+		labels = append(labels, seat.String())
+	}
+	return tx.Model(&models.Ticket{}).Where("booking_id = ? AND seat IN ?", bookingID, labels).
+		Update("status", models.TicketVoid).Error
+}
+
+// checkInResult tells door staff who was admitted
+type checkInResult struct {
+	Reference    string            `json:"reference"`
+	Seat         string            `json:"seat"`
+	TicketType   models.TicketType `json:"ticket_type"`
+	CustomerName string            `json:"customer_name"`
+	Movie        string            `json:"movie"`
+	ShowTime     time.Time         `json:"show_time"`
+	Hall         string            `json:"hall"`
+	AdmittedAt   time.Time         `json:"admitted_at"`
+}
+
+// checkIn admits the holder of a ticket token. Every ticket is admitted at
+// most once, so a copied ticket is turned away after the first scan.
+func checkIn(token string, staffID uint, now time.Time) (checkInResult, *BookingError) {
+	claims, err := tickets.Verify(TicketSecret, token)
+	if err != nil {
+		return checkInResult{}, &BookingError{Code: ErrCodeTicketInvalid, Message: "This is not a valid ticket"}
+	}
+	seat, err := models.ParseSeat(claims.Seat)
+	if err != nil {
+		return checkInResult{}, &BookingError{Code: ErrCodeTicketInvalid, Message: "This is not a valid ticket"}
+	}
+
+	// Hold the show's mutex so the seat cannot be cancelled meanwhile
+	mutex := getShowMutex(claims.ShowID)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	booking, err := loadBookingByReference(claims.Reference)
+	if err != nil || booking.ShowID != claims.ShowID || booking.Show.Movie == nil {
+		return checkInResult{}, &BookingError{Code: ErrCodeTicketInvalid, Message: "This ticket does not match a booking"}
+	}
+
+	show := booking.Show
+	opens := show.DateTime.Add(-CheckInOpensBefore)
+	ends := show.DateTime.Add(time.Duration(show.Movie.Duration) * time.Minute)
+	if now.Before(opens) {
+		return checkInResult{}, &BookingError{
+			Code:    ErrCodeShowNotCurrent,
+			Message: "This ticket is for " + utils.FormatDateTime(show.DateTime) + "; entry opens at " + utils.FormatTime(opens),
+		}
+	}
+	if now.After(ends) {
+		return checkInResult{}, &BookingError{
+			Code:    ErrCodeShowNotCurrent,
+			Message: "This ticket was for " + utils.FormatDateTime(show.DateTime) + ", which has ended",
+		}
+	}
+
+	var ticket models.Ticket
+	err = database.DB.Where("booking_id = ? AND seat = ?", booking.ID, seat.String()).First(&ticket).Error
+	if err != nil {
+		// Bookings confirmed before tickets were issued get theirs at the door
+		if booking.Status != models.BookingConfirmed || !booking.Seats.Contains(seat) {
+			return checkInResult{}, &BookingError{Code: ErrCodeTicketVoid, Message: "This ticket has been cancelled", Seats: models.Seats{seat}}
+		}
+		ticketBooking := booking
+		ticketBooking.Seats = models.Seats{seat}
+		if err := issueTickets(database.DB, ticketBooking); err != nil {
+			return checkInResult{}, &BookingError{Code: ErrCodeInternal, Message: "Error issuing ticket: " + err.Error()}
+		}
+		if err := database.DB.Where("booking_id = ? AND seat = ?", booking.ID, seat.String()).First(&ticket).Error; err != nil {
+			return checkInResult{}, &BookingError{Code: ErrCodeInternal, Message: "Error issuing ticket: " + err.Error()}
+		}
+	}
+
+	switch ticket.Status {
+	case models.TicketVoid:
+		return checkInResult{}, &BookingError{Code: ErrCodeTicketVoid, Message: "This ticket has been cancelled", Seats: models.Seats{seat}}
+	case models.TicketAdmitted:
+		return checkInResult{}, alreadyAdmitted(ticket, seat)
+	}
+
+	// Admit with a conditional update, so the ticket is only ever admitted once
+	result := database.DB.Model(&models.Ticket{}).
+		Where("id = ? AND status = ?", ticket.ID, models.TicketIssued).
+		Updates(map[string]interface{}{"status": models.TicketAdmitted, "admitted_at": now, "admitted_by": staffID})
+	if result.Error != nil {
+		return checkInResult{}, &BookingError{Code: ErrCodeInternal, Message: "Error admitting ticket: " + result.Error.Error()}
+	}
+	if result.RowsAffected == 0 {
+		database.DB.First(&ticket, ticket.ID)
+		return checkInResult{}, alreadyAdmitted(ticket, seat)
+	}
+
+	ticketType := models.TicketAdult
+	if price, ok := booking.Prices.For(seat); ok {
+		ticketType = price.TicketType
+	}
+
+	return checkInResult{
+		Reference:    booking.Reference,
+		Seat:         seat.String(),
+		TicketType:   ticketType,
+		CustomerName: booking.CustomerName,
+		Movie:        show.Movie.Title,
+		ShowTime:     show.DateTime,
+		Hall:         tickets.HallName(show.Hall),
+		AdmittedAt:   now,
+	}, nil
+}
+
+// alreadyAdmitted rejects a ticket scanned a second time
+func alreadyAdmitted(ticket models.Ticket, seat models.Seat) *BookingError {
+	message := "This ticket has already been used"
+	if ticket.AdmittedAt != nil {
+		message += " at " + utils.FormatTime(*ticket.AdmittedAt)
+	}
+	return &BookingError{Code: ErrCodeAlreadyAdmitted, Message: message, Seats: models.Seats{seat}}
+}
+
+// apiCheckInRequest is the JSON body accepted by APICheckInHandler
+type apiCheckInRequest struct {
+	Token string `json:"token"`
+}
+
+// APICheckInHandler admits the holder of a scanned ticket
+func APICheckInHandler(w http.ResponseWriter, r *http.Request) {
+	var body apiCheckInRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || strings.TrimSpace(body.Token) == "" {
+		sendJSONResponse(w, http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "A ticket token is required",
+		})
+		return
+	}
+
+	staff := r.Context().Value("user").(models.User)
+	result, bookingErr := checkIn(body.Token, staff.ID, time.Now())
+	if bookingErr != nil {
+		sendBookingError(w, failedBooking(bookingErr))
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    result,
+	})
+}
+
+// showAttendance compares the seats booked for a show with those admitted
+type showAttendance struct {
+	Show     models.Show
+	Booked   int
+	Admitted int
+}
+
+// Percent returns the share of booked seats that have been admitted
+func (a showAttendance) Percent() int {
+	if a.Booked == 0 {
+		return 0
+	}
+	return a.Admitted * 100 / a.Booked
+}
+
+// Waiting returns how many booked seats have not been admitted yet
+func (a showAttendance) Waiting() int {
+	return max(a.Booked-a.Admitted, 0)
+}
+
+// AdminCheckInsHandler shows how many booked seats have been admitted for
+// each show on a day, today by default
+func AdminCheckInsHandler(w http.ResponseWriter, r *http.Request) {
+	day := time.Now()
+	if value := r.URL.Query().Get("date"); value != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", value, time.Local)
+		if err != nil {
+			http.Error(w, "Invalid date", http.StatusBadRequest)
+			return
+		}
+		day = parsed
+	}
+	start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.Local)
+	end := start.AddDate(0, 0, 1)
+
+	var shows []models.Show
+	database.DB.Preload("Movie").Preload("Hall").
+		Where("date_time >= ? AND date_time < ?", start, end).Order("date_time").Find(&shows)
+
+	attendance := make([]showAttendance, 0, len(shows))
+	for _, show := range shows {
+		var bookings []models.Booking
+		database.DB.Where("show_id = ? AND status = ?", show.ID, models.BookingConfirmed).Find(&bookings)
+
+		var admitted int64
+		database.DB.Model(&models.Ticket{}).Where("show_id = ? AND status = ?", show.ID, models.TicketAdmitted).Count(&admitted)
+
+		entry := showAttendance{Show: show, Admitted: int(admitted)}
+		for _, booking := range bookings {
+			entry.Booked += len(booking.Seats)
+		}
+		attendance = append(attendance, entry)
+	}
+
+	templates.ExecuteTemplate(w, r, "admin_checkins.html", map[string]interface{}{
+		"Date":       start,
+		"Previous":   start.AddDate(0, 0, -1),
+		"Next":       end,
+		"Attendance": attendance,
+		"User":       r.Context().Value("user").(models.User),
+	})
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/utils"
+	"github.com/gorilla/mux"
+)
+
+// CheckoutHandler renders the checkout page for seats on hold
+func CheckoutHandler(w http.ResponseWriter, r *http.Request) {
+	booking, err := loadBookingByReference(mux.Vars(r)["reference"])
+	if err != nil {
+		http.Error(w, "Booking not found", http.StatusNotFound)
+		return
+	}
+
+	// Completed bookings go straight to their confirmation
+	if booking.Status == models.BookingConfirmed {
+		http.Redirect(w, r, "/booking/confirmation/"+booking.Reference, http.StatusSeeOther)
+		return
+	}
+
+	data := struct {
+		Booking       models.Booking
+		Active        bool
+		CanExtend     bool
+		SecondsLeft   int
+		ExtendMinutes int
+		Error         string
+		PaymentKey    string
+		TestTokens    bool
+	}{
+		Booking:       booking,
+		Active:        booking.IsActiveHold(time.Now()),
+		CanExtend:     booking.HoldExtensions < MaxHoldExtensions,
+		ExtendMinutes: int(HoldDuration.Minutes()),
+		Error:         r.URL.Query().Get("error"),
+		// A fresh key per page view lets the customer retry after a failed
+		// payment while a double-submitted form still charges only once
+		PaymentKey: utils.GenerateSessionToken(),
+		TestTokens: PaymentProvider.Name() == "fake",
+	}
+	if data.Active {
+		data.SecondsLeft = int(time.Until(*booking.ExpiresAt).Seconds())
+	}
+
+	templates.ExecuteTemplate(w, r, "checkout.html", data)
+}
+
+// ConfirmHoldHandler pays for a hold and converts it into a confirmed booking
+func ConfirmHoldHandler(w http.ResponseWriter, r *http.Request) {
+	booking, err := loadBookingByReference(mux.Vars(r)["reference"])
+	if err != nil {
+		http.Error(w, "Booking not found", http.StatusNotFound)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	allowPaymentTime(w)
+	response := checkoutHold(r.Context(), booking, r.FormValue("payment_token"), r.FormValue("idempotency_key"))
+	if !response.Success {
+		http.Redirect(w, r, "/booking/checkout/"+booking.Reference+"?error="+url.QueryEscape(response.ErrorMessage), http.StatusSeeOther)
+		return
+	}
+
+	http.Redirect(w, r, "/booking/confirmation/"+booking.Reference, http.StatusSeeOther)
+}
+
+// ExtendHoldHandler gives the customer more time to check out
+func ExtendHoldHandler(w http.ResponseWriter, r *http.Request) {
+	handleHoldAction(w, r, ActionExtend)
+}
+
+// ReleaseHoldHandler gives up held seats so other customers can book them
+func ReleaseHoldHandler(w http.ResponseWriter, r *http.Request) {
+	handleHoldAction(w, r, ActionRelease)
+}
+
+// handleHoldAction submits an action on an existing hold and redirects to the
+// page matching the outcome
+func handleHoldAction(w http.ResponseWriter, r *http.Request, action BookingAction) {
+	booking, err := loadBookingByReference(mux.Vars(r)["reference"])
+	if err != nil {
+		http.Error(w, "Booking not found", http.StatusNotFound)
+		return
+	}
+
+	response := submitBookingRequest(BookingRequest{
+		Action:    action,
+		BookingID: booking.ID,
+	})
+
+	checkoutURL := "/booking/checkout/" + booking.Reference
+
+	if !response.Success {
+		if response.Error != nil && response.Error.Code == ErrCodeBookingNotFound {
+			http.Error(w, response.ErrorMessage, http.StatusNotFound)
+			return
+		}
+		http.Redirect(w, r, checkoutURL+"?error="+url.QueryEscape(response.ErrorMessage), http.StatusSeeOther)
+		return
+	}
+
+	switch action {
+	case ActionRelease:
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, checkoutURL, http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,705 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/sessions"
+	"github.com/JoeDkhar/cinema-booking-system/internal/utils"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// Group session error codes
+const (
+	ErrCodeGroupEnded       BookingErrorCode = "group_ended"
+	ErrCodeNotOrganizer     BookingErrorCode = "not_organizer"
+	ErrCodeCustomerRequired BookingErrorCode = "customer_required"
+)
+
+var (
+	// GroupSessionIdleTimeout is how long a group session is kept once
+	// everyone has left it
+	GroupSessionIdleTimeout = 15 * time.Minute
+
+	// groupPingInterval is how often idle group connections are pinged; a
+	// connection that does not answer within groupPongWait is dropped
+	groupPingInterval = 30 * time.Second
+	groupPongWait     = 60 * time.Second
+)
+
+// groupMessageType identifies a message exchanged over a group session
+type groupMessageType string
+
+const (
+	// Sent by participants
+	groupSelect   groupMessageType = "select"
+	groupDeselect groupMessageType = "deselect"
+	groupFinalize groupMessageType = "finalize"
+
+	// Sent by the server
+	groupWelcome   groupMessageType = "welcome"
+	groupState     groupMessageType = "state"
+	groupError     groupMessageType = "error"
+	groupFinalized groupMessageType = "finalized"
+)
+
+// groupRequest is a message from a participant. Select and deselect name a
+// seat; select also sets its ticket type. Finalize carries the organizer's
+// details for the booking.
+type groupRequest struct {
+	Type         groupMessageType `json:"type"`
+	Seat         *models.Seat     `json:"seat,omitempty"`
+	CustomerName string           `json:"customer_name,omitempty"`
+	Email        string           `json:"email,omitempty"`
+	PromoCode    string           `json:"promo_code,omitempty"`
+}
+
+// groupMessage is a message to a participant
+type groupMessage struct {
+	Type         groupMessageType   `json:"type"`
+	Code         string             `json:"code,omitempty"`
+	You          int                `json:"you,omitempty"`
+	Organizer    bool               `json:"organizer,omitempty"`
+	Participants []groupParticipant `json:"participants,omitempty"`
+	Error        *BookingError      `json:"error,omitempty"`
+	Reference    string             `json:"reference,omitempty"`
+	CheckoutURL  string             `json:"checkout_url,omitempty"`
+}
+
+// groupParticipant is one person connected to a group session and the
+// seats they have picked
+type groupParticipant struct {
+	ID        int          `json:"id"`
+	Name      string       `json:"name"`
+	Organizer bool         `json:"organizer"`
+	Seats     models.Seats `json:"seats"`
+
+	send chan groupMessage // Closed to disconnect the participant
+}
+
+// groupSession lets friends pick seats of a show together. Picks are only
+// tentative: nothing is reserved until the organizer finalizes the combined
+// selection into a single hold.
+type groupSession struct {
+	Code           string
+	ShowID         uint
+	organizerToken string
+
+	mutex        sync.Mutex
+	participants map[int]*groupParticipant
+	nextID       int
+	closed       bool
+	idleTimer    *time.Timer
+	seatEvents   chan SeatEvent
+}
+
+var (
+	// Open group sessions, keyed by code
+	groupSessions = make(map[string]*groupSession)
+	// Mutex to protect the groupSessions map
+	groupSessionsMutex sync.Mutex
+)
+
+// createGroupSession opens a group session for an upcoming show
+func createGroupSession(showID uint) (*groupSession, *BookingError) {
+	show, err := loadShow(showID)
+	if err != nil {
+		return nil, &BookingError{Code: ErrCodeShowNotFound, Message: "Show not found"}
+	}
+	if !show.DateTime.After(time.Now()) {
+		return nil, &BookingError{Code: ErrCodeShowNotCurrent, Message: "The show has already started"}
+	}
+
+	session := &groupSession{
+		Code:           utils.GenerateSessionToken()[:12],
+		ShowID:         show.ID,
+		organizerToken: utils.GenerateSessionToken(),
+		participants:   make(map[int]*groupParticipant),
+		seatEvents:     subscribeSeats(show.ID),
+	}
+	go session.watchSeats(session.seatEvents)
+	session.scheduleExpiry()
+
+	groupSessionsMutex.Lock()
+	groupSessions[session.Code] = session
+	groupSessionsMutex.Unlock()
+
+	return session, nil
+}
+
+// findGroupSession returns the open group session of a show with a code
+func findGroupSession(showID uint, code string) *groupSession {
+	groupSessionsMutex.Lock()
+	defer groupSessionsMutex.Unlock()
+
+	session := groupSessions[code]
+	if session == nil || session.ShowID != showID {
+		return nil
+	}
+	return session
+}
+
+// isOrganizer reports whether a token is the session's organizer token
+func (s *groupSession) isOrganizer(token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.organizerToken)) == 1
+}
+
+// join adds a participant, or returns nil if the session has ended
+func (s *groupSession) join(name string, organizer bool) *groupParticipant {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+		s.idleTimer = nil
+	}
+
+	s.nextID++
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "Guest " + strconv.Itoa(s.nextID)
+	}
+	if len([]rune(name)) > 40 {
+		name = string([]rune(name)[:40])
+	}
+
+	participant := &groupParticipant{
+		ID:        s.nextID,
+		Name:      name,
+		Organizer: organizer,
+		Seats:     models.Seats{},
+		send:      make(chan groupMessage, 16),
+	}
+	s.participants[participant.ID] = participant
+
+	s.sendTo(participant, groupMessage{Type: groupWelcome, Code: s.Code, You: participant.ID, Organizer: organizer})
+	s.broadcastState()
+	return participant
+}
+
+// leave removes a participant and gives up their picks
+func (s *groupSession) leave(participant *groupParticipant) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.participants[participant.ID] != participant {
+		return
+	}
+	s.disconnect(participant)
+	delete(s.participants, participant.ID)
+
+	if len(s.participants) == 0 && !s.closed {
+		s.scheduleExpiry()
+	}
+	s.broadcastState()
+}
+
+// scheduleExpiry closes the session if nobody joins it in time. The caller
+// must hold the session's mutex.
+func (s *groupSession) scheduleExpiry() {
+	s.idleTimer = time.AfterFunc(GroupSessionIdleTimeout, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if len(s.participants) == 0 {
+			s.close()
+		}
+	})
+}
+
+// close ends the session, disconnecting everyone. The caller must hold the
+// session's mutex.
+func (s *groupSession) close() {
+	if s.closed {
+		return
+	}
+	s.closed = true
+
+	groupSessionsMutex.Lock()
+	delete(groupSessions, s.Code)
+	groupSessionsMutex.Unlock()
+
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+	}
+	unsubscribeSeats(s.ShowID, s.seatEvents)
+	for _, participant := range s.participants {
+		s.disconnect(participant)
+	}
+}
+
+// sendTo queues a message for a participant, disconnecting participants that
+// fall too far behind. The caller must hold the session's mutex.
+func (s *groupSession) sendTo(participant *groupParticipant, message groupMessage) {
+	if participant.send == nil {
+		return
+	}
+	select {
+	case participant.send <- message:
+	default:
+		s.disconnect(participant)
+	}
+}
+
+// disconnect closes a participant's connection. The caller must hold the
+// session's mutex.
+func (s *groupSession) disconnect(participant *groupParticipant) {
+	if participant.send != nil {
+		close(participant.send)
+		participant.send = nil
+	}
+}
+
+// broadcastState sends every participant's picks to everyone. The caller must
+// hold the session's mutex.
+func (s *groupSession) broadcastState() {
+	participants := s.sortedParticipants()
+	state := make([]groupParticipant, len(participants))
+	for i, participant := range participants {
+		state[i] = groupParticipant{
+			ID:        participant.ID,
+			Name:      participant.Name,
+			Organizer: participant.Organizer,
+			Seats:     append(models.Seats{}, participant.Seats...),
+		}
+	}
+
+	for _, participant := range participants {
+		s.sendTo(participant, groupMessage{Type: groupState, Participants: state})
+	}
+}
+
+// sortedParticipants lists participants in the order they joined. The
+// caller must hold the session's mutex.
+func (s *groupSession) sortedParticipants() []*groupParticipant {
+	participants := make([]*groupParticipant, 0, len(s.participants))
+	for _, participant := range s.participants {
+		participants = append(participants, participant)
+	}
+	sort.Slice(participants, func(i, j int) bool {
+		return participants[i].ID < participants[j].ID
+	})
+	return participants
+}
+
+// pickedBy returns the participant who picked a seat, if any. The caller must
+// hold the session's mutex.
+func (s *groupSession) pickedBy(seat models.Seat) (*groupParticipant, int) {
+	for _, participant := range s.participants {
+		for i, picked := range participant.Seats {
+			if picked.String() == seat.String() {
+				return participant, i
+			}
+		}
+	}
+	return nil, -1
+}
+
+// combinedSeats returns the seats picked by the whole group. The caller must
+// hold the session's mutex.
+func (s *groupSession) combinedSeats() models.Seats {
+	var seats models.Seats
+	for _, participant := range s.sortedParticipants() {
+		seats = append(seats, participant.Seats...)
+	}
+	return seats
+}
+
+// selectSeat adds a seat to a participant's picks, or changes the ticket type
+// of a seat they already picked
+func (s *groupSession) selectSeat(participant *groupParticipant, seat models.Seat) *BookingError {
+	if seat.TicketType == "" {
+		seat.TicketType = models.TicketAdult
+	}
+	if !seat.TicketType.Valid() {
+		return &BookingError{Code: ErrCodeInvalidTicket, Message: "Unknown ticket type " + string(seat.TicketType)}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	owner, index := s.pickedBy(seat)
+	if owner == participant {
+		participant.Seats[index].TicketType = seat.TicketType
+		s.broadcastState()
+		return nil
+	}
+	if owner != nil {
+		return &BookingError{
+			Code:    ErrCodeSeatsUnavailable,
+			Message: fmt.Sprintf("%s has already picked %s", owner.Name, seat),
+			Seats:   models.Seats{seat},
+		}
+	}
+	if len(s.combinedSeats()) >= MaxSeatsPerBooking {
+		return &BookingError{
+			Code:    ErrCodeTooManySeats,
+			Message: fmt.Sprintf("A booking may contain at most %d seats", MaxSeatsPerBooking),
+		}
+	}
+
+	// Check the seat against the hall and other bookings under the show's
+	// lock, so the answer is not out of date by the time it is given
+	mutex := getShowMutex(s.ShowID)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	show, err := loadShow(s.ShowID)
+	if err != nil {
+		return &BookingError{Code: ErrCodeShowNotFound, Message: "Show not found"}
+	}
+	if bookingErr := validateSeats(show.Hall.Layout, models.Seats{seat}); bookingErr != nil {
+		return bookingErr
+	}
+	if _, taken := takenSeatKeys(s.ShowID, time.Now())[seat.String()]; taken {
+		return &BookingError{
+			Code:    ErrCodeSeatsUnavailable,
+			Message: "Seat " + seat.String() + " is already booked",
+			Seats:   models.Seats{seat},
+		}
+	}
+
+	participant.Seats = append(participant.Seats, seat)
+	s.broadcastState()
+	return nil
+}
+
+// deselectSeat removes a seat from a participant's picks
+func (s *groupSession) deselectSeat(participant *groupParticipant, seat models.Seat) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if owner, index := s.pickedBy(seat); owner == participant {
+		participant.Seats = append(participant.Seats[:index], participant.Seats[index+1:]...)
+		s.broadcastState()
+	}
+}
+
+// dropSeats removes seats from everyone's picks, telling those who lose seats
+// why. The caller must hold the session's mutex.
+func (s *groupSession) dropSeats(seats models.Seats, message string) {
+	dropped := false
+	for _, seat := range seats {
+		owner, index := s.pickedBy(seat)
+		if owner == nil {
+			continue
+		}
+		owner.Seats = append(owner.Seats[:index], owner.Seats[index+1:]...)
+		s.sendTo(owner, groupMessage{Type: groupError, Error: &BookingError{
+			Code:    ErrCodeSeatsUnavailable,
+			Message: seat.String() + " " + message,
+			Seats:   models.Seats{seat},
+		}})
+		dropped = true
+	}
+	if dropped {
+		s.broadcastState()
+	}
+}
+
+// watchSeats drops seats from the group's picks as soon as they are held or
+// booked by someone else
+func (s *groupSession) watchSeats(events chan SeatEvent) {
+	for event := range events {
+		if event.Type == SeatsReleased {
+			continue
+		}
+
+		seats := make(models.Seats, 0, len(event.Seats))
+		for _, label := range event.Seats {
+			if seat, err := models.ParseSeat(label); err == nil {
+				seats = append(seats, seat)
+			}
+		}
+
+		s.mutex.Lock()
+		if !s.closed {
+			s.dropSeats(seats, "was just taken by someone else")
+		}
+		s.mutex.Unlock()
+	}
+
+	// The channel is also closed when the session falls behind on events
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.closed {
+		s.seatEvents = subscribeSeats(s.ShowID)
+		go s.watchSeats(s.seatEvents)
+	}
+}
+
+// finalize holds the group's combined picks in a single booking made out to
+// the organizer, and to their account if they are logged in, ending the session
+func (s *groupSession) finalize(participant *groupParticipant, request groupRequest, userID *uint) *BookingError {
+	if !participant.Organizer {
+		return &BookingError{Code: ErrCodeNotOrganizer, Message: "Only the organizer can book the group's seats"}
+	}
+	name := strings.TrimSpace(request.CustomerName)
+	email := strings.TrimSpace(request.Email)
+	if name == "" || !utils.ValidateEmail(email) {
+		return &BookingError{Code: ErrCodeCustomerRequired, Message: "A name and a valid email address are required"}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	seats := s.combinedSeats()
+	if len(seats) == 0 {
+		return &BookingError{Code: ErrCodeNoSeats, Message: "No seats selected"}
+	}
+
+	// The booking processor takes the show's lock. Seat events it publishes
+	// meanwhile wait for the session's mutex, by which time the session is
+	// closed and ignores its own hold.
+	response := submitBookingRequest(BookingRequest{
+		Action:       ActionHold,
+		ShowID:       s.ShowID,
+		CustomerName: name,
+		Email:        email,
+		Seats:        seats,
+		PromoCode:    request.PromoCode,
+		UserID:       userID,
+	})
+	if !response.Success {
+		if response.Error != nil && response.Error.Code == ErrCodeSeatsUnavailable {
+			s.dropSeats(response.Error.Seats, "is no longer available")
+		}
+		return response.Error
+	}
+
+	finalized := groupMessage{
+		Type:        groupFinalized,
+		Reference:   response.Reference,
+		CheckoutURL: "/booking/checkout/" + response.Reference,
+	}
+	for _, other := range s.participants {
+		message := finalized
+		if !other.Organizer {
+			message.CheckoutURL = ""
+		}
+		s.sendTo(other, message)
+	}
+	s.close()
+	return nil
+}
+
+// groupPage describes the group session a seat map belongs to
+type groupPage struct {
+	Code      string `json:"code"`
+	Organizer bool   `json:"organizer"`
+	ShareURL  string `json:"share_url"`
+	SocketURL string `json:"socket_url"`
+}
+
+// groupPath returns the path of a group session's seat map
+func groupPath(session *groupSession) string {
+	return fmt.Sprintf("/shows/%d/group/%s", session.ShowID, session.Code)
+}
+
+// groupOrganizerCookie names the cookie identifying a session's organizer
+const groupOrganizerCookie = "group_organizer"
+
+// CreateGroupSessionHandler starts a group session for a show and takes the
+// organizer to its seat map
+func CreateGroupSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid show ID", http.StatusBadRequest)
+		return
+	}
+
+	session, bookingErr := createGroupSession(uint(id))
+	if bookingErr != nil {
+		http.Error(w, bookingErr.Message, bookingErrorStatus(bookingErr))
+		return
+	}
+
+	http.SetCookie(w, sessions.NewCookie(groupOrganizerCookie, session.organizerToken, groupPath(session), time.Time{}))
+	http.Redirect(w, r, groupPath(session), http.StatusSeeOther)
+}
+
+// APICreateGroupSessionHandler starts a group session for a show. The
+// organizer token must be passed when connecting to finalize the booking.
+func APICreateGroupSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, APIResponse{Success: false, Error: "Invalid show ID"})
+		return
+	}
+
+	session, bookingErr := createGroupSession(uint(id))
+	if bookingErr != nil {
+		sendBookingError(w, failedBooking(bookingErr))
+		return
+	}
+
+	sendJSONResponse(w, http.StatusCreated, APIResponse{
+		Success: true,
+		Data: map[string]string{
+			"code":            session.Code,
+			"organizer_token": session.organizerToken,
+			"share_url":       BaseURL + groupPath(session),
+			"socket_path":     groupPath(session) + "/ws",
+		},
+	})
+}
+
+// GroupSessionHandler renders the seat map of a group session
+func GroupSessionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid show ID", http.StatusBadRequest)
+		return
+	}
+
+	session := findGroupSession(uint(id), vars["code"])
+	if session == nil {
+		http.Error(w, "This group booking has ended", http.StatusNotFound)
+		return
+	}
+
+	show, err := loadShow(session.ShowID)
+	if err != nil {
+		http.Error(w, "Show not found", http.StatusNotFound)
+		return
+	}
+
+	organizer := false
+	if cookie, err := r.Cookie(groupOrganizerCookie); err == nil {
+		organizer = session.isOrganizer(cookie.Value)
+	}
+
+	renderSeatSelection(w, r, show, &groupPage{
+		Code:      session.Code,
+		Organizer: organizer,
+		ShareURL:  BaseURL + groupPath(session),
+		SocketURL: groupPath(session) + "/ws",
+	})
+}
+
+// groupUpgrader upgrades group session connections. Its default origin check
+// refuses pages from other sites.
+var groupUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// GroupSocketHandler connects a participant to a group session over a
+// WebSocket. Participants give their name in the "name" query parameter; the
+// organizer is recognized by their cookie or a "token" query parameter.
+func GroupSocketHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid show ID", http.StatusBadRequest)
+		return
+	}
+
+	session := findGroupSession(uint(id), vars["code"])
+	if session == nil {
+		http.Error(w, "This group booking has ended", http.StatusNotFound)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if cookie, err := r.Cookie(groupOrganizerCookie); err == nil && token == "" {
+		token = cookie.Value
+	}
+
+	conn, err := groupUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already replied
+		return
+	}
+	defer conn.Close()
+
+	userID := currentUserID(r)
+	participant := session.join(r.URL.Query().Get("name"), session.isOrganizer(token))
+	if participant == nil {
+		conn.WriteJSON(groupMessage{Type: groupError, Error: &BookingError{Code: ErrCodeGroupEnded, Message: "This group booking has ended"}})
+		return
+	}
+	defer session.leave(participant)
+
+	go writeGroupMessages(conn, participant.send)
+
+	conn.SetReadLimit(4096)
+	conn.SetReadDeadline(time.Now().Add(groupPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(groupPongWait))
+	})
+
+	for {
+		var request groupRequest
+		if err := conn.ReadJSON(&request); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("Group session %s connection error: %v", session.Code, err)
+			}
+			return
+		}
+
+		var bookingErr *BookingError
+		switch request.Type {
+		case groupSelect, groupDeselect:
+			if request.Seat == nil {
+				bookingErr = &BookingError{Code: ErrCodeNoSeats, Message: "No seat given"}
+			} else if request.Type == groupSelect {
+				bookingErr = session.selectSeat(participant, *request.Seat)
+			} else {
+				session.deselectSeat(participant, *request.Seat)
+			}
+		case groupFinalize:
+			bookingErr = session.finalize(participant, request, userID)
+		default:
+			bookingErr = &BookingError{Code: ErrCodeInternal, Message: "Unknown message type " + string(request.Type)}
+		}
+
+		if bookingErr != nil {
+			session.mutex.Lock()
+			session.sendTo(participant, groupMessage{Type: groupError, Error: bookingErr})
+			session.mutex.Unlock()
+		}
+	}
+}
+
+// writeGroupMessages writes queued messages to a participant's connection
+// and keeps it alive with pings, until the queue is closed
+func writeGroupMessages(conn *websocket.Conn, send <-chan groupMessage) {
+	ping := time.NewTicker(groupPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case message, ok := <-send:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				conn.Close()
+				return
+			}
+			if err := conn.WriteJSON(message); err != nil {
+				conn.Close()
+				return
+			}
+
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}
+}
@@ -2,21 +2,26 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
 	"html/template"
+	"io"
 	"net/http"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/JoeDkhar/cinema-booking-system/internal/cache"
 	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/middleware"
 	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/money"
 	"github.com/JoeDkhar/cinema-booking-system/internal/utils"
 	"github.com/gorilla/mux"
 )
 
 var (
-	templates *template.Template
+	templates pageTemplates
 	// Mutex for each show to prevent double bookings
 	showMutexes = make(map[uint]*sync.Mutex)
 	// Global mutex to protect the showMutexes map
@@ -27,6 +32,37 @@ var (
 	showCache  = cache.NewCache[models.Show]()
 )
 
+// pageTemplates holds a separate template set for every page, so the
+// "title", "content" and "scripts" blocks each page defines do not
+// overwrite one another
+type pageTemplates map[string]*template.Template
+
+// ExecuteTemplate renders the named page for a request. Pages are rendered
+// from a copy of their template with the request's CSRF token, so forms can
+// include it with {{csrfField}}.
+func (p pageTemplates) ExecuteTemplate(w io.Writer, r *http.Request, name string, data interface{}) error {
+	tmpl, ok := p[name]
+	if !ok {
+		return fmt.Errorf("template %s not found", name)
+	}
+
+	page, err := tmpl.Clone()
+	if err != nil {
+		return err
+	}
+	token := middleware.CSRFToken(r)
+	page.Funcs(template.FuncMap{
+		"csrfToken": func() string {
+			return token
+		},
+		"csrfField": func() template.HTML {
+			return template.HTML(`<input type="hidden" name="` + middleware.CSRFFieldName + `" value="` +
+				template.HTMLEscapeString(token) + `">`)
+		},
+	})
+	return page.ExecuteTemplate(w, name, data)
+}
+
 // Initialize loads templates and sets up handlers
 func Initialize() {
 	// Define template functions
@@ -38,10 +74,25 @@ func Initialize() {
 		"formatDateTime": utils.FormatDateTime,
 		"formatDate":     utils.FormatDate,
 		"formatTime":     utils.FormatTime,
+		// Replaced with the request's token when a page is rendered
+		"csrfToken": func() string { return "" },
+		"csrfField": func() template.HTML { return "" },
+	}
+
+	// Parse every page together with the base layout
+	pages, err := filepath.Glob("templates/*.html")
+	if err != nil {
+		panic(err)
 	}
 
-	// Parse templates with functions
-	templates = template.Must(template.New("").Funcs(funcMap).ParseGlob("templates/*.html"))
+	templates = make(pageTemplates)
+	for _, page := range pages {
+		name := filepath.Base(page)
+		if name == "base.html" {
+			continue
+		}
+		templates[name] = template.Must(template.New(name).Funcs(funcMap).ParseFiles("templates/base.html", page))
+	}
 }
 
 // getShowMutex returns a mutex for a specific show
@@ -66,7 +117,7 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 		Movies: movies,
 	}
 
-	templates.ExecuteTemplate(w, "home.html", data)
+	templates.ExecuteTemplate(w, r, "home.html", data)
 }
 
 // MoviesHandler renders the movies listing page
@@ -80,7 +131,7 @@ func MoviesHandler(w http.ResponseWriter, r *http.Request) {
 		Movies: movies,
 	}
 
-	templates.ExecuteTemplate(w, "movies.html", data)
+	templates.ExecuteTemplate(w, r, "movies.html", data)
 }
 
 // MovieDetailHandler renders the details of a specific movie
@@ -98,7 +149,7 @@ func MovieDetailHandler(w http.ResponseWriter, r *http.Request) {
 
 	if !found {
 		// If not in cache, get from database
-		if err := database.DB.Preload("Shows").First(&movie, id).Error; err != nil {
+		if err := database.DB.Preload("Shows").Preload("Shows.Hall").First(&movie, id).Error; err != nil {
 			http.Error(w, "Movie not found", http.StatusNotFound)
 			return
 		}
@@ -113,7 +164,7 @@ func MovieDetailHandler(w http.ResponseWriter, r *http.Request) {
 		Movie: movie,
 	}
 
-	templates.ExecuteTemplate(w, "movie_detail.html", data)
+	templates.ExecuteTemplate(w, r, "movie_detail.html", data)
 }
 
 // ShowDetailHandler renders the page for selecting seats for a specific show
@@ -125,34 +176,61 @@ func ShowDetailHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var show models.Show
-	if err := database.DB.Preload("Movie").First(&show, id).Error; err != nil {
+	show, err := loadShow(uint(id))
+	if err != nil {
 		http.Error(w, "Show not found", http.StatusNotFound)
 		return
 	}
 
-	// Get all bookings for this show to determine booked seats
-	var bookings []models.Booking
-	database.DB.Where("show_id = ? AND confirmed = ?", show.ID, true).Find(&bookings)
+	renderSeatSelection(w, r, show, nil)
+}
 
-	// Create a map of booked seats
-	bookedSeats := make(map[string]bool)
-	for _, booking := range bookings {
-		for _, seat := range booking.Seats {
-			key := seat.Row + strconv.Itoa(seat.Number)
-			bookedSeats[key] = true
+// renderSeatSelection renders the seat map of a show, shared with friends
+// when it belongs to a group session
+func renderSeatSelection(w http.ResponseWriter, r *http.Request, show models.Show, group *groupPage) {
+	// Determine which seats are already booked or held
+	takenSeats := takenSeatKeys(show.ID, time.Now())
+
+	// List the seat categories found in this hall for the legend
+	var categories []models.SeatCategory
+	for _, category := range models.SeatCategories {
+		for _, seat := range show.Hall.Layout.AllSeats() {
+			if show.Hall.Layout.SeatCategory(seat) == category {
+				categories = append(categories, category)
+				break
+			}
 		}
 	}
 
 	data := struct {
 		Show        models.Show
-		BookedSeats map[string]bool
+		TakenSeats  map[string]models.BookingStatus
+		SeatsLeft   int
+		MaxSeats    int
+		HoldTime    int
+		Categories  []models.SeatCategory
+		TicketTypes []models.TicketType
+		PriceTable  map[models.SeatCategory]map[models.TicketType]money.Money
+		Locale      string
+		Group       *groupPage
+		// Filled in on the booking form for logged-in users
+		CustomerName  string
+		CustomerEmail string
 	}{
 		Show:        show,
-		BookedSeats: bookedSeats,
+		TakenSeats:  takenSeats,
+		SeatsLeft:   len(show.Hall.Layout.AllSeats()) - len(takenSeats),
+		MaxSeats:    MaxSeatsPerBooking,
+		HoldTime:    int(HoldDuration.Minutes()),
+		Categories:  categories,
+		TicketTypes: models.TicketTypes,
+		PriceTable:  PriceRules.PriceTable(show),
+		Locale:      money.DefaultLocale,
+		Group:       group,
 	}
+	data.CustomerName, data.CustomerEmail = bookingCustomer(r)
 
-	templates.ExecuteTemplate(w, "booking.html", data)
+	templates.ExecuteTemplate(w, r, "booking.html", data)
 }
 
 // BookingHandler handles the seat booking process
@@ -198,45 +276,40 @@ func BookingHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create a channel for the booking response
-	responseChan := make(chan BookingResponse)
-
-	// Create a booking request
-	bookingRequest := BookingRequest{
+	// Hold the seats while the customer checks out
+	response := submitBookingRequest(BookingRequest{
+		Action:       ActionHold,
 		ShowID:       uint(showID),
 		CustomerName: customerName,
 		Email:        email,
 		Seats:        seats,
-		ResponseChan: responseChan,
-	}
-
-	// Submit the booking request asynchronously
-	ProcessBookingAsync(bookingRequest)
-
-	// Wait for the response
-	response := <-responseChan
-	close(responseChan)
+		PromoCode:    r.FormValue("promo_code"),
+		UserID:       currentUserID(r),
+	})
 
 	if !response.Success {
-		http.Error(w, response.ErrorMessage, http.StatusConflict)
+		http.Error(w, response.ErrorMessage, bookingErrorStatus(response.Error))
 		return
 	}
 
-	// Redirect to confirmation page
-	http.Redirect(w, r, "/booking/confirmation/"+strconv.Itoa(int(response.BookingID)), http.StatusSeeOther)
+	// Redirect to checkout page
+	http.Redirect(w, r, "/booking/checkout/"+response.Reference, http.StatusSeeOther)
 }
 
 // BookingConfirmationHandler renders the booking confirmation page
 func BookingConfirmationHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id, err := strconv.Atoi(vars["id"])
+	booking, err := loadBookingByReference(mux.Vars(r)["reference"])
 	if err != nil {
-		http.Error(w, "Invalid booking ID", http.StatusBadRequest)
+		http.Error(w, "Booking not found", http.StatusNotFound)
 		return
 	}
 
-	var booking models.Booking
-	if err := database.DB.Preload("Show").Preload("Show.Movie").First(&booking, id).Error; err != nil {
+	// Seats still on hold have not been paid for yet
+	if booking.Status == models.BookingHeld {
+		http.Redirect(w, r, "/booking/checkout/"+booking.Reference, http.StatusSeeOther)
+		return
+	}
+	if booking.Status != models.BookingConfirmed && booking.Status != models.BookingCancelled {
 		http.Error(w, "Booking not found", http.StatusNotFound)
 		return
 	}
@@ -247,7 +320,7 @@ func BookingConfirmationHandler(w http.ResponseWriter, r *http.Request) {
 		Booking: booking,
 	}
 
-	templates.ExecuteTemplate(w, "confirmation.html", data)
+	templates.ExecuteTemplate(w, r, "confirmation.html", data)
 }
 
 // API Handlers for AJAX requests
@@ -261,48 +334,68 @@ func GetAvailableSeatsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var show models.Show
-	if err := database.DB.First(&show, id).Error; err != nil {
+	show, err := loadShow(uint(id))
+	if err != nil {
 		http.Error(w, "Show not found", http.StatusNotFound)
 		return
 	}
 
-	// Get all bookings for this show
-	var bookings []models.Booking
-	database.DB.Where("show_id = ? AND confirmed = ?", show.ID, true).Find(&bookings)
-
-	// Create a map of booked seats
-	bookedSeats := make(map[string]bool)
-	for _, booking := range bookings {
-		for _, seat := range booking.Seats {
-			key := seat.Row + strconv.Itoa(seat.Number)
-			bookedSeats[key] = true
-		}
-	}
+	// Get all booked or held seats for this show
+	takenSeats := takenSeatKeys(show.ID, time.Now())
 
 	// Convert to a response format
 	type SeatStatus struct {
-		Row    string `json:"row"`
-		Number int    `json:"number"`
-		Booked bool   `json:"booked"`
+		Row      string              `json:"row"`
+		Number   int                 `json:"number"`
+		Category models.SeatCategory `json:"category"`
+		Booked   bool                `json:"booked"`
+		Status   string              `json:"status"`
 	}
 
-	// Generate all seats for the show
+	// List every seat that exists in the show's hall
 	var seatStatuses []SeatStatus
-	rows := []string{"A", "B", "C", "D", "E", "F", "G", "H"}
-	seatsPerRow := show.TotalSeats / len(rows)
-
-	for _, row := range rows {
-		for num := 1; num <= seatsPerRow; num++ {
-			key := row + strconv.Itoa(num)
-			seatStatuses = append(seatStatuses, SeatStatus{
-				Row:    row,
-				Number: num,
-				Booked: bookedSeats[key],
-			})
+	for _, seat := range show.Hall.Layout.AllSeats() {
+		status, taken := takenSeats[seat.String()]
+		if !taken {
+			status = "available"
 		}
+		seatStatuses = append(seatStatuses, SeatStatus{
+			Row:      seat.Row,
+			Number:   seat.Number,
+			Category: show.Hall.Layout.SeatCategory(seat),
+			Booked:   taken,
+			Status:   string(status),
+		})
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(seatStatuses)
 }
+
+// loadShow retrieves a show together with its movie and hall
+func loadShow(id uint) (models.Show, error) {
+	var show models.Show
+	if err := database.DB.Preload("Movie").Preload("Hall").First(&show, id).Error; err != nil {
+		return show, err
+	}
+	if show.Hall == nil {
+		return show, fmt.Errorf("show %d has no hall", id)
+	}
+	return show, nil
+}
+
+// takenSeatKeys returns the labels of all seats taken by confirmed bookings
+// or active holds for a show, mapped to the status of the booking holding them
+func takenSeatKeys(showID uint, now time.Time) map[string]models.BookingStatus {
+	var bookings []models.Booking
+	database.DB.Where("show_id = ? AND (status = ? OR (status = ? AND expires_at > ?))",
+		showID, models.BookingConfirmed, models.BookingHeld, now).Find(&bookings)
+
+	takenSeats := make(map[string]models.BookingStatus)
+	for _, booking := range bookings {
+		for _, seat := range booking.Seats {
+			takenSeats[seat.String()] = booking.Status
+		}
+	}
+	return takenSeats
+}
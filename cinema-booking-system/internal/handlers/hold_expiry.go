@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+)
+
+var (
+	// Timers releasing each active hold when it lapses, keyed by booking ID
+	holdTimers = make(map[uint]*time.Timer)
+	// Mutex to protect the holdTimers map
+	holdTimersMutex sync.Mutex
+)
+
+// scheduleActiveHolds sets up expiry timers for holds that survived a restart
+func scheduleActiveHolds() {
+	var holds []models.Booking
+	database.DB.Where("status = ?", models.BookingHeld).Find(&holds)
+
+	for _, hold := range holds {
+		if hold.ExpiresAt == nil {
+			expireHold(hold.ID)
+			continue
+		}
+		scheduleHoldExpiry(hold.ID, *hold.ExpiresAt)
+	}
+}
+
+// scheduleHoldExpiry (re)starts the timer that expires a hold at expiresAt
+func scheduleHoldExpiry(bookingID uint, expiresAt time.Time) {
+	holdTimersMutex.Lock()
+	defer holdTimersMutex.Unlock()
+
+	if timer, exists := holdTimers[bookingID]; exists {
+		timer.Stop()
+	}
+
+	holdTimers[bookingID] = time.AfterFunc(time.Until(expiresAt), func() {
+		expireHold(bookingID)
+	})
+}
+
+// cancelHoldExpiry stops the expiry timer of a hold that was released or confirmed
+func cancelHoldExpiry(bookingID uint) {
+	holdTimersMutex.Lock()
+	defer holdTimersMutex.Unlock()
+
+	if timer, exists := holdTimers[bookingID]; exists {
+		timer.Stop()
+		delete(holdTimers, bookingID)
+	}
+}
+
+// stopHoldTimers stops every pending expiry timer
+func stopHoldTimers() {
+	holdTimersMutex.Lock()
+	defer holdTimersMutex.Unlock()
+
+	for bookingID, timer := range holdTimers {
+		timer.Stop()
+		delete(holdTimers, bookingID)
+	}
+}
+
+// expireHold marks a hold as expired if it has lapsed, freeing its seats
+func expireHold(bookingID uint) {
+	var showID uint
+	database.DB.Model(&models.Booking{}).Where("id = ?", bookingID).Pluck("show_id", &showID)
+	if showID == 0 {
+		cancelHoldExpiry(bookingID)
+		return
+	}
+
+	mutex := getShowMutex(showID)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var booking models.Booking
+	if err := database.DB.First(&booking, bookingID).Error; err != nil {
+		cancelHoldExpiry(bookingID)
+		return
+	}
+
+	// The hold may have been extended, confirmed or released in the meantime
+	if booking.Status != models.BookingHeld || booking.IsActiveHold(time.Now()) {
+		return
+	}
+
+	expireBooking(&booking)
+}
+
+// expireBooking marks a lapsed hold as expired. The caller must hold the show's mutex.
+func expireBooking(booking *models.Booking) {
+	booking.Status = models.BookingExpired
+	if err := database.DB.Save(booking).Error; err != nil {
+		log.Printf("Error expiring hold %d: %v", booking.ID, err)
+		return
+	}
+
+	cancelHoldExpiry(booking.ID)
+	releasePromoCode(booking.ID)
+	publishSeats(SeatsReleased, booking.ShowID, booking.Seats)
+	log.Printf("Hold %d expired, released seats %s", booking.ID, booking.Seats)
+	seatsReleased(*booking)
+}
@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/accounts"
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/notifications"
+	"github.com/JoeDkhar/cinema-booking-system/internal/sessions"
+	"github.com/JoeDkhar/cinema-booking-system/internal/utils"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// ClaimLinkValidity is how long a link to add guest bookings to an account works
+var ClaimLinkValidity = 24 * time.Hour
+
+// Filters of a user's bookings by when the show is
+const (
+	bookingsUpcoming = "upcoming"
+	bookingsPast     = "past"
+)
+
+// errClaimUsed is returned when a claim link has already been followed
+var errClaimUsed = errors.New("claim link already used")
+
+// abandonedStatuses are the holds that never became bookings, which users do
+// not see among their bookings
+var abandonedStatuses = []models.BookingStatus{models.BookingReleased, models.BookingExpired}
+
+// userBookings returns a user's bookings for upcoming or past shows, or for
+// all shows when when is empty. Upcoming shows come soonest first, others
+// most recent first.
+func userBookings(userID uint, when string, now time.Time) ([]models.Booking, error) {
+	query := database.DB.Joins("JOIN shows ON shows.id = bookings.show_id").
+		Preload("Show.Movie").Preload("Show.Hall").
+		Where("bookings.user_id = ? AND bookings.status NOT IN ?", userID, abandonedStatuses)
+
+	switch when {
+	case bookingsUpcoming:
+		query = query.Where("shows.date_time > ?", now).Order("shows.date_time")
+	case bookingsPast:
+		query = query.Where("shows.date_time <= ?", now).Order("shows.date_time DESC")
+	case "":
+		query = query.Order("shows.date_time DESC")
+	default:
+		return nil, fmt.Errorf("unknown filter %q, expected %s or %s", when, bookingsUpcoming, bookingsPast)
+	}
+
+	var bookings []models.Booking
+	err := query.Find(&bookings).Error
+	return bookings, err
+}
+
+// unclaimedBookings counts the guest bookings made with an email address
+func unclaimedBookings(email string) int64 {
+	var count int64
+	database.DB.Model(&models.Booking{}).
+		Where("user_id IS NULL AND LOWER(email) = LOWER(?) AND status NOT IN ?", email, abandonedStatuses).
+		Count(&count)
+	return count
+}
+
+// bookingCustomer returns the name and email address to fill the booking
+// form in with: the logged-in user's email and the name on their last booking
+func bookingCustomer(r *http.Request) (string, string) {
+	user, ok := currentUser(r)
+	if !ok {
+		return "", ""
+	}
+
+	var latest models.Booking
+	database.DB.Select("customer_name").Where("user_id = ?", user.ID).Order("id DESC").Limit(1).Find(&latest)
+	return latest.CustomerName, user.Email
+}
+
+// MyBookingsHandler lists the logged-in user's upcoming and past bookings
+func MyBookingsHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	now := time.Now()
+	upcoming, err := userBookings(user.ID, bookingsUpcoming, now)
+	if err != nil {
+		http.Error(w, "Error loading bookings: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	past, err := userBookings(user.ID, bookingsPast, now)
+	if err != nil {
+		http.Error(w, "Error loading bookings: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	claimed, _ := strconv.Atoi(r.URL.Query().Get("claimed"))
+	data := struct {
+		User      models.User
+		Upcoming  []models.Booking
+		Past      []models.Booking
+		Unclaimed int64
+		ClaimSent bool
+		Claimed   int
+
+		VerificationSent bool
+		Verified         bool
+	}{
+		User:      user,
+		Upcoming:  upcoming,
+		Past:      past,
+		Unclaimed: unclaimedBookings(user.Email),
+		ClaimSent: r.URL.Query().Get("claim") == "sent",
+		Claimed:   claimed,
+
+		VerificationSent: r.URL.Query().Get("verification") == "sent",
+		Verified:         r.URL.Query().Get("verified") == "true",
+	}
+
+	templates.ExecuteTemplate(w, r, "my_bookings.html", data)
+}
+
+// RequestBookingClaimHandler emails the user a link to add the bookings they
+// made as a guest with their account's email address to their account
+func RequestBookingClaimHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	count := unclaimedBookings(user.Email)
+	if count == 0 {
+		http.Redirect(w, r, "/account/bookings", http.StatusSeeOther)
+		return
+	}
+
+	token := utils.GenerateSessionToken()
+	claim := models.BookingClaim{
+		UserID:    user.ID,
+		Email:     user.Email,
+		TokenHash: sessions.HashToken(token),
+		ExpiresAt: time.Now().Add(ClaimLinkValidity),
+	}
+	if err := database.DB.Create(&claim).Error; err != nil {
+		http.Error(w, "Error creating claim: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if Outbox != nil {
+		err := Outbox.EnqueueAccount(notifications.BookingsClaim, strconv.Itoa(int(claim.ID)), notifications.AccountEmail{
+			User:      user,
+			Link:      "/account/bookings/claim/" + token,
+			ExpiresAt: claim.ExpiresAt,
+			Bookings:  int(count),
+		})
+		if err != nil {
+			log.Printf("Error queueing booking claim email for %s: %v", user.Username, err)
+		}
+	}
+
+	http.Redirect(w, r, "/account/bookings?claim=sent", http.StatusSeeOther)
+}
+
+// ClaimBookingsHandler follows a claim link, adding the guest bookings made
+// with the address it was sent to to the user's account
+func ClaimBookingsHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	var claim models.BookingClaim
+	err := database.DB.Where("token_hash = ? AND user_id = ?", sessions.HashToken(mux.Vars(r)["token"]), user.ID).
+		First(&claim).Error
+	if err != nil || !strings.EqualFold(claim.Email, user.Email) {
+		http.Error(w, "This link is not valid for your account", http.StatusNotFound)
+		return
+	}
+
+	claimed, err := claimBookings(claim, time.Now())
+	if errors.Is(err, errClaimUsed) {
+		http.Error(w, "This link has already been used or has expired", http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error claiming bookings: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s claimed %d guest bookings made with %s", user.Username, claimed, claim.Email)
+
+	// Receiving the link proves the address is the user's
+	if err := accounts.MarkEmailVerified(&user, time.Now()); err != nil {
+		log.Printf("Error verifying email of %s: %v", user.Username, err)
+	}
+
+	http.Redirect(w, r, "/account/bookings?claimed="+strconv.Itoa(int(claimed)), http.StatusSeeOther)
+}
+
+// claimBookings uses up a claim, attaching the guest bookings made with its
+// email address to its user. It returns how many bookings were attached.
+func claimBookings(claim models.BookingClaim, now time.Time) (int64, error) {
+	var claimed int64
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		// Only the first use of a live link counts
+		result := tx.Model(&models.BookingClaim{}).
+			Where("id = ? AND claimed_at IS NULL AND expires_at > ?", claim.ID, now).
+			UpdateColumn("claimed_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errClaimUsed
+		}
+
+		result = tx.Model(&models.Booking{}).
+			Where("user_id IS NULL AND LOWER(email) = LOWER(?) AND status NOT IN ?", claim.Email, abandonedStatuses).
+			UpdateColumn("user_id", claim.UserID)
+		claimed = result.RowsAffected
+		return result.Error
+	})
+	return claimed, err
+}
+
+// APIMyBookingsHandler lists the logged-in user's bookings, optionally only
+// those for upcoming or past shows with ?when=upcoming or ?when=past
+func APIMyBookingsHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	when := r.URL.Query().Get("when")
+	if when != "" && when != bookingsUpcoming && when != bookingsPast {
+		sendJSONResponse(w, http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "when must be " + bookingsUpcoming + " or " + bookingsPast,
+		})
+		return
+	}
+
+	bookings, err := userBookings(user.ID, when, time.Now())
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to retrieve bookings",
+		})
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    bookings,
+	})
+}
@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/accounts"
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/notifications"
+	"github.com/JoeDkhar/cinema-booking-system/internal/sessions"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// invalidLinkMessage is shown for account links that cannot be used
+const invalidLinkMessage = "This link is invalid, has expired or was already used"
+
+// sendAccountLink emails a user a single-use link for a purpose, such as to
+// verify their address, at path followed by the link's token
+func sendAccountLink(user models.User, purpose models.TokenPurpose, kind notifications.Kind, path string) error {
+	if Outbox == nil {
+		return nil
+	}
+
+	token, accountToken, err := accounts.IssueToken(user, purpose, time.Now())
+	if err != nil {
+		return err
+	}
+	return Outbox.EnqueueAccount(kind, strconv.Itoa(int(accountToken.ID)), notifications.AccountEmail{
+		User:      user,
+		Link:      path + token,
+		ExpiresAt: accountToken.ExpiresAt,
+	})
+}
+
+// VerifyEmailHandler follows a link emailed to a user, confirming the address
+// it was sent to is theirs
+func VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := accounts.VerifyEmail(mux.Vars(r)["token"], time.Now())
+	if errors.Is(err, accounts.ErrEmailChanged) {
+		http.Error(w, "This link was sent to an address that is no longer on your account", http.StatusGone)
+		return
+	}
+	if errors.Is(err, accounts.ErrInvalidToken) {
+		http.Error(w, invalidLinkMessage, http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error verifying email: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s verified %s", user.Username, user.Email)
+
+	if _, loggedIn := currentUser(r); loggedIn {
+		http.Redirect(w, r, "/account/bookings?verified=true", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/login?verified=true", http.StatusSeeOther)
+}
+
+// ResendVerificationHandler emails the logged-in user a new link to verify
+// their address
+func ResendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	if user.EmailVerified() {
+		http.Redirect(w, r, "/account/bookings", http.StatusSeeOther)
+		return
+	}
+
+	if err := sendAccountLink(user, models.TokenVerifyEmail, notifications.VerifyEmail, "/verify-email/"); err != nil {
+		http.Error(w, "Error sending verification email: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/account/bookings?verification=sent", http.StatusSeeOther)
+}
+
+// ForgotPasswordHandler emails a link to reset the password of the account
+// with the given email address. The page reads the same whether or not such
+// an account exists, so it cannot be used to find out who has one.
+func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		templates.ExecuteTemplate(w, r, "forgot_password.html", nil)
+		return
+	}
+
+	email := strings.TrimSpace(r.FormValue("email"))
+	if email == "" {
+		templates.ExecuteTemplate(w, r, "forgot_password.html", map[string]interface{}{
+			"Error": "Enter the email address of your account",
+		})
+		return
+	}
+
+	var user models.User
+	if err := database.DB.Where("LOWER(email) = LOWER(?)", email).First(&user).Error; err == nil {
+		if err := sendAccountLink(user, models.TokenResetPassword, notifications.PasswordReset, "/reset-password/"); err != nil {
+			log.Printf("Error sending password reset email to %s: %v", user.Username, err)
+		}
+	}
+
+	templates.ExecuteTemplate(w, r, "forgot_password.html", map[string]interface{}{
+		"Email": email,
+		"Sent":  true,
+	})
+}
+
+// ResetPasswordHandler follows a password reset link, letting the user choose
+// a new password. Setting it logs the user out everywhere.
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+
+	accountToken, err := accounts.LookupToken(token, models.TokenResetPassword, time.Now())
+	if err != nil {
+		http.Error(w, invalidLinkMessage, http.StatusGone)
+		return
+	}
+	user := *accountToken.User
+
+	if r.Method == http.MethodGet {
+		templates.ExecuteTemplate(w, r, "reset_password.html", map[string]interface{}{
+			"Token":     token,
+			"MinLength": accounts.MinPasswordLength,
+		})
+		return
+	}
+
+	password := r.FormValue("password")
+	if errMsg := checkNewPassword(password, r.FormValue("password_confirm"), user); errMsg != "" {
+		templates.ExecuteTemplate(w, r, "reset_password.html", map[string]interface{}{
+			"Token":     token,
+			"MinLength": accounts.MinPasswordLength,
+			"Error":     errMsg,
+		})
+		return
+	}
+
+	now := time.Now()
+	if _, err := accounts.UseToken(token, models.TokenResetPassword, now); err != nil {
+		http.Error(w, invalidLinkMessage, http.StatusGone)
+		return
+	}
+	if err := accounts.SetPassword(user, password, now); err != nil {
+		http.Error(w, "Error setting password: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Receiving the link proves the address is the user's
+	if strings.EqualFold(user.Email, accountToken.Email) {
+		if err := accounts.MarkEmailVerified(&user, now); err != nil {
+			log.Printf("Error verifying email of %s: %v", user.Username, err)
+		}
+	}
+	// Whoever can reset the password need not wait out a lockout
+	if err := accounts.ClearLoginFailures(user.Username, now); err != nil {
+		log.Printf("Error clearing failed logins for %s: %v", user.Username, err)
+	}
+	log.Printf("User %s reset their password", user.Username)
+
+	sessions.ClearCookie(w)
+	http.Redirect(w, r, "/login?reset=true", http.StatusSeeOther)
+}
+
+// ChangePasswordHandler lets the logged-in user change their password. Every
+// other device they are logged in on is logged out.
+func ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	if r.Method == http.MethodGet {
+		templates.ExecuteTemplate(w, r, "account_password.html", map[string]interface{}{
+			"User":      user,
+			"Changed":   r.URL.Query().Get("changed") == "true",
+			"MinLength": accounts.MinPasswordLength,
+		})
+		return
+	}
+
+	password := r.FormValue("password")
+	errMsg := checkNewPassword(password, r.FormValue("password_confirm"), user)
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(r.FormValue("current_password"))) != nil {
+		errMsg = "Your current password is incorrect"
+	}
+	if errMsg != "" {
+		templates.ExecuteTemplate(w, r, "account_password.html", map[string]interface{}{
+			"User":      user,
+			"Error":     errMsg,
+			"MinLength": accounts.MinPasswordLength,
+		})
+		return
+	}
+
+	now := time.Now()
+	if err := accounts.SetPassword(user, password, now); err != nil {
+		http.Error(w, "Error setting password: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s changed their password", user.Username)
+
+	// Every session was ended, so start a new one for this device
+	token, session, err := sessions.Create(user, r, now)
+	if err != nil {
+		sessions.ClearCookie(w)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	sessions.SetCookie(w, token, session)
+
+	http.Redirect(w, r, "/account/password?changed=true", http.StatusSeeOther)
+}
+
+// checkNewPassword returns why a new password and its confirmation cannot be
+// used, or an empty string if they can
+func checkNewPassword(password, confirm string, user models.User) string {
+	if password != confirm {
+		return "Passwords do not match"
+	}
+	if err := accounts.CheckPassword(password, user); err != nil {
+		return "Invalid password: " + err.Error()
+	}
+	return ""
+}
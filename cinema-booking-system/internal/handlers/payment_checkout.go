@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/money"
+	"github.com/JoeDkhar/cinema-booking-system/internal/payments"
+	"gorm.io/gorm"
+)
+
+// Payment error codes
+const (
+	ErrCodePaymentRequired   BookingErrorCode = "payment_required"
+	ErrCodePaymentDeclined   BookingErrorCode = "payment_declined"
+	ErrCodePaymentFailed     BookingErrorCode = "payment_failed"
+	ErrCodePaymentInProgress BookingErrorCode = "payment_in_progress"
+	ErrCodeIdempotencyKey    BookingErrorCode = "idempotency_key_reused"
+)
+
+var (
+	// PaymentProvider charges customers at checkout
+	PaymentProvider payments.Provider = payments.NewFakeProvider()
+
+	// PaymentTimeout bounds every call to the payment provider
+	PaymentTimeout = 30 * time.Second
+)
+
+// allowPaymentTime lets a request that calls the payment provider outlive the
+// server's write timeout, so a slow provider does not cut the customer off
+// after they were charged and leave them to pay again. Checkout calls the
+// provider twice, to authorize and then capture or void.
+func allowPaymentTime(w http.ResponseWriter) {
+	controller := http.NewResponseController(w)
+	if err := controller.SetWriteDeadline(time.Now().Add(2*PaymentTimeout + 15*time.Second)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Printf("Error extending write deadline for payment: %v", err)
+	}
+}
+
+// checkoutHold charges the customer for a held booking and confirms it.
+// Submitting the same idempotency key again returns the outcome of the first
+// attempt instead of charging twice.
+//
+// The provider is called outside the show's mutex so a slow payment does not
+// block other bookings for the show; the booking processor rechecks the hold
+// when confirming it and the authorization is voided if the hold was lost.
+func checkoutHold(ctx context.Context, booking models.Booking, token, idempotencyKey string) BookingResponse {
+	if idempotencyKey == "" {
+		return failedBooking(&BookingError{Code: ErrCodePaymentRequired, Message: "An idempotency key is required"})
+	}
+
+	// Replay earlier attempts made with the same key
+	var existing models.Payment
+	err := database.DB.Where("idempotency_key = ?", idempotencyKey).First(&existing).Error
+	if err == nil {
+		return replayPayment(existing, booking)
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return failedBooking(&BookingError{Code: ErrCodeInternal, Message: "Error loading payment: " + err.Error()})
+	}
+
+	if booking.Status != models.BookingHeld {
+		return failedBooking(&BookingError{Code: ErrCodeNotHeld, Message: "Booking is not on hold"})
+	}
+	if !booking.IsActiveHold(time.Now()) {
+		return failedBooking(&BookingError{Code: ErrCodeHoldExpired, Message: "The hold on these seats has expired"})
+	}
+
+	// Nothing to charge for free bookings
+	if !booking.TotalAmount.IsPositive() {
+		return submitBookingRequest(BookingRequest{Action: ActionConfirm, BookingID: booking.ID})
+	}
+
+	if token == "" {
+		return failedBooking(&BookingError{Code: ErrCodePaymentRequired, Message: "A payment method is required"})
+	}
+
+	// Record the attempt before contacting the provider; the unique key stops
+	// a concurrent duplicate submission from getting this far
+	payment := models.Payment{
+		BookingID:      booking.ID,
+		Provider:       PaymentProvider.Name(),
+		IdempotencyKey: idempotencyKey,
+		Amount:         booking.TotalAmount,
+		Status:         models.PaymentPending,
+	}
+	if err := database.DB.Create(&payment).Error; err != nil {
+		if database.DB.Where("idempotency_key = ?", idempotencyKey).First(&existing).Error == nil {
+			return replayPayment(existing, booking)
+		}
+		return failedBooking(&BookingError{Code: ErrCodeInternal, Message: "Error saving payment: " + err.Error()})
+	}
+
+	authCtx, cancel := context.WithTimeout(ctx, PaymentTimeout)
+	auth, err := PaymentProvider.Authorize(authCtx, payments.AuthorizeRequest{
+		Amount:         payment.Amount,
+		Token:          token,
+		Reference:      booking.Reference,
+		IdempotencyKey: idempotencyKey,
+	})
+	cancel()
+
+	if err != nil {
+		bookingErr := &BookingError{Code: ErrCodePaymentFailed, Message: "The payment could not be processed, please try again"}
+		payment.Status = models.PaymentFailed
+		if errors.Is(err, payments.ErrDeclined) {
+			bookingErr = &BookingError{Code: ErrCodePaymentDeclined, Message: "The payment was declined"}
+			payment.Status = models.PaymentDeclined
+		} else {
+			log.Printf("Payment for booking %s failed: %v", booking.Reference, err)
+		}
+		return failPayment(&payment, bookingErr)
+	}
+
+	payment.TransactionID = auth.TransactionID
+	payment.Status = models.PaymentAuthorized
+	if err := database.DB.Save(&payment).Error; err != nil {
+		log.Printf("Error saving authorization %s for booking %s: %v", auth.TransactionID, booking.Reference, err)
+	}
+
+	// Take the seats, giving the money back if the hold was lost meanwhile
+	response := submitBookingRequest(BookingRequest{Action: ActionConfirm, BookingID: booking.ID})
+	if !response.Success {
+		voidCtx, cancel := context.WithTimeout(context.Background(), PaymentTimeout)
+		defer cancel()
+		if err := PaymentProvider.Void(voidCtx, payment.TransactionID); err != nil {
+			log.Printf("Error voiding authorization %s for booking %s: %v", payment.TransactionID, booking.Reference, err)
+		}
+		payment.Status = models.PaymentVoided
+		return failPayment(&payment, response.Error)
+	}
+
+	captureCtx, cancel := context.WithTimeout(context.Background(), PaymentTimeout)
+	defer cancel()
+	if err := PaymentProvider.Capture(captureCtx, payment.TransactionID, payment.Amount); err != nil {
+		// The seats are confirmed and the money is reserved, so leave the
+		// authorization in place for staff to capture by hand
+		log.Printf("Error capturing payment %s for booking %s: %v", payment.TransactionID, booking.Reference, err)
+		payment.FailureMessage = "Capture failed: " + err.Error()
+		database.DB.Save(&payment)
+		return response
+	}
+
+	now := time.Now()
+	payment.Status = models.PaymentCaptured
+	payment.CapturedAt = &now
+	if err := database.DB.Save(&payment).Error; err != nil {
+		log.Printf("Error saving captured payment %s for booking %s: %v", payment.TransactionID, booking.Reference, err)
+	}
+
+	return response
+}
+
+// replayPayment returns the outcome of an earlier checkout attempt made with
+// the same idempotency key
+func replayPayment(payment models.Payment, booking models.Booking) BookingResponse {
+	if payment.BookingID != booking.ID {
+		return failedBooking(&BookingError{
+			Code:    ErrCodeIdempotencyKey,
+			Message: "The idempotency key was already used for another booking",
+		})
+	}
+
+	switch payment.Status {
+	case models.PaymentPending:
+		return failedBooking(&BookingError{Code: ErrCodePaymentInProgress, Message: "This payment is still being processed"})
+	case models.PaymentAuthorized:
+		// A confirmed booking whose capture failed is still a completed checkout
+		if booking.Status != models.BookingConfirmed {
+			return failedBooking(&BookingError{Code: ErrCodePaymentInProgress, Message: "This payment is still being processed"})
+		}
+	case models.PaymentDeclined, models.PaymentFailed, models.PaymentVoided:
+		return failedBooking(&BookingError{Code: BookingErrorCode(payment.FailureCode), Message: payment.FailureMessage})
+	}
+
+	return BookingResponse{
+		Success:   true,
+		BookingID: booking.ID,
+		Reference: booking.Reference,
+	}
+}
+
+// failPayment records why a payment did not go through
+func failPayment(payment *models.Payment, bookingErr *BookingError) BookingResponse {
+	payment.FailureCode = string(bookingErr.Code)
+	payment.FailureMessage = bookingErr.Message
+	if err := database.DB.Save(payment).Error; err != nil {
+		log.Printf("Error saving failed payment for booking %d: %v", payment.BookingID, err)
+	}
+	return failedBooking(bookingErr)
+}
+
+// cancelAndRefund submits a cancellation and returns the refund owed for it
+// through the payment provider
+func cancelAndRefund(ctx context.Context, request BookingRequest) BookingResponse {
+	request.Action = ActionCancel
+	response := submitBookingRequest(request)
+	if response.Success && response.CancellationID != 0 {
+		refundCancellation(ctx, response.CancellationID)
+	}
+	return response
+}
+
+// refundCancellation returns a cancellation's refund to the payments made for
+// its booking. Failures are logged and leave the cancellation without a
+// refund reference so staff can settle it by hand.
+func refundCancellation(ctx context.Context, cancellationID uint) {
+	var cancellation models.Cancellation
+	if err := database.DB.First(&cancellation, cancellationID).Error; err != nil {
+		log.Printf("Error loading cancellation %d for refund: %v", cancellationID, err)
+		return
+	}
+	if !cancellation.RefundAmount.IsPositive() {
+		return
+	}
+
+	var captured []models.Payment
+	database.DB.Where("booking_id = ? AND status = ?", cancellation.BookingID, models.PaymentCaptured).
+		Order("id").Find(&captured)
+
+	remaining := cancellation.RefundAmount
+	var references []string
+	for _, payment := range captured {
+		if !remaining.IsPositive() {
+			break
+		}
+		if err := money.CheckCurrency(payment.Amount, payment.RefundedAmount, remaining); err != nil {
+			log.Printf("Error refunding payment %s for cancellation %d: %v", payment.TransactionID, cancellation.ID, err)
+			return
+		}
+		amount := payment.Refundable()
+		if !amount.IsPositive() {
+			continue
+		}
+		if amount.Cmp(remaining) > 0 {
+			amount = remaining
+		}
+
+		refundCtx, cancel := context.WithTimeout(ctx, PaymentTimeout)
+		reference, err := PaymentProvider.Refund(refundCtx, payment.TransactionID, amount)
+		cancel()
+		if err != nil {
+			log.Printf("Error refunding %s of payment %s for cancellation %d: %v",
+				amount, payment.TransactionID, cancellation.ID, err)
+			return
+		}
+
+		payment.RefundedAmount = payment.RefundedAmount.Add(amount)
+		if !payment.Refundable().IsPositive() {
+			payment.Status = models.PaymentRefunded
+		}
+		database.DB.Save(&payment)
+
+		references = append(references, reference)
+		remaining = remaining.Sub(amount)
+	}
+
+	if len(references) == 0 {
+		log.Printf("No captured payment to refund cancellation %d from", cancellation.ID)
+		return
+	}
+
+	database.DB.Model(&cancellation).UpdateColumn("refund_reference", strings.Join(references, ","))
+}
@@ -0,0 +1,320 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/money"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// Promo code error codes
+const (
+	ErrCodeInvalidPromo BookingErrorCode = "invalid_promo_code"
+	ErrCodePromoUsedUp  BookingErrorCode = "promo_code_used_up"
+)
+
+// loadPromoCode finds a promo code and checks it can be used to book seats
+// for a show. The caller must hold the show's mutex.
+func loadPromoCode(code string, show models.Show, seats int, now time.Time) (*models.PromoCode, *BookingError) {
+	var promo models.PromoCode
+	if err := database.DB.Where("code = ?", models.NormalizePromoCode(code)).First(&promo).Error; err != nil {
+		return nil, &BookingError{Code: ErrCodeInvalidPromo, Message: "Unknown promo code " + code}
+	}
+
+	if err := promo.Check(show, seats, now); err != nil {
+		return nil, &BookingError{Code: ErrCodeInvalidPromo, Message: "Promo code " + promo.Code + ": " + err.Error()}
+	}
+	return &promo, nil
+}
+
+// redeemPromoCode records a promo code used for a new booking within the
+// transaction creating it. The use is counted with a single conditional
+// update, so concurrent bookings cannot push a code past its limit.
+func redeemPromoCode(tx *gorm.DB, promo *models.PromoCode, booking models.Booking, discount money.Money) error {
+	email := strings.ToLower(booking.Email)
+
+	if promo.MaxUsesPerEmail > 0 {
+		var used int64
+		tx.Model(&models.PromoRedemption{}).Where("promo_code_id = ? AND email = ?", promo.ID, email).Count(&used)
+		if used >= int64(promo.MaxUsesPerEmail) {
+			return &BookingError{
+				Code:    ErrCodePromoUsedUp,
+				Message: "Promo code " + promo.Code + " has already been used with this email address",
+			}
+		}
+	}
+
+	result := tx.Model(&models.PromoCode{}).
+		Where("id = ? AND (max_uses = 0 OR uses < max_uses)", promo.ID).
+		UpdateColumn("uses", gorm.Expr("uses + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return &BookingError{Code: ErrCodePromoUsedUp, Message: "Promo code " + promo.Code + " has been used up"}
+	}
+
+	return tx.Create(&models.PromoRedemption{
+		PromoCodeID: promo.ID,
+		BookingID:   booking.ID,
+		Email:       email,
+		Discount:    discount,
+	}).Error
+}
+
+// releasePromoCode gives back the promo code use of a hold that was never
+// paid for. The caller must hold the show's mutex.
+func releasePromoCode(bookingID uint) {
+	var redemption models.PromoRedemption
+	if database.DB.Where("booking_id = ?", bookingID).First(&redemption).Error != nil {
+		return
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&redemption).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.PromoCode{}).Where("id = ? AND uses > 0", redemption.PromoCodeID).
+			UpdateColumn("uses", gorm.Expr("uses - 1")).Error
+	})
+	if err != nil {
+		log.Printf("Error releasing promo code of booking %d: %v", bookingID, err)
+	}
+}
+
+// AdminPromoCodesHandler lists all promo codes
+func AdminPromoCodesHandler(w http.ResponseWriter, r *http.Request) {
+	var promos []models.PromoCode
+	database.DB.Preload("Movie").Order("created_at DESC").Find(&promos)
+
+	data := struct {
+		PromoCodes []models.PromoCode
+		Now        time.Time
+		User       models.User
+	}{
+		PromoCodes: promos,
+		Now:        time.Now(),
+		User:       r.Context().Value("user").(models.User),
+	}
+
+	templates.ExecuteTemplate(w, r, "admin_promo_codes.html", data)
+}
+
+// AdminNewPromoCodeHandler handles creation of new promo codes
+func AdminNewPromoCodeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		renderPromoForm(w, r, "Create", models.PromoCode{Type: models.DiscountPercent}, "")
+		return
+	}
+
+	promo, errMsg := parsePromoForm(r, models.PromoCode{})
+	if errMsg == "" {
+		errMsg = checkPromoCodeUnique(promo)
+	}
+	if errMsg == "" {
+		if err := database.DB.Create(&promo).Error; err != nil {
+			errMsg = "Error creating promo code: " + err.Error()
+		}
+	}
+
+	if errMsg != "" {
+		renderPromoForm(w, r, "Create", promo, errMsg)
+		return
+	}
+
+	// Redirect to admin promo codes page
+	http.Redirect(w, r, "/admin/promo-codes", http.StatusSeeOther)
+}
+
+// AdminEditPromoCodeHandler handles editing of existing promo codes
+func AdminEditPromoCodeHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid promo code ID", http.StatusBadRequest)
+		return
+	}
+
+	var promo models.PromoCode
+	if err := database.DB.First(&promo, id).Error; err != nil {
+		http.Error(w, "Promo code not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		renderPromoForm(w, r, "Edit", promo, "")
+		return
+	}
+
+	promo, errMsg := parsePromoForm(r, promo)
+	if errMsg == "" {
+		errMsg = checkPromoCodeUnique(promo)
+	}
+	if errMsg == "" {
+		// Only the settings are saved; the use count is kept up to date by bookings
+		if err := database.DB.Omit("Uses", "Movie").Save(&promo).Error; err != nil {
+			errMsg = "Error updating promo code: " + err.Error()
+		}
+	}
+
+	if errMsg != "" {
+		renderPromoForm(w, r, "Edit", promo, errMsg)
+		return
+	}
+
+	// Redirect to admin promo codes page
+	http.Redirect(w, r, "/admin/promo-codes", http.StatusSeeOther)
+}
+
+// renderPromoForm shows the promo code form with an optional error message
+func renderPromoForm(w http.ResponseWriter, r *http.Request, action string, promo models.PromoCode, errMsg string) {
+	var movies []models.Movie
+	database.DB.Order("title").Find(&movies)
+
+	var movieID uint
+	if promo.MovieID != nil {
+		movieID = *promo.MovieID
+	}
+
+	templates.ExecuteTemplate(w, r, "admin_promo_form.html", map[string]interface{}{
+		"Action":   action,
+		"Promo":    &promo,
+		"Movies":   movies,
+		"MovieID":  movieID,
+		"Weekdays": []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday, time.Sunday},
+		"Currency": money.DefaultCurrency,
+		"Error":    errMsg,
+		"User":     r.Context().Value("user").(models.User),
+	})
+}
+
+// parsePromoForm applies the submitted promo code form to promo and returns
+// an error message if the input is invalid
+func parsePromoForm(r *http.Request, promo models.PromoCode) (models.PromoCode, string) {
+	if err := r.ParseForm(); err != nil {
+		return promo, "Error parsing form"
+	}
+
+	promo.Code = models.NormalizePromoCode(r.FormValue("code"))
+	promo.Description = strings.TrimSpace(r.FormValue("description"))
+	promo.Type = models.DiscountType(r.FormValue("type"))
+	promo.Percent = 0
+	promo.Amount = money.Money{}
+	promo.Disabled = r.FormValue("disabled") != ""
+
+	switch promo.Type {
+	case models.DiscountPercent:
+		percent, err := strconv.ParseFloat(r.FormValue("percent"), 64)
+		if err != nil {
+			return promo, "Percentage must be a number"
+		}
+		promo.Percent = percent
+	case models.DiscountFixed:
+		amount, err := money.Parse(r.FormValue("amount"), money.DefaultCurrency)
+		if err != nil {
+			return promo, "Invalid amount: " + err.Error()
+		}
+		promo.Amount = amount
+	}
+
+	promo.MovieID = nil
+	promo.Movie = nil
+	if value := r.FormValue("movie_id"); value != "" {
+		movieID, err := strconv.Atoi(value)
+		if err != nil || database.DB.First(&models.Movie{}, movieID).Error != nil {
+			return promo, "Movie not found"
+		}
+		id := uint(movieID)
+		promo.MovieID = &id
+	}
+
+	promo.ShowID = nil
+	if value := strings.TrimSpace(r.FormValue("show_id")); value != "" {
+		showID, err := strconv.Atoi(value)
+		if err != nil || database.DB.First(&models.Show{}, showID).Error != nil {
+			return promo, "Show not found"
+		}
+		id := uint(showID)
+		promo.ShowID = &id
+	}
+
+	// Ticking every day is the same as not restricting the day
+	promo.Days = nil
+	for _, value := range r.Form["days"] {
+		day, err := strconv.Atoi(value)
+		if err != nil || day < 0 || day > 6 {
+			return promo, "Invalid day of the week"
+		}
+		promo.Days = append(promo.Days, time.Weekday(day))
+	}
+	if len(promo.Days) == 7 {
+		promo.Days = nil
+	}
+
+	limits := []struct {
+		field string
+		name  string
+		value *int
+	}{
+		{"min_seats", "Minimum seats", &promo.MinSeats},
+		{"max_uses", "Maximum uses", &promo.MaxUses},
+		{"max_uses_per_email", "Maximum uses per email", &promo.MaxUsesPerEmail},
+	}
+	for _, limit := range limits {
+		*limit.value = 0
+		if value := strings.TrimSpace(r.FormValue(limit.field)); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return promo, limit.name + " must be a whole number"
+			}
+			*limit.value = n
+		}
+	}
+
+	var err error
+	if promo.ValidFrom, err = parseDateTimeLocal(r.FormValue("valid_from")); err != nil {
+		return promo, "Invalid start of the validity period"
+	}
+	if promo.ValidUntil, err = parseDateTimeLocal(r.FormValue("valid_until")); err != nil {
+		return promo, "Invalid end of the validity period"
+	}
+
+	if err := promo.Validate(); err != nil {
+		return promo, "Invalid promo code: " + err.Error()
+	}
+	return promo, ""
+}
+
+// checkPromoCodeUnique makes sure no other promo code uses the same code
+func checkPromoCodeUnique(promo models.PromoCode) string {
+	var existing models.PromoCode
+	err := database.DB.Unscoped().Where("code = ? AND id <> ?", promo.Code, promo.ID).First(&existing).Error
+	if err == nil {
+		return "Promo code " + promo.Code + " already exists"
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return "Error checking promo code: " + err.Error()
+	}
+	return ""
+}
+
+// parseDateTimeLocal parses an optional datetime-local form value
+func parseDateTimeLocal(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	t, err := time.ParseInLocation("2006-01-02T15:04", value, time.Local)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/gorilla/mux"
+)
+
+// SeatEventType says what happened to the seats of a SeatEvent
+type SeatEventType string
+
+const (
+	// SeatsHeld seats are reserved while a customer checks out
+	SeatsHeld SeatEventType = "held"
+	// SeatsBooked seats have been paid for
+	SeatsBooked SeatEventType = "booked"
+	// SeatsReleased seats are available again
+	SeatsReleased SeatEventType = "released"
+)
+
+// SeatEvent tells open seat maps that seats of a show changed
+type SeatEvent struct {
+	Type   SeatEventType `json:"type"`
+	ShowID uint          `json:"show_id"`
+	Seats  []string      `json:"seats"`
+}
+
+var (
+	// SeatStreamHeartbeat is how often idle seat streams send a comment, so
+	// proxies do not close them
+	SeatStreamHeartbeat = 15 * time.Second
+
+	// seatSubscriberBuffer is how many events a slow seat map may fall behind
+	// before it is disconnected and has to reload the seat map
+	seatSubscriberBuffer = 32
+)
+
+var (
+	// Open seat streams of each show
+	seatSubscribers = make(map[uint]map[chan SeatEvent]bool)
+	// Closed to end every seat stream when the server shuts down
+	seatStreamsDone = make(chan struct{})
+	// Mutex to protect seatSubscribers and seatStreamsDone
+	seatSubscribersMutex sync.Mutex
+)
+
+// subscribeSeats returns a channel receiving the seat events of a show. The
+// channel is closed when the subscriber falls too far behind.
+func subscribeSeats(showID uint) chan SeatEvent {
+	seatSubscribersMutex.Lock()
+	defer seatSubscribersMutex.Unlock()
+
+	events := make(chan SeatEvent, seatSubscriberBuffer)
+	if seatSubscribers[showID] == nil {
+		seatSubscribers[showID] = make(map[chan SeatEvent]bool)
+	}
+	seatSubscribers[showID][events] = true
+	return events
+}
+
+// unsubscribeSeats stops sending seat events to a channel
+func unsubscribeSeats(showID uint, events chan SeatEvent) {
+	seatSubscribersMutex.Lock()
+	defer seatSubscribersMutex.Unlock()
+
+	if seatSubscribers[showID][events] {
+		delete(seatSubscribers[showID], events)
+		close(events)
+	}
+	if len(seatSubscribers[showID]) == 0 {
+		delete(seatSubscribers, showID)
+	}
+}
+
+// publishSeats sends a seat event to every open seat map of the show. It
+// never blocks the booking processor: subscribers whose buffer is full are
+// dropped instead.
+func publishSeats(eventType SeatEventType, showID uint, seats models.Seats) {
+	if len(seats) == 0 {
+		return
+	}
+
+	event := SeatEvent{Type: eventType, ShowID: showID, Seats: make([]string, len(seats))}
+	for i, seat := range seats {
+		event.Seats[i] = seat.String()
+	}
+
+	seatSubscribersMutex.Lock()
+	defer seatSubscribersMutex.Unlock()
+
+	for events := range seatSubscribers[showID] {
+		select {
+		case events <- event:
+		default:
+			delete(seatSubscribers[showID], events)
+			close(events)
+		}
+	}
+}
+
+// CloseSeatStreams ends every open seat stream, so the server can shut down
+// without waiting for browsers to disconnect
+func CloseSeatStreams() {
+	seatSubscribersMutex.Lock()
+	defer seatSubscribersMutex.Unlock()
+
+	select {
+	case <-seatStreamsDone:
+	default:
+		close(seatStreamsDone)
+	}
+}
+
+// seatStreamsClosed returns the channel closed by CloseSeatStreams
+func seatStreamsClosed() <-chan struct{} {
+	seatSubscribersMutex.Lock()
+	defer seatSubscribersMutex.Unlock()
+	return seatStreamsDone
+}
+
+// seatSnapshot is the first event of a seat stream, listing every seat
+// taken when the stream opened
+type seatSnapshot struct {
+	ShowID uint                            `json:"show_id"`
+	Taken  map[string]models.BookingStatus `json:"taken"`
+}
+
+// writeServerSentEvent writes one event in text/event-stream format
+func writeServerSentEvent(w http.ResponseWriter, event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+	return err
+}
+
+// SeatStreamHandler streams seat changes of a show as Server-Sent Events.
+// The stream opens with a "snapshot" of the taken seats, followed by a
+// "seats" event whenever seats are held, booked or released.
+func SeatStreamHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid show ID", http.StatusBadRequest)
+		return
+	}
+
+	show, err := loadShow(uint(id))
+	if err != nil {
+		http.Error(w, "Show not found", http.StatusNotFound)
+		return
+	}
+
+	// Streams outlive the server's write timeout
+	controller := http.NewResponseController(w)
+	if err := controller.SetWriteDeadline(time.Time{}); err != nil && err != http.ErrNotSupported {
+		log.Printf("Error clearing write deadline of seat stream for show %d: %v", show.ID, err)
+	}
+
+	// Subscribe before taking the snapshot, so no change falls in between
+	events := subscribeSeats(show.ID)
+	defer unsubscribeSeats(show.ID, events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// Browsers reconnect after this many milliseconds if the stream drops
+	fmt.Fprintf(w, "retry: %d\n\n", 3000)
+	snapshot := seatSnapshot{ShowID: show.ID, Taken: takenSeatKeys(show.ID, time.Now())}
+	if err := writeServerSentEvent(w, "snapshot", snapshot); err != nil {
+		return
+	}
+	if err := controller.Flush(); err != nil {
+		log.Printf("Seat stream for show %d cannot be flushed: %v", show.ID, err)
+		return
+	}
+
+	heartbeat := time.NewTicker(SeatStreamHeartbeat)
+	defer heartbeat.Stop()
+	done := seatStreamsClosed()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				// Fell behind; the browser reconnects and gets a new snapshot
+				return
+			}
+			if err := writeServerSentEvent(w, "seats", event); err != nil {
+				return
+			}
+
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+
+		case <-r.Context().Done():
+			return
+
+		case <-done:
+			return
+		}
+
+		if err := controller.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/tickets"
+	"github.com/gorilla/mux"
+)
+
+var (
+	// TicketSecret signs the tokens in ticket QR codes. Tickets issued under
+	// one secret cannot be verified with another.
+	TicketSecret []byte
+
+	// AttachTickets sends the PDF tickets along with booking confirmations
+	AttachTickets = true
+)
+
+// ticketsFilename names the PDF tickets of a booking
+func ticketsFilename(booking models.Booking) string {
+	return "tickets-" + booking.Reference + ".pdf"
+}
+
+// renderTickets returns the PDF tickets of a booking loaded with its show,
+// movie and hall
+func renderTickets(booking models.Booking) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := tickets.WritePDF(&buf, booking, TicketSecret); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ticketAttachments returns the PDF tickets of a booking as an email
+// attachment, or none if they are not wanted or cannot be made
+func ticketAttachments(booking models.Booking) []models.NotificationAttachment {
+	if !AttachTickets {
+		return nil
+	}
+
+	pdf, err := renderTickets(booking)
+	if err != nil {
+		log.Printf("Error creating tickets for booking %d: %v", booking.ID, err)
+		return nil
+	}
+	return []models.NotificationAttachment{{
+		Filename:    ticketsFilename(booking),
+		ContentType: "application/pdf",
+		Data:        pdf,
+	}}
+}
+
+// TicketsPDFHandler serves the printable tickets of a confirmed booking
+func TicketsPDFHandler(w http.ResponseWriter, r *http.Request) {
+	booking, err := loadBookingByReference(mux.Vars(r)["reference"])
+	if err != nil || booking.Status != models.BookingConfirmed {
+		http.Error(w, "Booking not found", http.StatusNotFound)
+		return
+	}
+
+	pdf, err := renderTickets(booking)
+	if err != nil {
+		log.Printf("Error creating tickets for booking %d: %v", booking.ID, err)
+		http.Error(w, "Error creating tickets", http.StatusInternalServerError)
+		return
+	}
+
+	disposition := "inline"
+	if r.URL.Query().Get("download") != "" {
+		disposition = "attachment"
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", disposition+`; filename="`+ticketsFilename(booking)+`"`)
+	w.Header().Set("Content-Length", strconv.Itoa(len(pdf)))
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Write(pdf)
+}
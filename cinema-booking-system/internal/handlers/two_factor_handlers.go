@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/accounts"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/sessions"
+	"github.com/skip2/go-qrcode"
+)
+
+// twoFactorCookieName holds the login waiting for its two-factor code
+const twoFactorCookieName = "login_challenge"
+
+// TwoFactorLoginHandler is the second step of logging in for users with
+// two-factor authentication, asking for a code from their authenticator app
+// or a recovery code before starting their session
+func TwoFactorLoginHandler(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(twoFactorCookieName)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	now := time.Now()
+	challenge, err := accounts.LookupToken(cookie.Value, models.TokenTwoFactorLogin, now)
+	if err != nil {
+		clearTwoFactorCookie(w)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	user := *challenge.User
+
+	redirect := localRedirect(r.FormValue("redirect"))
+	data := map[string]interface{}{"Redirect": redirect}
+
+	if r.Method == http.MethodGet {
+		templates.ExecuteTemplate(w, r, "login_two_factor.html", data)
+		return
+	}
+
+	// Wrong codes count towards the same lockout as wrong passwords
+	ip := sessions.ClientIP(r)
+	defer accounts.LockLogin(user.Username, ip)()
+	now = time.Now()
+	if block := accounts.CheckLogin(user.Username, ip, now); block.Blocked(now) {
+		renderLoginBlocked(w, r, "login_two_factor.html", data, block, now)
+		return
+	}
+
+	if err := accounts.CheckSecondFactor(user, r.FormValue("code"), now); err != nil {
+		if err := accounts.RecordLoginFailure(user.Username, ip, now); err != nil {
+			log.Printf("Error recording failed login for %s: %v", user.Username, err)
+		}
+		data["Error"] = "Invalid code"
+		templates.ExecuteTemplate(w, r, "login_two_factor.html", data)
+		return
+	}
+
+	if _, err := accounts.UseToken(cookie.Value, models.TokenTwoFactorLogin, now); err != nil {
+		clearTwoFactorCookie(w)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	clearTwoFactorCookie(w)
+
+	logIn(w, r, user, redirect, now)
+}
+
+// TwoFactorHandler shows whether the logged-in user has two-factor
+// authentication, with the QR code to finish setting it up once started
+func TwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+	renderTwoFactor(w, r, user, nil, "")
+}
+
+// StartTwoFactorHandler creates the secret for the logged-in user's
+// authenticator app, which they confirm with a code to turn two-factor
+// authentication on
+func StartTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	if !user.TwoFactorEnabled() {
+		if err := accounts.StartTwoFactor(&user); err != nil {
+			http.Error(w, "Error setting up two-factor authentication: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	http.Redirect(w, r, "/account/two-factor", http.StatusSeeOther)
+}
+
+// EnableTwoFactorHandler turns on two-factor authentication once the user
+// enters a code from their authenticator app, showing their recovery codes
+func EnableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	codes, err := accounts.EnableTwoFactor(&user, r.FormValue("code"), time.Now())
+	if errors.Is(err, accounts.ErrInvalidCode) {
+		renderTwoFactor(w, r, user, nil, "That code is not right. Check the time on your phone and try the newest code.")
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error enabling two-factor authentication: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s turned on two-factor authentication", user.Username)
+
+	renderTwoFactor(w, r, user, codes, "")
+}
+
+// RecoveryCodesHandler replaces the logged-in user's recovery codes
+func RecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	if err := accounts.CheckSecondFactor(user, r.FormValue("code"), time.Now()); err != nil {
+		renderTwoFactor(w, r, user, nil, "Enter a current code to get new recovery codes")
+		return
+	}
+
+	codes, err := accounts.RegenerateRecoveryCodes(user)
+	if err != nil {
+		http.Error(w, "Error creating recovery codes: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s replaced their recovery codes", user.Username)
+
+	renderTwoFactor(w, r, user, codes, "")
+}
+
+// DisableTwoFactorHandler turns off two-factor authentication for users
+// whose role does not require it
+func DisableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	if user.Role.RequiresTwoFactor() {
+		http.Error(w, "Your role requires two-factor authentication", http.StatusForbidden)
+		return
+	}
+	if err := accounts.CheckSecondFactor(user, r.FormValue("code"), time.Now()); err != nil {
+		renderTwoFactor(w, r, user, nil, "Enter a current code to turn off two-factor authentication")
+		return
+	}
+
+	if err := accounts.DisableTwoFactor(&user); err != nil {
+		http.Error(w, "Error disabling two-factor authentication: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s turned off two-factor authentication", user.Username)
+
+	http.Redirect(w, r, "/account/two-factor", http.StatusSeeOther)
+}
+
+// renderTwoFactor renders the two-factor page, with recovery codes when they
+// were just created and an optional error message
+func renderTwoFactor(w http.ResponseWriter, r *http.Request, user models.User, recoveryCodes []string, errMsg string) {
+	data := struct {
+		User          models.User
+		Required      bool
+		Secret        string
+		QRCode        template.URL
+		RecoveryCodes []string
+		Remaining     int64
+		Error         string
+	}{
+		User:          user,
+		Required:      user.Role.RequiresTwoFactor(),
+		RecoveryCodes: recoveryCodes,
+		Error:         errMsg,
+	}
+
+	if user.TwoFactorEnabled() {
+		data.Remaining = accounts.RemainingRecoveryCodes(user)
+	} else if user.TOTPSecret != "" {
+		png, err := qrcode.Encode(accounts.TwoFactorURI(user), qrcode.Medium, 256)
+		if err != nil {
+			http.Error(w, "Error creating QR code: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data.Secret = user.TOTPSecret
+		data.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	}
+
+	if errMsg != "" {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	templates.ExecuteTemplate(w, r, "account_two_factor.html", data)
+}
+
+// clearTwoFactorCookie forgets the login waiting for its two-factor code
+func clearTwoFactorCookie(w http.ResponseWriter) {
+	http.SetCookie(w, sessions.NewCookie(twoFactorCookieName, "", "/login", time.Now().Add(-time.Hour)))
+}
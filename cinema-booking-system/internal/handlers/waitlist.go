@@ -0,0 +1,483 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/money"
+	"github.com/JoeDkhar/cinema-booking-system/internal/notifications"
+	"github.com/JoeDkhar/cinema-booking-system/internal/utils"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// Waitlist error codes
+const (
+	ErrCodeSeatsAvailable    BookingErrorCode = "seats_available"
+	ErrCodeAlreadyWaitlisted BookingErrorCode = "already_waitlisted"
+	ErrCodeWaitlistNotFound  BookingErrorCode = "waitlist_not_found"
+)
+
+// WaitlistClaimWindow is how long seats offered to a waitlisted customer are
+// held before they go to the next customer in line
+var WaitlistClaimWindow = 30 * time.Minute
+
+// joinWaitlist puts a customer in line for seats of a show that does not
+// have enough left
+func joinWaitlist(showID uint, name, email string, count int) (models.WaitlistEntry, *BookingError) {
+	name = strings.TrimSpace(name)
+	email = strings.TrimSpace(email)
+	if name == "" || !utils.ValidateEmail(email) {
+		return models.WaitlistEntry{}, &BookingError{Code: ErrCodeCustomerRequired, Message: "A name and a valid email address are required"}
+	}
+	if count < 1 {
+		return models.WaitlistEntry{}, &BookingError{Code: ErrCodeNoSeats, Message: "No seats requested"}
+	}
+	if count > MaxSeatsPerBooking {
+		return models.WaitlistEntry{}, &BookingError{
+			Code:    ErrCodeTooManySeats,
+			Message: "A booking may contain at most " + strconv.Itoa(MaxSeatsPerBooking) + " seats",
+		}
+	}
+
+	mutex := getShowMutex(showID)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	show, err := loadShow(showID)
+	if err != nil {
+		return models.WaitlistEntry{}, &BookingError{Code: ErrCodeShowNotFound, Message: "Show not found"}
+	}
+	if !show.DateTime.After(time.Now()) {
+		return models.WaitlistEntry{}, &BookingError{Code: ErrCodeShowNotCurrent, Message: "The show has already started"}
+	}
+
+	left := len(freeSeats(show, time.Now()))
+	if left >= count {
+		return models.WaitlistEntry{}, &BookingError{
+			Code:    ErrCodeSeatsAvailable,
+			Message: strconv.Itoa(left) + " seats are still available and can be booked now",
+		}
+	}
+
+	var existing int64
+	database.DB.Model(&models.WaitlistEntry{}).
+		Where("show_id = ? AND LOWER(email) = LOWER(?) AND status IN ?", show.ID, email, []models.WaitlistStatus{models.WaitlistWaiting, models.WaitlistOffered}).
+		Count(&existing)
+	if existing > 0 {
+		return models.WaitlistEntry{}, &BookingError{Code: ErrCodeAlreadyWaitlisted, Message: "You are already on the waitlist for this show"}
+	}
+
+	entry := models.WaitlistEntry{
+		ShowID:       show.ID,
+		CustomerName: name,
+		Email:        email,
+		SeatCount:    count,
+		Token:        utils.GenerateSessionToken(),
+		Status:       models.WaitlistWaiting,
+	}
+	if err := database.DB.Create(&entry).Error; err != nil {
+		return models.WaitlistEntry{}, &BookingError{Code: ErrCodeInternal, Message: "Error joining waitlist: " + err.Error()}
+	}
+	return entry, nil
+}
+
+// leaveWaitlist takes a customer off the waitlist, letting go of any seats
+// held for them
+func leaveWaitlist(token string) (models.WaitlistEntry, *BookingError) {
+	entry, err := loadWaitlistEntry(token)
+	if err != nil {
+		return entry, &BookingError{Code: ErrCodeWaitlistNotFound, Message: "Waitlist entry not found"}
+	}
+
+	mutex := getShowMutex(entry.ShowID)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	// Reload under the lock, as the entry may have been offered seats since
+	if err := database.DB.First(&entry, entry.ID).Error; err != nil {
+		return entry, &BookingError{Code: ErrCodeWaitlistNotFound, Message: "Waitlist entry not found"}
+	}
+	if entry.Status != models.WaitlistWaiting && entry.Status != models.WaitlistOffered {
+		return entry, &BookingError{Code: ErrCodeNotCancellable, Message: "You are no longer on the waitlist"}
+	}
+
+	var offer models.Booking
+	offered := entry.Status == models.WaitlistOffered && entry.BookingID != nil &&
+		database.DB.First(&offer, *entry.BookingID).Error == nil && offer.Status == models.BookingHeld
+
+	entry.Status = models.WaitlistLeft
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&entry).Error; err != nil {
+			return err
+		}
+		if offered {
+			offer.Status = models.BookingReleased
+			offer.ExpiresAt = nil
+			return tx.Save(&offer).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return entry, &BookingError{Code: ErrCodeInternal, Message: "Error leaving waitlist: " + err.Error()}
+	}
+
+	if offered {
+		cancelHoldExpiry(offer.ID)
+		publishSeats(SeatsReleased, offer.ShowID, offer.Seats)
+		offerWaitlist(offer.ShowID)
+	}
+	return entry, nil
+}
+
+// seatsReleased passes seats a booking gave back on to the waitlist. If the
+// booking was itself a waitlist offer, the offer has lapsed. The caller must
+// hold the show's mutex.
+func seatsReleased(booking models.Booking) {
+	settleWaitlistOffer(booking.ID, models.WaitlistExpired)
+	offerWaitlist(booking.ShowID)
+}
+
+// settleWaitlistOffer records what became of the seats offered to a waitlist
+// entry once its hold is confirmed or ends
+func settleWaitlistOffer(bookingID uint, status models.WaitlistStatus) {
+	err := database.DB.Model(&models.WaitlistEntry{}).
+		Where("booking_id = ? AND status = ?", bookingID, models.WaitlistOffered).
+		Update("status", status).Error
+	if err != nil {
+		log.Printf("Error updating waitlist offer of booking %d: %v", bookingID, err)
+	}
+}
+
+// freeSeats returns the seats of a show that are neither booked nor held
+func freeSeats(show models.Show, now time.Time) models.Seats {
+	taken := takenSeatKeys(show.ID, now)
+	var free models.Seats
+	for _, seat := range show.Hall.Layout.AllSeats() {
+		if _, isTaken := taken[seat.String()]; !isTaken {
+			free = append(free, seat)
+		}
+	}
+	return free
+}
+
+// pickSeats chooses count of the free seats, preferring seats next to each
+// other in one row. Seats are returned in hall order.
+func pickSeats(free models.Seats, count int) models.Seats {
+	if len(free) < count {
+		return nil
+	}
+	for i := 0; i+count <= len(free); i++ {
+		first, last := free[i], free[i+count-1]
+		if first.Row == last.Row && last.Number-first.Number == count-1 {
+			return append(models.Seats{}, free[i:i+count]...)
+		}
+	}
+	return append(models.Seats{}, free[:count]...)
+}
+
+// offerWaitlist holds freed seats for customers waiting for the show, in the
+// order they joined. Customers wanting more seats than are free are passed
+// over until enough are. The caller must hold the show's mutex.
+func offerWaitlist(showID uint) {
+	show, err := loadShow(showID)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	if !show.DateTime.After(now) {
+		return
+	}
+
+	var waiting []models.WaitlistEntry
+	database.DB.Where("show_id = ? AND status = ?", showID, models.WaitlistWaiting).Order("id").Find(&waiting)
+	if len(waiting) == 0 {
+		return
+	}
+
+	free := freeSeats(show, now)
+	for _, entry := range waiting {
+		seats := pickSeats(free, entry.SeatCount)
+		if seats == nil {
+			continue
+		}
+		if err := offerSeats(show, entry, seats, now); err != nil {
+			log.Printf("Error offering seats to waitlist entry %d: %v", entry.ID, err)
+			continue
+		}
+		free = removeSeats(free, seats)
+	}
+}
+
+// removeSeats returns the seats that are not in taken
+func removeSeats(seats, taken models.Seats) models.Seats {
+	var remaining models.Seats
+	for _, seat := range seats {
+		if !taken.Contains(seat) {
+			remaining = append(remaining, seat)
+		}
+	}
+	return remaining
+}
+
+// offerSeats holds seats for a waitlisted customer and emails them a link to
+// claim them. The caller must hold the show's mutex.
+func offerSeats(show models.Show, entry models.WaitlistEntry, seats models.Seats, now time.Time) error {
+	prices, err := PriceRules.Price(show, seats)
+	if err != nil {
+		return err
+	}
+	prices = PriceRules.ApplyTax(prices)
+
+	expiresAt := now.Add(WaitlistClaimWindow)
+	booking := models.Booking{
+		ShowID:         show.ID,
+		CustomerName:   entry.CustomerName,
+		Email:          entry.Email,
+		Seats:          seats,
+		BookingTime:    now,
+		TotalAmount:    prices.Total(),
+		RefundedAmount: money.New(0, show.TicketPrice.Currency),
+		Prices:         prices,
+		Status:         models.BookingHeld,
+		ExpiresAt:      &expiresAt,
+	}
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&booking).Error; err != nil {
+			return err
+		}
+		entry.Status = models.WaitlistOffered
+		entry.BookingID = &booking.ID
+		entry.OfferedAt = &now
+		return tx.Save(&entry).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	scheduleHoldExpiry(booking.ID, expiresAt)
+	publishSeats(SeatsHeld, show.ID, seats)
+	notifyBooking(notifications.WaitlistOffer, booking.ID, notifications.BookingEmail{Waitlist: &entry})
+	log.Printf("Offered seats %s of show %d to waitlist entry %d", seats, show.ID, entry.ID)
+	return nil
+}
+
+// loadWaitlistEntry retrieves a waitlist entry by its token together with
+// its show, movie and hall
+func loadWaitlistEntry(token string) (models.WaitlistEntry, error) {
+	var entry models.WaitlistEntry
+	err := database.DB.Preload("Show").Preload("Show.Movie").Preload("Show.Hall").
+		Where("token = ?", token).First(&entry).Error
+	return entry, err
+}
+
+// waitlistPosition returns how many customers are ahead of a waiting entry,
+// counting the entry itself
+func waitlistPosition(entry models.WaitlistEntry) int {
+	var ahead int64
+	database.DB.Model(&models.WaitlistEntry{}).
+		Where("show_id = ? AND status = ? AND id <= ?", entry.ShowID, models.WaitlistWaiting, entry.ID).
+		Count(&ahead)
+	return int(ahead)
+}
+
+// waitlistOffer returns the hold offered to an entry if it can still be claimed
+func waitlistOffer(entry models.WaitlistEntry) (models.Booking, bool) {
+	if entry.Status != models.WaitlistOffered || entry.BookingID == nil {
+		return models.Booking{}, false
+	}
+	booking, err := loadBooking(*entry.BookingID)
+	if err != nil || !booking.IsActiveHold(time.Now()) {
+		return booking, false
+	}
+	return booking, true
+}
+
+// JoinWaitlistHandler adds a customer to the waitlist of a show from the
+// seat selection page
+func JoinWaitlistHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid show ID", http.StatusBadRequest)
+		return
+	}
+	count, err := strconv.Atoi(r.FormValue("seats"))
+	if err != nil {
+		http.Error(w, "Invalid number of seats", http.StatusBadRequest)
+		return
+	}
+
+	entry, bookingErr := joinWaitlist(uint(id), r.FormValue("customer_name"), r.FormValue("email"), count)
+	if bookingErr != nil {
+		http.Error(w, bookingErr.Message, bookingErrorStatus(bookingErr))
+		return
+	}
+
+	http.Redirect(w, r, "/waitlist/"+entry.Token, http.StatusSeeOther)
+}
+
+// WaitlistHandler shows a customer where they are on the waitlist and any
+// seats offered to them
+func WaitlistHandler(w http.ResponseWriter, r *http.Request) {
+	entry, err := loadWaitlistEntry(mux.Vars(r)["token"])
+	if err != nil {
+		http.Error(w, "Waitlist entry not found", http.StatusNotFound)
+		return
+	}
+
+	data := struct {
+		Entry    models.WaitlistEntry
+		Position int
+		Offer    models.Booking
+		HasOffer bool
+	}{
+		Entry: entry,
+	}
+	if entry.Status == models.WaitlistWaiting {
+		data.Position = waitlistPosition(entry)
+	}
+	data.Offer, data.HasOffer = waitlistOffer(entry)
+
+	templates.ExecuteTemplate(w, r, "waitlist.html", data)
+}
+
+// ClaimWaitlistHandler takes a customer to the checkout of the seats offered
+// to them, or back to their waitlist page if the offer has lapsed
+func ClaimWaitlistHandler(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+	entry, err := loadWaitlistEntry(token)
+	if err != nil {
+		http.Error(w, "Waitlist entry not found", http.StatusNotFound)
+		return
+	}
+
+	if offer, ok := waitlistOffer(entry); ok {
+		http.Redirect(w, r, "/booking/checkout/"+offer.Reference, http.StatusSeeOther)
+		return
+	}
+	if entry.Status == models.WaitlistClaimed && entry.BookingID != nil {
+		if booking, err := loadBooking(*entry.BookingID); err == nil {
+			http.Redirect(w, r, "/booking/confirmation/"+booking.Reference, http.StatusSeeOther)
+			return
+		}
+	}
+	http.Redirect(w, r, "/waitlist/"+token, http.StatusSeeOther)
+}
+
+// LeaveWaitlistHandler takes a customer off the waitlist
+func LeaveWaitlistHandler(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+	if _, bookingErr := leaveWaitlist(token); bookingErr != nil && bookingErr.Code != ErrCodeNotCancellable {
+		http.Error(w, bookingErr.Message, bookingErrorStatus(bookingErr))
+		return
+	}
+	http.Redirect(w, r, "/waitlist/"+token, http.StatusSeeOther)
+}
+
+// apiWaitlistRequest is the JSON body accepted by APIJoinWaitlistHandler
+type apiWaitlistRequest struct {
+	CustomerName string `json:"customer_name"`
+	Email        string `json:"email"`
+	Seats        int    `json:"seats"`
+}
+
+// apiWaitlistEntry describes a waitlist entry to its customer
+type apiWaitlistEntry struct {
+	Token     string                `json:"token"`
+	ShowID    uint                  `json:"show_id"`
+	SeatCount int                   `json:"seat_count"`
+	Status    models.WaitlistStatus `json:"status"`
+	Position  int                   `json:"position,omitempty"`
+	Offer     *apiWaitlistOffer     `json:"offer,omitempty"`
+}
+
+// apiWaitlistOffer describes seats held for a waitlisted customer
+type apiWaitlistOffer struct {
+	Reference   string       `json:"reference"`
+	Seats       models.Seats `json:"seats"`
+	TotalAmount money.Money  `json:"total_amount"`
+	ExpiresAt   time.Time    `json:"expires_at"`
+}
+
+// newAPIWaitlistEntry converts a waitlist entry for the API
+func newAPIWaitlistEntry(entry models.WaitlistEntry) apiWaitlistEntry {
+	response := apiWaitlistEntry{
+		Token:     entry.Token,
+		ShowID:    entry.ShowID,
+		SeatCount: entry.SeatCount,
+		Status:    entry.Status,
+	}
+	if entry.Status == models.WaitlistWaiting {
+		response.Position = waitlistPosition(entry)
+	}
+	if offer, ok := waitlistOffer(entry); ok {
+		response.Offer = &apiWaitlistOffer{
+			Reference:   offer.Reference,
+			Seats:       offer.Seats,
+			TotalAmount: offer.TotalAmount,
+			ExpiresAt:   *offer.ExpiresAt,
+		}
+	}
+	return response
+}
+
+// APIJoinWaitlistHandler adds a customer to the waitlist of a show
+func APIJoinWaitlistHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, APIResponse{Success: false, Error: "Invalid show ID"})
+		return
+	}
+
+	var body apiWaitlistRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, APIResponse{Success: false, Error: "Invalid request body"})
+		return
+	}
+
+	entry, bookingErr := joinWaitlist(uint(id), body.CustomerName, body.Email, body.Seats)
+	if bookingErr != nil {
+		sendBookingError(w, failedBooking(bookingErr))
+		return
+	}
+
+	sendJSONResponse(w, http.StatusCreated, APIResponse{
+		Success: true,
+		Data:    newAPIWaitlistEntry(entry),
+	})
+}
+
+// APIWaitlistDetailHandler returns a waitlist entry and any seats offered
+func APIWaitlistDetailHandler(w http.ResponseWriter, r *http.Request) {
+	entry, err := loadWaitlistEntry(mux.Vars(r)["token"])
+	if err != nil {
+		sendJSONResponse(w, http.StatusNotFound, APIResponse{Success: false, Error: "Waitlist entry not found"})
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    newAPIWaitlistEntry(entry),
+	})
+}
+
+// APILeaveWaitlistHandler takes a customer off the waitlist
+func APILeaveWaitlistHandler(w http.ResponseWriter, r *http.Request) {
+	entry, bookingErr := leaveWaitlist(mux.Vars(r)["token"])
+	if bookingErr != nil {
+		sendBookingError(w, failedBooking(bookingErr))
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    newAPIWaitlistEntry(entry),
+	})
+}
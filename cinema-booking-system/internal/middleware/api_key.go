@@ -0,0 +1,113 @@
+package middleware
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/apikeys"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/sessions"
+)
+
+// APIKeyMiddleware authenticates partners calling the API with a key in an
+// "Authorization: Bearer" header, within the key's rate limit. Requests
+// without a key, as the site's own pages and customers' apps make, are
+// limited by the address they come from instead.
+func APIKeyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		ip := sessions.ClientIP(r)
+		token, ok := bearerToken(r)
+		if !ok {
+			allowed, remaining, reset := apikeys.AllowAddress(ip, now)
+			if !withinRateLimit(w, apikeys.AddressLimit(), allowed, remaining, reset) {
+				log.Printf("Address %s is over the API rate limit", ip)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key, err := apikeys.Lookup(token, ip, now)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeJSONError(w, http.StatusUnauthorized, "Invalid or revoked API key")
+			return
+		}
+
+		allowed, remaining, reset := apikeys.Allow(key, now)
+		if !withinRateLimit(w, apikeys.Limit(key), allowed, remaining, reset) {
+			log.Printf("API key %s (%s) is over its rate limit", key.Prefix, key.Name)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "api_key", key)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// withinRateLimit sets the rate limit headers of a response, refusing the
+// request and returning false if it is over the limit
+func withinRateLimit(w http.ResponseWriter, limit int, allowed bool, remaining int, reset time.Duration) bool {
+	resetSeconds := strconv.Itoa(int(math.Ceil(reset.Seconds())))
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("X-RateLimit-Reset", resetSeconds)
+	if !allowed {
+		w.Header().Set("Retry-After", resetSeconds)
+		writeJSONError(w, http.StatusTooManyRequests, "Rate limit exceeded")
+	}
+	return allowed
+}
+
+// RequireAPIScope refuses requests made with an API key that was not given
+// the scope, and requests without a key if the scope is not public, unless
+// the site itself made them
+func RequireAPIScope(scope models.APIScope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, ok := r.Context().Value("api_key").(models.APIKey)
+			if ok && !key.Can(scope) {
+				log.Printf("API key %s (%s) denied %s: missing %s scope", key.Prefix, key.Name, r.URL.Path, scope)
+				writeJSONError(w, http.StatusForbidden, "This API key may not do this")
+				return
+			}
+			if !ok && !scope.Public() && !siteRequest(r) {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeJSONError(w, http.StatusUnauthorized, "An API key is required")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// siteRequest reports whether a request without a key came from the site
+// itself: from a visitor logged in to it, or from one of its pages, as
+// browsers say in the Sec-Fetch-Site and Origin headers of their requests
+func siteRequest(r *http.Request) bool {
+	if _, ok := sessionUser(r); ok {
+		return true
+	}
+	if r.Header.Get("Sec-Fetch-Site") == "same-origin" {
+		return true
+	}
+	origin, err := url.Parse(r.Header.Get("Origin"))
+	return err == nil && origin.Host != "" && origin.Host == r.Host
+}
+
+// bearerToken returns the token in a request's Authorization header
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
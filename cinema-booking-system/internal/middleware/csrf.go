@@ -0,0 +1,116 @@
+package middleware
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/sessions"
+	"github.com/JoeDkhar/cinema-booking-system/internal/utils"
+)
+
+const (
+	// CSRFFieldName is the form field forms send their CSRF token in
+	CSRFFieldName = "csrf_token"
+	// CSRFHeaderName is the header scripts send their CSRF token in
+	CSRFHeaderName = "X-CSRF-Token"
+	// csrfCookieName is the cookie the browser's CSRF token is kept in
+	csrfCookieName = "csrf_token"
+)
+
+// AllowedOrigins lists the other sites, such as "https://partner.example",
+// that may call the API from a browser. The site's own origin is always allowed.
+var AllowedOrigins []string
+
+// csrfContextKey is where the request's CSRF token is kept in its context
+type csrfContextKey struct{}
+
+// CSRFMiddleware rejects state-changing requests that other sites could have
+// made on a visitor's behalf. Every browser is given a random token in a
+// cookie which forms must send back; other sites cannot read it to do so.
+// Requests a browser only sends cross-site after a CORS preflight, such as
+// JSON posts and deletes, do not need it. Requests from origins that are not
+// allowed are refused outright.
+func CSRFMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := ""
+		if cookie, err := r.Cookie(csrfCookieName); err == nil && len(cookie.Value) == 32 {
+			token = cookie.Value
+		}
+		if token == "" {
+			token = utils.GenerateSessionToken()
+			http.SetCookie(w, sessions.NewCookie(csrfCookieName, token, "/", time.Time{}))
+		}
+		r = r.WithContext(context.WithValue(r.Context(), csrfContextKey{}, token))
+
+		if !safeMethod(r.Method) {
+			reason := ""
+			if origin := r.Header.Get("Origin"); origin != "" && !originAllowed(origin, r) {
+				reason = "origin " + origin + " is not allowed"
+			} else if r.Method == http.MethodPost && !isJSON(r) && !validCSRFToken(r, token) {
+				reason = "missing or invalid CSRF token"
+			}
+
+			if reason != "" {
+				log.Printf("Rejected %s %s: %s", r.Method, r.URL.Path, reason)
+				if strings.HasPrefix(r.URL.Path, "/api/") {
+					writeJSONError(w, http.StatusForbidden, "Request could not be verified")
+				} else {
+					http.Error(w, "Your session expired or the form came from another site. Go back, reload the page and try again.", http.StatusForbidden)
+				}
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CSRFToken returns the token forms on the page must send back
+func CSRFToken(r *http.Request) string {
+	token, _ := r.Context().Value(csrfContextKey{}).(string)
+	return token
+}
+
+// safeMethod reports whether a method only reads
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// isJSON reports whether a request has a JSON body
+func isJSON(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// validCSRFToken reports whether a request sent back the browser's token
+func validCSRFToken(r *http.Request, token string) bool {
+	sent := r.Header.Get(CSRFHeaderName)
+	if sent == "" {
+		sent = r.PostFormValue(CSRFFieldName)
+	}
+	return sent != "" && subtle.ConstantTimeCompare([]byte(sent), []byte(token)) == 1
+}
+
+// originAllowed reports whether requests from an origin may change things:
+// the site itself or one of AllowedOrigins
+func originAllowed(origin string, r *http.Request) bool {
+	if parsed, err := url.Parse(origin); err == nil && parsed.Host == r.Host {
+		return true
+	}
+	for _, allowed := range AllowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,15 +1,18 @@
 package middleware
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
 	"log"
+	"net"
 	"net/http"
 	"runtime/debug"
 	"strings"
 	"time"
 
-	"github.com/JoeDkhar/cinema-booking-system/internal/database"
 	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/sessions"
 )
 
 // LoggingMiddleware logs incoming HTTP requests
@@ -60,12 +63,16 @@ func RecoveryMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-// CORSMiddleware handles CORS headers
+// CORSMiddleware handles CORS headers, letting browsers on AllowedOrigins
+// read the site's responses
 func CORSMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Add("Vary", "Origin")
+		if origin := r.Header.Get("Origin"); origin != "" && originAllowed(origin, r) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, "+CSRFHeaderName)
+		}
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -79,26 +86,113 @@ func CORSMiddleware(next http.Handler) http.Handler {
 // AuthMiddleware checks if users are authenticated
 func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Get session cookie (simplified version - in a real app, use proper session management)
-		cookie, err := r.Cookie("session")
-		if err != nil {
+		user, ok := sessionUser(r)
+		if !ok {
 			http.Redirect(w, r, "/login?redirect="+r.URL.Path, http.StatusSeeOther)
 			return
 		}
 
-		// Validate session token
-		var user models.User
-		if err := database.DB.Where("session_token = ?", cookie.Value).First(&user).Error; err != nil {
-			http.Redirect(w, r, "/login?redirect="+r.URL.Path, http.StatusSeeOther)
+		// Add user to context
+		ctx := context.WithValue(r.Context(), "user", user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequirePermission only lets through users whose role grants the
+// permission, sending anyone not logged in to the login page and staff
+// without two-factor authentication to set it up
+func RequirePermission(permission models.Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := sessionUser(r)
+			if !ok {
+				http.Redirect(w, r, "/login?redirect="+r.URL.Path, http.StatusSeeOther)
+				return
+			}
+
+			if !user.Can(permission) {
+				log.Printf("User %s (%s) denied %s: missing %s permission", user.Username, user.Role, r.URL.Path, permission)
+				http.Error(w, "You do not have permission to do this", http.StatusForbidden)
+				return
+			}
+
+			if user.NeedsTwoFactor() {
+				http.Redirect(w, r, "/account/two-factor", http.StatusSeeOther)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), "user", user)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// RequireAPIUser is AuthMiddleware for the API. It answers with a JSON error
+// rather than redirecting clients to the login page.
+func RequireAPIUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := sessionUser(r)
+		if !ok {
+			writeJSONError(w, http.StatusUnauthorized, "Authentication required")
 			return
 		}
 
-		// Add user to context
 		ctx := context.WithValue(r.Context(), "user", user)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// RequireAPIPermission is RequirePermission for the API. It answers with
+// JSON errors rather than redirecting clients to the login page.
+func RequireAPIPermission(permission models.Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := sessionUser(r)
+			if !ok {
+				writeJSONError(w, http.StatusUnauthorized, "Authentication required")
+				return
+			}
+
+			if !user.Can(permission) {
+				writeJSONError(w, http.StatusForbidden, "You do not have permission to do this")
+				return
+			}
+
+			if user.NeedsTwoFactor() {
+				writeJSONError(w, http.StatusForbidden, "Set up two-factor authentication to do this")
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), "user", user)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// sessionUser returns the user a request is made by, reusing the one an
+// earlier middleware found
+func sessionUser(r *http.Request) (models.User, bool) {
+	if user, ok := r.Context().Value("user").(models.User); ok {
+		return user, true
+	}
+
+	session, err := sessions.FromRequest(r)
+	if err != nil {
+		return models.User{}, false
+	}
+	return *session.User, true
+}
+
+// writeJSONError sends an error in the same shape as the API's responses
+func writeJSONError(w http.ResponseWriter, statusCode int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": false,
+		"error":   message,
+	})
+}
+
 // Custom response writer to capture status code
 type loggingResponseWriter struct {
 	http.ResponseWriter
@@ -113,3 +207,19 @@ func (lrw *loggingResponseWriter) WriteHeader(code int) {
 	lrw.statusCode = code
 	lrw.ResponseWriter.WriteHeader(code)
 }
+
+// Unwrap lets http.ResponseController reach the underlying writer, so
+// streaming handlers can flush and clear deadlines
+func (lrw *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return lrw.ResponseWriter
+}
+
+// Hijack hands the connection over to WebSocket handlers, which upgrade it
+// without writing a header through the response writer
+func (lrw *loggingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(lrw.ResponseWriter).Hijack()
+	if err == nil {
+		lrw.statusCode = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
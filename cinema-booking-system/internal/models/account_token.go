@@ -0,0 +1,35 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// TokenPurpose says what an account token can be used for
+type TokenPurpose string
+
+const (
+	// TokenVerifyEmail confirms the user receives email at their address
+	TokenVerifyEmail TokenPurpose = "verify_email"
+	// TokenResetPassword lets a user who forgot their password choose a new one
+	TokenResetPassword TokenPurpose = "reset_password"
+	// TokenTwoFactorLogin lets a user who entered their password finish
+	// logging in with a two-factor code
+	TokenTwoFactorLogin TokenPurpose = "two_factor_login"
+)
+
+// AccountToken is the secret in a link emailed to a user, such as to verify
+// their address or reset their password, or in the cookie of a login waiting
+// for its two-factor code. Only a hash of the token is stored, and each
+// token works once before it expires.
+type AccountToken struct {
+	gorm.Model
+	UserID    uint         `json:"user_id" gorm:"index"`
+	User      *User        `json:"user,omitempty"`
+	Purpose   TokenPurpose `json:"purpose" gorm:"index"`
+	Email     string       `json:"email"` // Address the link was sent to
+	TokenHash string       `json:"-" gorm:"uniqueIndex"`
+	ExpiresAt time.Time    `json:"expires_at"`
+	UsedAt    *time.Time   `json:"used_at,omitempty"`
+}
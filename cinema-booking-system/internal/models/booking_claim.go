@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// BookingClaim lets a user attach the bookings they made as a guest to their
+// account. The link to claim them is emailed to the account's address, which
+// proves the user receives email sent there. Only a hash of the link's token
+// is stored, and each link works once.
+type BookingClaim struct {
+	gorm.Model
+	UserID    uint       `json:"user_id" gorm:"index"`
+	Email     string     `json:"email"` // Address the link was sent to
+	TokenHash string     `json:"-" gorm:"uniqueIndex"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	ClaimedAt *time.Time `json:"claimed_at,omitempty"`
+}
@@ -0,0 +1,85 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/money"
+	"gorm.io/gorm"
+)
+
+// Who cancelled a booking
+const (
+	CancelledByCustomer = "customer"
+	CancelledByAdmin    = "admin"
+	CancelledByPartner  = "partner" // Through the API with a partner's key
+)
+
+// Cancellation records seats given back from a booking and the refund owed for them
+type Cancellation struct {
+	gorm.Model
+	BookingID     uint        `json:"booking_id" gorm:"index"`
+	SeatsJSON     string      `json:"-"` // Stored as JSON string in database
+	Seats         Seats       `json:"seats" gorm:"-"`
+	RefundAmount  money.Money `json:"refund_amount" gorm:"embedded;embeddedPrefix:refund_amount_"`
+	RefundPercent int         `json:"refund_percent"`
+	CancelledBy   string      `json:"cancelled_by"`
+	UserID        *uint       `json:"user_id,omitempty"`
+	APIKeyID      *uint       `json:"api_key_id,omitempty"`
+	Reason        string      `json:"reason,omitempty"`
+	// Provider reference of the refund, empty until the money has been returned
+	RefundReference string `json:"refund_reference,omitempty"`
+}
+
+// BeforeSave handles JSON marshaling of seats before saving to the database
+func (c *Cancellation) BeforeSave(tx *gorm.DB) error {
+	seatsData, err := json.Marshal(c.Seats)
+	if err != nil {
+		return err
+	}
+	c.SeatsJSON = string(seatsData)
+	return nil
+}
+
+// AfterFind handles JSON unmarshaling of seats after retrieving from the database
+func (c *Cancellation) AfterFind(tx *gorm.DB) error {
+	if c.SeatsJSON == "" {
+		return nil
+	}
+
+	return json.Unmarshal([]byte(c.SeatsJSON), &c.Seats)
+}
+
+// CancellationPolicy decides how much of a booking is refunded depending on
+// how close to the show it is cancelled
+type CancellationPolicy struct {
+	// Cancellations at least this long before the show are refunded in full
+	FullRefundBefore time.Duration
+	// Percentage refunded for later cancellations made before the show starts
+	PartialRefundPercent int
+}
+
+// DefaultCancellationPolicy refunds in full up to 24 hours before the show
+// and half after that until the show starts
+var DefaultCancellationPolicy = CancellationPolicy{
+	FullRefundBefore:     24 * time.Hour,
+	PartialRefundPercent: 50,
+}
+
+// RefundPercent returns the percentage of the price refunded for a
+// cancellation made at now for a show starting at showTime
+func (p CancellationPolicy) RefundPercent(showTime, now time.Time) int {
+	switch {
+	case !now.Before(showTime):
+		return 0
+	case showTime.Sub(now) >= p.FullRefundBefore:
+		return 100
+	default:
+		return p.PartialRefundPercent
+	}
+}
+
+// Refund returns the amount refunded on amount, rounded to the minor unit
+func (p CancellationPolicy) Refund(amount money.Money, showTime, now time.Time) money.Money {
+	return amount.Percent(float64(p.RefundPercent(showTime, now)))
+}
@@ -0,0 +1,219 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// Hall represents a cinema auditorium with its seat map
+type Hall struct {
+	gorm.Model
+	Number     int        `json:"number" gorm:"uniqueIndex"`
+	Name       string     `json:"name"`
+	LayoutJSON string     `json:"-"` // Stored as JSON string in database
+	Layout     SeatLayout `json:"layout" gorm:"-"`
+}
+
+// SeatLayout describes the physical arrangement of seats in a hall,
+// starting with the row closest to the screen
+type SeatLayout struct {
+	Rows []RowLayout `json:"rows"`
+}
+
+// RowLayout describes a single row of seats. Seats are numbered from 1 to
+// Seats; numbers listed in Missing do not exist and leave a gap in the row.
+// Every seat has the row's category unless SeatCategories says otherwise.
+type RowLayout struct {
+	Label          string               `json:"label"`
+	Seats          int                  `json:"seats"`
+	Offset         int                  `json:"offset,omitempty"`          // Empty positions before the first seat
+	Aisles         []int                `json:"aisles,omitempty"`          // Seat numbers followed by an aisle
+	Missing        []int                `json:"missing,omitempty"`         // Seat numbers that do not exist
+	Category       SeatCategory         `json:"category,omitempty"`        // Defaults to standard
+	SeatCategories map[int]SeatCategory `json:"seat_categories,omitempty"` // Categories of individual seats
+}
+
+// BeforeSave validates the layout and marshals it before saving to the database
+func (h *Hall) BeforeSave(tx *gorm.DB) error {
+	if h.Number <= 0 {
+		return errors.New("hall number must be positive")
+	}
+	if err := h.Layout.Validate(); err != nil {
+		return err
+	}
+
+	if h.Name == "" {
+		h.Name = fmt.Sprintf("Hall %d", h.Number)
+	}
+
+	layoutData, err := json.Marshal(h.Layout)
+	if err != nil {
+		return err
+	}
+	h.LayoutJSON = string(layoutData)
+	return nil
+}
+
+// AfterFind handles JSON unmarshaling of the layout after retrieving from the database
+func (h *Hall) AfterFind(tx *gorm.DB) error {
+	if h.LayoutJSON == "" {
+		return nil
+	}
+
+	return json.Unmarshal([]byte(h.LayoutJSON), &h.Layout)
+}
+
+// Validate checks that the layout describes at least one bookable seat and
+// that every row is internally consistent
+func (l SeatLayout) Validate() error {
+	if len(l.Rows) == 0 {
+		return errors.New("layout must have at least one row")
+	}
+
+	labels := make(map[string]bool)
+	capacity := 0
+	for _, row := range l.Rows {
+		if row.Label == "" {
+			return errors.New("every row must have a label")
+		}
+		// Seats are named by their row and number, so "A1" seat 1 and "A"
+		// seat 11 would both be A11
+		if last := row.Label[len(row.Label)-1]; last >= '0' && last <= '9' {
+			return fmt.Errorf("row label %s must not end in a digit", row.Label)
+		}
+		if labels[row.Label] {
+			return fmt.Errorf("row %s is defined more than once", row.Label)
+		}
+		labels[row.Label] = true
+
+		if row.Seats <= 0 {
+			return fmt.Errorf("row %s must have at least one seat", row.Label)
+		}
+		if row.Offset < 0 {
+			return fmt.Errorf("row %s has a negative offset", row.Label)
+		}
+		for _, n := range row.Aisles {
+			if n < 1 || n >= row.Seats {
+				return fmt.Errorf("row %s has an aisle after seat %d, which is outside the row", row.Label, n)
+			}
+		}
+		for _, n := range row.Missing {
+			if n < 1 || n > row.Seats {
+				return fmt.Errorf("row %s lists missing seat %d, which is outside the row", row.Label, n)
+			}
+		}
+		if row.Category != "" && !row.Category.Valid() {
+			return fmt.Errorf("row %s has unknown seat category %q", row.Label, row.Category)
+		}
+		for n, category := range row.SeatCategories {
+			if n < 1 || n > row.Seats {
+				return fmt.Errorf("row %s sets the category of seat %d, which is outside the row", row.Label, n)
+			}
+			if !category.Valid() {
+				return fmt.Errorf("row %s has unknown seat category %q", row.Label, category)
+			}
+		}
+
+		capacity += row.Capacity()
+	}
+
+	if capacity == 0 {
+		return errors.New("layout must have at least one seat")
+	}
+	return nil
+}
+
+// Row returns the row with the given label
+func (l SeatLayout) Row(label string) (RowLayout, bool) {
+	for _, row := range l.Rows {
+		if row.Label == label {
+			return row, true
+		}
+	}
+	return RowLayout{}, false
+}
+
+// HasSeat reports whether the seat physically exists in the layout
+func (l SeatLayout) HasSeat(seat Seat) bool {
+	row, ok := l.Row(seat.Row)
+	if !ok {
+		return false
+	}
+	return row.HasSeat(seat.Number)
+}
+
+// SeatCategory returns the category of a seat in the layout
+func (l SeatLayout) SeatCategory(seat Seat) SeatCategory {
+	row, _ := l.Row(seat.Row)
+	return row.SeatCategory(seat.Number)
+}
+
+// Capacity returns the number of bookable seats in the layout
+func (l SeatLayout) Capacity() int {
+	total := 0
+	for _, row := range l.Rows {
+		total += row.Capacity()
+	}
+	return total
+}
+
+// AllSeats returns every bookable seat in the layout, row by row
+func (l SeatLayout) AllSeats() Seats {
+	seats := make(Seats, 0, l.Capacity())
+	for _, row := range l.Rows {
+		for n := 1; n <= row.Seats; n++ {
+			if row.HasSeat(n) {
+				seats = append(seats, Seat{Row: row.Label, Number: n})
+			}
+		}
+	}
+	return seats
+}
+
+// HasSeat reports whether the seat number exists in the row
+func (r RowLayout) HasSeat(number int) bool {
+	if number < 1 || number > r.Seats {
+		return false
+	}
+	for _, n := range r.Missing {
+		if n == number {
+			return false
+		}
+	}
+	return true
+}
+
+// SeatCategory returns the category of the seat number in the row
+func (r RowLayout) SeatCategory(number int) SeatCategory {
+	if category, ok := r.SeatCategories[number]; ok {
+		return category
+	}
+	if r.Category != "" {
+		return r.Category
+	}
+	return SeatStandard
+}
+
+// Capacity returns the number of bookable seats in the row
+func (r RowLayout) Capacity() int {
+	count := 0
+	for n := 1; n <= r.Seats; n++ {
+		if r.HasSeat(n) {
+			count++
+		}
+	}
+	return count
+}
+
+// UniformLayout builds a rectangular layout with the given row labels and
+// the same number of seats in every row
+func UniformLayout(labels []string, seatsPerRow int) SeatLayout {
+	layout := SeatLayout{Rows: make([]RowLayout, 0, len(labels))}
+	for _, label := range labels {
+		layout.Rows = append(layout.Rows, RowLayout{Label: label, Seats: seatsPerRow})
+	}
+	return layout
+}
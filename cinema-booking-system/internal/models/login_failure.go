@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// LoginFailure is a wrong password entered for a username, which need not
+// belong to a user, from an IP address. Recent failures slow down and then
+// lock out further logins to the account and from the address.
+type LoginFailure struct {
+	gorm.Model
+	Username  string `json:"username" gorm:"index"`
+	IPAddress string `json:"ip_address" gorm:"index"`
+	// Set once the account logs in or is unlocked, after which the failure
+	// only counts against the address
+	ClearedAt *time.Time `json:"cleared_at,omitempty"`
+}
@@ -3,8 +3,13 @@ package models
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/JoeDkhar/cinema-booking-system/internal/money"
+	"github.com/JoeDkhar/cinema-booking-system/internal/utils"
 	"gorm.io/gorm"
 )
 
@@ -17,28 +22,76 @@ type Movie struct {
 	Genre       string `json:"genre"`
 	ImageURL    string `json:"image_url"`
 	Shows       []Show `json:"shows" gorm:"foreignKey:MovieID"`
+
+	// ReleaseDate marks the start of the movie's opening weekend
+	ReleaseDate *time.Time `json:"release_date,omitempty"`
 }
 
 // Show represents a specific screening of a movie
 type Show struct {
 	gorm.Model
-	MovieID     uint      `json:"movie_id"`
-	DateTime    time.Time `json:"date_time"`
-	HallNumber  int       `json:"hall_number"`
-	TotalSeats  int       `json:"total_seats"`
-	TicketPrice float64   `json:"ticket_price"`
-	Bookings    []Booking `json:"bookings" gorm:"foreignKey:ShowID"`
+	MovieID     uint        `json:"movie_id"`
+	Movie       *Movie      `json:"movie,omitempty"`
+	HallID      uint        `json:"hall_id"`
+	Hall        *Hall       `json:"hall,omitempty"`
+	DateTime    time.Time   `json:"date_time"`
+	TicketPrice money.Money `json:"ticket_price" gorm:"embedded;embeddedPrefix:ticket_price_"`
+	Bookings    []Booking   `json:"bookings" gorm:"foreignKey:ShowID"`
 }
 
-// Seat represents a specific seat in the cinema hall
+// Seat represents a specific seat in the cinema hall. TicketType is only
+// set on seats being booked and defaults to an adult ticket.
 type Seat struct {
-	Row    string `json:"row"`
-	Number int    `json:"number"`
+	Row        string     `json:"row"`
+	Number     int        `json:"number"`
+	TicketType TicketType `json:"ticket_type,omitempty"`
+}
+
+// String returns the seat label, e.g. "A12"
+func (s Seat) String() string {
+	return s.Row + strconv.Itoa(s.Number)
+}
+
+// ParseSeat parses a seat label such as "A12" into a Seat
+func ParseSeat(label string) (Seat, error) {
+	label = strings.TrimSpace(label)
+	split := strings.LastIndexFunc(label, func(r rune) bool {
+		return r < '0' || r > '9'
+	}) + 1
+
+	if split == 0 || split == len(label) {
+		return Seat{}, fmt.Errorf("invalid seat %q", label)
+	}
+
+	number, err := strconv.Atoi(label[split:])
+	if err != nil {
+		return Seat{}, fmt.Errorf("invalid seat %q", label)
+	}
+	return Seat{Row: label[:split], Number: number}, nil
 }
 
 // Seats represents a collection of seats
 type Seats []Seat
 
+// String returns the seat labels as a comma-separated list
+func (s Seats) String() string {
+	labels := make([]string, len(s))
+	for i, seat := range s {
+		labels[i] = seat.String()
+	}
+	return strings.Join(labels, ", ")
+}
+
+// Contains reports whether seat is one of the seats
+func (s Seats) Contains(seat Seat) bool {
+	for _, candidate := range s {
+		if candidate.Row == seat.Row && candidate.Number == seat.Number {
+			return true
+		}
+	}
+	return false
+}
+
 // MarshalJSON custom JSON marshaler for Seats
 func (s Seats) MarshalJSON() ([]byte, error) {
 	return json.Marshal([]Seat(s))
@@ -54,17 +107,76 @@ func (s *Seats) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// BookingStatus describes where a booking is in its lifecycle
+type BookingStatus string
+
+const (
+	// BookingHeld marks seats reserved for a customer until ExpiresAt
+	BookingHeld BookingStatus = "held"
+	// BookingConfirmed marks a completed booking
+	BookingConfirmed BookingStatus = "confirmed"
+	// BookingReleased marks a hold the customer gave up before checkout
+	BookingReleased BookingStatus = "released"
+	// BookingExpired marks a hold that was not checked out in time
+	BookingExpired BookingStatus = "expired"
+	// BookingCancelled marks a confirmed booking that was called off
+	BookingCancelled BookingStatus = "cancelled"
+)
+
 // Booking represents a ticket booking
 type Booking struct {
 	gorm.Model
-	ShowID       uint      `json:"show_id"`
-	CustomerName string    `json:"customer_name"`
-	Email        string    `json:"email"`
-	SeatsJSON    string    `json:"-"` // Stored as JSON string in database
-	Seats        Seats     `json:"seats" gorm:"-"`
-	BookingTime  time.Time `json:"booking_time"`
-	TotalAmount  float64   `json:"total_amount"`
-	Confirmed    bool      `json:"confirmed" gorm:"default:false"`
+	Reference    string      `json:"reference" gorm:"uniqueIndex"`
+	ShowID       uint        `json:"show_id"`
+	Show         *Show       `json:"show,omitempty"`
+	CustomerName string      `json:"customer_name"`
+	Email        string      `json:"email"`
+	UserID       *uint       `json:"user_id,omitempty" gorm:"index"`    // Account the booking belongs to, if any
+	APIKeyID     *uint       `json:"api_key_id,omitempty" gorm:"index"` // Partner's key the booking was made with, if any
+	SeatsJSON    string      `json:"-"`                                 // Stored as JSON string in database
+	Seats        Seats       `json:"seats" gorm:"-"`
+	BookingTime  time.Time   `json:"booking_time"`
+	TotalAmount  money.Money `json:"total_amount" gorm:"embedded;embeddedPrefix:total_amount_"`
+	Confirmed    bool        `json:"confirmed" gorm:"default:false"`
+
+	PricesJSON string     `json:"-"`                         // Stored as JSON string in database
+	Prices     SeatPrices `json:"prices,omitempty" gorm:"-"` // Price breakdown per seat
+	PromoCode  string     `json:"promo_code,omitempty"`      // Code whose discount is included in the prices
+
+	Status         BookingStatus `json:"status" gorm:"index"`
+	ExpiresAt      *time.Time    `json:"expires_at,omitempty"` // When a hold lapses
+	HoldExtensions int           `json:"-"`
+
+	RefundedAmount money.Money    `json:"refunded_amount" gorm:"embedded;embeddedPrefix:refunded_amount_"`
+	Cancellations  []Cancellation `json:"cancellations,omitempty" gorm:"foreignKey:BookingID"`
+	Payments       []Payment      `json:"payments,omitempty" gorm:"foreignKey:BookingID"`
+}
+
+// IsActiveHold reports whether the booking is a hold that has not yet lapsed
+func (b *Booking) IsActiveHold(now time.Time) bool {
+	return b.Status == BookingHeld && b.ExpiresAt != nil && now.Before(*b.ExpiresAt)
+}
+
+// BeforeCreate assigns the public booking reference
+func (b *Booking) BeforeCreate(tx *gorm.DB) error {
+	if b.Reference != "" {
+		return nil
+	}
+
+	// Collisions are astronomically unlikely, but cheap to rule out
+	for attempt := 0; attempt < 3; attempt++ {
+		reference := utils.GenerateBookingReference()
+
+		var count int64
+		if err := tx.Session(&gorm.Session{NewDB: true}).Model(&Booking{}).Where("reference = ?", reference).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			b.Reference = reference
+			return nil
+		}
+	}
+	return errors.New("could not generate a unique booking reference")
 }
 
 // BeforeSave handles JSON marshaling of seats before saving to the database
@@ -73,21 +185,48 @@ func (b *Booking) BeforeSave(tx *gorm.DB) error {
 		return errors.New("booking must have at least one seat")
 	}
 
+	// Keep the legacy Confirmed flag in step with the status
+	if b.Status == "" {
+		if b.Confirmed {
+			b.Status = BookingConfirmed
+		} else {
+			b.Status = BookingHeld
+		}
+	}
+	b.Confirmed = b.Status == BookingConfirmed
+
 	seatsData, err := json.Marshal(b.Seats)
 	if err != nil {
 		return err
 	}
 	b.SeatsJSON = string(seatsData)
+
+	// Bookings made before seat pricing have no breakdown
+	b.PricesJSON = ""
+	if len(b.Prices) > 0 {
+		pricesData, err := json.Marshal(b.Prices)
+		if err != nil {
+			return err
+		}
+		b.PricesJSON = string(pricesData)
+	}
 	return nil
 }
 
-// AfterFind handles JSON unmarshaling of seats after retrieving from the database
+// AfterFind handles JSON unmarshaling of seats and prices after retrieving from the database
 func (b *Booking) AfterFind(tx *gorm.DB) error {
-	if b.SeatsJSON == "" {
-		return nil
+	if b.SeatsJSON != "" {
+		if err := json.Unmarshal([]byte(b.SeatsJSON), &b.Seats); err != nil {
+			return err
+		}
 	}
 
-	return json.Unmarshal([]byte(b.SeatsJSON), &b.Seats)
+	if b.PricesJSON != "" {
+		if err := json.Unmarshal([]byte(b.PricesJSON), &b.Prices); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // User represents a registered user of the system
@@ -96,6 +235,37 @@ type User struct {
 	Username     string `json:"username" gorm:"unique"`
 	Email        string `json:"email" gorm:"unique"`
 	PasswordHash string `json:"-"`
-	SessionToken string `json:"-"`
-	IsAdmin      bool   `json:"is_admin" gorm:"default:false"`
+	Role         Role   `json:"role" gorm:"default:customer;index"`
+
+	// EmailVerifiedAt is when the user proved they receive email at Email
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty"`
+
+	// TOTPSecret is shared with the user's authenticator app. It is set when
+	// they start setting up two-factor authentication, which is only on once
+	// TOTPEnabledAt is set.
+	TOTPSecret    string     `json:"-"`
+	TOTPEnabledAt *time.Time `json:"two_factor_enabled_at,omitempty"`
+	// TOTPLastStep is the period of the last code used, so no code works twice
+	TOTPLastStep int64 `json:"-"`
+}
+
+// EmailVerified reports whether the user has proved they own their email address
+func (u User) EmailVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+// TwoFactorEnabled reports whether logging in needs a code as well as the password
+func (u User) TwoFactorEnabled() bool {
+	return u.TOTPEnabledAt != nil
+}
+
+// NeedsTwoFactor reports whether the user's role requires two-factor
+// authentication they have not set up yet
+func (u User) NeedsTwoFactor() bool {
+	return u.Role.RequiresTwoFactor() && !u.TwoFactorEnabled()
+}
+
+// Can reports whether the user's role grants a permission
+func (u User) Can(permission Permission) bool {
+	return u.Role.Can(permission)
 }
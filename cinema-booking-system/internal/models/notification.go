@@ -0,0 +1,73 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// NotificationStatus represents where an email is in the outbox
+type NotificationStatus string
+
+const (
+	// NotificationPending is waiting to be sent or retried
+	NotificationPending NotificationStatus = "pending"
+	// NotificationSent was accepted by the mail server
+	NotificationSent NotificationStatus = "sent"
+	// NotificationFailed gave up after too many attempts
+	NotificationFailed NotificationStatus = "failed"
+)
+
+// Notification is an email in the outbox. Emails are stored before they are
+// sent so they survive restarts and failed deliveries can be retried.
+type Notification struct {
+	gorm.Model
+	Kind      string `json:"kind" gorm:"index"`
+	BookingID *uint  `json:"booking_id,omitempty" gorm:"index"`
+	// Identifies the event the email is about, so the same email is never
+	// queued twice
+	DedupeKey string `json:"-" gorm:"uniqueIndex"`
+
+	Recipient string `json:"recipient"`
+	Subject   string `json:"subject"`
+	TextBody  string `json:"-"`
+	HTMLBody  string `json:"-"`
+
+	AttachmentsJSON string                   `json:"-"` // Stored as JSON string in database
+	Attachments     []NotificationAttachment `json:"-" gorm:"-"`
+
+	Status        NotificationStatus `json:"status" gorm:"index"`
+	Attempts      int                `json:"attempts"`
+	NextAttemptAt time.Time          `json:"next_attempt_at" gorm:"index"`
+	LastError     string             `json:"last_error,omitempty"`
+	SentAt        *time.Time         `json:"sent_at,omitempty"`
+}
+
+// NotificationAttachment is a file sent along with an email
+type NotificationAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Data        []byte `json:"data"`
+}
+
+// BeforeSave handles JSON marshaling of attachments before saving to the database
+func (n *Notification) BeforeSave(tx *gorm.DB) error {
+	n.AttachmentsJSON = ""
+	if len(n.Attachments) > 0 {
+		data, err := json.Marshal(n.Attachments)
+		if err != nil {
+			return err
+		}
+		n.AttachmentsJSON = string(data)
+	}
+	return nil
+}
+
+// AfterFind handles JSON unmarshaling of attachments after retrieving from the database
+func (n *Notification) AfterFind(tx *gorm.DB) error {
+	if n.AttachmentsJSON == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(n.AttachmentsJSON), &n.Attachments)
+}
@@ -0,0 +1,52 @@
+package models
+
+import (
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/money"
+	"gorm.io/gorm"
+)
+
+// PaymentStatus tracks a payment through the provider
+type PaymentStatus string
+
+const (
+	// PaymentPending is recorded before the provider is contacted
+	PaymentPending PaymentStatus = "pending"
+	// PaymentAuthorized has money reserved but not yet collected
+	PaymentAuthorized PaymentStatus = "authorized"
+	// PaymentCaptured has money collected for a confirmed booking
+	PaymentCaptured PaymentStatus = "captured"
+	// PaymentDeclined was refused by the provider
+	PaymentDeclined PaymentStatus = "declined"
+	// PaymentFailed could not be completed, for example because the provider timed out
+	PaymentFailed PaymentStatus = "failed"
+	// PaymentVoided had its authorization released without collecting money
+	PaymentVoided PaymentStatus = "voided"
+	// PaymentRefunded has had all collected money returned
+	PaymentRefunded PaymentStatus = "refunded"
+)
+
+// Payment records an attempt to pay for a booking. The idempotency key makes
+// repeated checkout submissions charge the customer only once.
+type Payment struct {
+	gorm.Model
+	BookingID      uint          `json:"booking_id" gorm:"index"`
+	Provider       string        `json:"provider"`
+	TransactionID  string        `json:"-"`
+	IdempotencyKey string        `json:"-" gorm:"uniqueIndex"`
+	Amount         money.Money   `json:"amount" gorm:"embedded;embeddedPrefix:amount_"`
+	RefundedAmount money.Money   `json:"refunded_amount" gorm:"embedded;embeddedPrefix:refunded_amount_"`
+	Status         PaymentStatus `json:"status"`
+	FailureCode    string        `json:"failure_code,omitempty"`
+	FailureMessage string        `json:"failure_message,omitempty"`
+	CapturedAt     *time.Time    `json:"captured_at,omitempty"`
+}
+
+// Refundable returns how much of the payment can still be refunded
+func (p Payment) Refundable() money.Money {
+	if p.Status != PaymentCaptured {
+		return money.New(0, p.Amount.Currency)
+	}
+	return p.Amount.Sub(p.RefundedAmount)
+}
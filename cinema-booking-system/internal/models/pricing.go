@@ -0,0 +1,135 @@
+package models
+
+import (
+	"strings"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/money"
+)
+
+// SeatCategory is the kind of seat, which affects its price
+type SeatCategory string
+
+const (
+	SeatStandard            SeatCategory = "standard"
+	SeatPremium             SeatCategory = "premium"
+	SeatRecliner            SeatCategory = "recliner"
+	SeatWheelchairCompanion SeatCategory = "wheelchair_companion"
+)
+
+// SeatCategories lists every seat category, cheapest first
+var SeatCategories = []SeatCategory{SeatWheelchairCompanion, SeatStandard, SeatPremium, SeatRecliner}
+
+// Valid reports whether the category is known
+func (c SeatCategory) Valid() bool {
+	for _, category := range SeatCategories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// Label returns the category's display name
+func (c SeatCategory) Label() string {
+	return displayName(string(c))
+}
+
+// TicketType is the kind of ticket bought for a seat, such as a child ticket
+type TicketType string
+
+const (
+	TicketAdult   TicketType = "adult"
+	TicketChild   TicketType = "child"
+	TicketSenior  TicketType = "senior"
+	TicketStudent TicketType = "student"
+)
+
+// TicketTypes lists every ticket type
+var TicketTypes = []TicketType{TicketAdult, TicketChild, TicketSenior, TicketStudent}
+
+// Valid reports whether the ticket type is known
+func (t TicketType) Valid() bool {
+	for _, ticketType := range TicketTypes {
+		if t == ticketType {
+			return true
+		}
+	}
+	return false
+}
+
+// Label returns the ticket type's display name
+func (t TicketType) Label() string {
+	return displayName(string(t))
+}
+
+// PriceAdjustment is the effect of one pricing rule on a seat's price
+type PriceAdjustment struct {
+	Rule   string      `json:"rule"`
+	Amount money.Money `json:"amount"`
+	Promo  bool        `json:"promo,omitempty"` // Share of a promo code discount
+}
+
+// SeatPrice is the price charged for one seat and how it was worked out
+type SeatPrice struct {
+	Seat        Seat              `json:"seat"`
+	Category    SeatCategory      `json:"category"`
+	TicketType  TicketType        `json:"ticket_type"`
+	BasePrice   money.Money       `json:"base_price"`
+	Adjustments []PriceAdjustment `json:"adjustments,omitempty"`
+	Price       money.Money       `json:"price"`
+	Tax         money.Money       `json:"tax"` // Share of the booking's tax included in Price
+}
+
+// SeatPrices is the price breakdown of a booking
+type SeatPrices []SeatPrice
+
+// Total returns the sum of the seat prices
+func (p SeatPrices) Total() money.Money {
+	var total money.Money
+	for _, price := range p {
+		total = total.Add(price.Price)
+	}
+	return total
+}
+
+// Discount returns how much promo code discounts took off the seat prices
+func (p SeatPrices) Discount() money.Money {
+	var discount money.Money
+	for _, price := range p {
+		for _, adjustment := range price.Adjustments {
+			if adjustment.Promo {
+				discount = discount.Sub(adjustment.Amount)
+			}
+		}
+	}
+	return discount
+}
+
+// Tax returns how much tax the seat prices include
+func (p SeatPrices) Tax() money.Money {
+	var tax money.Money
+	for _, price := range p {
+		tax = tax.Add(price.Tax)
+	}
+	return tax
+}
+
+// For returns the price of a seat
+func (p SeatPrices) For(seat Seat) (SeatPrice, bool) {
+	for _, price := range p {
+		if price.Seat.String() == seat.String() {
+			return price, true
+		}
+	}
+	return SeatPrice{}, false
+}
+
+// displayName turns an identifier such as "wheelchair_companion" into
+// "Wheelchair companion"
+func displayName(name string) string {
+	name = strings.ReplaceAll(name, "_", " ")
+	if name == "" {
+		return name
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+}
@@ -0,0 +1,191 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/money"
+	"gorm.io/gorm"
+)
+
+// DiscountType is how a promo code reduces the price of a booking
+type DiscountType string
+
+const (
+	// DiscountPercent takes a percentage off the booking total
+	DiscountPercent DiscountType = "percent"
+	// DiscountFixed takes a fixed amount off the booking total
+	DiscountFixed DiscountType = "fixed"
+)
+
+var promoCodePattern = regexp.MustCompile(`^[A-Z0-9][A-Z0-9_-]{2,31}$`)
+
+// PromoCode is a discount customers can apply when booking. Restrictions
+// that are left empty do not apply, and usage limits of 0 are unlimited.
+type PromoCode struct {
+	gorm.Model
+	Code        string       `json:"code" gorm:"uniqueIndex"`
+	Description string       `json:"description"`
+	Type        DiscountType `json:"type"`
+	Percent     float64      `json:"percent,omitempty"`                             // For percentage discounts
+	Amount      money.Money  `json:"amount" gorm:"embedded;embeddedPrefix:amount_"` // For fixed discounts
+
+	// Restrictions on the shows the code can be used for
+	MovieID  *uint          `json:"movie_id,omitempty"`
+	Movie    *Movie         `json:"movie,omitempty"`
+	ShowID   *uint          `json:"show_id,omitempty"`
+	DaysJSON string         `json:"-"`                       // Stored as JSON string in database
+	Days     []time.Weekday `json:"days,omitempty" gorm:"-"` // Days of the week the show must be on
+	MinSeats int            `json:"min_seats,omitempty"`
+
+	// When the code can be redeemed
+	ValidFrom  *time.Time `json:"valid_from,omitempty"`
+	ValidUntil *time.Time `json:"valid_until,omitempty"`
+	Disabled   bool       `json:"disabled"`
+
+	// Usage limits and the number of bookings currently using the code
+	MaxUses         int `json:"max_uses,omitempty"`
+	MaxUsesPerEmail int `json:"max_uses_per_email,omitempty"`
+	Uses            int `json:"uses"`
+}
+
+// PromoRedemption records a promo code used for a booking. Redemptions of
+// holds that lapse or are released are deleted, giving the use back.
+type PromoRedemption struct {
+	gorm.Model
+	PromoCodeID uint        `json:"promo_code_id" gorm:"index"`
+	BookingID   uint        `json:"booking_id" gorm:"index"`
+	Email       string      `json:"email" gorm:"index"` // Lower case
+	Discount    money.Money `json:"discount" gorm:"embedded;embeddedPrefix:discount_"`
+}
+
+// NormalizePromoCode returns a promo code as it is stored, so codes can be
+// typed in any case
+func NormalizePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// BeforeSave handles JSON marshaling of the days before saving to the database
+func (p *PromoCode) BeforeSave(tx *gorm.DB) error {
+	p.DaysJSON = ""
+	if len(p.Days) == 0 {
+		return nil
+	}
+
+	daysData, err := json.Marshal(p.Days)
+	if err != nil {
+		return err
+	}
+	p.DaysJSON = string(daysData)
+	return nil
+}
+
+// AfterFind handles JSON unmarshaling of the days after retrieving from the database
+func (p *PromoCode) AfterFind(tx *gorm.DB) error {
+	if p.DaysJSON == "" {
+		return nil
+	}
+
+	return json.Unmarshal([]byte(p.DaysJSON), &p.Days)
+}
+
+// Validate checks that an admin-entered promo code makes sense
+func (p *PromoCode) Validate() error {
+	if !promoCodePattern.MatchString(p.Code) {
+		return errors.New("codes must be 3 to 32 letters, digits, dashes or underscores")
+	}
+
+	switch p.Type {
+	case DiscountPercent:
+		if p.Percent <= 0 || p.Percent > 100 {
+			return errors.New("percentage must be above 0 and at most 100")
+		}
+	case DiscountFixed:
+		if !p.Amount.IsPositive() {
+			return errors.New("amount must be positive")
+		}
+	default:
+		return fmt.Errorf("unknown discount type %q", p.Type)
+	}
+
+	if p.MinSeats < 0 || p.MaxUses < 0 || p.MaxUsesPerEmail < 0 {
+		return errors.New("limits cannot be negative")
+	}
+	if p.ValidFrom != nil && p.ValidUntil != nil && !p.ValidUntil.After(*p.ValidFrom) {
+		return errors.New("the code must stop being valid after it starts")
+	}
+	return nil
+}
+
+// Check returns why the code cannot be used to book seats for a show at
+// now, or nil if it can. Usage limits are checked when the code is redeemed.
+func (p *PromoCode) Check(show Show, seats int, now time.Time) error {
+	if p.Disabled {
+		return errors.New("this promo code is no longer available")
+	}
+	if p.ValidFrom != nil && now.Before(*p.ValidFrom) {
+		return errors.New("this promo code is not valid yet")
+	}
+	if p.ValidUntil != nil && !now.Before(*p.ValidUntil) {
+		return errors.New("this promo code has expired")
+	}
+
+	if p.MovieID != nil && *p.MovieID != show.MovieID {
+		return errors.New("this promo code is not valid for this movie")
+	}
+	if p.ShowID != nil && *p.ShowID != show.ID {
+		return errors.New("this promo code is not valid for this show")
+	}
+	if !p.ValidOn(show.DateTime.Weekday()) {
+		return fmt.Errorf("this promo code is not valid for shows on a %s", show.DateTime.Weekday())
+	}
+	if seats < p.MinSeats {
+		return fmt.Errorf("this promo code needs at least %d seats", p.MinSeats)
+	}
+	if p.Type == DiscountFixed && p.Amount.Currency != show.TicketPrice.Currency {
+		return fmt.Errorf("this promo code cannot be used for prices in %s", show.TicketPrice.Currency)
+	}
+	return nil
+}
+
+// ValidOn reports whether the code can be used for shows on a day of the week
+func (p *PromoCode) ValidOn(day time.Weekday) bool {
+	if len(p.Days) == 0 {
+		return true
+	}
+	for _, d := range p.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// Discount returns how much the code takes off a booking total, which is
+// never more than the total itself
+func (p *PromoCode) Discount(total money.Money) money.Money {
+	var discount money.Money
+	switch p.Type {
+	case DiscountPercent:
+		discount = total.Percent(p.Percent)
+	case DiscountFixed:
+		discount = p.Amount
+	}
+
+	if discount.Cmp(total) > 0 {
+		return total
+	}
+	return discount
+}
+
+// Label describes the discount, such as "20% off"
+func (p *PromoCode) Label() string {
+	if p.Type == DiscountFixed {
+		return p.Amount.String() + " off"
+	}
+	return strings.TrimSuffix(strings.TrimRight(fmt.Sprintf("%.2f", p.Percent), "0"), ".") + "% off"
+}
@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RecoveryCode lets a user with two-factor authentication log in without
+// their authenticator app. Only a hash of the code is stored, and each code
+// works once.
+type RecoveryCode struct {
+	gorm.Model
+	UserID   uint       `json:"user_id" gorm:"index"`
+	CodeHash string     `json:"-" gorm:"uniqueIndex"`
+	UsedAt   *time.Time `json:"used_at,omitempty"`
+}
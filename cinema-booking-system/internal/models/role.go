@@ -0,0 +1,83 @@
+package models
+
+// Role decides what a user may do in the back office
+type Role string
+
+const (
+	// RoleCustomer books tickets and has no back office access
+	RoleCustomer Role = "customer"
+	// RoleBoxOffice sells tickets at the counter and checks them in at the door
+	RoleBoxOffice Role = "box_office"
+	// RoleScheduler looks after movies and show times
+	RoleScheduler Role = "scheduler"
+	// RoleManager runs the cinema: bookings, schedule, halls and promotions
+	RoleManager Role = "manager"
+	// RoleAdmin may do everything, including assigning roles
+	RoleAdmin Role = "admin"
+)
+
+// Roles lists every role, least privileged first
+var Roles = []Role{RoleCustomer, RoleBoxOffice, RoleScheduler, RoleManager, RoleAdmin}
+
+// Permission is something a role may be allowed to do
+type Permission string
+
+const (
+	PermViewDashboard  Permission = "view_dashboard"
+	PermManageBookings Permission = "manage_bookings" // See and cancel any booking
+	PermCheckIn        Permission = "check_in"
+	PermManageSchedule Permission = "manage_schedule" // Movies and shows
+	PermManageHalls    Permission = "manage_halls"
+	PermManagePromos   Permission = "manage_promos"
+	PermManageUsers    Permission = "manage_users"
+	PermManageAPIKeys  Permission = "manage_api_keys" // Issue and revoke partners' keys
+)
+
+// rolePermissions lists what each role other than admin may do
+var rolePermissions = map[Role][]Permission{
+	RoleBoxOffice: {PermViewDashboard, PermManageBookings, PermCheckIn},
+	RoleScheduler: {PermViewDashboard, PermManageSchedule},
+	RoleManager: {
+		PermViewDashboard, PermManageBookings, PermCheckIn,
+		PermManageSchedule, PermManageHalls, PermManagePromos,
+	},
+}
+
+// Valid reports whether the role is known
+func (r Role) Valid() bool {
+	for _, role := range Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Label returns the role's display name
+func (r Role) Label() string {
+	return displayName(string(r))
+}
+
+// Can reports whether the role grants a permission
+func (r Role) Can(permission Permission) bool {
+	if r == RoleAdmin {
+		return true
+	}
+	for _, granted := range rolePermissions[r] {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// IsStaff reports whether the role has any back office access
+func (r Role) IsStaff() bool {
+	return r.Can(PermViewDashboard)
+}
+
+// RequiresTwoFactor reports whether users with the role must use two-factor
+// authentication, as staff can see every customer's bookings
+func (r Role) RequiresTwoFactor() bool {
+	return r.IsStaff()
+}
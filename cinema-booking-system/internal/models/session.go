@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Session is a user logged in on one device. Only a hash of the token in
+// the session cookie is stored, so a leaked database cannot be used to log in.
+type Session struct {
+	gorm.Model
+	UserID     uint      `json:"user_id" gorm:"index"`
+	User       *User     `json:"user,omitempty"`
+	TokenHash  string    `json:"-" gorm:"uniqueIndex"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at" gorm:"index"` // Ends the session however active it is
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+}
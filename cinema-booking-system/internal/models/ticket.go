@@ -0,0 +1,32 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// TicketStatus tracks a ticket from issue to the door
+type TicketStatus string
+
+const (
+	// TicketIssued is valid for entry
+	TicketIssued TicketStatus = "issued"
+	// TicketAdmitted has been scanned at the door and cannot be used again
+	TicketAdmitted TicketStatus = "admitted"
+	// TicketVoid was cancelled along with its seat
+	TicketVoid TicketStatus = "void"
+)
+
+// Ticket admits one person to one seat of a confirmed booking. The token is
+// what the ticket's QR code carries.
+type Ticket struct {
+	gorm.Model
+	BookingID  uint         `json:"booking_id" gorm:"uniqueIndex:idx_ticket_booking_seat"`
+	ShowID     uint         `json:"show_id" gorm:"index"`
+	Seat       string       `json:"seat" gorm:"uniqueIndex:idx_ticket_booking_seat"`
+	Token      string       `json:"-"`
+	Status     TicketStatus `json:"status" gorm:"index"`
+	AdmittedAt *time.Time   `json:"admitted_at,omitempty"`
+	AdmittedBy *uint        `json:"admitted_by,omitempty"` // Staff member who scanned the ticket
+}
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// WaitlistStatus tracks a waitlist entry from joining to getting seats
+type WaitlistStatus string
+
+const (
+	// WaitlistWaiting is in line for seats
+	WaitlistWaiting WaitlistStatus = "waiting"
+	// WaitlistOffered has seats held for it until the offer lapses
+	WaitlistOffered WaitlistStatus = "offered"
+	// WaitlistClaimed took up its offer and booked the seats
+	WaitlistClaimed WaitlistStatus = "claimed"
+	// WaitlistExpired let its offer lapse or turned it down
+	WaitlistExpired WaitlistStatus = "expired"
+	// WaitlistLeft was withdrawn by the customer
+	WaitlistLeft WaitlistStatus = "left"
+)
+
+// WaitlistEntry is a customer waiting for seats of a sold-out show. When
+// enough seats are freed they are held for the customer, who is sent a link
+// to claim them.
+type WaitlistEntry struct {
+	gorm.Model
+	ShowID       uint           `json:"show_id" gorm:"index"`
+	Show         *Show          `json:"show,omitempty"`
+	CustomerName string         `json:"customer_name"`
+	Email        string         `json:"email"`
+	SeatCount    int            `json:"seat_count"`
+	Token        string         `json:"-" gorm:"uniqueIndex"` // Secret in the customer's waitlist links
+	Status       WaitlistStatus `json:"status" gorm:"index"`
+	BookingID    *uint          `json:"booking_id,omitempty"` // Hold offered to the customer
+	OfferedAt    *time.Time     `json:"offered_at,omitempty"`
+}
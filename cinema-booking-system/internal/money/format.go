@@ -0,0 +1,98 @@
+package money
+
+import (
+	"strconv"
+	"strings"
+)
+
+// DefaultLocale is used by String and by templates
+var DefaultLocale = "en-US"
+
+// Currency describes how amounts in a currency are written
+type Currency struct {
+	Code     string
+	Exponent int    // Number of minor unit digits, 2 for cents
+	Symbol   string // Symbol shown next to amounts
+}
+
+// currencies lists the currencies with known symbols and minor units
+var currencies = map[string]Currency{
+	"AUD": {Code: "AUD", Exponent: 2, Symbol: "A$"},
+	"CAD": {Code: "CAD", Exponent: 2, Symbol: "CA$"},
+	"CHF": {Code: "CHF", Exponent: 2, Symbol: "CHF"},
+	"EUR": {Code: "EUR", Exponent: 2, Symbol: "€"},
+	"GBP": {Code: "GBP", Exponent: 2, Symbol: "£"},
+	"INR": {Code: "INR", Exponent: 2, Symbol: "₹"},
+	"JPY": {Code: "JPY", Exponent: 0, Symbol: "¥"},
+	"USD": {Code: "USD", Exponent: 2, Symbol: "$"},
+}
+
+// Lookup returns the currency with the given code. Unknown currencies have
+// two decimal places and are written with their code.
+func Lookup(code string) Currency {
+	if currency, ok := currencies[strings.ToUpper(code)]; ok {
+		return currency
+	}
+	return Currency{Code: code, Exponent: 2, Symbol: code}
+}
+
+// numberFormat describes how a locale writes amounts
+type numberFormat struct {
+	decimal     string
+	group       string
+	symbolAfter bool // "12,50 €" rather than "€12.50"
+}
+
+// locales lists the supported locales; others fall back to en-US
+var locales = map[string]numberFormat{
+	"en-US": {decimal: ".", group: ","},
+	"en-GB": {decimal: ".", group: ","},
+	"ja-JP": {decimal: ".", group: ","},
+	"de-DE": {decimal: ",", group: ".", symbolAfter: true},
+	"es-ES": {decimal: ",", group: ".", symbolAfter: true},
+	"fr-FR": {decimal: ",", group: " ", symbolAfter: true},
+	"it-IT": {decimal: ",", group: ".", symbolAfter: true},
+	"nl-NL": {decimal: ",", group: ".", symbolAfter: true},
+}
+
+// Format writes the amount the way the locale does, e.g. "$1,234.50" for
+// en-US or "1.234,50 €" for de-DE
+func (m Money) Format(locale string) string {
+	format, ok := locales[locale]
+	if !ok {
+		format = locales["en-US"]
+	}
+	currency := Lookup(m.currency())
+
+	amount := abs(m.Amount)
+	digits := strconv.FormatInt(amount, 10)
+	if len(digits) <= currency.Exponent {
+		digits = strings.Repeat("0", currency.Exponent-len(digits)+1) + digits
+	}
+	whole := digits[:len(digits)-currency.Exponent]
+	fraction := digits[len(digits)-currency.Exponent:]
+
+	// Group the whole part in thousands
+	var grouped strings.Builder
+	for i, digit := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			grouped.WriteString(format.group)
+		}
+		grouped.WriteRune(digit)
+	}
+
+	number := grouped.String()
+	if fraction != "" {
+		number += format.decimal + fraction
+	}
+
+	sign := ""
+	if m.Amount < 0 {
+		sign = "-"
+	}
+
+	if format.symbolAfter {
+		return sign + number + " " + currency.Symbol
+	}
+	return sign + currency.Symbol + number
+}
@@ -0,0 +1,295 @@
+package money
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// DefaultCurrency is used for amounts that do not name a currency
+var DefaultCurrency = "USD"
+
+// ErrCurrencyMismatch is returned when amounts in different currencies
+// would be added up or compared
+var ErrCurrencyMismatch = errors.New("amounts are in different currencies")
+
+// Money is an amount in the minor unit of its currency, such as cents.
+// The zero value is zero in any currency.
+type Money struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// New returns an amount of minor units in the given currency
+func New(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: strings.ToUpper(currency)}
+}
+
+// FromMajor converts an amount in major units, such as dollars, rounding
+// half away from zero to the nearest minor unit. It is meant for reading
+// amounts stored as floats; new amounts should come from New or Parse.
+func FromMajor(amount float64, currency string) Money {
+	currency = strings.ToUpper(currency)
+	scale := math.Pow10(Lookup(currency).Exponent)
+	return Money{Amount: int64(math.Round(amount * scale)), Currency: currency}
+}
+
+// Parse reads a decimal amount in major units such as "12.50" without
+// going through floating point
+func Parse(value, currency string) (Money, error) {
+	currency = strings.ToUpper(currency)
+	exponent := Lookup(currency).Exponent
+
+	value = strings.TrimSpace(value)
+	negative := strings.HasPrefix(value, "-")
+	value = strings.TrimPrefix(value, "-")
+
+	whole, fraction, hasFraction := strings.Cut(value, ".")
+	if whole == "" || (hasFraction && fraction == "") {
+		return Money{}, fmt.Errorf("invalid amount %q", value)
+	}
+	if len(fraction) > exponent {
+		return Money{}, fmt.Errorf("amount %q has more than %d decimal places", value, exponent)
+	}
+	fraction += strings.Repeat("0", exponent-len(fraction))
+
+	amount, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil || strings.ContainsAny(whole+fraction, "+-") {
+		return Money{}, fmt.Errorf("invalid amount %q", value)
+	}
+	if negative {
+		amount = -amount
+	}
+	return Money{Amount: amount, Currency: currency}, nil
+}
+
+// Major returns the amount in major units. It is meant for display and
+// client-side arithmetic only.
+func (m Money) Major() float64 {
+	return float64(m.Amount) / math.Pow10(Lookup(m.currency()).Exponent)
+}
+
+// Decimal returns the amount in major units without a currency symbol, such
+// as "1234.50", in the form Parse reads
+func (m Money) Decimal() string {
+	exponent := Lookup(m.currency()).Exponent
+	digits := strconv.FormatInt(abs(m.Amount), 10)
+	if len(digits) <= exponent {
+		digits = strings.Repeat("0", exponent-len(digits)+1) + digits
+	}
+
+	decimal := digits[:len(digits)-exponent]
+	if exponent > 0 {
+		decimal += "." + digits[len(digits)-exponent:]
+	}
+	if m.Amount < 0 {
+		decimal = "-" + decimal
+	}
+	return decimal
+}
+
+// Add returns the sum of two amounts in the same currency
+func (m Money) Add(other Money) Money {
+	currency := m.mustMatch(other)
+	return Money{Amount: m.Amount + other.Amount, Currency: currency}
+}
+
+// Sub returns the difference of two amounts in the same currency
+func (m Money) Sub(other Money) Money {
+	currency := m.mustMatch(other)
+	return Money{Amount: m.Amount - other.Amount, Currency: currency}
+}
+
+// Mul returns the amount multiplied by a whole number, e.g. a seat count
+func (m Money) Mul(n int64) Money {
+	return Money{Amount: m.Amount * n, Currency: m.Currency}
+}
+
+// Neg returns the amount with its sign flipped
+func (m Money) Neg() Money {
+	return Money{Amount: -m.Amount, Currency: m.Currency}
+}
+
+// Percent returns percent of the amount, rounded half away from zero to
+// the minor unit. Percentages are precise to two decimal places, so a
+// discount of 12.5% or a tax rate of 8.25% is applied exactly.
+func (m Money) Percent(percent float64) Money {
+	basisPoints := int64(math.Round(percent * 100))
+	return Money{Amount: divRound(m.Amount*basisPoints, 10000), Currency: m.Currency}
+}
+
+// TaxIncluded returns the tax contained in an amount that includes tax at
+// percent, such as the 20% VAT in a ticket price, rounded half away from
+// zero to the minor unit. Rates are precise to two decimal places, as with
+// Percent.
+func (m Money) TaxIncluded(percent float64) Money {
+	basisPoints := int64(math.Round(percent * 100))
+	return Money{Amount: divRound(m.Amount*basisPoints, 10000+basisPoints), Currency: m.Currency}
+}
+
+// Allocate splits the amount in proportion to the weights without losing or
+// inventing minor units; leftover units go to the first parts
+func (m Money) Allocate(weights ...int64) []Money {
+	var total int64
+	for _, weight := range weights {
+		total += weight
+	}
+
+	parts := make([]Money, len(weights))
+	if total == 0 {
+		for i := range parts {
+			parts[i] = Money{Currency: m.Currency}
+		}
+		return parts
+	}
+
+	remainder := m.Amount
+	for i, weight := range weights {
+		parts[i] = Money{Amount: m.Amount * weight / total, Currency: m.Currency}
+		remainder -= parts[i].Amount
+	}
+
+	step := int64(1)
+	if remainder < 0 {
+		step = -1
+	}
+	for i := 0; remainder != 0; i = (i + 1) % len(parts) {
+		if weights[i] == 0 {
+			continue
+		}
+		parts[i].Amount += step
+		remainder -= step
+	}
+	return parts
+}
+
+// Cmp compares two amounts in the same currency, returning -1, 0 or +1
+func (m Money) Cmp(other Money) int {
+	m.mustMatch(other)
+	switch {
+	case m.Amount < other.Amount:
+		return -1
+	case m.Amount > other.Amount:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// IsZero reports whether the amount is zero
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+// IsPositive reports whether the amount is above zero
+func (m Money) IsPositive() bool {
+	return m.Amount > 0
+}
+
+// IsNegative reports whether the amount is below zero
+func (m Money) IsNegative() bool {
+	return m.Amount < 0
+}
+
+// Sum adds up amounts in the same currency
+func Sum(amounts ...Money) Money {
+	var total Money
+	for _, amount := range amounts {
+		total = total.Add(amount)
+	}
+	return total
+}
+
+// CheckCurrency returns ErrCurrencyMismatch unless the amounts share a
+// currency, ignoring amounts without one. Amounts read from different
+// records, such as a booking and its payments, are checked with it before
+// they are added up or compared, as Add, Sub and Cmp panic on a mismatch.
+func CheckCurrency(amounts ...Money) error {
+	currency := ""
+	for _, amount := range amounts {
+		switch {
+		case amount.Currency == "":
+		case currency == "":
+			currency = amount.Currency
+		case amount.Currency != currency:
+			return fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, currency, amount.Currency)
+		}
+	}
+	return nil
+}
+
+// String formats the amount for the default locale
+func (m Money) String() string {
+	return m.Format(DefaultLocale)
+}
+
+// UnmarshalJSON reads an amount object. A bare number is read as major
+// units of the default currency, which is how amounts were stored before
+// they carried a currency.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] != '{' {
+		var major float64
+		if err := json.Unmarshal(data, &major); err != nil {
+			return errors.New("amount must be an object or a number")
+		}
+		*m = FromMajor(major, DefaultCurrency)
+		return nil
+	}
+
+	type plain Money
+	var value plain
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	*m = New(value.Amount, value.Currency)
+	return nil
+}
+
+// currency returns the amount's currency, falling back to the default
+func (m Money) currency() string {
+	if m.Currency == "" {
+		return DefaultCurrency
+	}
+	return m.Currency
+}
+
+// mustMatch returns the currency shared by both amounts. Amounts without a
+// currency take the other's; mixing currencies is a programming error, as
+// amounts from different records are checked with CheckCurrency first.
+func (m Money) mustMatch(other Money) string {
+	switch {
+	case m.Currency == "":
+		return other.Currency
+	case other.Currency == "" || other.Currency == m.Currency:
+		return m.Currency
+	default:
+		panic(fmt.Sprintf("money: mixing currencies %s and %s", m.Currency, other.Currency))
+	}
+}
+
+// divRound divides rounding half away from zero
+func divRound(numerator, denominator int64) int64 {
+	quotient := numerator / denominator
+	remainder := numerator % denominator
+	if 2*abs(remainder) >= denominator {
+		if numerator < 0 {
+			quotient--
+		} else {
+			quotient++
+		}
+	}
+	return quotient
+}
+
+// abs returns the absolute value of n
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
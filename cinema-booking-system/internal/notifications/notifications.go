@@ -0,0 +1,376 @@
+package notifications
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"net/textproto"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/utils"
+	"gorm.io/gorm/clause"
+)
+
+// Kind identifies which email is sent
+type Kind string
+
+const (
+	BookingConfirmed Kind = "booking_confirmed"
+	BookingCancelled Kind = "booking_cancelled"
+	ShowRescheduled  Kind = "show_rescheduled"
+	ShowReminder     Kind = "show_reminder"
+	WaitlistOffer    Kind = "waitlist_offer"
+
+	// Emails about a user's account rather than a booking
+	BookingsClaim Kind = "bookings_claim"
+	VerifyEmail   Kind = "verify_email"
+	PasswordReset Kind = "password_reset"
+)
+
+// Kinds lists every email about a booking the outbox can send
+var Kinds = []Kind{BookingConfirmed, BookingCancelled, ShowRescheduled, ShowReminder, WaitlistOffer}
+
+// AccountKinds lists every email about a user's account the outbox can send
+var AccountKinds = []Kind{BookingsClaim, VerifyEmail, PasswordReset}
+
+// BookingEmail is what the email templates are rendered with. The booking's
+// show, movie and hall must be loaded.
+type BookingEmail struct {
+	Booking models.Booking
+	// The cancellation a BookingCancelled email is about
+	Cancellation *models.Cancellation
+	// When the show was due to start before a ShowRescheduled email
+	PreviousTime time.Time
+	// The waitlist entry a WaitlistOffer email holds the booking's seats for
+	Waitlist *models.WaitlistEntry
+	// Files sent along with the email, such as the tickets
+	Attachments []models.NotificationAttachment
+	// Filled in by the outbox for links back to the site
+	BaseURL string
+}
+
+// AccountEmail is what the emails about a user's account are rendered with
+type AccountEmail struct {
+	User models.User
+	// Path of the link the email asks the user to follow, such as
+	// "/verify-email/<token>"
+	Link string
+	// When the link stops working
+	ExpiresAt time.Time
+	// How many guest bookings a BookingsClaim email offers to attach
+	Bookings int
+	// Filled in by the outbox for links back to the site
+	BaseURL string
+}
+
+//go:embed templates
+var templateFiles embed.FS
+
+var templateFuncs = map[string]interface{}{
+	"formatCurrency": utils.FormatCurrency,
+	"formatDateTime": utils.FormatDateTime,
+}
+
+var (
+	textTemplates = make(map[Kind]*texttemplate.Template)
+	htmlTemplates = make(map[Kind]*htmltemplate.Template)
+)
+
+// Every email has a plain text version, whose "subject" block is also the
+// email's subject, and an HTML version using the shared layout
+func init() {
+	for _, kind := range append(Kinds, AccountKinds...) {
+		name := string(kind)
+		textTemplates[kind] = texttemplate.Must(texttemplate.New(name+".txt").
+			Funcs(templateFuncs).ParseFS(templateFiles, "templates/"+name+".txt"))
+		htmlTemplates[kind] = htmltemplate.Must(htmltemplate.New("layout.html").
+			Funcs(templateFuncs).ParseFS(templateFiles, "templates/layout.html", "templates/"+name+".html"))
+	}
+}
+
+// Render returns the subject and both bodies of an email about a booking
+func Render(kind Kind, email BookingEmail) (Message, error) {
+	message, err := render(kind, email)
+	if err != nil {
+		return Message{}, err
+	}
+	message.To = email.Booking.Email
+	message.Attachments = email.Attachments
+	return message, nil
+}
+
+// RenderAccount returns the subject and both bodies of an email about a
+// user's account
+func RenderAccount(kind Kind, email AccountEmail) (Message, error) {
+	message, err := render(kind, email)
+	if err != nil {
+		return Message{}, err
+	}
+	message.To = email.User.Email
+	return message, nil
+}
+
+// render executes both templates of an email
+func render(kind Kind, data interface{}) (Message, error) {
+	textTmpl, ok := textTemplates[kind]
+	if !ok {
+		return Message{}, fmt.Errorf("unknown email kind %q", kind)
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := textTmpl.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return Message{}, err
+	}
+	if err := textTmpl.Execute(&text, data); err != nil {
+		return Message{}, err
+	}
+	if err := htmlTemplates[kind].Execute(&html, data); err != nil {
+		return Message{}, err
+	}
+
+	return Message{
+		Subject: subject.String(),
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
+
+// Outbox stores emails in the database and delivers them in the background,
+// retrying failed deliveries with an increasing delay
+type Outbox struct {
+	Transport Transport
+	// Base URL of the site used in links, without a trailing slash
+	BaseURL string
+	// How often delivery is attempted before an email is given up on
+	MaxAttempts int
+	// Delay before the first retry, doubling with every further attempt
+	RetryDelay time.Duration
+	// How often the outbox is checked for emails due for a retry
+	PollInterval time.Duration
+	// Bounds every delivery attempt
+	SendTimeout time.Duration
+
+	flushMutex sync.Mutex
+	wake       chan struct{}
+	stop       context.CancelFunc
+	done       chan struct{}
+}
+
+// NewOutbox creates an outbox delivering through transport
+func NewOutbox(transport Transport) *Outbox {
+	return &Outbox{
+		Transport:    transport,
+		BaseURL:      "http://localhost:8080",
+		MaxAttempts:  5,
+		RetryDelay:   time.Minute,
+		PollInterval: 30 * time.Second,
+		SendTimeout:  30 * time.Second,
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+// Enqueue renders an email about a booking and stores it for delivery.
+// Emails about an event that was already queued are ignored.
+func (o *Outbox) Enqueue(kind Kind, email BookingEmail) error {
+	key := dedupeKey(kind, email)
+
+	var count int64
+	database.DB.Model(&models.Notification{}).Where("dedupe_key = ?", key).Count(&count)
+	if count > 0 {
+		return nil
+	}
+
+	email.BaseURL = o.BaseURL
+	message, err := Render(kind, email)
+	if err != nil {
+		return fmt.Errorf("rendering %s email: %w", kind, err)
+	}
+
+	bookingID := email.Booking.ID
+	return o.store(kind, key, &bookingID, message)
+}
+
+// EnqueueAccount renders an email about a user's account and stores it for
+// delivery. key identifies the event the email is about, such as the claim
+// its link is for; emails whose key was already queued are ignored.
+func (o *Outbox) EnqueueAccount(kind Kind, key string, email AccountEmail) error {
+	email.BaseURL = o.BaseURL
+	message, err := RenderAccount(kind, email)
+	if err != nil {
+		return fmt.Errorf("rendering %s email: %w", kind, err)
+	}
+	return o.store(kind, fmt.Sprintf("%s:%s", kind, key), nil, message)
+}
+
+// store saves a rendered email to the outbox
+func (o *Outbox) store(kind Kind, key string, bookingID *uint, message Message) error {
+	notification := models.Notification{
+		Kind:          string(kind),
+		BookingID:     bookingID,
+		DedupeKey:     key,
+		Recipient:     message.To,
+		Subject:       message.Subject,
+		TextBody:      message.Text,
+		HTMLBody:      message.HTML,
+		Attachments:   message.Attachments,
+		Status:        models.NotificationPending,
+		NextAttemptAt: time.Now(),
+	}
+	result := database.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&notification)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected > 0 {
+		o.Wake()
+	}
+	return nil
+}
+
+// dedupeKey identifies the event an email is about. Reminders and
+// reschedules include the show time, so moving a show sends them again.
+func dedupeKey(kind Kind, email BookingEmail) string {
+	switch kind {
+	case BookingCancelled:
+		if email.Cancellation != nil {
+			return fmt.Sprintf("%s:%d", kind, email.Cancellation.ID)
+		}
+	case ShowRescheduled, ShowReminder:
+		if email.Booking.Show != nil {
+			return fmt.Sprintf("%s:%d:%d", kind, email.Booking.ID, email.Booking.Show.DateTime.Unix())
+		}
+	}
+	return fmt.Sprintf("%s:%d", kind, email.Booking.ID)
+}
+
+// Wake makes the background worker look for emails to send straight away
+func (o *Outbox) Wake() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start delivers queued emails in the background until Stop is called,
+// including any left over from before a restart
+func (o *Outbox) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	o.stop = cancel
+	o.done = make(chan struct{})
+
+	go func() {
+		defer close(o.done)
+
+		ticker := time.NewTicker(o.PollInterval)
+		defer ticker.Stop()
+
+		for {
+			o.Flush(ctx)
+
+			select {
+			case <-ticker.C:
+			case <-o.wake:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops background delivery, abandoning an attempt in progress
+func (o *Outbox) Stop() {
+	if o.stop == nil {
+		return
+	}
+	o.stop()
+	<-o.done
+}
+
+// Flush attempts delivery of every email that is due and returns how many
+// were sent
+func (o *Outbox) Flush(ctx context.Context) int {
+	o.flushMutex.Lock()
+	defer o.flushMutex.Unlock()
+
+	var due []models.Notification
+	database.DB.Where("status = ? AND next_attempt_at <= ?", models.NotificationPending, time.Now()).
+		Order("id").Limit(100).Find(&due)
+
+	sent := 0
+	for i := range due {
+		if ctx.Err() != nil {
+			break
+		}
+		if o.deliver(ctx, &due[i]) {
+			sent++
+		}
+	}
+	return sent
+}
+
+// deliver makes one attempt at sending an email and records the outcome
+func (o *Outbox) deliver(ctx context.Context, notification *models.Notification) bool {
+	sendCtx, cancel := context.WithTimeout(ctx, o.SendTimeout)
+	err := o.Transport.Send(sendCtx, Message{
+		To:          notification.Recipient,
+		Subject:     notification.Subject,
+		Text:        notification.TextBody,
+		HTML:        notification.HTMLBody,
+		Attachments: notification.Attachments,
+	})
+	cancel()
+
+	now := time.Now()
+	notification.Attempts++
+	if err == nil {
+		notification.Status = models.NotificationSent
+		notification.SentAt = &now
+		notification.LastError = ""
+	} else {
+		notification.LastError = err.Error()
+		if notification.Attempts >= o.MaxAttempts || isPermanent(err) {
+			notification.Status = models.NotificationFailed
+			log.Printf("Giving up on %s email %d to %s: %v", notification.Kind, notification.ID, notification.Recipient, err)
+		} else {
+			notification.NextAttemptAt = now.Add(o.RetryDelay << (notification.Attempts - 1))
+			log.Printf("Error sending %s email %d, retrying at %s: %v",
+				notification.Kind, notification.ID, notification.NextAttemptAt.Format(time.RFC3339), err)
+		}
+	}
+	// Account emails carry a link that logs the user in or resets their
+	// password, so it is not kept once the email is out of the outbox
+	if notification.Status != models.NotificationPending && isAccountKind(Kind(notification.Kind)) {
+		notification.TextBody = ""
+		notification.HTMLBody = ""
+	}
+
+	if err := database.DB.Save(notification).Error; err != nil {
+		log.Printf("Error saving email %d: %v", notification.ID, err)
+	}
+	return notification.Status == models.NotificationSent
+}
+
+// isAccountKind reports whether an email is about a user's account
+func isAccountKind(kind Kind) bool {
+	for _, accountKind := range AccountKinds {
+		if kind == accountKind {
+			return true
+		}
+	}
+	return false
+}
+
+// isPermanent reports whether the mail server rejected an email for good,
+// such as for an unknown mailbox, so retrying would not help
+func isPermanent(err error) bool {
+	var protoErr *textproto.Error
+	return errors.As(err, &protoErr) && protoErr.Code >= 500
+}
@@ -0,0 +1,229 @@
+package notifications
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+)
+
+// Message is an email with a plain text and an HTML version
+type Message struct {
+	To          string
+	Subject     string
+	Text        string
+	HTML        string
+	Attachments []models.NotificationAttachment
+}
+
+// Transport delivers emails
+type Transport interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// SMTPTransport delivers emails through an SMTP server. STARTTLS is used
+// when the server offers it, and port 465 connects with TLS from the start.
+type SMTPTransport struct {
+	Host     string
+	Port     int
+	Username string // Leave empty for servers that do not need to log in
+	Password string
+	From     mail.Address
+}
+
+// Send delivers msg, giving up when ctx is done
+func (t *SMTPTransport) Send(ctx context.Context, msg Message) error {
+	addr := net.JoinHostPort(t.Host, strconv.Itoa(t.Port))
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	// Abandon the conversation as soon as the context is done
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	tlsConfig := &tls.Config{ServerName: t.Host}
+	if t.Port == 465 {
+		conn = tls.Client(conn, tlsConfig)
+	}
+
+	client, err := smtp.NewClient(conn, t.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok && t.Port != 465 {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if t.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", t.Username, t.Password, t.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(t.From.Address); err != nil {
+		return err
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		return err
+	}
+
+	body, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if err := buildMessage(body, t.From, msg); err != nil {
+		body.Close()
+		return err
+	}
+	if err := body.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// buildMessage writes msg as a multipart/alternative MIME message, wrapped in
+// a multipart/mixed message when it has attachments
+func buildMessage(w io.Writer, from mail.Address, msg Message) error {
+	var body bytes.Buffer
+	alternative := multipart.NewWriter(&body)
+
+	// Plain text first, so clients prefer the HTML version when they can show it
+	for _, part := range []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	} {
+		writer, err := alternative.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return err
+		}
+		encoder := quotedprintable.NewWriter(writer)
+		if _, err := encoder.Write([]byte(part.body)); err != nil {
+			return err
+		}
+		if err := encoder.Close(); err != nil {
+			return err
+		}
+	}
+	if err := alternative.Close(); err != nil {
+		return err
+	}
+	contentType := "multipart/alternative; boundary=" + alternative.Boundary()
+
+	if len(msg.Attachments) > 0 {
+		var mixedBody bytes.Buffer
+		mixed := multipart.NewWriter(&mixedBody)
+
+		writer, err := mixed.CreatePart(textproto.MIMEHeader{"Content-Type": {contentType}})
+		if err != nil {
+			return err
+		}
+		if _, err := writer.Write(body.Bytes()); err != nil {
+			return err
+		}
+
+		for _, attachment := range msg.Attachments {
+			writer, err := mixed.CreatePart(textproto.MIMEHeader{
+				"Content-Type":              {mime.FormatMediaType(attachment.ContentType, map[string]string{"name": attachment.Filename})},
+				"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename})},
+				"Content-Transfer-Encoding": {"base64"},
+			})
+			if err != nil {
+				return err
+			}
+			if err := writeBase64Lines(writer, attachment.Data); err != nil {
+				return err
+			}
+		}
+		if err := mixed.Close(); err != nil {
+			return err
+		}
+
+		body = mixedBody
+		contentType = "multipart/mixed; boundary=" + mixed.Boundary()
+	}
+
+	var buf bytes.Buffer
+	headers := []struct{ key, value string }{
+		{"From", from.String()},
+		{"To", (&mail.Address{Address: msg.To}).String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", msg.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", messageID(from.Address)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", contentType},
+	}
+	for _, header := range headers {
+		fmt.Fprintf(&buf, "%s: %s\r\n", header.key, header.value)
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body.Bytes())
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// writeBase64Lines writes data base64 encoded in lines of 76 characters, as
+// MIME requires
+func writeBase64Lines(w io.Writer, data []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 0 {
+		n := min(76, len(encoded))
+		if _, err := io.WriteString(w, encoded[:n]+"\r\n"); err != nil {
+			return err
+		}
+		encoded = encoded[n:]
+	}
+	return nil
+}
+
+// messageID creates a unique Message-ID on the sender's domain
+func messageID(from string) string {
+	domain := "localhost"
+	if at := bytes.LastIndexByte([]byte(from), '@'); at >= 0 {
+		domain = from[at+1:]
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	return "<" + hex.EncodeToString(id) + "@" + domain + ">"
+}
+
+// LogTransport writes emails to the log instead of sending them, for
+// development without a mail server
+type LogTransport struct{}
+
+// Send logs msg
+func (LogTransport) Send(ctx context.Context, msg Message) error {
+	log.Printf("Email to %s: %s\n%s", msg.To, msg.Subject, msg.Text)
+	return nil
+}
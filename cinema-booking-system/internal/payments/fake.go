@@ -0,0 +1,201 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/money"
+)
+
+// Outcome scripts how the fake provider answers an authorization
+type Outcome int
+
+const (
+	// OutcomeApprove authorizes the payment
+	OutcomeApprove Outcome = iota
+	// OutcomeDecline refuses the payment
+	OutcomeDecline
+	// OutcomeTimeout blocks until the request's context is done
+	OutcomeTimeout
+	// OutcomeError fails with a provider error
+	OutcomeError
+)
+
+// Sandbox tokens the checkout form can send to the fake provider
+const (
+	TokenApprove = "tok_approve"
+	TokenDecline = "tok_decline"
+	TokenTimeout = "tok_timeout"
+	TokenError   = "tok_error"
+)
+
+// fakeTransaction tracks the money moved for one authorization
+type fakeTransaction struct {
+	authorized money.Money
+	captured   money.Money
+	refunded   money.Money
+	voided     bool
+}
+
+// FakeProvider is an in-memory sandbox gateway. Authorizations succeed unless
+// an outcome has been scripted or the request uses one of the sandbox tokens.
+type FakeProvider struct {
+	// OnAuthorize, if set, is called while an authorization is in flight,
+	// letting tests change the world before the provider answers
+	OnAuthorize func(request AuthorizeRequest)
+
+	mutex        sync.Mutex
+	script       []Outcome
+	transactions map[string]*fakeTransaction
+	idempotency  map[string]Authorization
+	nextID       int
+}
+
+// NewFakeProvider creates an empty sandbox gateway
+func NewFakeProvider() *FakeProvider {
+	return &FakeProvider{
+		transactions: make(map[string]*fakeTransaction),
+		idempotency:  make(map[string]Authorization),
+	}
+}
+
+// Name identifies the provider in stored payments
+func (f *FakeProvider) Name() string {
+	return "fake"
+}
+
+// Script queues outcomes for the next authorizations, in order
+func (f *FakeProvider) Script(outcomes ...Outcome) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.script = append(f.script, outcomes...)
+}
+
+// Authorize reserves the amount according to the scripted outcome or token
+func (f *FakeProvider) Authorize(ctx context.Context, request AuthorizeRequest) (Authorization, error) {
+	if !request.Amount.IsPositive() {
+		return Authorization{}, errors.New("amount must be positive")
+	}
+
+	f.mutex.Lock()
+	if auth, exists := f.idempotency[request.IdempotencyKey]; exists && request.IdempotencyKey != "" {
+		f.mutex.Unlock()
+		return auth, nil
+	}
+
+	outcome := outcomeForToken(request.Token)
+	if len(f.script) > 0 {
+		outcome = f.script[0]
+		f.script = f.script[1:]
+	}
+	f.mutex.Unlock()
+
+	if f.OnAuthorize != nil {
+		f.OnAuthorize(request)
+	}
+
+	switch outcome {
+	case OutcomeDecline:
+		return Authorization{}, ErrDeclined
+	case OutcomeTimeout:
+		<-ctx.Done()
+		return Authorization{}, ErrTimeout
+	case OutcomeError:
+		return Authorization{}, errors.New("sandbox provider error")
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.nextID++
+	auth := Authorization{
+		TransactionID: fmt.Sprintf("fake_txn_%d", f.nextID),
+		Amount:        request.Amount,
+	}
+	f.transactions[auth.TransactionID] = &fakeTransaction{authorized: request.Amount}
+	if request.IdempotencyKey != "" {
+		f.idempotency[request.IdempotencyKey] = auth
+	}
+	return auth, nil
+}
+
+// Capture collects a previously authorized amount
+func (f *FakeProvider) Capture(ctx context.Context, transactionID string, amount money.Money) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	txn, exists := f.transactions[transactionID]
+	if !exists {
+		return ErrUnknownTransaction
+	}
+	if txn.voided || txn.captured.IsPositive() || amount.Currency != txn.authorized.Currency || amount.Amount > txn.authorized.Amount {
+		return ErrInvalidState
+	}
+
+	txn.captured = amount
+	return nil
+}
+
+// Refund returns part or all of a captured amount
+func (f *FakeProvider) Refund(ctx context.Context, transactionID string, amount money.Money) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	txn, exists := f.transactions[transactionID]
+	if !exists {
+		return "", ErrUnknownTransaction
+	}
+
+	if !amount.IsPositive() || amount.Currency != txn.captured.Currency || txn.refunded.Add(amount).Amount > txn.captured.Amount {
+		return "", ErrInvalidState
+	}
+
+	txn.refunded = txn.refunded.Add(amount)
+	f.nextID++
+	return fmt.Sprintf("fake_refund_%d", f.nextID), nil
+}
+
+// Void releases an authorization that has not been captured
+func (f *FakeProvider) Void(ctx context.Context, transactionID string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	txn, exists := f.transactions[transactionID]
+	if !exists {
+		return ErrUnknownTransaction
+	}
+	if txn.captured.IsPositive() {
+		return ErrInvalidState
+	}
+
+	txn.voided = true
+	return nil
+}
+
+// Captured returns the amount collected for a transaction, less refunds
+func (f *FakeProvider) Captured(transactionID string) money.Money {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if txn, exists := f.transactions[transactionID]; exists {
+		return txn.captured.Sub(txn.refunded)
+	}
+	return money.Money{}
+}
+
+// outcomeForToken maps sandbox tokens to outcomes; any other token is approved
+func outcomeForToken(token string) Outcome {
+	switch token {
+	case TokenDecline:
+		return OutcomeDecline
+	case TokenTimeout:
+		return OutcomeTimeout
+	case TokenError:
+		return OutcomeError
+	default:
+		return OutcomeApprove
+	}
+}
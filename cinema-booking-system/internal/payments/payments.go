@@ -0,0 +1,48 @@
+package payments
+
+import (
+	"context"
+	"errors"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/money"
+)
+
+var (
+	// ErrDeclined is returned when the provider refuses to authorize a payment
+	ErrDeclined = errors.New("payment declined")
+	// ErrTimeout is returned when the provider does not answer in time
+	ErrTimeout = errors.New("payment provider timed out")
+	// ErrUnknownTransaction is returned for operations on a transaction the provider does not know
+	ErrUnknownTransaction = errors.New("unknown transaction")
+	// ErrInvalidState is returned when an operation does not fit the transaction's state,
+	// such as capturing a voided authorization or refunding more than was captured
+	ErrInvalidState = errors.New("operation not allowed in the transaction's current state")
+)
+
+// AuthorizeRequest describes a payment to reserve on the customer's payment method
+type AuthorizeRequest struct {
+	Amount         money.Money
+	Token          string // Payment method token collected by the checkout form
+	Reference      string // Booking reference shown on the customer's statement
+	IdempotencyKey string // Repeated requests with the same key authorize only once
+}
+
+// Authorization is a successful authorization
+type Authorization struct {
+	TransactionID string
+	Amount        money.Money
+}
+
+// Provider is a payment gateway able to reserve, collect and return money
+type Provider interface {
+	// Name identifies the provider in stored payments
+	Name() string
+	// Authorize reserves the amount without collecting it
+	Authorize(ctx context.Context, request AuthorizeRequest) (Authorization, error)
+	// Capture collects a previously authorized amount
+	Capture(ctx context.Context, transactionID string, amount money.Money) error
+	// Refund returns part or all of a captured amount and returns the refund's ID
+	Refund(ctx context.Context, transactionID string, amount money.Money) (string, error)
+	// Void releases an authorization that will not be captured
+	Void(ctx context.Context, transactionID string) error
+}
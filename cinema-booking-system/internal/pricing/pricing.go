@@ -0,0 +1,188 @@
+package pricing
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/money"
+)
+
+// Rules describes how a show's ticket price is adjusted for each seat. All
+// adjustments are percentages applied one after another to the running
+// price, each rounded to the minor unit: seat category first, then the time
+// of the show, then the ticket type. The zero value charges the show's
+// ticket price for every seat.
+type Rules struct {
+	// Percentage added for each seat category, e.g. 25 for premium seats
+	Categories map[models.SeatCategory]float64
+	// Percentage added for each ticket type, e.g. -30 for child tickets
+	TicketTypes map[models.TicketType]float64
+
+	// Shows starting before this hour of the day are matinees
+	MatineeBefore  int
+	MatineePercent float64
+	// Shows from Monday to Thursday get the weekday percentage
+	WeekdayPercent float64
+	// Friday to Sunday shows on a movie's opening weekend get the surcharge
+	OpeningWeekendPercent float64
+
+	// Tax rate included in ticket prices, e.g. 20 for 20% VAT. It is shown
+	// on bookings and does not change what customers pay.
+	TaxPercent float64
+}
+
+// DefaultRules are the prices the cinema charges out of the box
+var DefaultRules = Rules{
+	Categories: map[models.SeatCategory]float64{
+		models.SeatPremium:             25,
+		models.SeatRecliner:            60,
+		models.SeatWheelchairCompanion: -50,
+	},
+	TicketTypes: map[models.TicketType]float64{
+		models.TicketChild:   -30,
+		models.TicketSenior:  -25,
+		models.TicketStudent: -15,
+	},
+	MatineeBefore:         17,
+	MatineePercent:        -20,
+	WeekdayPercent:        -10,
+	OpeningWeekendPercent: 15,
+}
+
+// Price works out the price of every seat booked for a show. The show's
+// hall and movie must be loaded.
+func (r Rules) Price(show models.Show, seats models.Seats) (models.SeatPrices, error) {
+	if show.Hall == nil {
+		return nil, fmt.Errorf("show %d has no hall", show.ID)
+	}
+
+	prices := make(models.SeatPrices, 0, len(seats))
+	for _, seat := range seats {
+		ticketType := seat.TicketType
+		if ticketType == "" {
+			ticketType = models.TicketAdult
+		}
+		if !ticketType.Valid() {
+			return nil, fmt.Errorf("unknown ticket type %q for seat %s", seat.TicketType, seat)
+		}
+
+		price := r.SeatPrice(show, show.Hall.Layout.SeatCategory(seat), ticketType)
+		price.Seat = models.Seat{Row: seat.Row, Number: seat.Number}
+		prices = append(prices, price)
+	}
+	return prices, nil
+}
+
+// SeatPrice works out the price of a single ticket for a show
+func (r Rules) SeatPrice(show models.Show, category models.SeatCategory, ticketType models.TicketType) models.SeatPrice {
+	price := models.SeatPrice{
+		Category:   category,
+		TicketType: ticketType,
+		BasePrice:  show.TicketPrice,
+		Price:      show.TicketPrice,
+	}
+
+	apply := func(rule string, percent float64) {
+		if percent == 0 {
+			return
+		}
+		amount := price.Price.Percent(percent)
+		// Discounts never take a ticket below zero
+		if price.Price.Add(amount).IsNegative() {
+			amount = price.Price.Neg()
+		}
+		price.Price = price.Price.Add(amount)
+		price.Adjustments = append(price.Adjustments, models.PriceAdjustment{Rule: rule, Amount: amount})
+	}
+
+	apply(category.Label()+" seat", r.Categories[category])
+
+	if r.MatineeBefore > 0 && show.DateTime.Hour() < r.MatineeBefore {
+		apply("Matinee", r.MatineePercent)
+	}
+	if IsWeekday(show.DateTime) {
+		apply("Weekday", r.WeekdayPercent)
+	}
+	if show.Movie != nil && show.Movie.ReleaseDate != nil && IsOpeningWeekend(*show.Movie.ReleaseDate, show.DateTime) {
+		apply("Opening weekend", r.OpeningWeekendPercent)
+	}
+
+	apply(ticketType.Label()+" ticket", r.TicketTypes[ticketType])
+
+	return price
+}
+
+// ApplyDiscount spreads a discount off a booking's total over its seats in
+// proportion to their prices, so cancelling a seat later refunds only what
+// was actually paid for it
+func ApplyDiscount(prices models.SeatPrices, rule string, discount money.Money) models.SeatPrices {
+	weights := make([]int64, len(prices))
+	for i, price := range prices {
+		weights[i] = price.Price.Amount
+	}
+	shares := discount.Allocate(weights...)
+
+	discounted := make(models.SeatPrices, len(prices))
+	for i, price := range prices {
+		if !shares[i].IsZero() {
+			price.Price = price.Price.Sub(shares[i])
+			price.Adjustments = append(append([]models.PriceAdjustment(nil), price.Adjustments...),
+				models.PriceAdjustment{Rule: rule, Amount: shares[i].Neg(), Promo: true})
+		}
+		discounted[i] = price
+	}
+	return discounted
+}
+
+// ApplyTax works out the tax included in a booking's final seat prices. The
+// tax is rounded once on the booking's total and spread over the seats in
+// proportion to their prices, like discounts, so the shares add up to it.
+func (r Rules) ApplyTax(prices models.SeatPrices) models.SeatPrices {
+	weights := make([]int64, len(prices))
+	for i, price := range prices {
+		weights[i] = price.Price.Amount
+	}
+	shares := prices.Total().TaxIncluded(r.TaxPercent).Allocate(weights...)
+
+	taxed := make(models.SeatPrices, len(prices))
+	for i, price := range prices {
+		price.Tax = shares[i]
+		taxed[i] = price
+	}
+	return taxed
+}
+
+// PriceTable returns the price of every combination of seat category and
+// ticket type for a show
+func (r Rules) PriceTable(show models.Show) map[models.SeatCategory]map[models.TicketType]money.Money {
+	table := make(map[models.SeatCategory]map[models.TicketType]money.Money)
+	for _, category := range models.SeatCategories {
+		table[category] = make(map[models.TicketType]money.Money)
+		for _, ticketType := range models.TicketTypes {
+			table[category][ticketType] = r.SeatPrice(show, category, ticketType).Price
+		}
+	}
+	return table
+}
+
+// IsWeekday reports whether t falls between Monday and Thursday
+func IsWeekday(t time.Time) bool {
+	return t.Weekday() >= time.Monday && t.Weekday() <= time.Thursday
+}
+
+// IsOpeningWeekend reports whether t falls on the Friday, Saturday or Sunday
+// of the first weekend on or after the release date
+func IsOpeningWeekend(release, t time.Time) bool {
+	release = time.Date(release.Year(), release.Month(), release.Day(), 0, 0, 0, 0, t.Location())
+
+	// The opening weekend ends on the first Sunday on or after release
+	daysToSunday := (7 - int(release.Weekday())) % 7
+	end := release.AddDate(0, 0, daysToSunday+1)
+	start := end.AddDate(0, 0, -3)
+	if start.Before(release) {
+		start = release
+	}
+
+	return !t.Before(start) && t.Before(end)
+}
@@ -0,0 +1,173 @@
+// Package sessions keeps track of where users are logged in. Each login gets
+// its own session, so users can stay logged in on several devices and end
+// any of them.
+package sessions
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/utils"
+)
+
+// CookieName is the cookie holding the session token
+const CookieName = "session"
+
+var (
+	// IdleTimeout ends a session that has not been used for this long
+	IdleTimeout = 2 * time.Hour
+	// MaxAge ends a session this long after logging in, however active it is
+	MaxAge = 7 * 24 * time.Hour
+
+	// SecureCookies only lets browsers send the site's cookies over HTTPS.
+	// It must be set in production and left off for plain HTTP development.
+	SecureCookies = false
+	// SameSite limits which cross-site requests carry the site's cookies
+	SameSite = http.SameSiteLaxMode
+)
+
+// touchInterval limits how often a session's last use is written back, so
+// every request does not cost a database write
+const touchInterval = time.Minute
+
+// ErrNotFound is returned for sessions that do not exist or have ended
+var ErrNotFound = errors.New("session not found")
+
+// HashToken returns the hash a session token is stored under
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create logs a user in on the device making the request, returning the
+// token for the session cookie
+func Create(user models.User, r *http.Request, now time.Time) (string, models.Session, error) {
+	token := utils.GenerateSessionToken()
+	session := models.Session{
+		UserID:     user.ID,
+		TokenHash:  HashToken(token),
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(MaxAge),
+		UserAgent:  r.UserAgent(),
+		IPAddress:  ClientIP(r),
+	}
+	if err := database.DB.Create(&session).Error; err != nil {
+		return "", session, err
+	}
+	return token, session, nil
+}
+
+// Lookup returns the live session for a token and its user, recording that
+// the session was used. Sessions found to have ended are deleted.
+func Lookup(token string, now time.Time) (models.Session, error) {
+	if token == "" {
+		return models.Session{}, ErrNotFound
+	}
+
+	var session models.Session
+	if err := database.DB.Preload("User").Where("token_hash = ?", HashToken(token)).First(&session).Error; err != nil {
+		return session, ErrNotFound
+	}
+
+	if !Active(session, now) || session.User == nil {
+		database.DB.Unscoped().Delete(&session)
+		return models.Session{}, ErrNotFound
+	}
+
+	if now.Sub(session.LastSeenAt) >= touchInterval {
+		session.LastSeenAt = now
+		database.DB.Model(&models.Session{}).Where("id = ?", session.ID).UpdateColumn("last_seen_at", now)
+	}
+	return session, nil
+}
+
+// Active reports whether a session has neither sat idle too long nor
+// outlived its maximum age
+func Active(session models.Session, now time.Time) bool {
+	return now.Before(session.ExpiresAt) && now.Before(session.LastSeenAt.Add(IdleTimeout))
+}
+
+// FromRequest returns the live session of the request's session cookie
+func FromRequest(r *http.Request) (models.Session, error) {
+	cookie, err := r.Cookie(CookieName)
+	if err != nil {
+		return models.Session{}, ErrNotFound
+	}
+	return Lookup(cookie.Value, time.Now())
+}
+
+// List returns a user's live sessions, most recently used first
+func List(userID uint, now time.Time) []models.Session {
+	var sessions []models.Session
+	database.DB.Where("user_id = ? AND expires_at > ? AND last_seen_at > ?", userID, now, now.Add(-IdleTimeout)).
+		Order("last_seen_at DESC").Find(&sessions)
+	return sessions
+}
+
+// Revoke ends the session of a token
+func Revoke(token string) error {
+	return database.DB.Unscoped().Where("token_hash = ?", HashToken(token)).Delete(&models.Session{}).Error
+}
+
+// RevokeID ends one of a user's sessions
+func RevokeID(userID, sessionID uint) error {
+	result := database.DB.Unscoped().Where("id = ? AND user_id = ?", sessionID, userID).Delete(&models.Session{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RevokeAll ends every session of a user, logging them out everywhere
+func RevokeAll(userID uint) error {
+	return database.DB.Unscoped().Where("user_id = ?", userID).Delete(&models.Session{}).Error
+}
+
+// DeleteExpired removes sessions that have ended, returning how many
+func DeleteExpired(now time.Time) int64 {
+	result := database.DB.Unscoped().Where("expires_at <= ? OR last_seen_at <= ?", now, now.Add(-IdleTimeout)).
+		Delete(&models.Session{})
+	return result.RowsAffected
+}
+
+// NewCookie returns a cookie with the site's cookie settings, readable only
+// by the server. A zero expiry makes it last until the browser closes.
+func NewCookie(name, value, path string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   SecureCookies,
+		SameSite: SameSite,
+	}
+}
+
+// SetCookie sends the session cookie. It lasts as long as the session can.
+func SetCookie(w http.ResponseWriter, token string, session models.Session) {
+	http.SetCookie(w, NewCookie(CookieName, token, "/", session.ExpiresAt))
+}
+
+// ClearCookie removes the session cookie
+func ClearCookie(w http.ResponseWriter) {
+	http.SetCookie(w, NewCookie(CookieName, "", "/", time.Now().Add(-1*time.Hour)))
+}
+
+// ClientIP returns the address a request came from
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,134 @@
+package tickets
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/utils"
+	"github.com/go-pdf/fpdf"
+	"github.com/skip2/go-qrcode"
+)
+
+// Page layout in millimetres; tickets are printed one per A6 page
+const (
+	pageWidth = 105.0
+	margin    = 8.0
+	qrSize    = 46.0
+)
+
+// Token returns the signed token for one seat of a booking
+func Token(secret []byte, booking models.Booking, seat models.Seat) string {
+	return Sign(secret, Claims{Reference: booking.Reference, ShowID: booking.ShowID, Seat: seat.String()})
+}
+
+// HallName returns the name a hall is shown by on tickets
+func HallName(hall *models.Hall) string {
+	if hall == nil {
+		return ""
+	}
+	if hall.Name != "" {
+		return hall.Name
+	}
+	return fmt.Sprintf("Hall %d", hall.Number)
+}
+
+// WritePDF writes a PDF with a ticket page for every seat of a booking. Each
+// ticket carries a QR code of the seat's signed token. The booking's show,
+// movie and hall must be loaded.
+func WritePDF(w io.Writer, booking models.Booking, secret []byte) error {
+	if booking.Show == nil || booking.Show.Movie == nil {
+		return fmt.Errorf("booking %s has no show loaded", booking.Reference)
+	}
+	show := booking.Show
+
+	pdf := fpdf.New("P", "mm", "A6", "")
+	pdf.SetTitle("Tickets "+booking.Reference, true)
+	pdf.SetAuthor("Cinema Booking", true)
+	pdf.SetMargins(margin, margin, margin)
+	pdf.SetAutoPageBreak(false, margin)
+	// The core fonts only cover Windows-1252
+	text := pdf.UnicodeTranslatorFromDescriptor("")
+	contentWidth := pageWidth - 2*margin
+
+	for i, seat := range booking.Seats {
+		pdf.AddPage()
+
+		// Header bar
+		pdf.SetFillColor(229, 9, 20)
+		pdf.Rect(0, 0, pageWidth, 16, "F")
+		pdf.SetTextColor(255, 255, 255)
+		pdf.SetFont("Helvetica", "B", 12)
+		pdf.SetXY(margin, 4)
+		pdf.CellFormat(contentWidth, 8, "CINEMA BOOKING", "", 0, "L", false, 0, "")
+		pdf.SetFont("Helvetica", "", 9)
+		pdf.SetXY(margin, 4)
+		pdf.CellFormat(contentWidth, 8, fmt.Sprintf("Ticket %d of %d", i+1, len(booking.Seats)), "", 0, "R", false, 0, "")
+
+		// Show details
+		pdf.SetTextColor(0, 0, 0)
+		pdf.SetXY(margin, 21)
+		pdf.SetFont("Helvetica", "B", 15)
+		pdf.MultiCell(contentWidth, 7, text(show.Movie.Title), "", "L", false)
+		pdf.Ln(1)
+
+		detail := func(label, value string) {
+			pdf.SetFont("Helvetica", "", 8)
+			pdf.SetTextColor(110, 110, 110)
+			pdf.CellFormat(22, 5.5, label, "", 0, "L", false, 0, "")
+			pdf.SetFont("Helvetica", "", 10)
+			pdf.SetTextColor(0, 0, 0)
+			pdf.CellFormat(contentWidth-22, 5.5, text(value), "", 1, "L", false, 0, "")
+		}
+		detail("Date", utils.FormatDate(show.DateTime))
+		detail("Time", utils.FormatTime(show.DateTime))
+		detail("Hall", HallName(show.Hall))
+
+		price, priced := booking.Prices.For(seat)
+		ticketType := seat.TicketType
+		if priced {
+			ticketType = price.TicketType
+		}
+		if ticketType == "" {
+			ticketType = models.TicketAdult
+		}
+		ticket := ticketType.Label()
+		if priced && price.Category != "" {
+			ticket += ", " + price.Category.Label() + " seat"
+		}
+		detail("Ticket", ticket)
+		if priced {
+			detail("Price", utils.FormatCurrency(price.Price))
+		}
+
+		pdf.Ln(1)
+		pdf.SetFont("Helvetica", "", 8)
+		pdf.SetTextColor(110, 110, 110)
+		pdf.CellFormat(22, 9, "Seat", "", 0, "L", false, 0, "")
+		pdf.SetFont("Helvetica", "B", 22)
+		pdf.SetTextColor(0, 0, 0)
+		pdf.CellFormat(contentWidth-22, 9, text(seat.String()), "", 1, "L", false, 0, "")
+
+		// QR code of the seat's signed token
+		png, err := qrcode.Encode(Token(secret, booking, seat), qrcode.Medium, 512)
+		if err != nil {
+			return fmt.Errorf("encoding QR code: %w", err)
+		}
+		imageName := "qr-" + seat.String()
+		pdf.RegisterImageOptionsReader(imageName, fpdf.ImageOptions{ImageType: "PNG"}, bytes.NewReader(png))
+		qrTop := pdf.GetY() + 2
+		pdf.ImageOptions(imageName, (pageWidth-qrSize)/2, qrTop, qrSize, qrSize, false, fpdf.ImageOptions{ImageType: "PNG"}, 0, "")
+
+		// Booking details under the code
+		pdf.SetXY(margin, qrTop+qrSize+1)
+		pdf.SetFont("Courier", "B", 10)
+		pdf.CellFormat(contentWidth, 5, booking.Reference, "", 1, "C", false, 0, "")
+		pdf.SetFont("Helvetica", "", 8)
+		pdf.CellFormat(contentWidth, 4.5, text(booking.CustomerName), "", 1, "C", false, 0, "")
+		pdf.SetTextColor(110, 110, 110)
+		pdf.CellFormat(contentWidth, 4.5, "Show this ticket at the entrance", "", 1, "C", false, 0, "")
+	}
+
+	return pdf.Output(w)
+}
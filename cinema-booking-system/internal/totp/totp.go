@@ -0,0 +1,123 @@
+// Package totp implements the time-based one-time passwords of RFC 6238 that
+// authenticator apps generate, with the usual SHA-1, six digit, 30 second
+// settings those apps expect.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Digits is the length of each code
+	Digits = 6
+	// Period is how long each code is valid for
+	Period = 30 * time.Second
+
+	secretBytes = 20
+)
+
+// ErrInvalidSecret is returned for secrets that are not valid base32
+var ErrInvalidSecret = errors.New("invalid TOTP secret")
+
+// encoding is how secrets are written, as authenticator apps expect them
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random secret, base32 encoded
+func GenerateSecret() (string, error) {
+	secret := make([]byte, secretBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(secret), nil
+}
+
+// Step returns the number of the period a time falls in
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// Code returns the code for a secret at a time
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return code(key, Step(t)), nil
+}
+
+// Validate checks a code against a secret, allowing for clocks that are up
+// to skew periods apart. It returns the step the code belongs to, so callers
+// can refuse a code that was already used.
+func Validate(secret, given string, t time.Time, skew int) (int64, bool) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return 0, false
+	}
+
+	given = strings.ReplaceAll(strings.TrimSpace(given), " ", "")
+	if len(given) != Digits {
+		return 0, false
+	}
+
+	now := Step(t)
+	for offset := -int64(skew); offset <= int64(skew); offset++ {
+		step := now + offset
+		if subtle.ConstantTimeCompare([]byte(code(key, step)), []byte(given)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// URI returns the otpauth:// link that authenticator apps read from a QR
+// code to add an account
+func URI(issuer, account, secret string) string {
+	label := url.PathEscape(issuer + ":" + account)
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(Digits)},
+		"period":    {fmt.Sprint(int(Period / time.Second))},
+	}
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// decodeSecret decodes a base32 secret, ignoring case, spaces and padding
+func decodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	key, err := encoding.DecodeString(strings.TrimRight(secret, "="))
+	if err != nil || len(key) == 0 {
+		return nil, ErrInvalidSecret
+	}
+	return key, nil
+}
+
+// code computes the HOTP code of RFC 4226 for a counter
+func code(key []byte, counter int64) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulus := uint32(1)
+	for i := 0; i < Digits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", Digits, value%modulus)
+}
@@ -5,12 +5,15 @@ import (
 	"encoding/hex"
 	"fmt"
 	"regexp"
+	"strings"
 	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/money"
 )
 
-// FormatCurrency formats a float as a currency string
-func FormatCurrency(amount float64) string {
-	return fmt.Sprintf("$%.2f", amount)
+// FormatCurrency formats an amount for the configured locale
+func FormatCurrency(amount money.Money) string {
+	return amount.Format(money.DefaultLocale)
 }
 
 // FormatDateTime formats a time into a readable string
@@ -28,11 +31,30 @@ func FormatTime(t time.Time) string {
 	return t.Format("3:04 PM")
 }
 
-// GenerateBookingReference creates a unique reference number
+// bookingReferenceAlphabet avoids characters that are easily confused when
+// read out or typed (0/O, 1/I/L, U)
+const bookingReferenceAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// GenerateBookingReference creates a unique, non-guessable reference number
 func GenerateBookingReference() string {
-	bytes := make([]byte, 4)
+	bytes := make([]byte, 12)
 	rand.Read(bytes)
-	return fmt.Sprintf("BKG-%s", hex.EncodeToString(bytes))
+
+	reference := make([]byte, len(bytes))
+	for i, b := range bytes {
+		reference[i] = bookingReferenceAlphabet[int(b)%len(bookingReferenceAlphabet)]
+	}
+	return fmt.Sprintf("BKG-%s", reference)
+}
+
+// NormalizeBookingReference converts a reference typed by a customer into
+// its canonical form
+func NormalizeBookingReference(reference string) string {
+	reference = strings.ToUpper(strings.TrimSpace(reference))
+	if !strings.HasPrefix(reference, "BKG-") {
+		reference = "BKG-" + reference
+	}
+	return reference
 }
 
 // ValidateEmail checks if an email is valid
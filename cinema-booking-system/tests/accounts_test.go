@@ -0,0 +1,268 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/accounts"
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/handlers"
+	"github.com/JoeDkhar/cinema-booking-system/internal/middleware"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/notifications"
+	"github.com/JoeDkhar/cinema-booking-system/internal/sessions"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newPasswordRouter serves registration, login and the password and email
+// verification pages
+func newPasswordRouter() *mux.Router {
+	r := newAccountRouter()
+	r.HandleFunc("/register", handlers.RegisterHandler).Methods("POST")
+	r.HandleFunc("/verify-email/{token}", handlers.VerifyEmailHandler).Methods("GET")
+	r.HandleFunc("/forgot-password", handlers.ForgotPasswordHandler).Methods("POST")
+	r.HandleFunc("/reset-password/{token}", handlers.ResetPasswordHandler).Methods("GET", "POST")
+	account := r.PathPrefix("/account").Subrouter()
+	account.Use(middleware.AuthMiddleware)
+	account.HandleFunc("/password", handlers.ChangePasswordHandler).Methods("POST")
+	account.HandleFunc("/verify-email", handlers.ResendVerificationHandler).Methods("POST")
+	return r
+}
+
+// postForm submits a form, optionally with a session cookie
+func postForm(r http.Handler, path string, form url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+// emailedLink returns the last link matching pattern emailed to an address
+func emailedLink(t *testing.T, outbox *notifications.Outbox, server *smtpServer, to, pattern string) string {
+	outbox.Flush(context.Background())
+	link := ""
+	for _, received := range server.messages() {
+		if received.To[0] == "<"+to+">" {
+			if found := regexp.MustCompile(pattern).FindString(parseMail(t, received).Text); found != "" {
+				link = found
+			}
+		}
+	}
+	return link
+}
+
+// Test the rules passwords must meet
+func TestPasswordStrength(t *testing.T) {
+	user := models.User{Username: "moviebuff", Email: "film.fan@example.com"}
+
+	tests := []struct {
+		password string
+		valid    bool
+	}{
+		{"short1!", false},
+		{"onlyletterslong", false},
+		{"1234567890123", false},
+		{"Password123", false},
+		{"my-moviebuff-2024", false},
+		{"FILM.FAN-rocks-7", false},
+		{strings.Repeat("a1", 40), false},
+		{"correct horse 7 battery", true},
+		{"Sunlit-Matinee-42", true},
+	}
+	for _, test := range tests {
+		err := accounts.CheckPassword(test.password, user)
+		if (err == nil) != test.valid {
+			t.Errorf("Expected %q valid=%v, got %v", test.password, test.valid, err)
+		}
+	}
+}
+
+// Test that registering refuses weak passwords and emails a link that
+// verifies the address once
+func TestEmailVerification(t *testing.T) {
+	outbox, server, _ := setupNotifications(t)
+	database.DB.Exec("DELETE FROM account_tokens")
+	database.DB.Exec("DELETE FROM users")
+	r := newPasswordRouter()
+
+	form := url.Values{"username": {"newcomer"}, "email": {"newcomer@example.com"},
+		"password": {"password123"}, "password_confirm": {"password123"}}
+	postForm(r, "/register", form, nil)
+	var count int64
+	database.DB.Model(&models.User{}).Count(&count)
+	if count != 0 {
+		t.Fatalf("Expected a common password to be refused")
+	}
+
+	form.Set("password", "Late-Night-Double-Bill-9")
+	form.Set("password_confirm", "Late-Night-Double-Bill-9")
+	rec := postForm(r, "/register", form, nil)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/login?registered=true" {
+		t.Fatalf("Expected the account to be created, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	var user models.User
+	database.DB.Where("username = ?", "newcomer").First(&user)
+	if user.EmailVerified() {
+		t.Errorf("Expected a new account's email not to be verified yet")
+	}
+
+	link := emailedLink(t, outbox, server, "newcomer@example.com", `/verify-email/[0-9a-f]+`)
+	if link == "" {
+		t.Fatalf("Expected a verification link to be emailed")
+	}
+
+	rec = sessionRequest(r, "GET", link, nil)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/login?verified=true" {
+		t.Errorf("Expected the email to be verified, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	database.DB.First(&user, user.ID)
+	if !user.EmailVerified() {
+		t.Errorf("Expected the email to be marked verified")
+	}
+	if rec := sessionRequest(r, "GET", link, nil); rec.Code != http.StatusGone {
+		t.Errorf("Expected a used link to be refused, got %d", rec.Code)
+	}
+
+	// A link sent before the address changed does not verify the new one
+	database.DB.Model(&models.User{}).Where("id = ?", user.ID).UpdateColumn("email_verified_at", nil)
+	token, _, err := accounts.IssueToken(user, models.TokenVerifyEmail, time.Now())
+	if err != nil {
+		t.Fatalf("Error issuing token: %v", err)
+	}
+	database.DB.Model(&models.User{}).Where("id = ?", user.ID).UpdateColumn("email", "changed@example.com")
+	if rec := sessionRequest(r, "GET", "/verify-email/"+token, nil); rec.Code != http.StatusGone {
+		t.Errorf("Expected a link for an old address to be refused, got %d", rec.Code)
+	}
+	var changed models.User
+	database.DB.First(&changed, user.ID)
+	if changed.EmailVerified() {
+		t.Errorf("Expected the changed address to stay unverified")
+	}
+
+	// Logged-in users can ask for another link
+	createSession(t, models.User{Username: "unverified", Email: "unverified@example.com"}, "unverified-session")
+	rec = postForm(r, "/account/verify-email", nil, &http.Cookie{Name: sessions.CookieName, Value: "unverified-session"})
+	if rec.Header().Get("Location") != "/account/bookings?verification=sent" ||
+		emailedLink(t, outbox, server, "unverified@example.com", `/verify-email/[0-9a-f]+`) == "" {
+		t.Errorf("Expected another verification link to be sent, got %q", rec.Header().Get("Location"))
+	}
+}
+
+// Test that a forgotten password can be reset once with an emailed link,
+// logging the user out everywhere
+func TestPasswordReset(t *testing.T) {
+	outbox, server, _ := setupNotifications(t)
+	database.DB.Exec("DELETE FROM account_tokens")
+	database.DB.Exec("DELETE FROM sessions")
+	database.DB.Exec("DELETE FROM users")
+	r := newPasswordRouter()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("popcorn"), bcrypt.MinCost)
+	user := models.User{Username: "forgetful", Email: "forgetful@example.com", PasswordHash: string(hash)}
+	database.DB.Create(&user)
+	laptop := login(t, r, "forgetful", "popcorn", "Laptop Browser")
+
+	// The page reads the same whether or not the account exists
+	known := postForm(r, "/forgot-password", url.Values{"email": {"Forgetful@Example.com"}}, nil)
+	unknown := postForm(r, "/forgot-password", url.Values{"email": {"nobody@example.com"}}, nil)
+	if known.Code != unknown.Code || known.Body.String() != strings.Replace(unknown.Body.String(), "nobody@example.com", "Forgetful@Example.com", -1) {
+		t.Errorf("Expected the same response for unknown addresses, got %d and %d", known.Code, unknown.Code)
+	}
+	if emailedLink(t, outbox, server, "nobody@example.com", `.+`) != "" {
+		t.Errorf("Expected nothing to be emailed to an unknown address")
+	}
+
+	link := emailedLink(t, outbox, server, "forgetful@example.com", `/reset-password/[0-9a-f]+`)
+	if link == "" {
+		t.Fatalf("Expected a reset link to be emailed")
+	}
+	if rec := sessionRequest(r, "GET", link, nil); rec.Code != http.StatusOK {
+		t.Errorf("Expected the reset link to open, got %d", rec.Code)
+	}
+
+	// The link is not kept once the email has been sent
+	var sent models.Notification
+	database.DB.Where("kind = ? AND recipient = ?", notifications.PasswordReset, "forgetful@example.com").First(&sent)
+	if sent.Status != models.NotificationSent || strings.Contains(sent.TextBody+sent.HTMLBody, "/reset-password/") {
+		t.Errorf("Expected the sent email's body to be cleared, got %s %q", sent.Status, sent.TextBody)
+	}
+
+	// A weak password leaves the link usable
+	postForm(r, link, url.Values{"password": {"popcorn2"}, "password_confirm": {"popcorn2"}}, nil)
+	rec := postForm(r, link, url.Values{"password": {"Front-Row-Seat-88"}, "password_confirm": {"Front-Row-Seat-88"}}, nil)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/login?reset=true" {
+		t.Fatalf("Expected the password to be reset, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+
+	if loggedIn(r, laptop) {
+		t.Errorf("Expected resetting the password to log out every device")
+	}
+	login(t, r, "forgetful", "Front-Row-Seat-88", "Laptop Browser")
+	database.DB.First(&user, user.ID)
+	if !user.EmailVerified() {
+		t.Errorf("Expected following the emailed link to verify the address")
+	}
+
+	// Each link works once
+	rec = postForm(r, link, url.Values{"password": {"Back-Row-Seat-99"}, "password_confirm": {"Back-Row-Seat-99"}}, nil)
+	if rec.Code != http.StatusGone {
+		t.Errorf("Expected a used link to be refused, got %d", rec.Code)
+	}
+
+	// Links stop working once they expire
+	postForm(r, "/forgot-password", url.Values{"email": {"forgetful@example.com"}}, nil)
+	link = emailedLink(t, outbox, server, "forgetful@example.com", `/reset-password/[0-9a-f]+`)
+	database.DB.Model(&models.AccountToken{}).Where("used_at IS NULL").UpdateColumn("expires_at", time.Now().Add(-time.Minute))
+	if rec := sessionRequest(r, "GET", link, nil); rec.Code != http.StatusGone {
+		t.Errorf("Expected an expired link to be refused, got %d", rec.Code)
+	}
+}
+
+// Test that changing the password needs the current one and logs out every
+// other device
+func TestChangePassword(t *testing.T) {
+	database.DB.Exec("DELETE FROM sessions")
+	database.DB.Exec("DELETE FROM users")
+	r := newPasswordRouter()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("Old-Password-1"), bcrypt.MinCost)
+	database.DB.Create(&models.User{Username: "changer", Email: "changer@example.com", PasswordHash: string(hash)})
+	laptop := login(t, r, "changer", "Old-Password-1", "Laptop Browser")
+	phone := login(t, r, "changer", "Old-Password-1", "Phone Browser")
+
+	form := url.Values{"current_password": {"wrong"}, "password": {"New-Password-2"}, "password_confirm": {"New-Password-2"}}
+	if rec := postForm(r, "/account/password", form, laptop); rec.Code != http.StatusOK || !loggedIn(r, phone) {
+		t.Fatalf("Expected a wrong current password to be refused, got %d", rec.Code)
+	}
+
+	form.Set("current_password", "Old-Password-1")
+	rec := postForm(r, "/account/password", form, laptop)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/account/password?changed=true" {
+		t.Fatalf("Expected the password to be changed, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+
+	if loggedIn(r, phone) || loggedIn(r, laptop) {
+		t.Errorf("Expected every existing session to end")
+	}
+	var fresh *http.Cookie
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == sessions.CookieName && cookie.Value != "" {
+			fresh = cookie
+		}
+	}
+	if fresh == nil || !loggedIn(r, fresh) {
+		t.Errorf("Expected this device to get a new session")
+	}
+	login(t, r, "changer", "New-Password-2", "Phone Browser")
+}
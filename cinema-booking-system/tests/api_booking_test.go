@@ -0,0 +1,174 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/handlers"
+	"github.com/JoeDkhar/cinema-booking-system/internal/middleware"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/gorilla/mux"
+)
+
+// newAPIRouter registers the movie and booking API routes the same way the
+// server does
+func newAPIRouter() *mux.Router {
+	r := mux.NewRouter()
+	api := r.PathPrefix("/api/v1").Subrouter()
+	api.Use(middleware.APIKeyMiddleware)
+	scope := func(needed models.APIScope, handler http.HandlerFunc) http.Handler {
+		return middleware.RequireAPIScope(needed)(handler)
+	}
+	api.Handle("/movies", scope(models.ScopeReadCatalog, handlers.APIMoviesHandler)).Methods("GET")
+	api.Handle("/bookings", scope(models.ScopeCreateBookings, handlers.APICreateBookingHandler)).Methods("POST")
+	api.Handle("/bookings/{reference}", scope(models.ScopeCreateBookings, handlers.APIBookingDetailHandler)).Methods("GET")
+	api.Handle("/bookings/{reference}", scope(models.ScopeCancelBookings, handlers.APICancelBookingHandler)).Methods("DELETE")
+	api.Handle("/me/bookings", middleware.RequireAPIScope(models.ScopeAccount)(middleware.RequireAPIUser(http.HandlerFunc(handlers.APIMyBookingsHandler)))).Methods("GET")
+	return r
+}
+
+// apiRequest performs a request against the router as the site's own pages
+// do, and decodes the response envelope
+func apiRequest(t *testing.T, r http.Handler, method, path string, body interface{}) (int, handlers.APIResponse) {
+	return sendAPIRequest(t, r, method, path, http.Header{"Sec-Fetch-Site": {"same-origin"}}, body)
+}
+
+// partnerRequest is apiRequest made from another server, with an API key if
+// one is given
+func partnerRequest(t *testing.T, r http.Handler, method, path, key string, body interface{}) (int, handlers.APIResponse) {
+	header := http.Header{}
+	if key != "" {
+		header.Set("Authorization", "Bearer "+key)
+	}
+	return sendAPIRequest(t, r, method, path, header, body)
+}
+
+// sendAPIRequest performs a request with the given headers against the
+// router and decodes the response envelope
+func sendAPIRequest(t *testing.T, r http.Handler, method, path string, header http.Header, body interface{}) (int, handlers.APIResponse) {
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			t.Fatalf("Error encoding request: %v", err)
+		}
+	}
+
+	req := httptest.NewRequest(method, path, &payload)
+	req.Header = header
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	var response handlers.APIResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Error decoding response %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, response
+}
+
+// Test the create, fetch and cancel lifecycle of the JSON booking API
+func TestAPIBookingLifecycle(t *testing.T) {
+	database.DB.Exec("DELETE FROM bookings")
+	database.DB.Exec("DELETE FROM shows")
+	database.DB.Exec("DELETE FROM movies")
+
+	show := setupTestShow(t)
+	router := newAPIRouter()
+
+	request := map[string]interface{}{
+		"show_id":       show.ID,
+		"customer_name": "Kiosk Customer",
+		"email":         "kiosk@example.com",
+		"seats":         []map[string]interface{}{{"row": "H", "number": 3}},
+		"payment_token": "tok_approve",
+	}
+
+	code, created := apiRequest(t, router, "POST", "/api/v1/bookings", request)
+	if code != http.StatusCreated || !created.Success {
+		t.Fatalf("Expected 201, got %d: %s", code, created.Error)
+	}
+
+	reference := created.Data.(map[string]interface{})["reference"].(string)
+	path := "/api/v1/bookings/" + reference
+
+	// Bookings are not reachable by their sequential ID
+	id := int(created.Data.(map[string]interface{})["ID"].(float64))
+	if code, _ := apiRequest(t, router, "GET", "/api/v1/bookings/"+strconv.Itoa(id), nil); code != http.StatusNotFound {
+		t.Errorf("Expected 404 fetching a booking by ID, got %d", code)
+	}
+
+	// Looking a booking up without a key needs its email
+	if code, _ := apiRequest(t, router, "GET", path, nil); code != http.StatusNotFound {
+		t.Errorf("Expected 404 fetching a booking without its email, got %d", code)
+	}
+	if code, _ := apiRequest(t, router, "GET", path+"?email=kiosk@example.com", nil); code != http.StatusOK {
+		t.Errorf("Expected 200 fetching booking, got %d", code)
+	}
+
+	// The same seat cannot be booked twice
+	if code, conflict := apiRequest(t, router, "POST", "/api/v1/bookings", request); code != http.StatusConflict {
+		t.Errorf("Expected 409 for a taken seat, got %d: %s", code, conflict.Error)
+	}
+
+	// Cancelling requires the email the booking was made with
+	if code, _ := apiRequest(t, router, "DELETE", path+"?email=someone@example.com", nil); code != http.StatusNotFound {
+		t.Errorf("Expected 404 cancelling with the wrong email, got %d", code)
+	}
+
+	code, cancelled := apiRequest(t, router, "DELETE", path+"?email=kiosk@example.com", nil)
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200 cancelling booking, got %d: %s", code, cancelled.Error)
+	}
+	if status := cancelled.Data.(map[string]interface{})["booking"].(map[string]interface{})["status"]; status != "cancelled" {
+		t.Errorf("Expected status cancelled, got %v", status)
+	}
+
+	// The seat is free again once the booking is cancelled
+	if code, rebooked := apiRequest(t, router, "POST", "/api/v1/bookings", request); code != http.StatusCreated {
+		t.Errorf("Expected 201 rebooking a cancelled seat, got %d: %s", code, rebooked.Error)
+	}
+}
+
+// Test the status codes returned for rejected API bookings
+func TestAPIBookingErrors(t *testing.T) {
+	database.DB.Exec("DELETE FROM bookings")
+	database.DB.Exec("DELETE FROM shows")
+	database.DB.Exec("DELETE FROM movies")
+
+	show := setupTestShow(t)
+	router := newAPIRouter()
+
+	cases := []struct {
+		name    string
+		request map[string]interface{}
+		code    int
+	}{
+		{"unknown show", map[string]interface{}{
+			"show_id": show.ID + 1000, "customer_name": "A", "email": "a@example.com",
+			"seats": []map[string]interface{}{{"row": "A", "number": 1}},
+		}, http.StatusNotFound},
+		{"invalid seat", map[string]interface{}{
+			"show_id": show.ID, "customer_name": "A", "email": "a@example.com",
+			"seats": []map[string]interface{}{{"row": "Z", "number": 99}},
+		}, http.StatusUnprocessableEntity},
+		{"missing name", map[string]interface{}{
+			"show_id": show.ID, "email": "a@example.com",
+			"seats": []map[string]interface{}{{"row": "A", "number": 1}},
+		}, http.StatusUnprocessableEntity},
+	}
+
+	for _, c := range cases {
+		if code, response := apiRequest(t, router, "POST", "/api/v1/bookings", c.request); code != c.code {
+			t.Errorf("%s: expected %d, got %d: %s", c.name, c.code, code, response.Error)
+		}
+	}
+
+	if code, _ := apiRequest(t, router, "GET", "/api/v1/bookings/BKG-DOESNOTEXIST", nil); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown booking, got %d", code)
+	}
+}
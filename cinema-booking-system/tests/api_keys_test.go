@@ -0,0 +1,276 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/apikeys"
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/handlers"
+	"github.com/JoeDkhar/cinema-booking-system/internal/middleware"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/gorilla/mux"
+)
+
+// issueKey issues an API key for a test
+func issueKey(t *testing.T, name string, rateLimit int, scopes ...models.APIScope) (string, models.APIKey) {
+	token, key, err := apikeys.Issue(name, scopes, rateLimit, models.User{})
+	if err != nil {
+		t.Fatalf("Error issuing API key: %v", err)
+	}
+	return token, key
+}
+
+// Test that API keys are checked, limited to their scopes and stop working
+// once revoked, while requests without a key may only read the catalog
+// unless the site itself makes them
+func TestAPIKeyAuthentication(t *testing.T) {
+	database.DB.Exec("DELETE FROM api_keys")
+	r := newAPIRouter()
+	reader, readerKey := issueKey(t, "Reader", 0, models.ScopeReadCatalog)
+	booker, _ := issueKey(t, "Booker", 0, models.ScopeCreateBookings)
+
+	if code, _ := partnerRequest(t, r, "GET", "/api/v1/movies", "", nil); code != http.StatusOK {
+		t.Errorf("Expected the catalog to work without a key, got %d", code)
+	}
+	if code, _ := partnerRequest(t, r, "POST", "/api/v1/bookings", "", map[string]interface{}{"show_id": 1}); code != http.StatusUnauthorized {
+		t.Errorf("Expected booking without a key to be refused, got %d", code)
+	}
+	if code, _ := partnerRequest(t, r, "DELETE", "/api/v1/bookings/ABC123", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("Expected cancelling without a key to be refused, got %d", code)
+	}
+	if code, _ := partnerRequest(t, r, "GET", "/api/v1/bookings/ABC123", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("Expected looking up bookings without a key to be refused, got %d", code)
+	}
+	header := http.Header{"Origin": {"http://example.com"}}
+	if code, _ := sendAPIRequest(t, r, "DELETE", "/api/v1/bookings/ABC123", header, nil); code != http.StatusNotFound {
+		t.Errorf("Expected the site's own pages to reach the booking routes without a key, got %d", code)
+	}
+	if code, _ := partnerRequest(t, r, "GET", "/api/v1/movies", reader, nil); code != http.StatusOK {
+		t.Errorf("Expected a key with the catalog scope to list movies, got %d", code)
+	}
+	if code, _ := partnerRequest(t, r, "GET", "/api/v1/movies", booker, nil); code != http.StatusForbidden {
+		t.Errorf("Expected a key without the catalog scope to be refused, got %d", code)
+	}
+	if code, _ := partnerRequest(t, r, "GET", "/api/v1/bookings/ABC123", reader, nil); code != http.StatusForbidden {
+		t.Errorf("Expected a key without the bookings scope to be refused, got %d", code)
+	}
+	if code, _ := partnerRequest(t, r, "GET", "/api/v1/me/bookings", reader, nil); code != http.StatusForbidden {
+		t.Errorf("Expected keys not to act for a logged-in user, got %d", code)
+	}
+	if code, _ := apiRequest(t, r, "GET", "/api/v1/me/bookings", nil); code != http.StatusUnauthorized {
+		t.Errorf("Expected requests without a key to need a login, got %d", code)
+	}
+
+	req := httptest.NewRequest("GET", "/api/v1/movies", nil)
+	req.Header.Set("Authorization", "Bearer cbk_not-a-real-key")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("Expected an unknown key to be refused, got %d", rec.Code)
+	}
+
+	var used models.APIKey
+	database.DB.First(&used, readerKey.ID)
+	if used.LastUsedAt == nil || used.LastUsedIP != "192.0.2.1" {
+		t.Errorf("Expected the key's last use to be recorded, got %v %q", used.LastUsedAt, used.LastUsedIP)
+	}
+	if used.Prefix == "" || used.KeyHash == reader || used.KeyHash == "" {
+		t.Errorf("Expected only a hash of the key to be stored")
+	}
+
+	if err := apikeys.Revoke(readerKey.ID, time.Now()); err != nil {
+		t.Fatalf("Error revoking key: %v", err)
+	}
+	if code, _ := partnerRequest(t, r, "GET", "/api/v1/movies", reader, nil); code != http.StatusUnauthorized {
+		t.Errorf("Expected a revoked key to be refused, got %d", code)
+	}
+	if err := apikeys.Revoke(readerKey.ID, time.Now()); err != apikeys.ErrNotFound {
+		t.Errorf("Expected revoking a key twice to fail, got %v", err)
+	}
+}
+
+// Test that each key may only make its own number of requests a minute
+func TestAPIKeyRateLimit(t *testing.T) {
+	database.DB.Exec("DELETE FROM api_keys")
+	r := newAPIRouter()
+	limited, _ := issueKey(t, "Limited", 3, models.ScopeReadCatalog)
+	other, _ := issueKey(t, "Other", 0, models.ScopeReadCatalog)
+
+	get := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/movies", nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 3; i++ {
+		rec := get(limited)
+		if rec.Code != http.StatusOK || rec.Header().Get("X-RateLimit-Remaining") != strconv.Itoa(2-i) {
+			t.Fatalf("Expected request %d to be allowed, got %d with %s left", i+1, rec.Code, rec.Header().Get("X-RateLimit-Remaining"))
+		}
+	}
+	rec := get(limited)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected the key to be over its limit, got %d", rec.Code)
+	}
+
+	if rec := get(other); rec.Code != http.StatusOK || rec.Header().Get("X-RateLimit-Limit") != strconv.Itoa(apikeys.DefaultRateLimit) {
+		t.Errorf("Expected other keys to keep their own limit, got %d", rec.Code)
+	}
+
+	// The limit starts again in the next window
+	key, _ := apikeys.Lookup(limited, "", time.Now())
+	if allowed, _, _ := apikeys.Allow(key, time.Now().Add(apikeys.RateWindow)); !allowed {
+		t.Errorf("Expected the key to be allowed again after a minute")
+	}
+}
+
+// Test that requests without a key are limited by the address they come from
+func TestAnonymousAPIRateLimit(t *testing.T) {
+	limit := apikeys.AnonymousRateLimit
+	t.Cleanup(func() { apikeys.AnonymousRateLimit = limit })
+	apikeys.AnonymousRateLimit = 2
+	r := newAPIRouter()
+
+	get := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/movies", nil)
+		req.RemoteAddr = ip + ":40000"
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := get("198.51.100.7"); rec.Code != http.StatusOK || rec.Header().Get("X-RateLimit-Limit") != "2" {
+			t.Fatalf("Expected request %d to be allowed, got %d", i+1, rec.Code)
+		}
+	}
+	if rec := get("198.51.100.7"); rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected the address to be over its limit, got %d", rec.Code)
+	}
+	if rec := get("198.51.100.8"); rec.Code != http.StatusOK {
+		t.Errorf("Expected other addresses to keep their own limit, got %d", rec.Code)
+	}
+
+	// Windows that have ended are forgotten, starting the limit again
+	apikeys.PruneWindows(time.Now().Add(apikeys.RateWindow))
+	if allowed, _, _ := apikeys.AllowAddress("198.51.100.7", time.Now()); !allowed {
+		t.Errorf("Expected the address to be allowed again once its window was pruned")
+	}
+
+	// Requests without a key never get more than keys do
+	apikeys.AnonymousRateLimit = apikeys.DefaultRateLimit + 1
+	if rec := get("198.51.100.9"); rec.Header().Get("X-RateLimit-Limit") != strconv.Itoa(apikeys.DefaultRateLimit) {
+		t.Errorf("Expected the limit without a key to be capped at %d, got %s", apikeys.DefaultRateLimit, rec.Header().Get("X-RateLimit-Limit"))
+	}
+}
+
+// Test that partners' bookings record their key, and that a key may look up
+// and, with the cancel scope, cancel only the bookings made with it
+func TestAPIKeyBookings(t *testing.T) {
+	database.DB.Exec("DELETE FROM api_keys")
+	database.DB.Exec("DELETE FROM cancellations")
+	database.DB.Exec("DELETE FROM bookings")
+	database.DB.Exec("DELETE FROM shows")
+	database.DB.Exec("DELETE FROM movies")
+	show := setupTestShow(t)
+	r := newAPIRouter()
+
+	partner, partnerKey := issueKey(t, "Reseller", 0, models.ScopeCreateBookings, models.ScopeCancelBookings)
+	rival, _ := issueKey(t, "Rival", 0, models.ScopeCreateBookings, models.ScopeCancelBookings)
+	bookOnly, _ := issueKey(t, "Book Only", 0, models.ScopeCreateBookings)
+
+	code, created := partnerRequest(t, r, "POST", "/api/v1/bookings", partner, map[string]interface{}{
+		"show_id":       show.ID,
+		"customer_name": "Resold Customer",
+		"email":         "resold@example.com",
+		"seats":         []map[string]interface{}{{"row": "D", "number": 4}},
+		"payment_token": "tok_approve",
+	})
+	if code != http.StatusCreated {
+		t.Fatalf("Expected the partner to book, got %d: %s", code, created.Error)
+	}
+	reference := created.Data.(map[string]interface{})["reference"].(string)
+
+	var booking models.Booking
+	database.DB.Where("reference = ?", reference).First(&booking)
+	if booking.APIKeyID == nil || *booking.APIKeyID != partnerKey.ID {
+		t.Errorf("Expected the booking to record the partner's key, got %v", booking.APIKeyID)
+	}
+
+	path := "/api/v1/bookings/" + reference
+	if code, _ := partnerRequest(t, r, "GET", path, partner, nil); code != http.StatusOK {
+		t.Errorf("Expected the partner to look up its booking, got %d", code)
+	}
+	if code, _ := partnerRequest(t, r, "GET", path, rival, nil); code != http.StatusNotFound {
+		t.Errorf("Expected another partner not to look up the booking, got %d", code)
+	}
+	if code, _ := partnerRequest(t, r, "DELETE", path, bookOnly, nil); code != http.StatusForbidden {
+		t.Errorf("Expected a key without the cancel scope to be refused, got %d", code)
+	}
+	if code, _ := partnerRequest(t, r, "DELETE", path, rival, nil); code != http.StatusNotFound {
+		t.Errorf("Expected another partner not to cancel the booking, got %d", code)
+	}
+	if code, cancelled := partnerRequest(t, r, "DELETE", path, partner, nil); code != http.StatusOK {
+		t.Fatalf("Expected the partner to cancel its booking, got %d: %s", code, cancelled.Error)
+	}
+
+	var cancellation models.Cancellation
+	database.DB.Where("booking_id = ?", booking.ID).First(&cancellation)
+	if cancellation.CancelledBy != models.CancelledByPartner || cancellation.APIKeyID == nil || *cancellation.APIKeyID != partnerKey.ID {
+		t.Errorf("Expected the cancellation to record the partner, got %s %v", cancellation.CancelledBy, cancellation.APIKeyID)
+	}
+}
+
+// Test that only admins issue and revoke API keys
+func TestAdminAPIKeys(t *testing.T) {
+	database.DB.Exec("DELETE FROM api_keys")
+	setupRoleUsers(t)
+
+	r := mux.NewRouter()
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(middleware.AuthMiddleware)
+	admin.Handle("/api-keys", middleware.RequirePermission(models.PermManageAPIKeys)(http.HandlerFunc(handlers.AdminCreateAPIKeyHandler))).Methods("POST")
+	admin.Handle("/api-keys/{id:[0-9]+}/revoke", middleware.RequirePermission(models.PermManageAPIKeys)(http.HandlerFunc(handlers.AdminRevokeAPIKeyHandler))).Methods("POST")
+
+	form := url.Values{"name": {"Reseller"}, "scopes": {"read_catalog", "create_bookings"}, "rate_limit": {"120"}}
+	if rec := adminRequest(r, "POST", "/admin/api-keys", models.RoleManager, form); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected managers not to issue API keys, got %d", rec.Code)
+	}
+	if rec := adminRequest(r, "POST", "/admin/api-keys", models.RoleAdmin, url.Values{"name": {"No Scopes"}}); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected a key without scopes to be refused, got %d", rec.Code)
+	}
+	if rec := adminRequest(r, "POST", "/admin/api-keys", models.RoleAdmin, url.Values{"name": {"Bad"}, "scopes": {"delete_everything"}}); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected an unknown scope to be refused, got %d", rec.Code)
+	}
+	if rec := adminRequest(r, "POST", "/admin/api-keys", models.RoleAdmin, form); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the admin to issue a key, got %d", rec.Code)
+	}
+
+	var key models.APIKey
+	if err := database.DB.Where("name = ?", "Reseller").First(&key).Error; err != nil {
+		t.Fatalf("Expected the key to be saved: %v", err)
+	}
+	if key.RateLimit != 120 || !key.Can(models.ScopeReadCatalog) || !key.Can(models.ScopeCreateBookings) || key.Can(models.ScopeCancelBookings) {
+		t.Errorf("Expected the key to have the chosen limit and scopes, got %d %v", key.RateLimit, key.Scopes)
+	}
+
+	path := "/admin/api-keys/" + strconv.Itoa(int(key.ID)) + "/revoke"
+	if rec := adminRequest(r, "POST", path, models.RoleAdmin, nil); rec.Code != http.StatusSeeOther {
+		t.Fatalf("Expected the key to be revoked, got %d", rec.Code)
+	}
+	var revoked models.APIKey
+	database.DB.First(&revoked, key.ID)
+	if !revoked.Revoked() {
+		t.Errorf("Expected the key to be revoked")
+	}
+	if rec := adminRequest(r, "POST", path, models.RoleAdmin, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected revoking a revoked key to give 404, got %d", rec.Code)
+	}
+}
@@ -2,42 +2,14 @@ package tests
 
 import (
 	"encoding/json"
-	"os"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/JoeDkhar/cinema-booking-system/internal/database"
 	"github.com/JoeDkhar/cinema-booking-system/internal/models"
-	"gorm.io/driver/sqlite"
-	"gorm.io/gorm"
 )
 
-// TestMain sets up the test database
-func TestMain(m *testing.M) {
-	// Set up a test database
-	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
-	if err != nil {
-		panic("failed to connect to test database")
-	}
-
-	database.DB = db
-
-	// Migrate the schema
-	err = db.AutoMigrate(
-		&models.Movie{},
-		&models.Show{},
-		&models.Booking{},
-		&models.User{},
-	)
-	if err != nil {
-		panic("failed to migrate test database")
-	}
-
-	// Run tests
-	os.Exit(m.Run())
-}
-
 // setupTestShow creates a test show with 100 seats
 func setupTestShow(t *testing.T) models.Show {
 	movie := models.Movie{
@@ -51,12 +23,20 @@ func setupTestShow(t *testing.T) models.Show {
 		t.Fatalf("Error creating test movie: %v", err)
 	}
 
+	hall := models.Hall{
+		Number: 1,
+		Layout: models.UniformLayout([]string{"A", "B", "C", "D", "E", "F", "G", "H", "I", "J"}, 10),
+	}
+
+	if err := database.DB.Where("number = ?", hall.Number).FirstOrCreate(&hall).Error; err != nil {
+		t.Fatalf("Error creating test hall: %v", err)
+	}
+
 	show := models.Show{
 		MovieID:     movie.ID,
 		DateTime:    time.Now().Add(24 * time.Hour),
-		HallNumber:  1,
-		TotalSeats:  100,
-		TicketPrice: 10.0,
+		HallID:      hall.ID,
+		TicketPrice: usd(1000),
 	}
 
 	if err := database.DB.Create(&show).Error; err != nil {
@@ -87,7 +67,7 @@ func TestCreateBooking(t *testing.T) {
 		Email:        "john@example.com",
 		Seats:        seats,
 		BookingTime:  time.Now(),
-		TotalAmount:  float64(len(seats)) * show.TicketPrice,
+		TotalAmount:  show.TicketPrice.Mul(int64(len(seats))),
 		Confirmed:    true,
 	}
 
@@ -109,8 +89,8 @@ func TestCreateBooking(t *testing.T) {
 		t.Errorf("Expected 2 seats, got %d", len(savedBooking.Seats))
 	}
 
-	if savedBooking.TotalAmount != 20.0 {
-		t.Errorf("Expected total amount 20.0, got %.2f", savedBooking.TotalAmount)
+	if savedBooking.TotalAmount != usd(2000) {
+		t.Errorf("Expected total amount $20.00, got %s", savedBooking.TotalAmount)
 	}
 }
 
@@ -172,7 +152,7 @@ func TestConcurrentBooking(t *testing.T) {
 					Email:        customerName + "@example.com",
 					Seats:        seats,
 					BookingTime:  time.Now(),
-					TotalAmount:  float64(len(seats)) * show.TicketPrice,
+					TotalAmount:  show.TicketPrice.Mul(int64(len(seats))),
 					Confirmed:    true,
 				}
 
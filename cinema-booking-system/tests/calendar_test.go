@@ -0,0 +1,201 @@
+package tests
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/calendar"
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/handlers"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/gorilla/mux"
+)
+
+// icsEvent is the properties of one VEVENT of a calendar
+type icsEvent map[string]string
+
+// parseCalendar unfolds an iCalendar file and returns its events
+func parseCalendar(t *testing.T, data string) []icsEvent {
+	if !strings.HasPrefix(data, "BEGIN:VCALENDAR\r\n") || !strings.HasSuffix(data, "END:VCALENDAR\r\n") {
+		t.Fatalf("Expected a calendar, got %q", data)
+	}
+
+	var events []icsEvent
+	var current icsEvent
+	for _, line := range strings.Split(strings.ReplaceAll(data, "\r\n ", ""), "\r\n") {
+		name, value, _ := strings.Cut(line, ":")
+		switch {
+		case line == "BEGIN:VEVENT":
+			current = icsEvent{}
+		case line == "END:VEVENT":
+			events = append(events, current)
+			current = nil
+		case current != nil:
+			current[name] = value
+		}
+	}
+	return events
+}
+
+// Test that long and special text is escaped and folded as iCalendar requires
+func TestCalendarFormat(t *testing.T) {
+	start := time.Date(2030, 3, 14, 19, 30, 0, 0, time.FixedZone("CET", 3600))
+	cal := calendar.Calendar{
+		Name: "Late shows",
+		Events: []calendar.Event{{
+			UID:         "show-1@cinema.test",
+			Start:       start,
+			End:         start.Add(150 * time.Minute),
+			Summary:     "Crouching Tiger, Hidden Dragon; Director's Cut",
+			Location:    "Hall 1",
+			Description: strings.Repeat("Ünïcödé ", 20) + "\nSecond line",
+		}},
+	}
+
+	var buf bytes.Buffer
+	if err := cal.Write(&buf, time.Now()); err != nil {
+		t.Fatalf("Error writing calendar: %v", err)
+	}
+
+	for _, line := range strings.Split(buf.String(), "\r\n") {
+		if len(line) > 75 {
+			t.Errorf("Expected lines of at most 75 octets, got %d: %q", len(line), line)
+		}
+		if !utf8.ValidString(line) {
+			t.Errorf("Expected folding to keep characters whole, got %q", line)
+		}
+	}
+
+	events := parseCalendar(t, buf.String())
+	if len(events) != 1 {
+		t.Fatalf("Expected one event, got %d", len(events))
+	}
+	event := events[0]
+	if event["SUMMARY"] != `Crouching Tiger\, Hidden Dragon\; Director's Cut` {
+		t.Errorf("Unexpected summary %q", event["SUMMARY"])
+	}
+	if event["DESCRIPTION"] != strings.Repeat("Ünïcödé ", 20)+`\nSecond line` {
+		t.Errorf("Unexpected description %q", event["DESCRIPTION"])
+	}
+	if event["DTSTART"] != "20300314T183000Z" || event["DTEND"] != "20300314T210000Z" {
+		t.Errorf("Expected times in UTC, got %s to %s", event["DTSTART"], event["DTEND"])
+	}
+}
+
+// Test that a confirmed booking can be added to a calendar
+func TestBookingCalendar(t *testing.T) {
+	database.DB.Exec("DELETE FROM cancellations")
+	database.DB.Exec("DELETE FROM bookings")
+	database.DB.Exec("DELETE FROM shows")
+	database.DB.Exec("DELETE FROM movies")
+	show := setupTestShow(t)
+
+	booked := submitBooking(handlers.BookingRequest{
+		ShowID:       show.ID,
+		CustomerName: "Calendar User",
+		Email:        "calendar@example.com",
+		Seats:        models.Seats{{Row: "D", Number: 7}, {Row: "D", Number: 8}},
+	})
+	if !booked.Success {
+		t.Fatalf("Expected booking to succeed, got %s", booked.ErrorMessage)
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/booking/confirmation/{reference}/booking.ics", handlers.BookingCalendarHandler).Methods("GET")
+	download := func(reference string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest("GET", "/booking/confirmation/"+reference+"/booking.ics", nil))
+		return rec
+	}
+
+	rec := download(booked.Reference)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the calendar event, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if contentType := rec.Header().Get("Content-Type"); contentType != "text/calendar; charset=utf-8" {
+		t.Errorf("Expected a calendar, got %q", contentType)
+	}
+
+	events := parseCalendar(t, rec.Body.String())
+	if len(events) != 1 {
+		t.Fatalf("Expected one event, got %d", len(events))
+	}
+	event := events[0]
+	start := show.DateTime.UTC().Format("20060102T150405Z")
+	end := show.DateTime.Add(120 * time.Minute).UTC().Format("20060102T150405Z")
+	if event["DTSTART"] != start || event["DTEND"] != end {
+		t.Errorf("Expected the event to last the movie from %s to %s, got %s to %s", start, end, event["DTSTART"], event["DTEND"])
+	}
+	if event["SUMMARY"] != "Test Movie" || event["LOCATION"] != "Hall 1" {
+		t.Errorf("Unexpected event %v", event)
+	}
+	if !strings.HasPrefix(event["UID"], "booking-"+booked.Reference+"@") {
+		t.Errorf("Expected a UID for the booking, got %q", event["UID"])
+	}
+	if !strings.Contains(event["DESCRIPTION"], "D7\\, D8") {
+		t.Errorf("Expected the seats in the description, got %q", event["DESCRIPTION"])
+	}
+
+	// Cancelled bookings are no longer offered
+	cancelled := submitBooking(handlers.BookingRequest{Action: handlers.ActionCancel, BookingID: booked.BookingID})
+	if !cancelled.Success {
+		t.Fatalf("Expected cancellation to succeed, got %s", cancelled.ErrorMessage)
+	}
+	if rec := download(booked.Reference); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected no event for a cancelled booking, got %d", rec.Code)
+	}
+}
+
+// Test that a movie's feed lists its upcoming shows only
+func TestMovieCalendarFeed(t *testing.T) {
+	database.DB.Exec("DELETE FROM cancellations")
+	database.DB.Exec("DELETE FROM bookings")
+	database.DB.Exec("DELETE FROM shows")
+	database.DB.Exec("DELETE FROM movies")
+	show := setupTestShow(t)
+
+	later := models.Show{MovieID: show.MovieID, HallID: show.HallID, DateTime: show.DateTime.Add(48 * time.Hour), TicketPrice: usd(1200)}
+	past := models.Show{MovieID: show.MovieID, HallID: show.HallID, DateTime: time.Now().Add(-48 * time.Hour), TicketPrice: usd(1000)}
+	database.DB.Create(&later)
+	database.DB.Create(&past)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/movies/{id:[0-9]+}/shows.ics", handlers.MovieCalendarHandler).Methods("GET")
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/movies/"+strconv.Itoa(int(show.MovieID))+"/shows.ics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the feed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), "X-WR-CALNAME:Test Movie\r\n") {
+		t.Errorf("Expected the feed to be named after the movie")
+	}
+
+	events := parseCalendar(t, rec.Body.String())
+	if len(events) != 2 {
+		t.Fatalf("Expected the two upcoming shows, got %d", len(events))
+	}
+	for i, expected := range []models.Show{show, later} {
+		if events[i]["DTSTART"] != expected.DateTime.UTC().Format("20060102T150405Z") {
+			t.Errorf("Expected show %d at %s, got %s", i, expected.DateTime.UTC(), events[i]["DTSTART"])
+		}
+		if !strings.HasPrefix(events[i]["UID"], "show-"+strconv.Itoa(int(expected.ID))+"@") {
+			t.Errorf("Expected a UID for show %d, got %q", expected.ID, events[i]["UID"])
+		}
+		if !strings.HasSuffix(events[i]["URL"], "/shows/"+strconv.Itoa(int(expected.ID))) {
+			t.Errorf("Expected a link to book show %d, got %q", expected.ID, events[i]["URL"])
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/movies/999999/shows.ics", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected no feed for an unknown movie, got %d", rec.Code)
+	}
+}
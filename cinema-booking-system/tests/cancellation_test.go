@@ -0,0 +1,163 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/handlers"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/money"
+)
+
+// Test the refund percentages of the cancellation policy
+func TestCancellationPolicyRefund(t *testing.T) {
+	policy := models.CancellationPolicy{FullRefundBefore: 24 * time.Hour, PartialRefundPercent: 50}
+	showTime := time.Date(2030, 1, 10, 19, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name    string
+		now     time.Time
+		percent int
+		refund  money.Money
+	}{
+		{"two days before", showTime.Add(-48 * time.Hour), 100, usd(2500)},
+		{"exactly 24h before", showTime.Add(-24 * time.Hour), 100, usd(2500)},
+		{"an hour before", showTime.Add(-time.Hour), 50, usd(1250)},
+		{"at show time", showTime, 0, usd(0)},
+		{"after start", showTime.Add(time.Hour), 0, usd(0)},
+	}
+
+	for _, c := range cases {
+		if got := policy.RefundPercent(showTime, c.now); got != c.percent {
+			t.Errorf("%s: expected %d%%, got %d%%", c.name, c.percent, got)
+		}
+		if got := policy.Refund(usd(2500), showTime, c.now); got != c.refund {
+			t.Errorf("%s: expected refund %s, got %s", c.name, c.refund, got)
+		}
+	}
+}
+
+// Test cancelling part of a booking and then the rest of it
+func TestPartialCancellation(t *testing.T) {
+	database.DB.Exec("DELETE FROM cancellations")
+	database.DB.Exec("DELETE FROM bookings")
+	database.DB.Exec("DELETE FROM shows")
+	database.DB.Exec("DELETE FROM movies")
+
+	show := setupTestShow(t)
+
+	booked := submitBooking(handlers.BookingRequest{
+		ShowID:       show.ID,
+		CustomerName: "Group",
+		Email:        "group@example.com",
+		Seats:        models.Seats{{Row: "J", Number: 1}, {Row: "J", Number: 2}, {Row: "J", Number: 3}},
+	})
+	if !booked.Success {
+		t.Fatalf("Expected booking to succeed, got %s", booked.ErrorMessage)
+	}
+
+	// Seats outside the booking cannot be cancelled
+	wrong := submitBooking(handlers.BookingRequest{
+		Action:    handlers.ActionCancel,
+		BookingID: booked.BookingID,
+		Seats:     models.Seats{{Row: "J", Number: 4}},
+	})
+	if wrong.Success || wrong.Error.Code != handlers.ErrCodeInvalidSeats {
+		t.Errorf("Expected cancelling a seat outside the booking to fail, got %+v", wrong.Error)
+	}
+
+	partial := submitBooking(handlers.BookingRequest{
+		Action:    handlers.ActionCancel,
+		BookingID: booked.BookingID,
+		Seats:     models.Seats{{Row: "J", Number: 2}},
+	})
+	if !partial.Success {
+		t.Fatalf("Expected partial cancellation to succeed, got %s", partial.ErrorMessage)
+	}
+
+	var booking models.Booking
+	database.DB.First(&booking, booked.BookingID)
+	if booking.Status != models.BookingConfirmed || len(booking.Seats) != 2 {
+		t.Errorf("Expected a confirmed booking with 2 seats, got %s with %d", booking.Status, len(booking.Seats))
+	}
+	// The test show starts in just under 24 hours, so half the seat price is refunded
+	if booking.TotalAmount != usd(2000) || booking.RefundedAmount != usd(500) {
+		t.Errorf("Expected total $20.00 and refund $5.00, got %s and %s", booking.TotalAmount, booking.RefundedAmount)
+	}
+
+	// The cancelled seat can be booked by someone else straight away
+	rebook := submitBooking(handlers.BookingRequest{
+		ShowID:       show.ID,
+		CustomerName: "Other",
+		Email:        "other@example.com",
+		Seats:        models.Seats{{Row: "J", Number: 2}},
+	})
+	if !rebook.Success {
+		t.Errorf("Expected the cancelled seat to be bookable, got %s", rebook.ErrorMessage)
+	}
+
+	rest := submitBooking(handlers.BookingRequest{Action: handlers.ActionCancel, BookingID: booked.BookingID})
+	if !rest.Success {
+		t.Fatalf("Expected full cancellation to succeed, got %s", rest.ErrorMessage)
+	}
+
+	database.DB.First(&booking, booked.BookingID)
+	if booking.Status != models.BookingCancelled {
+		t.Errorf("Expected booking to be cancelled, got %s", booking.Status)
+	}
+
+	var cancellations []models.Cancellation
+	database.DB.Where("booking_id = ?", booked.BookingID).Find(&cancellations)
+	if len(cancellations) != 2 {
+		t.Errorf("Expected 2 cancellation records, got %d", len(cancellations))
+	}
+}
+
+// Test that a booking whose amounts are in different currencies, such as one
+// stored before the site's currency changed, is refused rather than bringing
+// down the booking processor
+func TestCancellationCurrencyMismatch(t *testing.T) {
+	database.DB.Exec("DELETE FROM cancellations")
+	database.DB.Exec("DELETE FROM bookings")
+	database.DB.Exec("DELETE FROM shows")
+	database.DB.Exec("DELETE FROM movies")
+
+	show := setupTestShow(t)
+	booked := submitBooking(handlers.BookingRequest{
+		ShowID:       show.ID,
+		CustomerName: "Traveller",
+		Email:        "traveller@example.com",
+		Seats:        models.Seats{{Row: "J", Number: 1}, {Row: "J", Number: 2}},
+	})
+	if !booked.Success {
+		t.Fatalf("Expected booking to succeed, got %s", booked.ErrorMessage)
+	}
+
+	var booking models.Booking
+	database.DB.First(&booking, booked.BookingID)
+	for i := range booking.Prices {
+		booking.Prices[i].Price = money.New(booking.Prices[i].Price.Amount, "EUR")
+	}
+	database.DB.Save(&booking)
+
+	cancelled := submitBooking(handlers.BookingRequest{
+		Action:    handlers.ActionCancel,
+		BookingID: booked.BookingID,
+		Seats:     models.Seats{{Row: "J", Number: 1}},
+	})
+	if cancelled.Success || cancelled.Error.Code != handlers.ErrCodeCurrencyMismatch {
+		t.Fatalf("Expected the cancellation to be refused, got %+v", cancelled.Error)
+	}
+
+	// The processor keeps serving other requests
+	other := submitBooking(handlers.BookingRequest{
+		ShowID:       show.ID,
+		CustomerName: "Other",
+		Email:        "other@example.com",
+		Seats:        models.Seats{{Row: "J", Number: 3}},
+	})
+	if !other.Success {
+		t.Errorf("Expected the next booking to succeed, got %s", other.ErrorMessage)
+	}
+}
@@ -0,0 +1,226 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/handlers"
+	"github.com/JoeDkhar/cinema-booking-system/internal/middleware"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/tickets"
+	"github.com/gorilla/mux"
+)
+
+// setupCheckIn creates a show starting soon, a staff member and a customer
+// account, with a fresh ticket secret
+func setupCheckIn(t *testing.T) models.Show {
+	database.DB.Exec("DELETE FROM tickets")
+	database.DB.Exec("DELETE FROM cancellations")
+	database.DB.Exec("DELETE FROM bookings")
+	database.DB.Exec("DELETE FROM shows")
+	database.DB.Exec("DELETE FROM movies")
+	database.DB.Exec("DELETE FROM users")
+
+	previous := handlers.TicketSecret
+	handlers.TicketSecret = []byte("door secret")
+	t.Cleanup(func() { handlers.TicketSecret = previous })
+
+	createSession(t, models.User{Username: "door", Email: "door@cinema.test", Role: models.RoleBoxOffice}, "staff-session")
+	createSession(t, models.User{Username: "customer", Email: "customer@example.com"}, "customer-session")
+
+	show := setupTestShow(t)
+	show.DateTime = time.Now().Add(30 * time.Minute)
+	database.DB.Model(&show).UpdateColumn("date_time", show.DateTime)
+	return show
+}
+
+// scanTicket posts a ticket token to the check-in endpoint with a session
+func scanTicket(t *testing.T, session, token string) (int, handlers.APIResponse) {
+	r := mux.NewRouter()
+	r.Handle("/api/v1/checkin", middleware.RequireAPIPermission(models.PermCheckIn)(http.HandlerFunc(handlers.APICheckInHandler))).Methods("POST")
+
+	body, _ := json.Marshal(map[string]string{"token": token})
+	req := httptest.NewRequest("POST", "/api/v1/checkin", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if session != "" {
+		req.AddCookie(&http.Cookie{Name: "session", Value: session})
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	var response handlers.APIResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Error decoding response %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, response
+}
+
+// ticketToken returns the token printed on the ticket for a seat
+func ticketToken(t *testing.T, bookingID uint, seat models.Seat) string {
+	var ticket models.Ticket
+	if err := database.DB.Where("booking_id = ? AND seat = ?", bookingID, seat.String()).First(&ticket).Error; err != nil {
+		t.Fatalf("Expected a ticket for %s: %v", seat, err)
+	}
+	return ticket.Token
+}
+
+// errorCode returns the booking error code of a failed API response
+func errorCode(response handlers.APIResponse) string {
+	details, _ := response.Details.(map[string]interface{})
+	code, _ := details["code"].(string)
+	return code
+}
+
+// Test that a ticket admits its holder once and is refused afterwards
+func TestCheckIn(t *testing.T) {
+	show := setupCheckIn(t)
+
+	seats := models.Seats{{Row: "A", Number: 1}, {Row: "A", Number: 2, TicketType: models.TicketChild}}
+	booked := submitBooking(handlers.BookingRequest{
+		ShowID:       show.ID,
+		CustomerName: "Moviegoer",
+		Email:        "goer@example.com",
+		Seats:        seats,
+	})
+	if !booked.Success {
+		t.Fatalf("Expected booking to succeed, got %s", booked.ErrorMessage)
+	}
+
+	var issued int64
+	database.DB.Model(&models.Ticket{}).Where("booking_id = ? AND status = ?", booked.BookingID, models.TicketIssued).Count(&issued)
+	if issued != 2 {
+		t.Fatalf("Expected a ticket per seat, got %d", issued)
+	}
+	token := ticketToken(t, booked.BookingID, seats[1])
+
+	// Only staff may check tickets in
+	if code, _ := scanTicket(t, "", token); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a session, got %d", code)
+	}
+	if code, _ := scanTicket(t, "customer-session", token); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a customer, got %d", code)
+	}
+
+	code, response := scanTicket(t, "staff-session", token)
+	if code != http.StatusOK {
+		t.Fatalf("Expected the ticket to be admitted, got %d: %s", code, response.Error)
+	}
+	data, _ := response.Data.(map[string]interface{})
+	if data["seat"] != "A2" || data["ticket_type"] != string(models.TicketChild) || data["reference"] != booked.Reference {
+		t.Errorf("Unexpected check-in result %v", data)
+	}
+
+	// Scanning the same ticket again is a replay
+	code, response = scanTicket(t, "staff-session", token)
+	if code != http.StatusConflict || errorCode(response) != string(handlers.ErrCodeAlreadyAdmitted) {
+		t.Errorf("Expected a replay to be refused, got %d: %v", code, response.Details)
+	}
+
+	var ticket models.Ticket
+	database.DB.Where("booking_id = ? AND seat = ?", booked.BookingID, "A2").First(&ticket)
+	var staff models.User
+	database.DB.Where("username = ?", "door").First(&staff)
+	if ticket.Status != models.TicketAdmitted || ticket.AdmittedAt == nil || ticket.AdmittedBy == nil || *ticket.AdmittedBy != staff.ID {
+		t.Errorf("Expected the ticket to record its admission by staff, got %+v", ticket)
+	}
+
+	// A forged ticket fails the signature check
+	forged := tickets.Sign([]byte("guessed secret"), tickets.Claims{Reference: booked.Reference, ShowID: show.ID, Seat: "A1"})
+	if code, response := scanTicket(t, "staff-session", forged); code != http.StatusUnprocessableEntity || errorCode(response) != string(handlers.ErrCodeTicketInvalid) {
+		t.Errorf("Expected a forged ticket to be refused, got %d: %v", code, response.Details)
+	}
+}
+
+// Test that copies of a ticket scanned at the same time admit only one person
+func TestCheckInConcurrentScans(t *testing.T) {
+	show := setupCheckIn(t)
+
+	booked := submitBooking(handlers.BookingRequest{
+		ShowID:       show.ID,
+		CustomerName: "Copier",
+		Email:        "copier@example.com",
+		Seats:        models.Seats{{Row: "B", Number: 1}},
+	})
+	if !booked.Success {
+		t.Fatalf("Expected booking to succeed, got %s", booked.ErrorMessage)
+	}
+	token := ticketToken(t, booked.BookingID, models.Seat{Row: "B", Number: 1})
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	admitted := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if code, _ := scanTicket(t, "staff-session", token); code == http.StatusOK {
+				mutex.Lock()
+				admitted++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if admitted != 1 {
+		t.Errorf("Expected exactly one admission, got %d", admitted)
+	}
+}
+
+// Test that cancelled seats and tickets for other times are turned away
+func TestCheckInRejections(t *testing.T) {
+	show := setupCheckIn(t)
+
+	booked := submitBooking(handlers.BookingRequest{
+		ShowID:       show.ID,
+		CustomerName: "Changed Mind",
+		Email:        "changed@example.com",
+		Seats:        models.Seats{{Row: "C", Number: 1}, {Row: "C", Number: 2}},
+	})
+	if !booked.Success {
+		t.Fatalf("Expected booking to succeed, got %s", booked.ErrorMessage)
+	}
+	cancelledToken := ticketToken(t, booked.BookingID, models.Seat{Row: "C", Number: 2})
+
+	cancelled := submitBooking(handlers.BookingRequest{
+		Action:    handlers.ActionCancel,
+		BookingID: booked.BookingID,
+		Seats:     models.Seats{{Row: "C", Number: 2}},
+	})
+	if !cancelled.Success {
+		t.Fatalf("Expected cancellation to succeed, got %s", cancelled.ErrorMessage)
+	}
+	if code, response := scanTicket(t, "staff-session", cancelledToken); code != http.StatusConflict || errorCode(response) != string(handlers.ErrCodeTicketVoid) {
+		t.Errorf("Expected a cancelled seat's ticket to be void, got %d: %v", code, response.Details)
+	}
+
+	// Bookings confirmed before tickets existed are issued one at the door
+	database.DB.Exec("DELETE FROM tickets WHERE booking_id = ?", booked.BookingID)
+	var booking models.Booking
+	database.DB.First(&booking, booked.BookingID)
+	legacy := tickets.Token(handlers.TicketSecret, booking, models.Seat{Row: "C", Number: 1})
+	if code, response := scanTicket(t, "staff-session", legacy); code != http.StatusOK {
+		t.Errorf("Expected a ticket from before check-in to be admitted, got %d: %s", code, response.Error)
+	}
+	if code, _ := scanTicket(t, "staff-session", legacy); code != http.StatusConflict {
+		t.Errorf("Expected the issued ticket to be admitted only once, got %d", code)
+	}
+
+	// Tickets are only accepted around the show's time
+	for name, showTime := range map[string]time.Time{
+		"tomorrow": time.Now().Add(24 * time.Hour),
+		"ended":    time.Now().Add(-3 * time.Hour),
+	} {
+		database.DB.Model(&models.Show{}).Where("id = ?", show.ID).UpdateColumn("date_time", showTime)
+		database.DB.Model(&models.Ticket{}).Where("booking_id = ?", booked.BookingID).UpdateColumn("status", models.TicketIssued)
+		if code, response := scanTicket(t, "staff-session", legacy); code != http.StatusConflict || errorCode(response) != string(handlers.ErrCodeShowNotCurrent) {
+			t.Errorf("%s: expected the show not to be current, got %d: %v", name, code, response.Details)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/middleware"
+	"github.com/JoeDkhar/cinema-booking-system/internal/sessions"
+	"github.com/gorilla/mux"
+)
+
+// newCSRFRouter serves a form post, a JSON API and a page showing the token
+func newCSRFRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.Use(middleware.CORSMiddleware)
+	r.Use(middleware.CSRFMiddleware)
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(middleware.CSRFToken(r)))
+	}
+	r.HandleFunc("/form", ok).Methods("GET", "POST")
+	r.HandleFunc("/api/v1/bookings", ok).Methods("POST")
+	r.HandleFunc("/api/v1/bookings/{reference}", ok).Methods("DELETE")
+	return r
+}
+
+// csrfCookie fetches a page to get the browser's CSRF cookie
+func csrfCookie(t *testing.T, r http.Handler) *http.Cookie {
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/form", nil))
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == middleware.CSRFFieldName {
+			if cookie.Value != rec.Body.String() {
+				t.Fatalf("Expected pages to get the cookie's token, got %q and %q", cookie.Value, rec.Body.String())
+			}
+			return cookie
+		}
+	}
+	t.Fatalf("Expected a CSRF cookie")
+	return nil
+}
+
+// csrfRequest sends a request with headers and an optional cookie
+func csrfRequest(r http.Handler, method, path, contentType, body string, cookie *http.Cookie, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+// Test that state-changing requests must prove they came from the site
+func TestCSRFMiddleware(t *testing.T) {
+	middleware.AllowedOrigins = []string{"https://partner.example"}
+	defer func() { middleware.AllowedOrigins = nil }()
+
+	r := newCSRFRouter()
+	cookie := csrfCookie(t, r)
+	if !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Errorf("Expected an HttpOnly, SameSite=Lax cookie, got %+v", cookie)
+	}
+
+	// A returning browser keeps its token
+	if rec := csrfRequest(r, "GET", "/form", "", "", cookie, nil); rec.Body.String() != cookie.Value || len(rec.Result().Cookies()) != 0 {
+		t.Errorf("Expected the browser's token to be reused")
+	}
+
+	form := "application/x-www-form-urlencoded"
+	valid := url.Values{middleware.CSRFFieldName: {cookie.Value}}.Encode()
+	tests := []struct {
+		name                      string
+		method, path, contentType string
+		body                      string
+		cookie                    *http.Cookie
+		headers                   map[string]string
+		expected                  int
+	}{
+		{"form with token", "POST", "/form", form, valid, cookie, nil, http.StatusOK},
+		{"form without token", "POST", "/form", form, "", cookie, nil, http.StatusForbidden},
+		{"form without cookie", "POST", "/form", form, valid, nil, nil, http.StatusForbidden},
+		{"form with another token", "POST", "/form", form, url.Values{middleware.CSRFFieldName: {strings.Repeat("a", 32)}}.Encode(), cookie, nil, http.StatusForbidden},
+		{"token in header", "POST", "/form", form, "", cookie, map[string]string{middleware.CSRFHeaderName: cookie.Value}, http.StatusOK},
+		{"same site origin", "POST", "/form", form, valid, cookie, map[string]string{"Origin": "http://example.com"}, http.StatusOK},
+		{"foreign origin", "POST", "/form", form, valid, cookie, map[string]string{"Origin": "https://evil.example"}, http.StatusForbidden},
+		{"sandboxed origin", "POST", "/form", form, valid, cookie, map[string]string{"Origin": "null"}, http.StatusForbidden},
+		{"JSON", "POST", "/api/v1/bookings", "application/json", "{}", nil, nil, http.StatusOK},
+		{"JSON from allowed origin", "POST", "/api/v1/bookings", "application/json; charset=utf-8", "{}", nil, map[string]string{"Origin": "https://partner.example"}, http.StatusOK},
+		{"JSON from foreign origin", "POST", "/api/v1/bookings", "application/json", "{}", nil, map[string]string{"Origin": "https://evil.example"}, http.StatusForbidden},
+		{"JSON disguised as text", "POST", "/api/v1/bookings", "text/plain", "{}", nil, nil, http.StatusForbidden},
+		{"delete", "DELETE", "/api/v1/bookings/ABC123", "", "", nil, nil, http.StatusOK},
+	}
+	for _, test := range tests {
+		rec := csrfRequest(r, test.method, test.path, test.contentType, test.body, test.cookie, test.headers)
+		if rec.Code != test.expected {
+			t.Errorf("Expected %s to give %d, got %d", test.name, test.expected, rec.Code)
+		}
+	}
+
+	// API clients get JSON errors
+	rec := csrfRequest(r, "POST", "/api/v1/bookings", "text/plain", "{}", nil, nil)
+	if rec.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Expected a JSON error, got %q", rec.Header().Get("Content-Type"))
+	}
+}
+
+// Test that only allowed origins may read the site's responses
+func TestCORSAllowedOrigins(t *testing.T) {
+	middleware.AllowedOrigins = []string{"https://partner.example"}
+	defer func() { middleware.AllowedOrigins = nil }()
+	r := newCSRFRouter()
+
+	rec := csrfRequest(r, "GET", "/form", "", "", nil, map[string]string{"Origin": "https://partner.example"})
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://partner.example" {
+		t.Errorf("Expected the allowed origin to be echoed, got %q", got)
+	}
+	if !strings.Contains(rec.Header().Get("Access-Control-Allow-Headers"), middleware.CSRFHeaderName) {
+		t.Errorf("Expected scripts to be allowed to send the CSRF header")
+	}
+	if rec.Header().Get("Vary") != "Origin" {
+		t.Errorf("Expected responses to vary by origin")
+	}
+
+	for _, origin := range []string{"https://evil.example", ""} {
+		rec = csrfRequest(r, "GET", "/form", "", "", nil, map[string]string{"Origin": origin})
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("Expected no CORS access for %q, got %q", origin, got)
+		}
+	}
+}
+
+// Test that cookies follow the configured Secure and SameSite settings
+func TestCookieSettings(t *testing.T) {
+	defer func(secure bool, sameSite http.SameSite) {
+		sessions.SecureCookies, sessions.SameSite = secure, sameSite
+	}(sessions.SecureCookies, sessions.SameSite)
+
+	sessions.SecureCookies = true
+	sessions.SameSite = http.SameSiteStrictMode
+	cookie := csrfCookie(t, newCSRFRouter())
+	if !cookie.Secure || cookie.SameSite != http.SameSiteStrictMode || !cookie.HttpOnly {
+		t.Errorf("Expected a Secure, SameSite=Strict cookie, got %+v", cookie)
+	}
+
+	rec := httptest.NewRecorder()
+	sessions.ClearCookie(rec)
+	if cleared := rec.Result().Cookies()[0]; !cleared.Secure || cleared.SameSite != http.SameSiteStrictMode {
+		t.Errorf("Expected session cookies to share the settings, got %+v", cleared)
+	}
+}
@@ -0,0 +1,206 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/handlers"
+	"github.com/JoeDkhar/cinema-booking-system/internal/middleware"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// groupTestMessage is a message from a group session
+type groupTestMessage struct {
+	Type         string `json:"type"`
+	You          int    `json:"you"`
+	Organizer    bool   `json:"organizer"`
+	Participants []struct {
+		ID        int          `json:"id"`
+		Name      string       `json:"name"`
+		Organizer bool         `json:"organizer"`
+		Seats     models.Seats `json:"seats"`
+	} `json:"participants"`
+	Error       *handlers.BookingError `json:"error"`
+	Reference   string                 `json:"reference"`
+	CheckoutURL string                 `json:"checkout_url"`
+}
+
+// picks returns the seats picked by each participant, e.g. "Org:A1 Friend:A2"
+func (m groupTestMessage) picks() string {
+	var picks []string
+	for _, participant := range m.Participants {
+		picks = append(picks, participant.Name+":"+participant.Seats.String())
+	}
+	return strings.Join(picks, " ")
+}
+
+// startGroupServer serves the group session routes through the logging middleware
+func startGroupServer(t *testing.T) *httptest.Server {
+	r := mux.NewRouter()
+	r.Use(middleware.LoggingMiddleware)
+	r.HandleFunc("/shows/{id:[0-9]+}/group/{code}", handlers.GroupSessionHandler).Methods("GET")
+	r.HandleFunc("/shows/{id:[0-9]+}/group/{code}/ws", handlers.GroupSocketHandler).Methods("GET")
+	r.HandleFunc("/api/v1/shows/{id:[0-9]+}/groups", handlers.APICreateGroupSessionHandler).Methods("POST")
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// joinGroup connects to a group session and reads the welcome message
+func joinGroup(t *testing.T, server *httptest.Server, socketPath, name, token string) *websocket.Conn {
+	query := url.Values{"name": {name}}
+	if token != "" {
+		query.Set("token", token)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+socketPath+"?"+query.Encode(), nil)
+	if err != nil {
+		t.Fatalf("Error joining group as %s: %v", name, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	if welcome := nextGroupMessage(t, conn, "welcome"); welcome.Organizer != (token != "") {
+		t.Errorf("Expected %s to join as organizer %v, got %+v", name, token != "", welcome)
+	}
+	return conn
+}
+
+// nextGroupMessage reads messages until one of the given type arrives
+func nextGroupMessage(t *testing.T, conn *websocket.Conn, messageType string) groupTestMessage {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var message groupTestMessage
+		if err := conn.ReadJSON(&message); err != nil {
+			t.Fatalf("Error waiting for %s message: %v", messageType, err)
+		}
+		if message.Type == messageType {
+			return message
+		}
+	}
+}
+
+// waitForPicks reads state messages until the group's picks match
+func waitForPicks(t *testing.T, conn *websocket.Conn, expected string) {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var message groupTestMessage
+		if err := conn.ReadJSON(&message); err != nil {
+			t.Fatalf("Error waiting for picks %q: %v", expected, err)
+		}
+		if message.Type == "state" && message.picks() == expected {
+			return
+		}
+	}
+}
+
+// sendGroup sends a message to a group session
+func sendGroup(t *testing.T, conn *websocket.Conn, message map[string]interface{}) {
+	if err := conn.WriteJSON(message); err != nil {
+		t.Fatalf("Error sending %v: %v", message, err)
+	}
+}
+
+// Test that friends share their picks and the organizer books them together
+func TestGroupBooking(t *testing.T) {
+	database.DB.Exec("DELETE FROM cancellations")
+	database.DB.Exec("DELETE FROM bookings")
+	database.DB.Exec("DELETE FROM shows")
+	database.DB.Exec("DELETE FROM movies")
+	show := setupTestShow(t)
+	server := startGroupServer(t)
+
+	resp, err := http.Post(server.URL+"/api/v1/shows/"+strconv.Itoa(int(show.ID))+"/groups", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Error creating group: %v", err)
+	}
+	var created struct {
+		Success bool              `json:"success"`
+		Data    map[string]string `json:"data"`
+	}
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || !created.Success {
+		t.Fatalf("Expected a group session, got %d", resp.StatusCode)
+	}
+	socketPath := created.Data["socket_path"]
+
+	organizer := joinGroup(t, server, socketPath, "Org", created.Data["organizer_token"])
+	friend := joinGroup(t, server, socketPath, "Friend", "")
+	waitForPicks(t, organizer, "Org: Friend:")
+
+	// Picks are shared with everyone
+	sendGroup(t, organizer, map[string]interface{}{"type": "select", "seat": map[string]interface{}{"row": "A", "number": 1}})
+	waitForPicks(t, friend, "Org:A1 Friend:")
+	sendGroup(t, friend, map[string]interface{}{"type": "select", "seat": map[string]interface{}{"row": "A", "number": 2, "ticket_type": "child"}})
+	waitForPicks(t, organizer, "Org:A1 Friend:A2")
+
+	// A seat picked by one friend is not available to another
+	sendGroup(t, friend, map[string]interface{}{"type": "select", "seat": map[string]interface{}{"row": "A", "number": 1}})
+	if message := nextGroupMessage(t, friend, "error"); message.Error.Code != handlers.ErrCodeSeatsUnavailable || !strings.Contains(message.Error.Message, "Org") {
+		t.Errorf("Expected A1 to be Org's, got %+v", message.Error)
+	}
+
+	// Seats booked by someone outside the group are dropped from its picks
+	sendGroup(t, friend, map[string]interface{}{"type": "select", "seat": map[string]interface{}{"row": "A", "number": 3}})
+	waitForPicks(t, organizer, "Org:A1 Friend:A2, A3")
+	if outsider := submitBooking(handlers.BookingRequest{
+		ShowID:       show.ID,
+		CustomerName: "Outsider",
+		Email:        "outsider@example.com",
+		Seats:        models.Seats{{Row: "A", Number: 3}},
+	}); !outsider.Success {
+		t.Fatalf("Expected booking to succeed, got %s", outsider.ErrorMessage)
+	}
+	if message := nextGroupMessage(t, friend, "error"); message.Error.Code != handlers.ErrCodeSeatsUnavailable || message.Error.Seats.String() != "A3" {
+		t.Errorf("Expected to be told A3 was taken, got %+v", message.Error)
+	}
+	waitForPicks(t, organizer, "Org:A1 Friend:A2")
+
+	// Seats taken already cannot be picked
+	sendGroup(t, organizer, map[string]interface{}{"type": "select", "seat": map[string]interface{}{"row": "A", "number": 3}})
+	if message := nextGroupMessage(t, organizer, "error"); message.Error.Code != handlers.ErrCodeSeatsUnavailable {
+		t.Errorf("Expected A3 to be unavailable, got %+v", message.Error)
+	}
+
+	// Only the organizer books
+	sendGroup(t, friend, map[string]interface{}{"type": "finalize", "customer_name": "Friend", "email": "friend@example.com"})
+	if message := nextGroupMessage(t, friend, "error"); message.Error.Code != handlers.ErrCodeNotOrganizer {
+		t.Errorf("Expected only the organizer to book, got %+v", message.Error)
+	}
+
+	sendGroup(t, organizer, map[string]interface{}{"type": "finalize", "customer_name": "Org", "email": "org@example.com"})
+	finalized := nextGroupMessage(t, organizer, "finalized")
+	if finalized.Reference == "" || finalized.CheckoutURL != "/booking/checkout/"+finalized.Reference {
+		t.Fatalf("Expected the organizer to check out, got %+v", finalized)
+	}
+	if message := nextGroupMessage(t, friend, "finalized"); message.Reference != finalized.Reference || message.CheckoutURL != "" {
+		t.Errorf("Expected the friend to hear about the booking, got %+v", message)
+	}
+
+	var booking models.Booking
+	database.DB.Where("reference = ?", finalized.Reference).First(&booking)
+	if booking.Status != models.BookingHeld || booking.CustomerName != "Org" || booking.Seats.String() != "A1, A2" {
+		t.Errorf("Expected one hold of everyone's seats for the organizer, got %+v", booking)
+	}
+	if price, ok := booking.Prices.For(models.Seat{Row: "A", Number: 2}); !ok || price.TicketType != models.TicketChild {
+		t.Errorf("Expected the friend's child ticket, got %+v", booking.Prices)
+	}
+
+	// The session ends once booked
+	rec, err := http.Get(server.URL + strings.TrimSuffix(socketPath, "/ws"))
+	if err != nil {
+		t.Fatalf("Error loading group page: %v", err)
+	}
+	rec.Body.Close()
+	if rec.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected the group to have ended, got %d", rec.StatusCode)
+	}
+}
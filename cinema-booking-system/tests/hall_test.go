@@ -0,0 +1,112 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+)
+
+// Test seat lookups against a layout with gaps and aisles
+func TestSeatLayoutHasSeat(t *testing.T) {
+	layout := models.SeatLayout{
+		Rows: []models.RowLayout{
+			{Label: "A", Seats: 8, Offset: 1},
+			{Label: "B", Seats: 10, Aisles: []int{5}, Missing: []int{1, 10}},
+		},
+	}
+
+	if err := layout.Validate(); err != nil {
+		t.Fatalf("Expected layout to be valid, got %v", err)
+	}
+
+	if layout.Capacity() != 16 {
+		t.Errorf("Expected capacity 16, got %d", layout.Capacity())
+	}
+
+	cases := []struct {
+		seat   models.Seat
+		exists bool
+	}{
+		{models.Seat{Row: "A", Number: 1}, true},
+		{models.Seat{Row: "A", Number: 8}, true},
+		{models.Seat{Row: "A", Number: 9}, false},
+		{models.Seat{Row: "B", Number: 1}, false},
+		{models.Seat{Row: "B", Number: 5}, true},
+		{models.Seat{Row: "B", Number: 10}, false},
+		{models.Seat{Row: "C", Number: 1}, false},
+		{models.Seat{Row: "", Number: -5}, false},
+	}
+
+	for _, c := range cases {
+		if got := layout.HasSeat(c.seat); got != c.exists {
+			t.Errorf("HasSeat(%s) = %v, expected %v", c.seat, got, c.exists)
+		}
+	}
+
+	if seats := layout.AllSeats(); len(seats) != layout.Capacity() {
+		t.Errorf("Expected %d seats from AllSeats, got %d", layout.Capacity(), len(seats))
+	}
+}
+
+// Test that inconsistent layouts are rejected
+func TestSeatLayoutValidate(t *testing.T) {
+	invalid := map[string]models.SeatLayout{
+		"no rows":         {},
+		"empty label":     {Rows: []models.RowLayout{{Label: "", Seats: 5}}},
+		"duplicate label": {Rows: []models.RowLayout{{Label: "A", Seats: 5}, {Label: "A", Seats: 5}}},
+		"label digit":     {Rows: []models.RowLayout{{Label: "A", Seats: 12}, {Label: "A1", Seats: 5}}},
+		"no seats":        {Rows: []models.RowLayout{{Label: "A", Seats: 0}}},
+		"aisle outside":   {Rows: []models.RowLayout{{Label: "A", Seats: 5, Aisles: []int{5}}}},
+		"missing outside": {Rows: []models.RowLayout{{Label: "A", Seats: 5, Missing: []int{6}}}},
+		"all missing":     {Rows: []models.RowLayout{{Label: "A", Seats: 2, Missing: []int{1, 2}}}},
+	}
+
+	for name, layout := range invalid {
+		if err := layout.Validate(); err == nil {
+			t.Errorf("Expected layout %q to be invalid", name)
+		}
+	}
+}
+
+// Test that a hall's layout survives a round trip through the database
+func TestHallPersistence(t *testing.T) {
+	database.DB.Exec("DELETE FROM halls")
+
+	hall := models.Hall{
+		Number: 7,
+		Layout: models.SeatLayout{
+			Rows: []models.RowLayout{
+				{Label: "A", Seats: 6, Aisles: []int{3}},
+				{Label: "B", Seats: 6, Missing: []int{6}},
+			},
+		},
+	}
+
+	if err := database.DB.Create(&hall).Error; err != nil {
+		t.Fatalf("Error creating hall: %v", err)
+	}
+
+	var savedHall models.Hall
+	if err := database.DB.First(&savedHall, hall.ID).Error; err != nil {
+		t.Fatalf("Error retrieving saved hall: %v", err)
+	}
+
+	if savedHall.Name != "Hall 7" {
+		t.Errorf("Expected default name 'Hall 7', got '%s'", savedHall.Name)
+	}
+
+	if savedHall.Layout.Capacity() != 11 {
+		t.Errorf("Expected capacity 11, got %d", savedHall.Layout.Capacity())
+	}
+
+	if savedHall.Layout.HasSeat(models.Seat{Row: "B", Number: 6}) {
+		t.Errorf("Expected seat B6 to be missing")
+	}
+
+	// Invalid layouts must not be saved
+	broken := models.Hall{Number: 8, Layout: models.SeatLayout{}}
+	if err := database.DB.Create(&broken).Error; err == nil {
+		t.Errorf("Expected hall without rows to be rejected")
+	}
+}
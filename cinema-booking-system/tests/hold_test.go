@@ -0,0 +1,130 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/handlers"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+)
+
+// Test that a hold blocks other customers until it is released
+func TestHoldBlocksSeatsUntilReleased(t *testing.T) {
+	database.DB.Exec("DELETE FROM bookings")
+	database.DB.Exec("DELETE FROM shows")
+	database.DB.Exec("DELETE FROM movies")
+
+	show := setupTestShow(t)
+	seats := models.Seats{{Row: "E", Number: 3}}
+
+	hold := submitBooking(handlers.BookingRequest{
+		Action:       handlers.ActionHold,
+		ShowID:       show.ID,
+		CustomerName: "Holder",
+		Email:        "holder@example.com",
+		Seats:        seats,
+	})
+	if !hold.Success {
+		t.Fatalf("Expected hold to succeed, got %s", hold.ErrorMessage)
+	}
+
+	competing := handlers.BookingRequest{
+		ShowID:       show.ID,
+		CustomerName: "Competitor",
+		Email:        "competitor@example.com",
+		Seats:        seats,
+	}
+
+	if response := submitBooking(competing); response.Success {
+		t.Fatalf("Expected held seat to be unavailable")
+	}
+
+	extended := submitBooking(handlers.BookingRequest{Action: handlers.ActionExtend, BookingID: hold.BookingID})
+	if !extended.Success {
+		t.Fatalf("Expected hold to be extended, got %s", extended.ErrorMessage)
+	}
+
+	released := submitBooking(handlers.BookingRequest{Action: handlers.ActionRelease, BookingID: hold.BookingID})
+	if !released.Success {
+		t.Fatalf("Expected hold to be released, got %s", released.ErrorMessage)
+	}
+
+	if response := submitBooking(competing); !response.Success {
+		t.Errorf("Expected released seat to be bookable, got %s", response.ErrorMessage)
+	}
+
+	// A released hold can no longer be checked out
+	confirmed := submitBooking(handlers.BookingRequest{Action: handlers.ActionConfirm, BookingID: hold.BookingID})
+	if confirmed.Success || confirmed.Error.Code != handlers.ErrCodeNotHeld {
+		t.Errorf("Expected confirming a released hold to fail with %s, got %+v", handlers.ErrCodeNotHeld, confirmed.Error)
+	}
+}
+
+// Test that a hold is converted into a confirmed booking on checkout
+func TestHoldConfirm(t *testing.T) {
+	database.DB.Exec("DELETE FROM bookings")
+	database.DB.Exec("DELETE FROM shows")
+	database.DB.Exec("DELETE FROM movies")
+
+	show := setupTestShow(t)
+
+	hold := submitBooking(handlers.BookingRequest{
+		Action:       handlers.ActionHold,
+		ShowID:       show.ID,
+		CustomerName: "Holder",
+		Email:        "holder@example.com",
+		Seats:        models.Seats{{Row: "F", Number: 1}, {Row: "F", Number: 2}},
+	})
+	if !hold.Success {
+		t.Fatalf("Expected hold to succeed, got %s", hold.ErrorMessage)
+	}
+
+	confirmed := submitBooking(handlers.BookingRequest{Action: handlers.ActionConfirm, BookingID: hold.BookingID})
+	if !confirmed.Success {
+		t.Fatalf("Expected hold to be confirmed, got %s", confirmed.ErrorMessage)
+	}
+
+	var booking models.Booking
+	database.DB.First(&booking, hold.BookingID)
+	if booking.Status != models.BookingConfirmed || !booking.Confirmed || booking.ExpiresAt != nil {
+		t.Errorf("Expected a confirmed booking without expiry, got status %s", booking.Status)
+	}
+}
+
+// Test that a hold lapses exactly when it expires rather than on the cleanup ticker
+func TestHoldExpiresOnTime(t *testing.T) {
+	database.DB.Exec("DELETE FROM bookings")
+	database.DB.Exec("DELETE FROM shows")
+	database.DB.Exec("DELETE FROM movies")
+
+	previous := handlers.HoldDuration
+	handlers.HoldDuration = 100 * time.Millisecond
+	defer func() { handlers.HoldDuration = previous }()
+
+	show := setupTestShow(t)
+
+	hold := submitBooking(handlers.BookingRequest{
+		Action:       handlers.ActionHold,
+		ShowID:       show.ID,
+		CustomerName: "Holder",
+		Email:        "holder@example.com",
+		Seats:        models.Seats{{Row: "G", Number: 7}},
+	})
+	if !hold.Success {
+		t.Fatalf("Expected hold to succeed, got %s", hold.ErrorMessage)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	var booking models.Booking
+	database.DB.First(&booking, hold.BookingID)
+	if booking.Status != models.BookingExpired {
+		t.Errorf("Expected hold to be expired, got status %s", booking.Status)
+	}
+
+	confirmed := submitBooking(handlers.BookingRequest{Action: handlers.ActionConfirm, BookingID: hold.BookingID})
+	if confirmed.Success {
+		t.Errorf("Expected an expired hold not to be confirmed")
+	}
+}
@@ -0,0 +1,215 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/accounts"
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/handlers"
+	"github.com/JoeDkhar/cinema-booking-system/internal/middleware"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// setupLockout sets small login limits for a test and creates a user
+func setupLockout(t *testing.T, username, password string) models.User {
+	database.DB.Exec("DELETE FROM login_failures")
+	database.DB.Exec("DELETE FROM sessions")
+	database.DB.Exec("DELETE FROM users")
+
+	free, delay, maxDelay := accounts.FreeLoginAttempts, accounts.LoginDelay, accounts.MaxLoginDelay
+	threshold, duration, ipThreshold := accounts.LockoutThreshold, accounts.LockoutDuration, accounts.IPLockoutThreshold
+	t.Cleanup(func() {
+		accounts.FreeLoginAttempts, accounts.LoginDelay, accounts.MaxLoginDelay = free, delay, maxDelay
+		accounts.LockoutThreshold, accounts.LockoutDuration, accounts.IPLockoutThreshold = threshold, duration, ipThreshold
+	})
+	accounts.FreeLoginAttempts = 2
+	accounts.LoginDelay = 10 * time.Second
+	accounts.MaxLoginDelay = time.Minute
+	accounts.LockoutThreshold = 5
+	accounts.LockoutDuration = 30 * time.Minute
+	accounts.IPLockoutThreshold = 8
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	user := models.User{Username: username, Email: username + "@example.com", PasswordHash: string(hash)}
+	database.DB.Create(&user)
+	return user
+}
+
+// loginFrom tries to log in from an IP address
+func loginFrom(r http.Handler, username, password, ip string) *httptest.ResponseRecorder {
+	form := url.Values{"username": {username}, "password": {password}}
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = ip + ":40000"
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+// Test that wrong passwords tried in parallel cannot all get past the check
+// before any of them is recorded
+func TestParallelLoginLockout(t *testing.T) {
+	user := setupLockout(t, "target", "Right-Password-1")
+	r := newAccountRouter()
+
+	// A realistic cost keeps each attempt busy long enough to overlap
+	hash, _ := bcrypt.GenerateFromPassword([]byte("Right-Password-1"), bcrypt.DefaultCost)
+	database.DB.Model(&user).UpdateColumn("password_hash", string(hash))
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- loginFrom(r, "target", "wrong", "203.0.113.1").Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	delayed := 0
+	for code := range codes {
+		if code == http.StatusTooManyRequests {
+			delayed++
+		}
+	}
+	var count int64
+	database.DB.Model(&models.LoginFailure{}).Count(&count)
+	if count != 2 || delayed != 8 {
+		t.Errorf("Expected only the 2 free wrong passwords to be checked, got %d checked and %d delayed", count, delayed)
+	}
+}
+
+// Test that wrong passwords delay further logins and then lock the account
+func TestLoginLockout(t *testing.T) {
+	setupLockout(t, "target", "Right-Password-1")
+	r := newAccountRouter()
+
+	// The first wrong passwords are free
+	for i := 0; i < 2; i++ {
+		if rec := loginFrom(r, "target", "wrong", "203.0.113.1"); rec.Code != http.StatusOK {
+			t.Fatalf("Expected wrong password %d to be refused normally, got %d", i+1, rec.Code)
+		}
+	}
+
+	// After that each login waits, even with the right password
+	rec := loginFrom(r, "target", "Right-Password-1", "203.0.113.1")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "10" {
+		t.Fatalf("Expected the login to be delayed 10 seconds, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	// The delay doubles with each wrong password
+	for _, wait := range []string{"20", "40", "1800"} {
+		database.DB.Model(&models.LoginFailure{}).Where("1 = 1").UpdateColumn("created_at", time.Now().Add(-time.Minute))
+		loginFrom(r, "target", "wrong", "203.0.113.1")
+		rec := loginFrom(r, "target", "Right-Password-1", "203.0.113.1")
+		if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != wait {
+			t.Errorf("Expected to wait %s seconds, got %d %q", wait, rec.Code, rec.Header().Get("Retry-After"))
+		}
+	}
+
+	// The account is now locked from every address
+	if rec := loginFrom(r, "target", "Right-Password-1", "198.51.100.7"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the locked account to refuse other addresses, got %d", rec.Code)
+	}
+	var failures int64
+	database.DB.Model(&models.LoginFailure{}).Count(&failures)
+	if failures != 5 {
+		t.Errorf("Expected refused logins not to count as failures, got %d", failures)
+	}
+
+	// Once the lockout passes, the right password works and clears the count
+	database.DB.Model(&models.LoginFailure{}).Where("1 = 1").UpdateColumn("created_at", time.Now().Add(-31*time.Minute))
+	if rec := loginFrom(r, "target", "Right-Password-1", "203.0.113.1"); rec.Code != http.StatusSeeOther {
+		t.Errorf("Expected the login to work after the lockout, got %d", rec.Code)
+	}
+}
+
+// Test that unknown usernames are refused and locked out like real ones
+func TestLoginUnknownUser(t *testing.T) {
+	setupLockout(t, "known", "Right-Password-1")
+	r := newAccountRouter()
+
+	known := loginFrom(r, "known", "wrong", "203.0.113.2")
+	unknown := loginFrom(r, "unknown", "wrong", "203.0.113.2")
+	if known.Code != unknown.Code || known.Body.String() != unknown.Body.String() {
+		t.Errorf("Expected unknown usernames to look like wrong passwords, got %d and %d", known.Code, unknown.Code)
+	}
+
+	start := time.Now()
+	loginFrom(r, "unknown", "wrong", "203.0.113.2")
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("Expected an unknown username to take as long as checking a password, took %v", elapsed)
+	}
+
+	if rec := loginFrom(r, "unknown", "wrong", "203.0.113.2"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected unknown usernames to be delayed too, got %d", rec.Code)
+	}
+}
+
+// Test that many wrong passwords from one address lock it out of every account
+func TestLoginIPLockout(t *testing.T) {
+	setupLockout(t, "victim", "Right-Password-1")
+	r := newAccountRouter()
+
+	for i := 0; i < 8; i++ {
+		loginFrom(r, "guess"+string(rune('a'+i)), "wrong", "203.0.113.3")
+	}
+
+	if rec := loginFrom(r, "victim", "Right-Password-1", "203.0.113.3"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the address to be locked out, got %d", rec.Code)
+	}
+	if rec := loginFrom(r, "victim", "Right-Password-1", "198.51.100.8"); rec.Code != http.StatusSeeOther {
+		t.Errorf("Expected other addresses to log in, got %d", rec.Code)
+	}
+
+	// Logging in does not let an address wipe its own failures
+	if rec := loginFrom(r, "victim", "Right-Password-1", "203.0.113.3"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the address to stay locked out, got %d", rec.Code)
+	}
+}
+
+// Test that admins see locked accounts and can unlock them
+func TestAdminUnlockUser(t *testing.T) {
+	user := setupLockout(t, "locked", "Right-Password-1")
+	createSession(t, models.User{Username: "admin", Email: "admin@cinema.test", Role: models.RoleAdmin}, "admin-session")
+	createSession(t, models.User{Username: "manager", Email: "manager@cinema.test", Role: models.RoleManager}, "manager-session")
+	for i := 0; i < 5; i++ {
+		accounts.RecordLoginFailure("locked", "203.0.113.4", time.Now())
+	}
+
+	locked, err := accounts.LockedAccounts(time.Now())
+	if err != nil || len(locked) != 1 || locked[user.ID].Before(time.Now().Add(29*time.Minute)) {
+		t.Fatalf("Expected the account to be listed as locked, got %v %v", locked, err)
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/login", handlers.LoginHandler).Methods("POST")
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(middleware.AuthMiddleware)
+	admin.Handle("/users/{id:[0-9]+}/unlock", middleware.RequirePermission(models.PermManageUsers)(http.HandlerFunc(handlers.AdminUnlockUserHandler))).Methods("POST")
+	path := "/admin/users/" + strconv.Itoa(int(user.ID)) + "/unlock"
+
+	if rec := adminRequest(r, "POST", path, models.RoleManager, nil); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected managers not to unlock users, got %d", rec.Code)
+	}
+	if rec := adminRequest(r, "POST", path, models.RoleAdmin, nil); rec.Code != http.StatusSeeOther {
+		t.Fatalf("Expected the account to be unlocked, got %d", rec.Code)
+	}
+	if locked, _ := accounts.LockedAccounts(time.Now()); len(locked) != 0 {
+		t.Errorf("Expected no locked accounts, got %v", locked)
+	}
+	if rec := loginFrom(r, "locked", "Right-Password-1", "198.51.100.9"); rec.Code != http.StatusSeeOther {
+		t.Errorf("Expected the unlocked user to log in, got %d", rec.Code)
+	}
+}
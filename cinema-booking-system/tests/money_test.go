@@ -0,0 +1,201 @@
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/money"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// Test parsing decimal amounts without going through floating point
+func TestMoneyParse(t *testing.T) {
+	cases := []struct {
+		value    string
+		currency string
+		amount   int64
+		valid    bool
+	}{
+		{"12.50", "USD", 1250, true},
+		{"12.5", "usd", 1250, true},
+		{"0.29", "USD", 29, true},
+		{"-3", "EUR", -300, true},
+		{"1500", "JPY", 1500, true},
+		{"12.505", "USD", 0, false}, // Sub-cent amounts are rejected, not rounded
+		{"12.5", "JPY", 0, false},
+		{"12.", "USD", 0, false},
+		{"abc", "USD", 0, false},
+		{"1.-5", "USD", 0, false},
+	}
+
+	for _, c := range cases {
+		got, err := money.Parse(c.value, c.currency)
+		if (err == nil) != c.valid {
+			t.Errorf("Parse(%q): expected valid %v, got error %v", c.value, c.valid, err)
+			continue
+		}
+		if c.valid && got.Amount != c.amount {
+			t.Errorf("Parse(%q): expected %d minor units, got %d", c.value, c.amount, got.Amount)
+		}
+	}
+
+	// Decimal writes amounts back in the form Parse reads
+	for _, amount := range []money.Money{usd(1250), usd(-5), money.New(1500, "JPY")} {
+		if parsed, err := money.Parse(amount.Decimal(), amount.Currency); err != nil || parsed != amount {
+			t.Errorf("Expected %q to parse back to %+v, got %+v (%v)", amount.Decimal(), amount, parsed, err)
+		}
+	}
+}
+
+// Test that percentages round half away from zero and allocation keeps every cent
+func TestMoneyRounding(t *testing.T) {
+	cases := []struct {
+		amount  int64
+		percent float64
+		result  int64
+	}{
+		{1000, 15, 150},
+		{1050, -15, -158}, // -157.5 rounds away from zero
+		{1, 50, 1},
+		{999, 33.33, 333},
+		{-125, 10, -13},
+	}
+	for _, c := range cases {
+		if got := usd(c.amount).Percent(c.percent); got.Amount != c.result {
+			t.Errorf("%d at %.2f%%: expected %d, got %d", c.amount, c.percent, c.result, got.Amount)
+		}
+	}
+
+	// Tax included in a price is rounded the same way
+	taxCases := []struct {
+		amount  int64
+		percent float64
+		tax     int64
+	}{
+		{1200, 20, 200},
+		{1000, 8.25, 76}, // 76.21
+		{1250, 7.5, 87},  // 87.21
+		{105, 5, 5},
+		{2205, 5, 105},    // exactly 105
+		{1050, 10.5, 100}, // 99.77
+	}
+	for _, c := range taxCases {
+		if got := usd(c.amount).TaxIncluded(c.percent); got.Amount != c.tax {
+			t.Errorf("Tax in %d at %.2f%%: expected %d, got %d", c.amount, c.percent, c.tax, got.Amount)
+		}
+	}
+
+	parts := usd(1000).Allocate(1, 1, 1)
+	if parts[0] != usd(334) || parts[1] != usd(333) || parts[2] != usd(333) {
+		t.Errorf("Expected $10.00 split into 3.34, 3.33 and 3.33, got %v", parts)
+	}
+	if total := money.Sum(parts...); total != usd(1000) {
+		t.Errorf("Expected allocated parts to add up to $10.00, got %s", total)
+	}
+}
+
+// Test that amounts in different currencies are told apart before they meet
+func TestMoneyCheckCurrency(t *testing.T) {
+	if err := money.CheckCurrency(usd(100), money.Money{}, usd(-5)); err != nil {
+		t.Errorf("Expected amounts in one currency to match, got %v", err)
+	}
+	if err := money.CheckCurrency(usd(100), money.New(100, "EUR")); !errors.Is(err, money.ErrCurrencyMismatch) {
+		t.Errorf("Expected dollars and euros not to match, got %v", err)
+	}
+}
+
+// Test formatting amounts for different locales and currencies
+func TestMoneyFormat(t *testing.T) {
+	cases := []struct {
+		amount money.Money
+		locale string
+		want   string
+	}{
+		{money.New(123450, "USD"), "en-US", "$1,234.50"},
+		{money.New(-250, "USD"), "en-US", "-$2.50"},
+		{money.New(123450, "EUR"), "de-DE", "1.234,50\u00a0€"},
+		{money.New(999, "GBP"), "en-GB", "£9.99"},
+		{money.New(1500, "JPY"), "ja-JP", "¥1,500"},
+		{money.New(500, "XYZ"), "en-US", "XYZ5.00"},
+	}
+
+	for _, c := range cases {
+		if got := c.amount.Format(c.locale); got != c.want {
+			t.Errorf("Format(%d %s, %s): expected %q, got %q", c.amount.Amount, c.amount.Currency, c.locale, c.want, got)
+		}
+	}
+}
+
+// Test that JSON amounts round-trip and legacy float amounts are still read
+func TestMoneyJSON(t *testing.T) {
+	data, _ := json.Marshal(usd(1250))
+	var decoded money.Money
+	if err := json.Unmarshal(data, &decoded); err != nil || decoded != usd(1250) {
+		t.Errorf("Expected %s to round-trip, got %+v (%v)", data, decoded, err)
+	}
+
+	// Price breakdowns saved before amounts had a currency hold bare floats
+	var legacy models.SeatPrices
+	if err := json.Unmarshal([]byte(`[{"seat":{"row":"A","number":1},"base_price":12.5,"price":0.3}]`), &legacy); err != nil {
+		t.Fatalf("Error reading legacy prices: %v", err)
+	}
+	if legacy[0].BasePrice != usd(1250) || legacy[0].Price != usd(30) {
+		t.Errorf("Expected legacy prices of $12.50 and $0.30, got %+v", legacy[0])
+	}
+}
+
+// Test that float amounts in an old database are converted to cents
+func TestMigrateMoneyColumns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+
+	legacy, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Error opening legacy database: %v", err)
+	}
+	// Tables as GORM created them when amounts were float64
+	legacy.Exec(`CREATE TABLE "shows" ("id" integer PRIMARY KEY, "created_at" datetime, "updated_at" datetime,` +
+		`"deleted_at" datetime, "movie_id" integer, "date_time" datetime, "hall" integer, "ticket_price" real)`)
+	legacy.Exec(`CREATE TABLE "bookings" ("id" integer PRIMARY KEY, "created_at" datetime, "updated_at" datetime,` +
+		`"deleted_at" datetime, "show_id" integer, "customer_name" text, "email" text, "seats_json" text,` +
+		`"booking_time" datetime, "total_amount" real, "confirmed" numeric)`)
+	legacy.Exec(`INSERT INTO shows (id, movie_id, hall, ticket_price) VALUES (1, 1, 1, 12.5)`)
+	// 0.1 + 0.2 was stored as 0.30000000000000004
+	legacy.Exec(`INSERT INTO bookings (id, show_id, customer_name, email, seats_json, total_amount, confirmed)
+		VALUES (1, 1, 'Old', 'old@example.com', '[]', 0.1 + 0.2, 1)`)
+	if sqlDB, err := legacy.DB(); err == nil {
+		sqlDB.Close()
+	}
+
+	previous := database.DB
+	defer func() { database.DB = previous }()
+
+	if err := database.Initialize(path); err != nil {
+		t.Fatalf("Error migrating legacy database: %v", err)
+	}
+	defer func() {
+		if sqlDB, err := database.DB.DB(); err == nil {
+			sqlDB.Close()
+		}
+	}()
+
+	var show models.Show
+	database.DB.First(&show, 1)
+	if show.TicketPrice != usd(1250) {
+		t.Errorf("Expected ticket price $12.50, got %+v", show.TicketPrice)
+	}
+
+	var booking models.Booking
+	database.DB.First(&booking, 1)
+	if booking.TotalAmount != usd(30) {
+		t.Errorf("Expected total $0.30, got %+v", booking.TotalAmount)
+	}
+
+	if database.DB.Migrator().HasColumn(&models.Booking{}, "total_amount") {
+		t.Errorf("Expected the float column to be dropped")
+	}
+}
@@ -0,0 +1,214 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/handlers"
+	"github.com/JoeDkhar/cinema-booking-system/internal/middleware"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/sessions"
+	"github.com/gorilla/mux"
+)
+
+// newMyBookingsRouter serves booking, the user's booking list and claims
+func newMyBookingsRouter() *mux.Router {
+	r := mux.NewRouter()
+	api := r.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/bookings", handlers.APICreateBookingHandler).Methods("POST")
+	api.Handle("/me/bookings", middleware.RequireAPIUser(http.HandlerFunc(handlers.APIMyBookingsHandler))).Methods("GET")
+	account := r.PathPrefix("/account").Subrouter()
+	account.Use(middleware.AuthMiddleware)
+	account.HandleFunc("/bookings/claim", handlers.RequestBookingClaimHandler).Methods("POST")
+	account.HandleFunc("/bookings/claim/{token}", handlers.ClaimBookingsHandler).Methods("GET")
+	return r
+}
+
+// userRequest sends a JSON request as the user of a session token
+func userRequest(t *testing.T, r http.Handler, method, path, token string, body interface{}) (*httptest.ResponseRecorder, handlers.APIResponse) {
+	var payload bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&payload).Encode(body)
+	}
+	req := httptest.NewRequest(method, path, &payload)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.AddCookie(&http.Cookie{Name: sessions.CookieName, Value: token})
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	var response handlers.APIResponse
+	json.Unmarshal(rec.Body.Bytes(), &response)
+	return rec, response
+}
+
+// bookingOwner returns the user a booking belongs to, or 0 for guest bookings
+func bookingOwner(reference string) uint {
+	var booking models.Booking
+	database.DB.Where("reference = ?", reference).First(&booking)
+	if booking.UserID == nil {
+		return 0
+	}
+	return *booking.UserID
+}
+
+// Test that bookings made while logged in are listed for the user
+func TestUserBookings(t *testing.T) {
+	database.DB.Exec("DELETE FROM bookings")
+	database.DB.Exec("DELETE FROM users")
+	show := setupTestShow(t)
+	r := newMyBookingsRouter()
+
+	user := createSession(t, models.User{Username: "regular", Email: "regular@example.com"}, "regular-session")
+	request := map[string]interface{}{
+		"show_id":       show.ID,
+		"customer_name": "Regular Viewer",
+		"email":         "regular@example.com",
+		"seats":         []map[string]interface{}{{"row": "A", "number": 1}},
+		"payment_token": "tok_approve",
+	}
+
+	rec, created := userRequest(t, r, "POST", "/api/v1/bookings", "regular-session", request)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected the booking to be created, got %d: %s", rec.Code, created.Error)
+	}
+	upcoming := created.Data.(map[string]interface{})["reference"].(string)
+	if owner := bookingOwner(upcoming); owner != user.ID {
+		t.Errorf("Expected the booking to belong to the user, got %d", owner)
+	}
+
+	// The same email without logging in makes a guest booking
+	request["seats"] = []map[string]interface{}{{"row": "A", "number": 2}}
+	_, guest := userRequest(t, r, "POST", "/api/v1/bookings", "", request)
+	if owner := bookingOwner(guest.Data.(map[string]interface{})["reference"].(string)); owner != 0 {
+		t.Errorf("Expected a guest booking to have no owner, got %d", owner)
+	}
+
+	// A past show the user went to, and a hold they abandoned
+	pastShow := models.Show{MovieID: show.MovieID, HallID: show.HallID, DateTime: time.Now().Add(-48 * time.Hour), TicketPrice: usd(1000)}
+	database.DB.Create(&pastShow)
+	past := models.Booking{ShowID: pastShow.ID, CustomerName: "Regular Viewer", Email: "regular@example.com", UserID: &user.ID,
+		Seats: models.Seats{{Row: "B", Number: 1}}, Status: models.BookingConfirmed, TotalAmount: usd(1000)}
+	database.DB.Create(&past)
+	database.DB.Create(&models.Booking{ShowID: show.ID, CustomerName: "Regular Viewer", Email: "regular@example.com", UserID: &user.ID,
+		Seats: models.Seats{{Row: "C", Number: 1}}, Status: models.BookingReleased, TotalAmount: usd(1000)})
+
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"", []string{upcoming, past.Reference}},
+		{"?when=upcoming", []string{upcoming}},
+		{"?when=past", []string{past.Reference}},
+	}
+	for _, test := range tests {
+		rec, listed := userRequest(t, r, "GET", "/api/v1/me/bookings"+test.query, "regular-session", nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200 listing bookings%s, got %d: %s", test.query, rec.Code, listed.Error)
+		}
+		var references []string
+		for _, booking := range listed.Data.([]interface{}) {
+			references = append(references, booking.(map[string]interface{})["reference"].(string))
+		}
+		if strings.Join(references, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("Expected bookings%s to be %v, got %v", test.query, test.expected, references)
+		}
+	}
+
+	if rec, _ := userRequest(t, r, "GET", "/api/v1/me/bookings?when=someday", "regular-session", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown filter to be refused, got %d", rec.Code)
+	}
+	if rec, _ := userRequest(t, r, "GET", "/api/v1/me/bookings", "", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected guests to be refused, got %d", rec.Code)
+	}
+}
+
+// Test that guest bookings are only attached after following the emailed link
+func TestClaimGuestBookings(t *testing.T) {
+	outbox, server, show := setupNotifications(t)
+	database.DB.Exec("DELETE FROM booking_claims")
+	database.DB.Exec("DELETE FROM users")
+	r := newMyBookingsRouter()
+
+	user := createSession(t, models.User{Username: "claimer", Email: "claimer@example.com"}, "claimer-session")
+	createSession(t, models.User{Username: "intruder", Email: "intruder@example.com"}, "intruder-session")
+
+	guest := func(email string, seat int, status models.BookingStatus) models.Booking {
+		booking := models.Booking{ShowID: show.ID, CustomerName: "Guest", Email: email,
+			Seats: models.Seats{{Row: "D", Number: seat}}, Status: status, TotalAmount: usd(1000)}
+		database.DB.Create(&booking)
+		return booking
+	}
+	mine := guest("Claimer@Example.com", 1, models.BookingConfirmed)
+	theirs := guest("someone@example.com", 2, models.BookingConfirmed)
+	abandoned := guest("claimer@example.com", 3, models.BookingExpired)
+
+	rec, _ := userRequest(t, r, "POST", "/account/bookings/claim", "claimer-session", nil)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/account/bookings?claim=sent" {
+		t.Fatalf("Expected the claim link to be sent, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	if bookingOwner(mine.Reference) != 0 {
+		t.Errorf("Expected bookings to wait until the link is followed")
+	}
+
+	outbox.Flush(context.Background())
+	var link string
+	for _, received := range server.messages() {
+		email := parseMail(t, received)
+		if received.To[0] == "<claimer@example.com>" && strings.Contains(email.Subject, "Add your bookings") {
+			link = regexp.MustCompile(`/account/bookings/claim/[0-9a-f]+`).FindString(email.Text)
+		}
+	}
+	if link == "" {
+		t.Fatalf("Expected the claim link to be emailed to the account's address")
+	}
+
+	// The link only works for the account it was sent for
+	if rec, _ := userRequest(t, r, "GET", link, "intruder-session", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected another user to be refused, got %d", rec.Code)
+	}
+
+	rec, _ = userRequest(t, r, "GET", link, "claimer-session", nil)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/account/bookings?claimed=1" {
+		t.Errorf("Expected one booking to be claimed, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	if bookingOwner(mine.Reference) != user.ID {
+		t.Errorf("Expected the guest booking to belong to the user")
+	}
+	if bookingOwner(theirs.Reference) != 0 || bookingOwner(abandoned.Reference) != 0 {
+		t.Errorf("Expected other bookings to stay as they were")
+	}
+
+	// Each link works once
+	if rec, _ := userRequest(t, r, "GET", link, "claimer-session", nil); rec.Code != http.StatusGone {
+		t.Errorf("Expected a used link to be refused, got %d", rec.Code)
+	}
+
+	// Nothing is left to claim, so no further link is sent
+	rec, _ = userRequest(t, r, "POST", "/account/bookings/claim", "claimer-session", nil)
+	var claims int64
+	database.DB.Model(&models.BookingClaim{}).Count(&claims)
+	if rec.Header().Get("Location") != "/account/bookings" || claims != 1 {
+		t.Errorf("Expected no new claim, got %q and %d claims", rec.Header().Get("Location"), claims)
+	}
+
+	// Links stop working once they expire
+	later := guest("claimer@example.com", 4, models.BookingConfirmed)
+	userRequest(t, r, "POST", "/account/bookings/claim", "claimer-session", nil)
+	database.DB.Model(&models.BookingClaim{}).Where("claimed_at IS NULL").UpdateColumn("expires_at", time.Now().Add(-time.Minute))
+	outbox.Flush(context.Background())
+	messages := server.messages()
+	link = regexp.MustCompile(`/account/bookings/claim/[0-9a-f]+`).FindString(parseMail(t, messages[len(messages)-1]).Text)
+	if rec, _ := userRequest(t, r, "GET", link, "claimer-session", nil); rec.Code != http.StatusGone || bookingOwner(later.Reference) != 0 {
+		t.Errorf("Expected an expired link to be refused, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,556 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/handlers"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/notifications"
+	"github.com/JoeDkhar/cinema-booking-system/internal/utils"
+	"github.com/gorilla/mux"
+)
+
+// receivedMail is an email accepted by the SMTP stand-in
+type receivedMail struct {
+	From string
+	To   []string
+	Data string
+}
+
+// smtpServer is a minimal in-process SMTP server that records the emails it
+// accepts and can be told to reject the next few
+type smtpServer struct {
+	listener net.Listener
+
+	mutex    sync.Mutex
+	received []receivedMail
+	failNext int
+	failCode int
+}
+
+// startSMTPServer listens on a free local port until the test ends
+func startSMTPServer(t *testing.T) *smtpServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting SMTP server: %v", err)
+	}
+
+	server := &smtpServer{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+
+	return server
+}
+
+// transport returns an SMTP transport delivering to the server
+func (s *smtpServer) transport() *notifications.SMTPTransport {
+	addr := s.listener.Addr().(*net.TCPAddr)
+	return &notifications.SMTPTransport{
+		Host: "127.0.0.1",
+		Port: addr.Port,
+		From: mail.Address{Name: "Cinema Booking", Address: "bookings@cinema.test"},
+	}
+}
+
+// failWith makes the server reject the next n emails with an SMTP code
+func (s *smtpServer) failWith(n, code int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failNext = n
+	s.failCode = code
+}
+
+// messages returns the emails accepted so far
+func (s *smtpServer) messages() []receivedMail {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]receivedMail(nil), s.received...)
+}
+
+// serve holds one SMTP conversation
+func (s *smtpServer) serve(netConn net.Conn) {
+	conn := textproto.NewConn(netConn)
+	defer conn.Close()
+
+	var current receivedMail
+	conn.PrintfLine("220 cinema.test ESMTP ready")
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch verb {
+		case "EHLO":
+			conn.PrintfLine("250-cinema.test")
+			conn.PrintfLine("250 8BITMIME")
+		case "HELO", "NOOP":
+			conn.PrintfLine("250 OK")
+		case "MAIL":
+			s.mutex.Lock()
+			fail, code := s.failNext > 0, s.failCode
+			if fail {
+				s.failNext--
+			}
+			s.mutex.Unlock()
+			if fail {
+				conn.PrintfLine("%d Rejected by test", code)
+				continue
+			}
+			current = receivedMail{From: strings.Fields(line[len("MAIL FROM:"):])[0]}
+			conn.PrintfLine("250 OK")
+		case "RCPT":
+			current.To = append(current.To, line[len("RCPT TO:"):])
+			conn.PrintfLine("250 OK")
+		case "DATA":
+			conn.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := io.ReadAll(conn.DotReader())
+			if err != nil {
+				return
+			}
+			current.Data = string(data)
+			s.mutex.Lock()
+			s.received = append(s.received, current)
+			s.mutex.Unlock()
+			conn.PrintfLine("250 Queued")
+		case "RSET":
+			current = receivedMail{}
+			conn.PrintfLine("250 OK")
+		case "QUIT":
+			conn.PrintfLine("221 Bye")
+			return
+		default:
+			conn.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+// parsedMail is a received email split into its headers, both bodies and
+// its attachments
+type parsedMail struct {
+	Subject     string
+	Header      mail.Header
+	Text        string
+	HTML        string
+	Attachments map[string][]byte
+}
+
+// parseMail decodes a multipart/alternative email, which may be wrapped in a
+// multipart/mixed email with attachments
+func parseMail(t *testing.T, received receivedMail) parsedMail {
+	msg, err := mail.ReadMessage(strings.NewReader(received.Data))
+	if err != nil {
+		t.Fatalf("Error reading email: %v", err)
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatalf("Error decoding subject: %v", err)
+	}
+	parsed := parsedMail{Subject: subject, Header: msg.Header, Attachments: make(map[string][]byte)}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("Error parsing content type %q: %v", msg.Header.Get("Content-Type"), err)
+	}
+	switch mediaType {
+	case "multipart/alternative":
+		parseAlternative(t, msg.Body, params["boundary"], &parsed)
+	case "multipart/mixed":
+		parts := multipart.NewReader(msg.Body, params["boundary"])
+		for {
+			part, err := parts.NextRawPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Error reading email part: %v", err)
+			}
+
+			partType, partParams, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			if partType == "multipart/alternative" {
+				parseAlternative(t, part, partParams["boundary"], &parsed)
+				continue
+			}
+			_, disposition, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+			data, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, part))
+			if err != nil {
+				t.Fatalf("Error decoding attachment: %v", err)
+			}
+			parsed.Attachments[disposition["filename"]] = data
+		}
+	default:
+		t.Fatalf("Expected a multipart email, got %q", mediaType)
+	}
+
+	return parsed
+}
+
+// parseAlternative decodes the plain text and HTML versions of an email
+func parseAlternative(t *testing.T, body io.Reader, boundary string, parsed *parsedMail) {
+	parts := multipart.NewReader(body, boundary)
+	for {
+		// NextRawPart leaves the quoted-printable encoding for the test to check
+		part, err := parts.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error reading email part: %v", err)
+		}
+		if encoding := part.Header.Get("Content-Transfer-Encoding"); encoding != "quoted-printable" {
+			t.Errorf("Expected quoted-printable parts, got %q", encoding)
+		}
+		data, err := io.ReadAll(quotedprintable.NewReader(part))
+		if err != nil {
+			t.Fatalf("Error decoding email part: %v", err)
+		}
+
+		switch {
+		case strings.HasPrefix(part.Header.Get("Content-Type"), "text/plain"):
+			parsed.Text = string(data)
+		case strings.HasPrefix(part.Header.Get("Content-Type"), "text/html"):
+			parsed.HTML = string(data)
+		}
+	}
+}
+
+// setupNotifications gives each test clean tables and an outbox delivering
+// to a fresh SMTP stand-in
+func setupNotifications(t *testing.T) (*notifications.Outbox, *smtpServer, models.Show) {
+	database.DB.Exec("DELETE FROM notifications")
+	database.DB.Exec("DELETE FROM cancellations")
+	database.DB.Exec("DELETE FROM bookings")
+	database.DB.Exec("DELETE FROM shows")
+	database.DB.Exec("DELETE FROM movies")
+
+	server := startSMTPServer(t)
+	outbox := notifications.NewOutbox(server.transport())
+	outbox.BaseURL = "https://cinema.test"
+	outbox.RetryDelay = 0
+	outbox.SendTimeout = 5 * time.Second
+
+	previous := handlers.Outbox
+	handlers.Outbox = outbox
+	t.Cleanup(func() { handlers.Outbox = previous })
+
+	return outbox, server, setupTestShow(t)
+}
+
+// Test that the SMTP transport sends both versions of an email
+func TestSMTPTransport(t *testing.T) {
+	server := startSMTPServer(t)
+
+	err := server.transport().Send(context.Background(), notifications.Message{
+		To:      "guest@example.com",
+		Subject: "Café night is confirmed",
+		Text:    "See you at the café. " + strings.Repeat("Long line ", 20),
+		HTML:    `<p style="color: red">See you at the café.</p>`,
+	})
+	if err != nil {
+		t.Fatalf("Expected the email to be sent, got %v", err)
+	}
+
+	received := server.messages()
+	if len(received) != 1 {
+		t.Fatalf("Expected one email, got %d", len(received))
+	}
+	if received[0].From != "<bookings@cinema.test>" || len(received[0].To) != 1 || received[0].To[0] != "<guest@example.com>" {
+		t.Errorf("Unexpected envelope from %s to %v", received[0].From, received[0].To)
+	}
+
+	email := parseMail(t, received[0])
+	if email.Subject != "Café night is confirmed" {
+		t.Errorf("Expected the subject to survive encoding, got %q", email.Subject)
+	}
+	if from := email.Header.Get("From"); from != `"Cinema Booking" <bookings@cinema.test>` {
+		t.Errorf("Unexpected From header %q", from)
+	}
+	for _, header := range []string{"Date", "Message-ID", "MIME-Version"} {
+		if email.Header.Get(header) == "" {
+			t.Errorf("Expected a %s header", header)
+		}
+	}
+	if !strings.HasPrefix(email.Text, "See you at the café.") || !strings.HasSuffix(email.Text, "Long line ") {
+		t.Errorf("Unexpected text body %q", email.Text)
+	}
+	if email.HTML != `<p style="color: red">See you at the café.</p>` {
+		t.Errorf("Unexpected HTML body %q", email.HTML)
+	}
+}
+
+// Test that failed deliveries are retried, also after a restart, and that
+// permanent failures and repeated failures are given up on
+func TestOutboxRetries(t *testing.T) {
+	outbox, server, show := setupNotifications(t)
+	handlers.Outbox = nil // Queue the emails by hand below
+
+	booked := submitBooking(handlers.BookingRequest{
+		ShowID:       show.ID,
+		CustomerName: "Retry",
+		Email:        "retry@example.com",
+		Seats:        models.Seats{{Row: "A", Number: 1}},
+	})
+	if !booked.Success {
+		t.Fatalf("Expected booking to succeed, got %s", booked.ErrorMessage)
+	}
+	var booking models.Booking
+	database.DB.Preload("Show.Movie").Preload("Show.Hall").First(&booking, booked.BookingID)
+
+	// Two temporary failures, then success from an outbox that was restarted
+	server.failWith(2, 451)
+	if err := outbox.Enqueue(notifications.BookingConfirmed, notifications.BookingEmail{Booking: booking}); err != nil {
+		t.Fatalf("Error queueing email: %v", err)
+	}
+	if sent := outbox.Flush(context.Background()); sent != 0 {
+		t.Errorf("Expected the first attempt to fail, got %d sent", sent)
+	}
+
+	restarted := notifications.NewOutbox(server.transport())
+	restarted.RetryDelay = 0
+	restarted.Flush(context.Background())
+	if sent := restarted.Flush(context.Background()); sent != 1 {
+		t.Errorf("Expected the third attempt to succeed, got %d sent", sent)
+	}
+
+	var notification models.Notification
+	database.DB.Where("kind = ?", notifications.BookingConfirmed).First(&notification)
+	if notification.Status != models.NotificationSent || notification.Attempts != 3 || notification.SentAt == nil {
+		t.Errorf("Expected the email to be sent on the third attempt, got %s after %d", notification.Status, notification.Attempts)
+	}
+	if len(server.messages()) != 1 {
+		t.Errorf("Expected exactly one email to arrive, got %d", len(server.messages()))
+	}
+
+	// Queueing the same event again is ignored
+	outbox.Enqueue(notifications.BookingConfirmed, notifications.BookingEmail{Booking: booking})
+	if sent := outbox.Flush(context.Background()); sent != 0 {
+		t.Errorf("Expected a duplicate email to be ignored, got %d sent", sent)
+	}
+
+	// A permanent rejection is not retried
+	server.failWith(1, 550)
+	outbox.Enqueue(notifications.ShowReminder, notifications.BookingEmail{Booking: booking})
+	outbox.Flush(context.Background())
+	outbox.Flush(context.Background())
+
+	var reminder models.Notification
+	database.DB.Where("kind = ?", notifications.ShowReminder).First(&reminder)
+	if reminder.Status != models.NotificationFailed || reminder.Attempts != 1 || !strings.Contains(reminder.LastError, "550") {
+		t.Errorf("Expected the rejected email to fail at once, got %s after %d: %s", reminder.Status, reminder.Attempts, reminder.LastError)
+	}
+
+	// Temporary failures are given up on after MaxAttempts
+	outbox.MaxAttempts = 2
+	server.failWith(5, 421)
+	outbox.Enqueue(notifications.ShowRescheduled, notifications.BookingEmail{Booking: booking, PreviousTime: show.DateTime})
+	for i := 0; i < 3; i++ {
+		outbox.Flush(context.Background())
+	}
+
+	var rescheduled models.Notification
+	database.DB.Where("kind = ?", notifications.ShowRescheduled).First(&rescheduled)
+	if rescheduled.Status != models.NotificationFailed || rescheduled.Attempts != 2 {
+		t.Errorf("Expected the email to fail after 2 attempts, got %s after %d", rescheduled.Status, rescheduled.Attempts)
+	}
+}
+
+// Test the emails sent when bookings are confirmed and cancelled
+func TestBookingLifecycleEmails(t *testing.T) {
+	outbox, server, show := setupNotifications(t)
+
+	booked := submitBooking(handlers.BookingRequest{
+		ShowID:       show.ID,
+		CustomerName: "Mail Reader",
+		Email:        "reader@example.com",
+		Seats:        models.Seats{{Row: "B", Number: 1}, {Row: "B", Number: 2}},
+	})
+	if !booked.Success {
+		t.Fatalf("Expected booking to succeed, got %s", booked.ErrorMessage)
+	}
+
+	// Holds are only confirmed once paid for
+	held := submitBooking(handlers.BookingRequest{
+		Action:       handlers.ActionHold,
+		ShowID:       show.ID,
+		CustomerName: "Mail Reader",
+		Email:        "holder@example.com",
+		Seats:        models.Seats{{Row: "C", Number: 1}},
+	})
+	if !held.Success {
+		t.Fatalf("Expected hold to succeed, got %s", held.ErrorMessage)
+	}
+	if sent := outbox.Flush(context.Background()); sent != 1 {
+		t.Fatalf("Expected one confirmation for the booking and none for the hold, got %d", sent)
+	}
+
+	confirmation := parseMail(t, server.messages()[0])
+	if !strings.Contains(confirmation.Subject, "confirmed") || !strings.Contains(confirmation.Subject, booked.Reference) {
+		t.Errorf("Unexpected confirmation subject %q", confirmation.Subject)
+	}
+	if pdf := confirmation.Attachments["tickets-"+booked.Reference+".pdf"]; !bytes.HasPrefix(pdf, []byte("%PDF-")) {
+		t.Errorf("Expected the tickets to be attached as a PDF, got %v", confirmation.Attachments)
+	}
+	for _, body := range []string{confirmation.Text, confirmation.HTML} {
+		for _, want := range []string{"Test Movie", "B1, B2", "$20.00", "https://cinema.test/booking/confirmation/" + booked.Reference} {
+			if !strings.Contains(body, want) {
+				t.Errorf("Expected the confirmation to mention %q:\n%s", want, body)
+			}
+		}
+	}
+
+	if confirmed := submitBooking(handlers.BookingRequest{Action: handlers.ActionConfirm, BookingID: held.BookingID}); !confirmed.Success {
+		t.Fatalf("Expected hold to be confirmed, got %s", confirmed.ErrorMessage)
+	}
+	if sent := outbox.Flush(context.Background()); sent != 1 {
+		t.Errorf("Expected a confirmation once the hold was confirmed, got %d", sent)
+	}
+
+	// Every cancellation is its own email
+	for _, seats := range []models.Seats{{{Row: "B", Number: 2}}, nil} {
+		cancelled := submitBooking(handlers.BookingRequest{
+			Action:    handlers.ActionCancel,
+			BookingID: booked.BookingID,
+			Seats:     seats,
+		})
+		if !cancelled.Success {
+			t.Fatalf("Expected cancellation to succeed, got %s", cancelled.ErrorMessage)
+		}
+	}
+	if sent := outbox.Flush(context.Background()); sent != 2 {
+		t.Fatalf("Expected an email for each cancellation, got %d", sent)
+	}
+
+	received := server.messages()
+	partial, full := parseMail(t, received[2]), parseMail(t, received[3])
+	if !strings.Contains(partial.Subject, "cancelled") || !strings.Contains(partial.Text, "Some of the seats") ||
+		!strings.Contains(partial.Text, "Cancelled seats: B2") || !strings.Contains(partial.Text, "Refund: $5.00 (50%)") {
+		t.Errorf("Unexpected partial cancellation email:\n%s", partial.Text)
+	}
+	if !strings.Contains(full.Text, "has been cancelled") || !strings.Contains(full.Text, "Cancelled seats: B1") {
+		t.Errorf("Unexpected cancellation email:\n%s", full.Text)
+	}
+}
+
+// Test that rescheduling a show emails its confirmed bookings
+func TestShowRescheduledEmails(t *testing.T) {
+	outbox, server, show := setupNotifications(t)
+
+	for i, action := range []handlers.BookingAction{handlers.ActionBook, handlers.ActionHold} {
+		response := submitBooking(handlers.BookingRequest{
+			Action:       action,
+			ShowID:       show.ID,
+			CustomerName: "Moved",
+			Email:        "moved@example.com",
+			Seats:        models.Seats{{Row: "D", Number: i + 1}},
+		})
+		if !response.Success {
+			t.Fatalf("Expected booking to succeed, got %s", response.ErrorMessage)
+		}
+	}
+	outbox.Flush(context.Background())
+
+	newTime := show.DateTime.Add(48 * time.Hour).Truncate(time.Minute).UTC()
+	form := url.Values{
+		"date": {newTime.Format("2006-01-02")},
+		"time": {newTime.Format("15:04")},
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/shows/{id:[0-9]+}/reschedule", handlers.AdminRescheduleShowHandler).Methods("GET", "POST")
+	req := httptest.NewRequest("POST", fmt.Sprintf("/admin/shows/%d/reschedule", show.ID), strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req = req.WithContext(context.WithValue(req.Context(), "user", models.User{Username: "admin", Role: models.RoleAdmin}))
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("Expected a redirect after rescheduling, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var updated models.Show
+	database.DB.First(&updated, show.ID)
+	if !updated.DateTime.Equal(newTime) {
+		t.Errorf("Expected the show to move to %s, got %s", newTime, updated.DateTime)
+	}
+
+	if sent := outbox.Flush(context.Background()); sent != 1 {
+		t.Fatalf("Expected one email for the confirmed booking, got %d", sent)
+	}
+	received := server.messages()
+	email := parseMail(t, received[len(received)-1])
+	if !strings.Contains(email.Subject, "New time") ||
+		!strings.Contains(email.Text, "Was: "+utils.FormatDateTime(show.DateTime)) ||
+		!strings.Contains(email.Text, "Now: "+utils.FormatDateTime(newTime)) {
+		t.Errorf("Unexpected reschedule email %q:\n%s", email.Subject, email.Text)
+	}
+}
+
+// Test that reminders are sent once for bookings made before the reminder window
+func TestShowReminders(t *testing.T) {
+	outbox, server, show := setupNotifications(t)
+
+	var bookingIDs []uint
+	for n := 1; n <= 2; n++ {
+		response := submitBooking(handlers.BookingRequest{
+			ShowID:       show.ID,
+			CustomerName: "Forgetful",
+			Email:        fmt.Sprintf("forgetful%d@example.com", n),
+			Seats:        models.Seats{{Row: "E", Number: n}},
+		})
+		if !response.Success {
+			t.Fatalf("Expected booking to succeed, got %s", response.ErrorMessage)
+		}
+		bookingIDs = append(bookingIDs, response.BookingID)
+	}
+	outbox.Flush(context.Background())
+	confirmations := len(server.messages())
+
+	// Only the first booking was made before the window opened
+	database.DB.Model(&models.Booking{}).Where("id = ?", bookingIDs[0]).
+		UpdateColumn("booking_time", time.Now().Add(-72*time.Hour))
+
+	handlers.SendShowReminders(time.Now())
+	handlers.SendShowReminders(time.Now())
+	if sent := outbox.Flush(context.Background()); sent != 1 {
+		t.Fatalf("Expected a single reminder, got %d", sent)
+	}
+
+	reminder := parseMail(t, server.messages()[confirmations])
+	if !strings.HasPrefix(reminder.Subject, "Reminder: Test Movie") || !strings.Contains(reminder.Text, "Hi Forgetful") {
+		t.Errorf("Unexpected reminder %q:\n%s", reminder.Subject, reminder.Text)
+	}
+
+	// Shows further away are not reminded of yet
+	handlers.SendShowReminders(time.Now().Add(-2 * time.Hour))
+	if sent := outbox.Flush(context.Background()); sent != 0 {
+		t.Errorf("Expected no reminder before the window, got %d", sent)
+	}
+}
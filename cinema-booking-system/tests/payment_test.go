@@ -0,0 +1,263 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/handlers"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/payments"
+	"github.com/gorilla/mux"
+)
+
+// setupPayments gives each test a fresh sandbox provider and clean tables
+func setupPayments(t *testing.T) (*payments.FakeProvider, models.Show) {
+	database.DB.Exec("DELETE FROM payments")
+	database.DB.Exec("DELETE FROM cancellations")
+	database.DB.Exec("DELETE FROM bookings")
+	database.DB.Exec("DELETE FROM shows")
+	database.DB.Exec("DELETE FROM movies")
+
+	provider := payments.NewFakeProvider()
+	previous := handlers.PaymentProvider
+	handlers.PaymentProvider = provider
+	t.Cleanup(func() { handlers.PaymentProvider = previous })
+
+	return provider, setupTestShow(t)
+}
+
+// payForSeats books seats through the API with the given idempotency key
+func payForSeats(t *testing.T, show models.Show, key, token string, seats ...models.Seat) (int, handlers.APIResponse) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"show_id":       show.ID,
+		"customer_name": "Paying Customer",
+		"email":         "payer@example.com",
+		"seats":         seats,
+		"payment_token": token,
+	})
+
+	req := httptest.NewRequest("POST", "/api/v1/bookings", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", key)
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	rec := httptest.NewRecorder()
+	newAPIRouter().ServeHTTP(rec, req)
+
+	var response handlers.APIResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Error decoding response %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, response
+}
+
+// Test that a successful checkout captures the booking's total once
+func TestPaymentCaptured(t *testing.T) {
+	provider, show := setupPayments(t)
+
+	seats := []models.Seat{{Row: "C", Number: 1}, {Row: "C", Number: 2}}
+	code, created := payForSeats(t, show, "key-captured", payments.TokenApprove, seats...)
+	if code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", code, created.Error)
+	}
+
+	var payment models.Payment
+	if err := database.DB.Where("idempotency_key = ?", "key-captured").First(&payment).Error; err != nil {
+		t.Fatalf("Expected a payment to be recorded: %v", err)
+	}
+	if payment.Status != models.PaymentCaptured || payment.Amount != usd(2000) {
+		t.Errorf("Expected $20.00 captured, got %s %s", payment.Amount, payment.Status)
+	}
+	if captured := provider.Captured(payment.TransactionID); captured != usd(2000) {
+		t.Errorf("Expected the provider to hold $20.00, got %s", captured)
+	}
+
+	var booking models.Booking
+	database.DB.First(&booking, payment.BookingID)
+	if booking.Status != models.BookingConfirmed {
+		t.Errorf("Expected booking to be confirmed, got %s", booking.Status)
+	}
+
+	// Retrying with the same key returns the same booking without charging again
+	code, replayed := payForSeats(t, show, "key-captured", payments.TokenApprove, seats...)
+	if code != http.StatusCreated {
+		t.Fatalf("Expected 201 replaying the request, got %d: %s", code, replayed.Error)
+	}
+	if replayed.Data.(map[string]interface{})["reference"] != booking.Reference {
+		t.Errorf("Expected the replay to return booking %s", booking.Reference)
+	}
+
+	var count int64
+	database.DB.Model(&models.Payment{}).Count(&count)
+	if count != 1 {
+		t.Errorf("Expected exactly one payment, got %d", count)
+	}
+}
+
+// Test that declined and timed out payments leave the seats free
+func TestPaymentFailures(t *testing.T) {
+	provider, show := setupPayments(t)
+
+	previousTimeout := handlers.PaymentTimeout
+	handlers.PaymentTimeout = 50 * time.Millisecond
+	defer func() { handlers.PaymentTimeout = previousTimeout }()
+
+	seat := models.Seat{Row: "D", Number: 4}
+
+	provider.Script(payments.OutcomeDecline)
+	if code, response := payForSeats(t, show, "key-declined", payments.TokenApprove, seat); code != http.StatusPaymentRequired {
+		t.Errorf("Expected 402 for a declined payment, got %d: %s", code, response.Error)
+	}
+
+	if code, response := payForSeats(t, show, "key-timeout", payments.TokenTimeout, seat); code != http.StatusBadGateway {
+		t.Errorf("Expected 502 when the provider times out, got %d: %s", code, response.Error)
+	}
+
+	var failed models.Payment
+	database.DB.Where("idempotency_key = ?", "key-timeout").First(&failed)
+	if failed.Status != models.PaymentFailed {
+		t.Errorf("Expected the timed out payment to be failed, got %s", failed.Status)
+	}
+
+	// Replaying a declined request reports the decline again
+	if code, _ := payForSeats(t, show, "key-declined", payments.TokenApprove, seat); code != http.StatusPaymentRequired {
+		t.Errorf("Expected 402 replaying a declined payment, got %d", code)
+	}
+
+	// The seat was released after each failure and can still be bought
+	if code, response := payForSeats(t, show, "key-retry", payments.TokenApprove, seat); code != http.StatusCreated {
+		t.Errorf("Expected 201 paying with a new key, got %d: %s", code, response.Error)
+	}
+}
+
+// Test that an authorization is voided when the hold lapses during payment
+func TestPaymentVoidedWhenHoldLost(t *testing.T) {
+	provider, show := setupPayments(t)
+
+	hold := submitBooking(handlers.BookingRequest{
+		Action:       handlers.ActionHold,
+		ShowID:       show.ID,
+		CustomerName: "Slow Payer",
+		Email:        "slow@example.com",
+		Seats:        models.Seats{{Row: "E", Number: 5}},
+	})
+	if !hold.Success {
+		t.Fatalf("Expected hold to succeed, got %s", hold.ErrorMessage)
+	}
+
+	// The hold is given up while the provider is still deciding
+	provider.OnAuthorize = func(payments.AuthorizeRequest) {
+		submitBooking(handlers.BookingRequest{Action: handlers.ActionRelease, BookingID: hold.BookingID})
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/booking/{reference}/confirm", handlers.ConfirmHoldHandler).Methods("POST")
+
+	form := url.Values{"payment_token": {payments.TokenApprove}, "idempotency_key": {"key-lost"}}
+	req := httptest.NewRequest("POST", "/booking/"+hold.Reference+"/confirm", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	if location := rec.Header().Get("Location"); !strings.HasPrefix(location, "/booking/checkout/") {
+		t.Errorf("Expected to be sent back to checkout, got %q", location)
+	}
+
+	var booking models.Booking
+	database.DB.First(&booking, hold.BookingID)
+	if booking.Status != models.BookingReleased {
+		t.Errorf("Expected booking to stay released, got %s", booking.Status)
+	}
+
+	var payment models.Payment
+	database.DB.Where("idempotency_key = ?", "key-lost").First(&payment)
+	if payment.Status != models.PaymentVoided {
+		t.Errorf("Expected the payment to be voided, got %s", payment.Status)
+	}
+	if !provider.Captured(payment.TransactionID).IsZero() {
+		t.Errorf("Expected nothing to be captured for a lost hold")
+	}
+}
+
+// Test that cancelling a paid booking refunds the money through the provider
+func TestCancellationRefundsPayment(t *testing.T) {
+	provider, show := setupPayments(t)
+
+	code, created := payForSeats(t, show, "key-refund", payments.TokenApprove,
+		models.Seat{Row: "F", Number: 1}, models.Seat{Row: "F", Number: 2})
+	if code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", code, created.Error)
+	}
+	reference := created.Data.(map[string]interface{})["reference"].(string)
+
+	code, cancelled := apiRequest(t, newAPIRouter(), "DELETE", "/api/v1/bookings/"+reference+"?email=payer@example.com",
+		map[string]interface{}{"seats": []models.Seat{{Row: "F", Number: 2}}})
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200 cancelling a seat, got %d: %s", code, cancelled.Error)
+	}
+
+	var cancellation models.Cancellation
+	database.DB.Last(&cancellation)
+	if cancellation.RefundReference == "" {
+		t.Errorf("Expected the cancellation to record a refund reference")
+	}
+
+	var payment models.Payment
+	database.DB.Where("idempotency_key = ?", "key-refund").First(&payment)
+	if payment.RefundedAmount != cancellation.RefundAmount {
+		t.Errorf("Expected %s refunded on the payment, got %s", cancellation.RefundAmount, payment.RefundedAmount)
+	}
+	if remaining := provider.Captured(payment.TransactionID); remaining != payment.Amount.Sub(cancellation.RefundAmount) {
+		t.Errorf("Expected the provider to keep %s, got %s", payment.Amount.Sub(cancellation.RefundAmount), remaining)
+	}
+}
+
+// slowProvider is the sandbox provider taking a while to authorize
+type slowProvider struct {
+	*payments.FakeProvider
+	delay time.Duration
+}
+
+// Authorize waits before authorizing
+func (p slowProvider) Authorize(ctx context.Context, request payments.AuthorizeRequest) (payments.Authorization, error) {
+	time.Sleep(p.delay)
+	return p.FakeProvider.Authorize(ctx, request)
+}
+
+// Test that a payment slower than the server's write timeout still gets its
+// response to the customer
+func TestSlowPaymentOutlivesWriteTimeout(t *testing.T) {
+	provider, show := setupPayments(t)
+	handlers.PaymentProvider = slowProvider{FakeProvider: provider, delay: 300 * time.Millisecond}
+
+	server := httptest.NewUnstartedServer(newAPIRouter())
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"show_id":       show.ID,
+		"customer_name": "Patient Customer",
+		"email":         "patient@example.com",
+		"seats":         models.Seats{{Row: "E", Number: 5}},
+		"payment_token": payments.TokenApprove,
+	})
+	req, _ := http.NewRequest("POST", server.URL+"/api/v1/bookings", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Origin", server.URL)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Expected the response to arrive after a slow payment, got %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("Expected 201 after a slow payment, got %d", resp.StatusCode)
+	}
+}
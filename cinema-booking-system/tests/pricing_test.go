@@ -0,0 +1,210 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/handlers"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/money"
+	"github.com/JoeDkhar/cinema-booking-system/internal/pricing"
+)
+
+// Test that the pricing rules are applied in order to the running price
+func TestSeatPriceRules(t *testing.T) {
+	release := time.Date(2030, 1, 10, 0, 0, 0, 0, time.UTC) // Thursday
+	hall := models.Hall{Layout: models.SeatLayout{Rows: []models.RowLayout{
+		{Label: "A", Seats: 4, SeatCategories: map[int]models.SeatCategory{4: models.SeatWheelchairCompanion}},
+		{Label: "B", Seats: 4, Category: models.SeatPremium},
+	}}}
+	movie := models.Movie{ReleaseDate: &release}
+
+	cases := []struct {
+		name        string
+		showTime    time.Time
+		seat        models.Seat
+		price       money.Money
+		adjustments int
+	}{
+		// 10.00 +25% premium, -20% matinee, -10% weekday, -30% child
+		{"weekday matinee child premium", time.Date(2030, 1, 9, 14, 0, 0, 0, time.UTC),
+			models.Seat{Row: "B", Number: 1, TicketType: models.TicketChild}, usd(630), 4},
+		// 10.00 +15% opening weekend
+		{"opening weekend evening adult", time.Date(2030, 1, 12, 20, 0, 0, 0, time.UTC),
+			models.Seat{Row: "A", Number: 1}, usd(1150), 1},
+		// 10.00 with no rules applying
+		{"weekend after opening", time.Date(2030, 1, 19, 20, 0, 0, 0, time.UTC),
+			models.Seat{Row: "A", Number: 2, TicketType: models.TicketAdult}, usd(1000), 0},
+		// 10.00 -50% companion, -25% senior
+		{"companion seat senior", time.Date(2030, 1, 19, 20, 0, 0, 0, time.UTC),
+			models.Seat{Row: "A", Number: 4, TicketType: models.TicketSenior}, usd(375), 2},
+	}
+
+	for _, c := range cases {
+		show := models.Show{DateTime: c.showTime, TicketPrice: usd(1000), Hall: &hall, Movie: &movie}
+		prices, err := pricing.DefaultRules.Price(show, models.Seats{c.seat})
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", c.name, err)
+		}
+
+		if prices[0].Price != c.price {
+			t.Errorf("%s: expected %s, got %s (%+v)", c.name, c.price, prices[0].Price, prices[0].Adjustments)
+		}
+		if len(prices[0].Adjustments) != c.adjustments {
+			t.Errorf("%s: expected %d adjustments, got %+v", c.name, c.adjustments, prices[0].Adjustments)
+		}
+	}
+
+	// Unknown ticket types are rejected
+	show := models.Show{DateTime: release, TicketPrice: usd(1000), Hall: &hall}
+	if _, err := pricing.DefaultRules.Price(show, models.Seats{{Row: "A", Number: 1, TicketType: "vip"}}); err == nil {
+		t.Errorf("Expected an unknown ticket type to be rejected")
+	}
+}
+
+// Test which days count as a movie's opening weekend
+func TestIsOpeningWeekend(t *testing.T) {
+	cases := []struct {
+		release string
+		show    string
+		opening bool
+	}{
+		{"2030-01-10", "2030-01-10", false}, // Release day is a Thursday
+		{"2030-01-10", "2030-01-11", true},
+		{"2030-01-10", "2030-01-13", true},
+		{"2030-01-10", "2030-01-14", false},
+		{"2030-01-12", "2030-01-11", false}, // Saturday release skips the Friday before
+		{"2030-01-12", "2030-01-12", true},
+		{"2030-01-13", "2030-01-13", true}, // Sunday release is a one-day weekend
+		{"2030-01-13", "2030-01-18", false},
+	}
+
+	for _, c := range cases {
+		release, _ := time.Parse("2006-01-02", c.release)
+		show, _ := time.Parse("2006-01-02", c.show)
+		show = show.Add(19 * time.Hour)
+
+		if got := pricing.IsOpeningWeekend(release, show); got != c.opening {
+			t.Errorf("Release %s, show %s: expected %v, got %v", c.release, c.show, c.opening, got)
+		}
+	}
+}
+
+// Test that tax is rounded once on the total and its shares add up to it
+func TestApplyTax(t *testing.T) {
+	prices := models.SeatPrices{{Price: usd(1000)}, {Price: usd(1000)}, {Price: usd(1000)}, {Price: usd(0)}}
+
+	taxed := pricing.Rules{TaxPercent: 8.25}.ApplyTax(prices)
+	// $30.00 including 8.25% tax holds 228.64 cents of it
+	if taxed.Tax() != usd(229) {
+		t.Errorf("Expected $2.29 tax, got %s", taxed.Tax())
+	}
+	if taxed[0].Tax != usd(77) || taxed[1].Tax != usd(76) || taxed[2].Tax != usd(76) || !taxed[3].Tax.IsZero() {
+		t.Errorf("Expected the tax split 0.77, 0.76, 0.76 and nothing on the free seat, got %v", taxed)
+	}
+	if taxed.Total() != usd(3000) {
+		t.Errorf("Expected tax not to change the total, got %s", taxed.Total())
+	}
+	if prices[0].Tax.IsPositive() {
+		t.Errorf("Expected the original prices to be left alone")
+	}
+
+	if untaxed := (pricing.Rules{}).ApplyTax(prices); !untaxed.Tax().IsZero() {
+		t.Errorf("Expected no tax without a rate, got %s", untaxed.Tax())
+	}
+}
+
+// Test that bookings store a per-seat price breakdown and refund by seat
+func TestBookingPriceBreakdown(t *testing.T) {
+	database.DB.Exec("DELETE FROM cancellations")
+	database.DB.Exec("DELETE FROM bookings")
+	database.DB.Exec("DELETE FROM shows")
+	database.DB.Exec("DELETE FROM movies")
+
+	previous := handlers.PriceRules
+	handlers.PriceRules = pricing.Rules{
+		Categories:  map[models.SeatCategory]float64{models.SeatPremium: 50},
+		TicketTypes: map[models.TicketType]float64{models.TicketChild: -50},
+		TaxPercent:  20,
+	}
+	defer func() { handlers.PriceRules = previous }()
+
+	show := setupTestShow(t)
+
+	// Make the back row of the test hall premium
+	var hall models.Hall
+	database.DB.First(&hall, show.HallID)
+	original := hall.Layout
+	hall.Layout.Rows[len(hall.Layout.Rows)-1].Category = models.SeatPremium
+	database.DB.Save(&hall)
+	defer func() {
+		hall.Layout = original
+		database.DB.Save(&hall)
+	}()
+
+	booked := submitBooking(handlers.BookingRequest{
+		ShowID:       show.ID,
+		CustomerName: "Family",
+		Email:        "family@example.com",
+		Seats: models.Seats{
+			{Row: "A", Number: 1, TicketType: models.TicketAdult},
+			{Row: "J", Number: 1, TicketType: models.TicketChild},
+		},
+	})
+	if !booked.Success {
+		t.Fatalf("Expected booking to succeed, got %s", booked.ErrorMessage)
+	}
+
+	var booking models.Booking
+	database.DB.First(&booking, booked.BookingID)
+
+	// Adult standard 10.00, child premium 10.00 +50% -50% = 7.50
+	if booking.TotalAmount != usd(1750) {
+		t.Errorf("Expected total $17.50, got %s", booking.TotalAmount)
+	}
+	if len(booking.Prices) != 2 {
+		t.Fatalf("Expected a price for each seat, got %+v", booking.Prices)
+	}
+	child, _ := booking.Prices.For(models.Seat{Row: "J", Number: 1})
+	if child.Category != models.SeatPremium || child.TicketType != models.TicketChild || child.Price != usd(750) {
+		t.Errorf("Expected premium child seat at 7.50, got %+v", child)
+	}
+	// The 20% tax in $17.50 is $2.92, shared over the seats by price
+	if booking.Prices.Tax() != usd(292) || child.Tax != usd(125) {
+		t.Errorf("Expected $2.92 tax with $1.25 on the child seat, got %s and %s", booking.Prices.Tax(), child.Tax)
+	}
+
+	// Cancelling the child seat refunds what that seat cost
+	cancelled := submitBooking(handlers.BookingRequest{
+		Action:    handlers.ActionCancel,
+		BookingID: booked.BookingID,
+		Seats:     models.Seats{{Row: "J", Number: 1}},
+	})
+	if !cancelled.Success {
+		t.Fatalf("Expected cancellation to succeed, got %s", cancelled.ErrorMessage)
+	}
+
+	var cancellation models.Cancellation
+	database.DB.First(&cancellation, cancelled.CancellationID)
+	expectedRefund := usd(750).Percent(float64(cancellation.RefundPercent))
+	if cancellation.RefundAmount != expectedRefund {
+		t.Errorf("Expected refund %s, got %s", expectedRefund, cancellation.RefundAmount)
+	}
+
+	database.DB.First(&booking, booked.BookingID)
+	if booking.TotalAmount != usd(1000) || len(booking.Prices) != 1 {
+		t.Errorf("Expected the adult seat to remain at $10.00, got %s with %+v", booking.TotalAmount, booking.Prices)
+	}
+
+	// Unknown ticket types are rejected before anything is booked
+	invalid := submitBooking(handlers.BookingRequest{
+		ShowID:       show.ID,
+		CustomerName: "Typo",
+		Email:        "typo@example.com",
+		Seats:        models.Seats{{Row: "B", Number: 1, TicketType: "adlut"}},
+	})
+	if invalid.Success || invalid.Error.Code != handlers.ErrCodeInvalidTicket {
+		t.Errorf("Expected an unknown ticket type to be rejected, got %+v", invalid)
+	}
+}
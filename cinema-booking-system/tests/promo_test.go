@@ -0,0 +1,222 @@
+package tests
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/handlers"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/money"
+)
+
+// setupPromoCode clears earlier bookings and creates a promo code for a fresh show
+func setupPromoCode(t *testing.T, promo models.PromoCode) (models.PromoCode, models.Show) {
+	database.DB.Exec("DELETE FROM promo_redemptions")
+	database.DB.Exec("DELETE FROM promo_codes")
+	database.DB.Exec("DELETE FROM cancellations")
+	database.DB.Exec("DELETE FROM bookings")
+	database.DB.Exec("DELETE FROM shows")
+	database.DB.Exec("DELETE FROM movies")
+
+	show := setupTestShow(t)
+	if err := database.DB.Create(&promo).Error; err != nil {
+		t.Fatalf("Error creating promo code: %v", err)
+	}
+	return promo, show
+}
+
+// Test the restrictions on where a promo code can be used
+func TestPromoCodeCheck(t *testing.T) {
+	now := time.Date(2030, 1, 7, 12, 0, 0, 0, time.UTC)
+	later := now.Add(time.Hour)
+	movieID, showID := uint(1), uint(2)
+	show := models.Show{
+		MovieID:     1,
+		DateTime:    time.Date(2030, 1, 9, 19, 0, 0, 0, time.UTC), // Wednesday
+		TicketPrice: usd(1000),
+	}
+	show.ID = 2
+
+	cases := []struct {
+		name  string
+		promo models.PromoCode
+		seats int
+		valid bool
+	}{
+		{"no restrictions", models.PromoCode{}, 1, true},
+		{"disabled", models.PromoCode{Disabled: true}, 1, false},
+		{"not started", models.PromoCode{ValidFrom: &later}, 1, false},
+		{"expired", models.PromoCode{ValidUntil: &now}, 1, false},
+		{"matching movie and show", models.PromoCode{MovieID: &movieID, ShowID: &showID}, 1, true},
+		{"other movie", models.PromoCode{MovieID: &showID}, 1, false},
+		{"other show", models.PromoCode{ShowID: &movieID}, 1, false},
+		{"show day", models.PromoCode{Days: []time.Weekday{time.Tuesday, time.Wednesday}}, 1, true},
+		{"other day", models.PromoCode{Days: []time.Weekday{time.Saturday}}, 1, false},
+		{"enough seats", models.PromoCode{MinSeats: 3}, 3, true},
+		{"too few seats", models.PromoCode{MinSeats: 3}, 2, false},
+		{"other currency", models.PromoCode{Type: models.DiscountFixed, Amount: money.New(500, "EUR")}, 1, false},
+	}
+
+	for _, c := range cases {
+		err := c.promo.Check(show, c.seats, now)
+		if (err == nil) != c.valid {
+			t.Errorf("%s: expected valid %v, got %v", c.name, c.valid, err)
+		}
+	}
+}
+
+// Test that discounts are spread over the seats and refunded with them
+func TestPromoCodeDiscount(t *testing.T) {
+	promo, show := setupPromoCode(t, models.PromoCode{Code: "TENOFF", Type: models.DiscountFixed, Amount: usd(1000)})
+
+	booked := submitBooking(handlers.BookingRequest{
+		ShowID:       show.ID,
+		CustomerName: "Saver",
+		Email:        "saver@example.com",
+		Seats:        models.Seats{{Row: "A", Number: 1}, {Row: "A", Number: 2}, {Row: "A", Number: 3}},
+		PromoCode:    " tenoff ",
+	})
+	if !booked.Success {
+		t.Fatalf("Expected booking with a promo code to succeed, got %s", booked.ErrorMessage)
+	}
+
+	var booking models.Booking
+	database.DB.First(&booking, booked.BookingID)
+	if booking.TotalAmount != usd(2000) || booking.PromoCode != promo.Code {
+		t.Errorf("Expected $20.00 after %s, got %s with %q", promo.Code, booking.TotalAmount, booking.PromoCode)
+	}
+	// $10.00 over three $10.00 seats is 3.34, 3.33 and 3.33
+	if discount := booking.Prices.Discount(); discount != usd(1000) {
+		t.Errorf("Expected the seat prices to carry the $10.00 discount, got %s", discount)
+	}
+	if first, _ := booking.Prices.For(models.Seat{Row: "A", Number: 1}); first.Price != usd(666) {
+		t.Errorf("Expected the first seat to cost $6.66, got %s", first.Price)
+	}
+
+	// A cancelled seat refunds what was paid for it after the discount
+	cancelled := submitBooking(handlers.BookingRequest{
+		Action:      handlers.ActionCancel,
+		BookingID:   booked.BookingID,
+		Seats:       models.Seats{{Row: "A", Number: 3}},
+		CancelledBy: models.CancelledByAdmin,
+	})
+	if !cancelled.Success {
+		t.Fatalf("Expected cancellation to succeed, got %s", cancelled.ErrorMessage)
+	}
+	var cancellation models.Cancellation
+	database.DB.First(&cancellation, cancelled.CancellationID)
+	if expected := usd(667).Percent(float64(cancellation.RefundPercent)); cancellation.RefundAmount != expected {
+		t.Errorf("Expected refund %s, got %s", expected, cancellation.RefundAmount)
+	}
+
+	// Percentage discounts round to the cent
+	database.DB.Create(&models.PromoCode{Code: "THIRD", Type: models.DiscountPercent, Percent: 33.33})
+	booked = submitBooking(handlers.BookingRequest{
+		ShowID:       show.ID,
+		CustomerName: "Saver",
+		Email:        "saver@example.com",
+		Seats:        models.Seats{{Row: "B", Number: 1}},
+		PromoCode:    "THIRD",
+	})
+	if !booked.Success {
+		t.Fatalf("Expected booking with a percentage code to succeed, got %s", booked.ErrorMessage)
+	}
+	var discounted models.Booking
+	database.DB.First(&discounted, booked.BookingID)
+	if discounted.TotalAmount != usd(667) {
+		t.Errorf("Expected $6.67 after a third off, got %s", discounted.TotalAmount)
+	}
+
+	// Unknown codes are rejected through the API
+	code, response := apiRequest(t, newAPIRouter(), "POST", "/api/v1/bookings", map[string]interface{}{
+		"show_id":       show.ID,
+		"customer_name": "Guesser",
+		"email":         "guess@example.com",
+		"seats":         []models.Seat{{Row: "C", Number: 1}},
+		"payment_token": "tok_approve",
+		"promo_code":    "FREEBIES",
+	})
+	if code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for an unknown promo code, got %d: %s", code, response.Error)
+	}
+}
+
+// Test that a single-use code is only redeemed once under concurrency
+func TestPromoCodeSingleUse(t *testing.T) {
+	_, show := setupPromoCode(t, models.PromoCode{Code: "ONCE", Type: models.DiscountPercent, Percent: 50, MaxUses: 1})
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	successes := 0
+
+	for i := 1; i <= 10; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			response := submitBooking(handlers.BookingRequest{
+				ShowID:       show.ID,
+				CustomerName: fmt.Sprintf("Customer %d", n),
+				Email:        fmt.Sprintf("customer%d@example.com", n),
+				Seats:        models.Seats{{Row: "D", Number: n}},
+				PromoCode:    "ONCE",
+			})
+			if response.Success {
+				mutex.Lock()
+				successes++
+				mutex.Unlock()
+			} else if response.Error.Code != handlers.ErrCodePromoUsedUp {
+				t.Errorf("Expected the code to be used up, got %+v", response.Error)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if successes != 1 {
+		t.Errorf("Expected exactly one booking to use the code, got %d", successes)
+	}
+
+	var promo models.PromoCode
+	database.DB.Where("code = ?", "ONCE").First(&promo)
+	var redemptions int64
+	database.DB.Model(&models.PromoRedemption{}).Count(&redemptions)
+	if promo.Uses != 1 || redemptions != 1 {
+		t.Errorf("Expected one use and one redemption, got %d and %d", promo.Uses, redemptions)
+	}
+}
+
+// Test the per-email limit and that released holds give the use back
+func TestPromoCodePerEmail(t *testing.T) {
+	_, show := setupPromoCode(t, models.PromoCode{Code: "WELCOME", Type: models.DiscountPercent, Percent: 20, MaxUsesPerEmail: 1})
+
+	request := handlers.BookingRequest{
+		Action:       handlers.ActionHold,
+		ShowID:       show.ID,
+		CustomerName: "Repeat",
+		Email:        "repeat@example.com",
+		Seats:        models.Seats{{Row: "E", Number: 1}},
+		PromoCode:    "WELCOME",
+	}
+	first := submitBooking(request)
+	if !first.Success {
+		t.Fatalf("Expected first hold to succeed, got %s", first.ErrorMessage)
+	}
+
+	request.Email = "REPEAT@example.com"
+	request.Seats = models.Seats{{Row: "E", Number: 2}}
+	if second := submitBooking(request); second.Success || second.Error.Code != handlers.ErrCodePromoUsedUp {
+		t.Errorf("Expected the same email to be refused a second use, got %+v", second)
+	}
+
+	released := submitBooking(handlers.BookingRequest{Action: handlers.ActionRelease, BookingID: first.BookingID})
+	if !released.Success {
+		t.Fatalf("Expected release to succeed, got %s", released.ErrorMessage)
+	}
+
+	if third := submitBooking(request); !third.Success {
+		t.Errorf("Expected the code to be usable again after the hold was released, got %s", third.ErrorMessage)
+	}
+}
@@ -0,0 +1,238 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/handlers"
+	"github.com/JoeDkhar/cinema-booking-system/internal/middleware"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// Test what each role may do
+func TestRolePermissions(t *testing.T) {
+	tests := []struct {
+		role    models.Role
+		allowed []models.Permission
+	}{
+		{models.RoleCustomer, nil},
+		{models.RoleBoxOffice, []models.Permission{models.PermViewDashboard, models.PermManageBookings, models.PermCheckIn}},
+		{models.RoleScheduler, []models.Permission{models.PermViewDashboard, models.PermManageSchedule}},
+		{models.RoleManager, []models.Permission{
+			models.PermViewDashboard, models.PermManageBookings, models.PermCheckIn,
+			models.PermManageSchedule, models.PermManageHalls, models.PermManagePromos,
+		}},
+		{models.RoleAdmin, []models.Permission{
+			models.PermViewDashboard, models.PermManageBookings, models.PermCheckIn,
+			models.PermManageSchedule, models.PermManageHalls, models.PermManagePromos, models.PermManageUsers,
+		}},
+		{models.Role("owner"), nil},
+	}
+
+	all := []models.Permission{
+		models.PermViewDashboard, models.PermManageBookings, models.PermCheckIn,
+		models.PermManageSchedule, models.PermManageHalls, models.PermManagePromos, models.PermManageUsers,
+	}
+	for _, test := range tests {
+		for _, permission := range all {
+			expected := false
+			for _, allowed := range test.allowed {
+				expected = expected || allowed == permission
+			}
+			if got := test.role.Can(permission); got != expected {
+				t.Errorf("Expected %s Can(%s) to be %v, got %v", test.role, permission, expected, got)
+			}
+		}
+	}
+}
+
+// setupRoleUsers creates a user with a session for every role
+func setupRoleUsers(t *testing.T) map[models.Role]models.User {
+	database.DB.Exec("DELETE FROM users")
+
+	users := make(map[models.Role]models.User)
+	for _, role := range models.Roles {
+		users[role] = createSession(t, models.User{
+			Username: string(role),
+			Email:    string(role) + "@cinema.test",
+			Role:     role,
+		}, string(role)+"-session")
+	}
+	return users
+}
+
+// adminRequest sends a request to the router with the session of a role
+func adminRequest(r http.Handler, method, path string, role models.Role, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if role != "" {
+		req.AddCookie(&http.Cookie{Name: "session", Value: string(role) + "-session"})
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+// Test that admin routes only let in roles with the permission they need
+func TestRequirePermission(t *testing.T) {
+	setupRoleUsers(t)
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value("user").(models.User)
+		w.Write([]byte(user.Username))
+	})
+	r := mux.NewRouter()
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(middleware.AuthMiddleware)
+	admin.Handle("/halls", middleware.RequirePermission(models.PermManageHalls)(ok)).Methods("GET")
+	admin.Handle("/dashboard", middleware.RequirePermission(models.PermViewDashboard)(ok)).Methods("GET")
+	r.Handle("/api/v1/checkin", middleware.RequireAPIPermission(models.PermCheckIn)(ok)).Methods("POST")
+
+	tests := []struct {
+		method, path string
+		role         models.Role
+		expected     int
+	}{
+		{"GET", "/admin/halls", "", http.StatusSeeOther},
+		{"GET", "/admin/halls", models.RoleCustomer, http.StatusForbidden},
+		{"GET", "/admin/halls", models.RoleScheduler, http.StatusForbidden},
+		{"GET", "/admin/halls", models.RoleManager, http.StatusOK},
+		{"GET", "/admin/halls", models.RoleAdmin, http.StatusOK},
+		{"GET", "/admin/dashboard", models.RoleCustomer, http.StatusForbidden},
+		{"GET", "/admin/dashboard", models.RoleBoxOffice, http.StatusOK},
+		{"POST", "/api/v1/checkin", "", http.StatusUnauthorized},
+		{"POST", "/api/v1/checkin", models.RoleScheduler, http.StatusForbidden},
+		{"POST", "/api/v1/checkin", models.RoleBoxOffice, http.StatusOK},
+	}
+	for _, test := range tests {
+		rec := adminRequest(r, test.method, test.path, test.role, nil)
+		if rec.Code != test.expected {
+			t.Errorf("Expected %s %s as %q to give %d, got %d", test.method, test.path, test.role, test.expected, rec.Code)
+		}
+		if rec.Code == http.StatusOK && rec.Body.String() != string(test.role) {
+			t.Errorf("Expected the handler to see %s, got %q", test.role, rec.Body.String())
+		}
+	}
+
+	// API clients get JSON errors rather than the login page
+	rec := adminRequest(r, "POST", "/api/v1/checkin", models.RoleCustomer, nil)
+	if rec.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Expected a JSON error, got %q", rec.Header().Get("Content-Type"))
+	}
+}
+
+// Test that admins assign roles to other users but not to themselves
+func TestAdminUpdateUserRole(t *testing.T) {
+	users := setupRoleUsers(t)
+
+	r := mux.NewRouter()
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(middleware.AuthMiddleware)
+	admin.Handle("/users/{id:[0-9]+}/role", middleware.RequirePermission(models.PermManageUsers)(http.HandlerFunc(handlers.AdminUpdateUserRoleHandler))).Methods("POST")
+
+	path := func(role models.Role) string {
+		return "/admin/users/" + strconv.Itoa(int(users[role].ID)) + "/role"
+	}
+	roleOf := func(role models.Role) models.Role {
+		var user models.User
+		database.DB.First(&user, users[role].ID)
+		return user.Role
+	}
+
+	rec := adminRequest(r, "POST", path(models.RoleCustomer), models.RoleAdmin, url.Values{"role": {"scheduler"}})
+	if rec.Code != http.StatusSeeOther || roleOf(models.RoleCustomer) != models.RoleScheduler {
+		t.Errorf("Expected the customer to become a scheduler, got %d %s", rec.Code, roleOf(models.RoleCustomer))
+	}
+
+	// Managers may not hand out roles
+	rec = adminRequest(r, "POST", path(models.RoleBoxOffice), models.RoleManager, url.Values{"role": {"admin"}})
+	if rec.Code != http.StatusForbidden || roleOf(models.RoleBoxOffice) != models.RoleBoxOffice {
+		t.Errorf("Expected a manager to be refused, got %d %s", rec.Code, roleOf(models.RoleBoxOffice))
+	}
+
+	rec = adminRequest(r, "POST", path(models.RoleBoxOffice), models.RoleAdmin, url.Values{"role": {"owner"}})
+	if rec.Code != http.StatusUnprocessableEntity || roleOf(models.RoleBoxOffice) != models.RoleBoxOffice {
+		t.Errorf("Expected an unknown role to be refused, got %d %s", rec.Code, roleOf(models.RoleBoxOffice))
+	}
+
+	rec = adminRequest(r, "POST", path(models.RoleAdmin), models.RoleAdmin, url.Values{"role": {"customer"}})
+	if rec.Code != http.StatusUnprocessableEntity || roleOf(models.RoleAdmin) != models.RoleAdmin {
+		t.Errorf("Expected admins to keep their own role, got %d %s", rec.Code, roleOf(models.RoleAdmin))
+	}
+}
+
+// Test that the first admin can be created and existing users promoted
+func TestBootstrapAdmin(t *testing.T) {
+	database.DB.Exec("DELETE FROM users")
+
+	if _, _, err := database.BootstrapAdmin("root", "root@example.com", ""); err == nil {
+		t.Errorf("Expected a new admin to need a password")
+	}
+
+	user, created, err := database.BootstrapAdmin("root", "root@example.com", "s3cret")
+	if err != nil || !created || user.Role != models.RoleAdmin {
+		t.Fatalf("Expected a new admin, got %+v %v %v", user, created, err)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte("s3cret")) != nil {
+		t.Errorf("Expected the password to be hashed")
+	}
+
+	database.DB.Create(&models.User{Username: "someone", Email: "someone@example.com", PasswordHash: "kept"})
+	user, created, err = database.BootstrapAdmin("someone", "", "")
+	if err != nil || created || user.Role != models.RoleAdmin || user.PasswordHash != "kept" {
+		t.Errorf("Expected the existing user to be promoted as is, got %+v %v %v", user, created, err)
+	}
+}
+
+// Test that the admin and staff flags of an old database become roles
+func TestMigrateUserRoles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+
+	legacy, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Error opening legacy database: %v", err)
+	}
+	// The users table as GORM created it before roles
+	legacy.Exec(`CREATE TABLE "users" ("id" integer PRIMARY KEY, "created_at" datetime, "updated_at" datetime,` +
+		`"deleted_at" datetime, "username" text UNIQUE, "email" text UNIQUE, "password_hash" text,` +
+		`"session_token" text, "is_admin" numeric DEFAULT false, "is_staff" numeric DEFAULT false)`)
+	legacy.Exec(`INSERT INTO users (id, username, email, is_admin, is_staff) VALUES
+		(1, 'boss', 'boss@example.com', 1, 1), (2, 'door', 'door@example.com', 0, 1), (3, 'fan', 'fan@example.com', 0, 0)`)
+	if sqlDB, err := legacy.DB(); err == nil {
+		sqlDB.Close()
+	}
+
+	previous := database.DB
+	defer func() { database.DB = previous }()
+
+	if err := database.Initialize(path); err != nil {
+		t.Fatalf("Error migrating legacy database: %v", err)
+	}
+	defer func() {
+		if sqlDB, err := database.DB.DB(); err == nil {
+			sqlDB.Close()
+		}
+	}()
+
+	for id, expected := range map[uint]models.Role{1: models.RoleAdmin, 2: models.RoleBoxOffice, 3: models.RoleCustomer} {
+		var user models.User
+		database.DB.First(&user, id)
+		if user.Role != expected {
+			t.Errorf("Expected %s to be %s, got %q", user.Username, expected, user.Role)
+		}
+	}
+
+	if database.DB.Migrator().HasColumn(&models.User{}, "is_admin") || database.DB.Migrator().HasColumn(&models.User{}, "is_staff") {
+		t.Errorf("Expected the flag columns to be dropped")
+	}
+}
@@ -0,0 +1,182 @@
+package tests
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/handlers"
+	"github.com/JoeDkhar/cinema-booking-system/internal/middleware"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/gorilla/mux"
+)
+
+// serverSentEvent is one event read from a text/event-stream
+type serverSentEvent struct {
+	Name string
+	Data string
+}
+
+// openSeatStream connects to the seat stream of a show through the logging
+// middleware, returning the events as they arrive
+func openSeatStream(t *testing.T, showID uint) <-chan serverSentEvent {
+	r := mux.NewRouter()
+	r.Use(middleware.LoggingMiddleware)
+	r.HandleFunc("/api/v1/shows/{id:[0-9]+}/seats/stream", handlers.SeatStreamHandler).Methods("GET")
+	server := httptest.NewServer(r)
+
+	resp, err := http.Get(server.URL + "/api/v1/shows/" + strconv.Itoa(int(showID)) + "/seats/stream")
+	if err != nil {
+		t.Fatalf("Error opening seat stream: %v", err)
+	}
+	t.Cleanup(func() {
+		resp.Body.Close()
+		server.Close()
+	})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	events := make(chan serverSentEvent, 16)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		var event serverSentEvent
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if event.Name != "" {
+					events <- event
+				}
+				event = serverSentEvent{}
+			case strings.HasPrefix(line, "event: "):
+				event.Name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				event.Data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+	return events
+}
+
+// nextSeatEvent waits for the next event of a seat stream
+func nextSeatEvent(t *testing.T, events <-chan serverSentEvent) serverSentEvent {
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatalf("Seat stream closed unexpectedly")
+		}
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timed out waiting for a seat event")
+	}
+	return serverSentEvent{}
+}
+
+// expectSeatEvent checks that the next event reports seats changing
+func expectSeatEvent(t *testing.T, events <-chan serverSentEvent, eventType handlers.SeatEventType, seats ...string) {
+	event := nextSeatEvent(t, events)
+	var change handlers.SeatEvent
+	if event.Name != "seats" || json.Unmarshal([]byte(event.Data), &change) != nil {
+		t.Fatalf("Expected a seats event, got %+v", event)
+	}
+	if change.Type != eventType || strings.Join(change.Seats, ",") != strings.Join(seats, ",") {
+		t.Errorf("Expected %s %v, got %s %v", eventType, seats, change.Type, change.Seats)
+	}
+}
+
+// Test that open seat maps hear about seats being held, booked and released
+func TestSeatStream(t *testing.T) {
+	database.DB.Exec("DELETE FROM cancellations")
+	database.DB.Exec("DELETE FROM bookings")
+	database.DB.Exec("DELETE FROM shows")
+	database.DB.Exec("DELETE FROM movies")
+	show := setupTestShow(t)
+
+	earlier := submitBooking(handlers.BookingRequest{
+		ShowID:       show.ID,
+		CustomerName: "Early Bird",
+		Email:        "early@example.com",
+		Seats:        models.Seats{{Row: "A", Number: 1}},
+	})
+	if !earlier.Success {
+		t.Fatalf("Expected booking to succeed, got %s", earlier.ErrorMessage)
+	}
+
+	events := openSeatStream(t, show.ID)
+
+	// The stream opens with the seats already taken
+	event := nextSeatEvent(t, events)
+	var snapshot struct {
+		ShowID uint              `json:"show_id"`
+		Taken  map[string]string `json:"taken"`
+	}
+	if event.Name != "snapshot" || json.Unmarshal([]byte(event.Data), &snapshot) != nil {
+		t.Fatalf("Expected a snapshot first, got %+v", event)
+	}
+	if snapshot.ShowID != show.ID || len(snapshot.Taken) != 1 || snapshot.Taken["A1"] != string(models.BookingConfirmed) {
+		t.Errorf("Unexpected snapshot %+v", snapshot)
+	}
+
+	held := submitBooking(handlers.BookingRequest{
+		Action:       handlers.ActionHold,
+		ShowID:       show.ID,
+		CustomerName: "Checking Out",
+		Email:        "checkout@example.com",
+		Seats:        models.Seats{{Row: "B", Number: 1}, {Row: "B", Number: 2}},
+	})
+	if !held.Success {
+		t.Fatalf("Expected hold to succeed, got %s", held.ErrorMessage)
+	}
+	expectSeatEvent(t, events, handlers.SeatsHeld, "B1", "B2")
+
+	confirmed := submitBooking(handlers.BookingRequest{Action: handlers.ActionConfirm, BookingID: held.BookingID})
+	if !confirmed.Success {
+		t.Fatalf("Expected confirmation to succeed, got %s", confirmed.ErrorMessage)
+	}
+	expectSeatEvent(t, events, handlers.SeatsBooked, "B1", "B2")
+
+	cancelled := submitBooking(handlers.BookingRequest{
+		Action:    handlers.ActionCancel,
+		BookingID: held.BookingID,
+		Seats:     models.Seats{{Row: "B", Number: 2}},
+	})
+	if !cancelled.Success {
+		t.Fatalf("Expected cancellation to succeed, got %s", cancelled.ErrorMessage)
+	}
+	expectSeatEvent(t, events, handlers.SeatsReleased, "B2")
+
+	// Rejected requests change nothing, so nothing is sent
+	if rejected := submitBooking(handlers.BookingRequest{
+		ShowID:       show.ID,
+		CustomerName: "Too Late",
+		Email:        "late@example.com",
+		Seats:        models.Seats{{Row: "A", Number: 1}},
+	}); rejected.Success {
+		t.Fatalf("Expected a taken seat to be refused")
+	}
+
+	released := submitBooking(handlers.BookingRequest{
+		Action:       handlers.ActionHold,
+		ShowID:       show.ID,
+		CustomerName: "Changed Mind",
+		Email:        "changed@example.com",
+		Seats:        models.Seats{{Row: "C", Number: 5}},
+	})
+	if !released.Success {
+		t.Fatalf("Expected hold to succeed, got %s", released.ErrorMessage)
+	}
+	expectSeatEvent(t, events, handlers.SeatsHeld, "C5")
+
+	if response := submitBooking(handlers.BookingRequest{Action: handlers.ActionRelease, BookingID: released.BookingID}); !response.Success {
+		t.Fatalf("Expected release to succeed, got %s", response.ErrorMessage)
+	}
+	expectSeatEvent(t, events, handlers.SeatsReleased, "C5")
+}
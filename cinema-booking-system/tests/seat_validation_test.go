@@ -0,0 +1,105 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/handlers"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+)
+
+// submitBooking sends a booking request through the booking processor and waits for the result
+func submitBooking(request handlers.BookingRequest) handlers.BookingResponse {
+	request.ResponseChan = make(chan handlers.BookingResponse)
+	handlers.ProcessBookingAsync(request)
+	return <-request.ResponseChan
+}
+
+// Test that seat selections are validated against the hall before booking
+func TestBookingSeatValidation(t *testing.T) {
+	database.DB.Exec("DELETE FROM bookings")
+	database.DB.Exec("DELETE FROM shows")
+	database.DB.Exec("DELETE FROM movies")
+
+	show := setupTestShow(t)
+
+	tooMany := make(models.Seats, 0, handlers.MaxSeatsPerBooking+1)
+	for i := 1; i <= handlers.MaxSeatsPerBooking+1; i++ {
+		tooMany = append(tooMany, models.Seat{Row: "C", Number: (i-1)%10 + 1})
+	}
+
+	cases := []struct {
+		name         string
+		seats        models.Seats
+		code         handlers.BookingErrorCode
+		invalidSeats int
+	}{
+		{"no seats", models.Seats{}, handlers.ErrCodeNoSeats, 0},
+		{"unknown row", models.Seats{{Row: "Z", Number: 99}, {Row: "A", Number: 1}}, handlers.ErrCodeInvalidSeats, 1},
+		{"bad number", models.Seats{{Row: "", Number: -5}, {Row: "A", Number: 11}}, handlers.ErrCodeInvalidSeats, 2},
+		{"duplicate", models.Seats{{Row: "A", Number: 2}, {Row: "A", Number: 2}}, handlers.ErrCodeDuplicateSeats, 1},
+		{"too many", tooMany, handlers.ErrCodeTooManySeats, 0},
+	}
+
+	for _, c := range cases {
+		response := submitBooking(handlers.BookingRequest{
+			ShowID:       show.ID,
+			CustomerName: "Jane Doe",
+			Email:        "jane@example.com",
+			Seats:        c.seats,
+		})
+
+		if response.Success {
+			t.Errorf("%s: expected booking to be rejected", c.name)
+			continue
+		}
+		if response.Error == nil || response.Error.Code != c.code {
+			t.Errorf("%s: expected error code %s, got %+v", c.name, c.code, response.Error)
+			continue
+		}
+		if len(response.Error.Seats) != c.invalidSeats {
+			t.Errorf("%s: expected %d reported seats, got %d", c.name, c.invalidSeats, len(response.Error.Seats))
+		}
+	}
+
+	var count int64
+	database.DB.Model(&models.Booking{}).Where("show_id = ?", show.ID).Count(&count)
+	if count != 0 {
+		t.Errorf("Expected no bookings to be saved, got %d", count)
+	}
+}
+
+// Test that a second booking for the same seat reports the conflicting seat
+func TestBookingSeatConflict(t *testing.T) {
+	database.DB.Exec("DELETE FROM bookings")
+	database.DB.Exec("DELETE FROM shows")
+	database.DB.Exec("DELETE FROM movies")
+
+	show := setupTestShow(t)
+
+	first := submitBooking(handlers.BookingRequest{
+		ShowID:       show.ID,
+		CustomerName: "First",
+		Email:        "first@example.com",
+		Seats:        models.Seats{{Row: "D", Number: 4}, {Row: "D", Number: 5}},
+	})
+	if !first.Success {
+		t.Fatalf("Expected first booking to succeed, got %s", first.ErrorMessage)
+	}
+
+	second := submitBooking(handlers.BookingRequest{
+		ShowID:       show.ID,
+		CustomerName: "Second",
+		Email:        "second@example.com",
+		Seats:        models.Seats{{Row: "D", Number: 5}, {Row: "D", Number: 6}},
+	})
+	if second.Success {
+		t.Fatalf("Expected second booking to be rejected")
+	}
+	if second.Error.Code != handlers.ErrCodeSeatsUnavailable {
+		t.Errorf("Expected error code %s, got %s", handlers.ErrCodeSeatsUnavailable, second.Error.Code)
+	}
+	if len(second.Error.Seats) != 1 || second.Error.Seats[0].String() != "D5" {
+		t.Errorf("Expected only D5 to be reported, got %v", second.Error.Seats)
+	}
+}
@@ -0,0 +1,264 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/handlers"
+	"github.com/JoeDkhar/cinema-booking-system/internal/middleware"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/sessions"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// createSession saves a user logged in with the given session token
+func createSession(t *testing.T, user models.User, token string) models.User {
+	// Staff must have two-factor authentication on to use the back office
+	if user.Role.RequiresTwoFactor() && user.TOTPEnabledAt == nil {
+		enabledAt := time.Now()
+		user.TOTPEnabledAt = &enabledAt
+	}
+	if err := database.DB.Create(&user).Error; err != nil {
+		t.Fatalf("Error creating %s: %v", user.Username, err)
+	}
+
+	now := time.Now()
+	database.DB.Unscoped().Where("token_hash = ?", sessions.HashToken(token)).Delete(&models.Session{})
+	session := models.Session{
+		UserID:     user.ID,
+		TokenHash:  sessions.HashToken(token),
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(sessions.MaxAge),
+	}
+	if err := database.DB.Create(&session).Error; err != nil {
+		t.Fatalf("Error creating session for %s: %v", user.Username, err)
+	}
+	return user
+}
+
+// newAccountRouter serves login, logout and the account session pages
+func newAccountRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/login", handlers.LoginHandler).Methods("POST")
+	r.HandleFunc("/logout", handlers.LogoutHandler).Methods("POST")
+	account := r.PathPrefix("/account").Subrouter()
+	account.Use(middleware.AuthMiddleware)
+	account.HandleFunc("/whoami", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Context().Value("user").(models.User).Username))
+	}).Methods("GET")
+	account.HandleFunc("/sessions/{id:[0-9]+}/revoke", handlers.RevokeSessionHandler).Methods("POST")
+	account.HandleFunc("/sessions/revoke-all", handlers.LogoutEverywhereHandler).Methods("POST")
+	return r
+}
+
+// login logs a user in from a device, returning the session cookie
+func login(t *testing.T, r http.Handler, username, password, device string) *http.Cookie {
+	form := url.Values{"username": {username}, "password": {password}}
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", device)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == sessions.CookieName && cookie.Value != "" {
+			return cookie
+		}
+	}
+	t.Fatalf("Expected %s to be logged in on %s, got %d", username, device, rec.Code)
+	return nil
+}
+
+// sessionRequest sends a request with a session cookie
+func sessionRequest(r http.Handler, method, path string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+// loggedIn reports whether a session cookie still gets into the account pages
+func loggedIn(r http.Handler, cookie *http.Cookie) bool {
+	return sessionRequest(r, "GET", "/account/whoami", cookie).Code == http.StatusOK
+}
+
+// Test that each device gets its own session and logging out ends only that one
+func TestSessionsPerDevice(t *testing.T) {
+	database.DB.Exec("DELETE FROM sessions")
+	database.DB.Exec("DELETE FROM users")
+	r := newAccountRouter()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("popcorn"), bcrypt.MinCost)
+	user := models.User{Username: "viewer", Email: "viewer@example.com", PasswordHash: string(hash)}
+	database.DB.Create(&user)
+
+	laptop := login(t, r, "viewer", "popcorn", "Laptop Browser")
+	phone := login(t, r, "viewer", "popcorn", "Phone Browser")
+	if !loggedIn(r, laptop) || !loggedIn(r, phone) {
+		t.Fatalf("Expected both devices to stay logged in")
+	}
+	if laptop.Expires.Before(time.Now().Add(sessions.MaxAge - time.Minute)) {
+		t.Errorf("Expected the cookie to last as long as the session, got %v", laptop.Expires)
+	}
+
+	listed := sessions.List(user.ID, time.Now())
+	if len(listed) != 2 || listed[0].UserAgent == "" || listed[0].IPAddress == "" {
+		t.Fatalf("Expected two sessions with their devices, got %+v", listed)
+	}
+	var stored int64
+	database.DB.Model(&models.Session{}).Where("token_hash = ?", laptop.Value).Count(&stored)
+	if stored != 0 {
+		t.Errorf("Expected session tokens not to be stored as they are")
+	}
+
+	// Logging out ends the session on the server, not just the cookie
+	sessionRequest(r, "POST", "/logout", laptop)
+	if loggedIn(r, laptop) {
+		t.Errorf("Expected the laptop's token to stop working after logging out")
+	}
+	if !loggedIn(r, phone) {
+		t.Errorf("Expected the phone to stay logged in")
+	}
+}
+
+// Test that logging in only goes on to pages on this site
+func TestLoginRedirect(t *testing.T) {
+	database.DB.Exec("DELETE FROM login_failures")
+	database.DB.Exec("DELETE FROM sessions")
+	database.DB.Exec("DELETE FROM users")
+	r := newAccountRouter()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("popcorn"), bcrypt.MinCost)
+	database.DB.Create(&models.User{Username: "returner", Email: "returner@example.com", PasswordHash: string(hash)})
+
+	tests := []struct {
+		redirect string
+		location string
+	}{
+		{"", "/"},
+		{"/my-bookings?page=2", "/my-bookings?page=2"},
+		{"https://evil.example.com/", "/"},
+		{"//evil.example.com/", "/"},
+		{"/\\evil.example.com/", "/"},
+		{"/\t/evil.example.com/", "/"},
+		{"my-bookings", "/"},
+	}
+	for _, tt := range tests {
+		form := url.Values{"username": {"returner"}, "password": {"popcorn"}, "redirect": {tt.redirect}}
+		rec := postForm(r, "/login", form, nil)
+		if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != tt.location {
+			t.Errorf("Expected logging in with redirect %q to go to %q, got %d %q", tt.redirect, tt.location, rec.Code, rec.Header().Get("Location"))
+		}
+	}
+}
+
+// Test that sessions end when idle too long or too old
+func TestSessionTimeouts(t *testing.T) {
+	database.DB.Exec("DELETE FROM sessions")
+	database.DB.Exec("DELETE FROM users")
+	r := newAccountRouter()
+
+	user := createSession(t, models.User{Username: "idle", Email: "idle@example.com"}, "idle-session")
+	cookie := &http.Cookie{Name: sessions.CookieName, Value: "idle-session"}
+	session := func() models.Session {
+		var session models.Session
+		database.DB.Where("user_id = ?", user.ID).First(&session)
+		return session
+	}
+
+	// Use keeps the session alive
+	database.DB.Model(&models.Session{}).Where("user_id = ?", user.ID).
+		UpdateColumn("last_seen_at", time.Now().Add(-sessions.IdleTimeout+time.Minute))
+	if !loggedIn(r, cookie) {
+		t.Fatalf("Expected a recently used session to work")
+	}
+	if seen := session().LastSeenAt; time.Since(seen) > time.Minute {
+		t.Errorf("Expected the session's last use to be recorded, got %v", seen)
+	}
+
+	database.DB.Model(&models.Session{}).Where("user_id = ?", user.ID).
+		UpdateColumn("last_seen_at", time.Now().Add(-sessions.IdleTimeout-time.Minute))
+	if loggedIn(r, cookie) {
+		t.Errorf("Expected an idle session to have ended")
+	}
+	if session().ID != 0 {
+		t.Errorf("Expected the ended session to be deleted")
+	}
+
+	// However active, a session ends at its maximum age
+	createSession(t, models.User{Username: "busy", Email: "busy@example.com"}, "busy-session")
+	database.DB.Model(&models.Session{}).Where("token_hash = ?", sessions.HashToken("busy-session")).
+		UpdateColumn("expires_at", time.Now().Add(-time.Minute))
+	if loggedIn(r, &http.Cookie{Name: sessions.CookieName, Value: "busy-session"}) {
+		t.Errorf("Expected a session past its maximum age to have ended")
+	}
+
+	createSession(t, models.User{Username: "gone", Email: "gone@example.com"}, "gone-session")
+	database.DB.Model(&models.Session{}).Where("token_hash = ?", sessions.HashToken("gone-session")).
+		UpdateColumn("last_seen_at", time.Now().Add(-sessions.IdleTimeout-time.Minute))
+	if deleted := sessions.DeleteExpired(time.Now()); deleted != 1 {
+		t.Errorf("Expected the idle session to be cleaned up, got %d", deleted)
+	}
+}
+
+// Test logging out of other devices and everywhere at once
+func TestRevokeSessions(t *testing.T) {
+	database.DB.Exec("DELETE FROM sessions")
+	database.DB.Exec("DELETE FROM users")
+	r := newAccountRouter()
+
+	user := createSession(t, models.User{Username: "owner", Email: "owner@example.com"}, "owner-laptop")
+	other := createSession(t, models.User{Username: "other", Email: "other@example.com"}, "other-session")
+	database.DB.Create(&models.Session{
+		UserID:     user.ID,
+		TokenHash:  sessions.HashToken("owner-phone"),
+		LastSeenAt: time.Now(),
+		ExpiresAt:  time.Now().Add(time.Hour),
+	})
+	laptop := &http.Cookie{Name: sessions.CookieName, Value: "owner-laptop"}
+	phone := &http.Cookie{Name: sessions.CookieName, Value: "owner-phone"}
+
+	var phoneSession, otherSession models.Session
+	database.DB.Where("token_hash = ?", sessions.HashToken("owner-phone")).First(&phoneSession)
+	database.DB.Where("user_id = ?", other.ID).First(&otherSession)
+
+	// Another user's sessions cannot be ended
+	if rec := sessionRequest(r, "POST", "/account/sessions/"+strconv.Itoa(int(otherSession.ID))+"/revoke", laptop); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected another user's session to be out of reach, got %d", rec.Code)
+	}
+
+	rec := sessionRequest(r, "POST", "/account/sessions/"+strconv.Itoa(int(phoneSession.ID))+"/revoke", laptop)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/account/sessions" {
+		t.Errorf("Expected to return to the session list, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	if loggedIn(r, phone) || !loggedIn(r, laptop) {
+		t.Errorf("Expected only the phone to be logged out")
+	}
+
+	database.DB.Create(&models.Session{
+		UserID:     user.ID,
+		TokenHash:  sessions.HashToken("owner-tablet"),
+		LastSeenAt: time.Now(),
+		ExpiresAt:  time.Now().Add(time.Hour),
+	})
+	rec = sessionRequest(r, "POST", "/account/sessions/revoke-all", laptop)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/login" {
+		t.Errorf("Expected to be sent to the login page, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	if loggedIn(r, laptop) || loggedIn(r, &http.Cookie{Name: sessions.CookieName, Value: "owner-tablet"}) {
+		t.Errorf("Expected every device to be logged out")
+	}
+	if !loggedIn(r, &http.Cookie{Name: sessions.CookieName, Value: "other-session"}) {
+		t.Errorf("Expected other users to stay logged in")
+	}
+}
@@ -0,0 +1,65 @@
+package tests
+
+import (
+	"os"
+	"testing"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/handlers"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/money"
+	"github.com/JoeDkhar/cinema-booking-system/internal/pricing"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// TestMain sets up the test database
+func TestMain(m *testing.M) {
+	// Set up a test database
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	if err != nil {
+		panic("failed to connect to test database")
+	}
+
+	database.DB = db
+
+	// Migrate the schema
+	err = db.AutoMigrate(
+		&models.Hall{},
+		&models.Movie{},
+		&models.Show{},
+		&models.Booking{},
+		&models.Cancellation{},
+		&models.Payment{},
+		&models.PromoCode{},
+		&models.PromoRedemption{},
+		&models.Notification{},
+		&models.Ticket{},
+		&models.WaitlistEntry{},
+		&models.User{},
+		&models.Session{},
+		&models.BookingClaim{},
+		&models.AccountToken{},
+		&models.LoginFailure{},
+		&models.RecoveryCode{},
+		&models.APIKey{},
+	)
+	if err != nil {
+		panic("failed to migrate test database")
+	}
+
+	// Charge every seat the show's ticket price so amounts do not depend on
+	// when the tests run; pricing_test.go covers the pricing rules
+	handlers.PriceRules = pricing.Rules{}
+
+	// Start the booking processor used by the request pipeline tests
+	handlers.StartBookingProcessor()
+
+	// Run tests
+	os.Exit(m.Run())
+}
+
+// usd returns an amount in cents of the default currency
+func usd(cents int64) money.Money {
+	return money.New(cents, money.DefaultCurrency)
+}
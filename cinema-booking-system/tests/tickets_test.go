@@ -0,0 +1,124 @@
+package tests
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/handlers"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/tickets"
+	"github.com/gorilla/mux"
+)
+
+// Test that ticket tokens only verify unchanged and with the right secret
+func TestTicketToken(t *testing.T) {
+	secret := []byte("door secret")
+	claims := tickets.Claims{Reference: "BKG-ABCDEFGHJKMN", ShowID: 7, Seat: "C12"}
+
+	token := tickets.Sign(secret, claims)
+	verified, err := tickets.Verify(secret, token)
+	if err != nil || verified != claims {
+		t.Fatalf("Expected %+v back, got %+v (%v)", claims, verified, err)
+	}
+
+	// Swap in the claims for another seat under the same signature
+	forged := tickets.Sign(secret, tickets.Claims{Reference: claims.Reference, ShowID: 7, Seat: "C13"})
+	payload, _, _ := strings.Cut(forged, ".")
+	_, signature, _ := strings.Cut(token, ".")
+
+	for name, bad := range map[string]string{
+		"forged seat":  payload + "." + signature,
+		"truncated":    token[:len(token)-2],
+		"no signature": payload,
+		"garbage":      "not-a-ticket",
+	} {
+		if _, err := tickets.Verify(secret, bad); err != tickets.ErrInvalidToken {
+			t.Errorf("%s: expected an invalid token, got %v", name, err)
+		}
+	}
+
+	if _, err := tickets.Verify([]byte("other secret"), token); err != tickets.ErrInvalidToken {
+		t.Errorf("Expected a token signed with another secret to be rejected, got %v", err)
+	}
+}
+
+// Test that confirmed bookings can download a ticket page per seat
+func TestTicketsPDF(t *testing.T) {
+	database.DB.Exec("DELETE FROM cancellations")
+	database.DB.Exec("DELETE FROM bookings")
+	database.DB.Exec("DELETE FROM shows")
+	database.DB.Exec("DELETE FROM movies")
+	show := setupTestShow(t)
+
+	previous := handlers.TicketSecret
+	handlers.TicketSecret = []byte("door secret")
+	t.Cleanup(func() { handlers.TicketSecret = previous })
+
+	booked := submitBooking(handlers.BookingRequest{
+		ShowID:       show.ID,
+		CustomerName: "Ticket Holder",
+		Email:        "holder@example.com",
+		Seats:        models.Seats{{Row: "F", Number: 4}, {Row: "F", Number: 5, TicketType: models.TicketChild}, {Row: "F", Number: 6}},
+	})
+	if !booked.Success {
+		t.Fatalf("Expected booking to succeed, got %s", booked.ErrorMessage)
+	}
+	held := submitBooking(handlers.BookingRequest{
+		Action:       handlers.ActionHold,
+		ShowID:       show.ID,
+		CustomerName: "Not Paid",
+		Email:        "unpaid@example.com",
+		Seats:        models.Seats{{Row: "G", Number: 1}},
+	})
+	if !held.Success {
+		t.Fatalf("Expected hold to succeed, got %s", held.ErrorMessage)
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/booking/confirmation/{reference}/tickets.pdf", handlers.TicketsPDFHandler).Methods("GET")
+	download := func(reference string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest("GET", "/booking/confirmation/"+reference+"/tickets.pdf?download=1", nil))
+		return rec
+	}
+
+	rec := download(strings.ToLower(booked.Reference))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the tickets, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if contentType := rec.Header().Get("Content-Type"); contentType != "application/pdf" {
+		t.Errorf("Expected a PDF, got %q", contentType)
+	}
+	if disposition := rec.Header().Get("Content-Disposition"); disposition != `attachment; filename="tickets-`+booked.Reference+`.pdf"` {
+		t.Errorf("Unexpected Content-Disposition %q", disposition)
+	}
+
+	pdf := rec.Body.Bytes()
+	if !bytes.HasPrefix(pdf, []byte("%PDF-")) {
+		t.Fatalf("Expected a PDF document, got %q", pdf[:min(len(pdf), 20)])
+	}
+	if pages := len(regexp.MustCompile(`/Type /Page\b[^s]`).FindAll(pdf, -1)); pages != 3 {
+		t.Errorf("Expected a page per seat, got %d", pages)
+	}
+
+	// Unpaid and unknown bookings have no tickets
+	if rec := download(held.Reference); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected no tickets for a hold, got %d", rec.Code)
+	}
+	if rec := download("BKG-UNKNOWN"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected no tickets for an unknown booking, got %d", rec.Code)
+	}
+
+	// Each page's QR code carries the seat's signed token
+	var booking models.Booking
+	database.DB.First(&booking, booked.BookingID)
+	claims, err := tickets.Verify(handlers.TicketSecret, tickets.Token(handlers.TicketSecret, booking, booking.Seats[1]))
+	if err != nil || claims.Reference != booked.Reference || claims.ShowID != show.ID || claims.Seat != "F5" {
+		t.Errorf("Unexpected ticket claims %+v (%v)", claims, err)
+	}
+}
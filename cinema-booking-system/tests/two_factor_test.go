@@ -0,0 +1,294 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/accounts"
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/handlers"
+	"github.com/JoeDkhar/cinema-booking-system/internal/middleware"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/JoeDkhar/cinema-booking-system/internal/sessions"
+	"github.com/JoeDkhar/cinema-booking-system/internal/totp"
+	"github.com/gorilla/mux"
+)
+
+// newTwoFactorRouter serves both login steps, the two-factor account pages
+// and a back office page and API endpoint for staff
+func newTwoFactorRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/login", handlers.LoginHandler).Methods("POST")
+	r.HandleFunc("/login/two-factor", handlers.TwoFactorLoginHandler).Methods("GET", "POST")
+	account := r.PathPrefix("/account").Subrouter()
+	account.Use(middleware.AuthMiddleware)
+	account.HandleFunc("/whoami", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Context().Value("user").(models.User).Username))
+	}).Methods("GET")
+	account.HandleFunc("/two-factor", handlers.TwoFactorHandler).Methods("GET")
+	account.HandleFunc("/two-factor/start", handlers.StartTwoFactorHandler).Methods("POST")
+	account.HandleFunc("/two-factor/enable", handlers.EnableTwoFactorHandler).Methods("POST")
+	account.HandleFunc("/two-factor/recovery-codes", handlers.RecoveryCodesHandler).Methods("POST")
+	account.HandleFunc("/two-factor/disable", handlers.DisableTwoFactorHandler).Methods("POST")
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(middleware.AuthMiddleware)
+	admin.Handle("/dashboard", middleware.RequirePermission(models.PermViewDashboard)(ok)).Methods("GET")
+	r.Handle("/api/v1/checkin", middleware.RequireAPIPermission(models.PermCheckIn)(ok)).Methods("POST")
+	return r
+}
+
+// setupTwoFactor creates a user with two-factor authentication turned on a
+// period ago, returning them with their secret and recovery codes
+func setupTwoFactor(t *testing.T, username, password string) (models.User, []string) {
+	user := setupLockout(t, username, password)
+	database.DB.Exec("DELETE FROM recovery_codes")
+	database.DB.Exec("DELETE FROM account_tokens")
+
+	if err := accounts.StartTwoFactor(&user); err != nil {
+		t.Fatalf("Error starting two-factor authentication: %v", err)
+	}
+	earlier := time.Now().Add(-totp.Period)
+	code, _ := totp.Code(user.TOTPSecret, earlier)
+	codes, err := accounts.EnableTwoFactor(&user, code, earlier)
+	if err != nil {
+		t.Fatalf("Error enabling two-factor authentication: %v", err)
+	}
+	return user, codes
+}
+
+// passwordStep logs in with a password, returning the cookie for the
+// two-factor step and the response
+func passwordStep(t *testing.T, r http.Handler, username, password string) (*http.Cookie, *httptest.ResponseRecorder) {
+	rec := loginFrom(r, username, password, "192.0.2.10")
+	var challenge *http.Cookie
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == sessions.CookieName && cookie.Value != "" {
+			t.Fatalf("Expected no session before the two-factor code")
+		}
+		if cookie.Name == "login_challenge" {
+			challenge = cookie
+		}
+	}
+	return challenge, rec
+}
+
+// codeStep enters a two-factor code, returning the session cookie if it
+// logged the user in
+func codeStep(r http.Handler, challenge *http.Cookie, code string) (*http.Cookie, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest("POST", "/login/two-factor", strings.NewReader(url.Values{"code": {code}, "redirect": {"/account/whoami"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = "192.0.2.10:40000"
+	if challenge != nil {
+		req.AddCookie(challenge)
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == sessions.CookieName && cookie.Value != "" {
+			return cookie, rec
+		}
+	}
+	return nil, rec
+}
+
+// Test codes against the SHA-1 test vectors of RFC 6238
+func TestTOTPCodes(t *testing.T) {
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" // "12345678901234567890"
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, want := range vectors {
+		if code, err := totp.Code(secret, time.Unix(unix, 0)); err != nil || code != want {
+			t.Errorf("Expected the code at %d to be %s, got %s %v", unix, want, code, err)
+		}
+	}
+
+	at := time.Unix(1111111109, 0)
+	if step, ok := totp.Validate(secret, "081804", at.Add(totp.Period), 1); !ok || step != totp.Step(at) {
+		t.Errorf("Expected a code from the last period to be accepted, got %d %v", step, ok)
+	}
+	if _, ok := totp.Validate(secret, "081804", at.Add(2*totp.Period), 1); ok {
+		t.Errorf("Expected a code from two periods ago to be refused")
+	}
+	if _, ok := totp.Validate("not base32!", "081804", at, 1); ok {
+		t.Errorf("Expected an invalid secret to accept no codes")
+	}
+
+	uri := totp.URI("CineTickets", "alice", secret)
+	if !strings.HasPrefix(uri, "otpauth://totp/CineTickets:alice?") || !strings.Contains(uri, "secret="+secret) || !strings.Contains(uri, "issuer=CineTickets") {
+		t.Errorf("Expected a provisioning URI for the account, got %s", uri)
+	}
+}
+
+// Test that users with two-factor authentication need a code after their
+// password, and that each code and recovery code works only once
+func TestTwoFactorLogin(t *testing.T) {
+	user, recoveryCodes := setupTwoFactor(t, "careful", "Right-Password-1")
+	r := newTwoFactorRouter()
+
+	if len(recoveryCodes) != accounts.RecoveryCodeCount {
+		t.Fatalf("Expected %d recovery codes, got %d", accounts.RecoveryCodeCount, len(recoveryCodes))
+	}
+
+	challenge, rec := passwordStep(t, r, "careful", "Right-Password-1")
+	if rec.Code != http.StatusSeeOther || !strings.HasPrefix(rec.Header().Get("Location"), "/login/two-factor") || challenge == nil {
+		t.Fatalf("Expected to be asked for a code, got %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+
+	if _, rec := codeStep(r, nil, "123456"); rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/login" {
+		t.Errorf("Expected a code without a password to go back to the login page, got %d", rec.Code)
+	}
+	if cookie, _ := codeStep(r, challenge, "000000"); cookie != nil {
+		t.Errorf("Expected a wrong code not to log in")
+	}
+
+	code, _ := totp.Code(user.TOTPSecret, time.Now())
+	cookie, rec := codeStep(r, challenge, code)
+	if cookie == nil || rec.Header().Get("Location") != "/account/whoami" || !loggedIn(r, cookie) {
+		t.Fatalf("Expected the right code to log in, got %d", rec.Code)
+	}
+	if cookie, _ := codeStep(r, challenge, code); cookie != nil {
+		t.Errorf("Expected the password step to be used up")
+	}
+
+	// A code seen by an attacker cannot be used again
+	challenge, _ = passwordStep(t, r, "careful", "Right-Password-1")
+	if cookie, _ := codeStep(r, challenge, code); cookie != nil {
+		t.Errorf("Expected a used code to be refused")
+	}
+
+	recovery := strings.ToUpper(recoveryCodes[0])
+	if cookie, _ := codeStep(r, challenge, recovery); cookie == nil {
+		t.Fatalf("Expected a recovery code to log in")
+	}
+	if remaining := accounts.RemainingRecoveryCodes(user); remaining != int64(accounts.RecoveryCodeCount-1) {
+		t.Errorf("Expected %d recovery codes left, got %d", accounts.RecoveryCodeCount-1, remaining)
+	}
+	challenge, _ = passwordStep(t, r, "careful", "Right-Password-1")
+	if cookie, _ := codeStep(r, challenge, recoveryCodes[0]); cookie != nil {
+		t.Errorf("Expected a used recovery code to be refused")
+	}
+}
+
+// Test that wrong codes count towards the same lockout as wrong passwords
+func TestTwoFactorLockout(t *testing.T) {
+	user, _ := setupTwoFactor(t, "guessed", "Right-Password-1")
+	r := newTwoFactorRouter()
+
+	challenge, _ := passwordStep(t, r, "guessed", "Right-Password-1")
+	for i := 0; i < accounts.FreeLoginAttempts; i++ {
+		codeStep(r, challenge, "000000")
+	}
+
+	code, _ := totp.Code(user.TOTPSecret, time.Now())
+	if cookie, rec := codeStep(r, challenge, code); cookie != nil || rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected guessing codes to delay logging in, got %d", rec.Code)
+	}
+	// The right password alone does not clear the wrong codes
+	if _, rec := passwordStep(t, r, "guessed", "Right-Password-1"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the password step to be delayed too, got %d", rec.Code)
+	}
+}
+
+// Test setting up two-factor authentication from the account page, and that
+// only customers may turn it off
+func TestTwoFactorEnrolment(t *testing.T) {
+	database.DB.Exec("DELETE FROM recovery_codes")
+	database.DB.Exec("DELETE FROM users")
+	r := newTwoFactorRouter()
+	customer := createSession(t, models.User{Username: "customer", Email: "customer@example.com"}, "customer-session")
+	session := &http.Cookie{Name: sessions.CookieName, Value: "customer-session"}
+
+	if rec := sessionRequest(r, "GET", "/account/two-factor", session); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the two-factor page, got %d", rec.Code)
+	}
+	database.DB.First(&customer, customer.ID)
+	if customer.TOTPSecret != "" {
+		t.Fatalf("Expected viewing the two-factor page not to create a secret")
+	}
+
+	if rec := postForm(r, "/account/two-factor/start", url.Values{}, session); rec.Code != http.StatusSeeOther {
+		t.Fatalf("Expected setting up two-factor authentication to start, got %d", rec.Code)
+	}
+	database.DB.First(&customer, customer.ID)
+	if customer.TOTPSecret == "" || customer.TwoFactorEnabled() {
+		t.Fatalf("Expected a secret waiting to be confirmed")
+	}
+
+	if rec := postForm(r, "/account/two-factor/enable", url.Values{"code": {"000000"}}, session); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected a wrong code not to turn on two-factor authentication, got %d", rec.Code)
+	}
+	code, _ := totp.Code(customer.TOTPSecret, time.Now().Add(-totp.Period))
+	if rec := postForm(r, "/account/two-factor/enable", url.Values{"code": {code}}, session); rec.Code != http.StatusOK {
+		t.Fatalf("Expected two-factor authentication to be turned on, got %d", rec.Code)
+	}
+	if remaining := accounts.RemainingRecoveryCodes(customer); remaining != int64(accounts.RecoveryCodeCount) {
+		t.Errorf("Expected %d recovery codes, got %d", accounts.RecoveryCodeCount, remaining)
+	}
+
+	if rec := postForm(r, "/account/two-factor/disable", url.Values{"code": {"000000"}}, session); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected turning off without a code to be refused, got %d", rec.Code)
+	}
+	code, _ = totp.Code(customer.TOTPSecret, time.Now())
+	if rec := postForm(r, "/account/two-factor/disable", url.Values{"code": {code}}, session); rec.Code != http.StatusSeeOther {
+		t.Fatalf("Expected two-factor authentication to be turned off, got %d", rec.Code)
+	}
+	var disabled models.User
+	database.DB.First(&disabled, customer.ID)
+	if disabled.TwoFactorEnabled() || disabled.TOTPSecret != "" || accounts.RemainingRecoveryCodes(disabled) != 0 {
+		t.Errorf("Expected the secret and recovery codes to be forgotten")
+	}
+
+	manager := createSession(t, models.User{Username: "manager", Email: "manager@cinema.test", Role: models.RoleManager}, "manager-session")
+	manager.TOTPSecret, _ = totp.GenerateSecret()
+	database.DB.Model(&manager).UpdateColumn("totp_secret", manager.TOTPSecret)
+	code, _ = totp.Code(manager.TOTPSecret, time.Now())
+	staff := &http.Cookie{Name: sessions.CookieName, Value: "manager-session"}
+	if rec := postForm(r, "/account/two-factor/disable", url.Values{"code": {code}}, staff); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected staff not to turn off two-factor authentication, got %d", rec.Code)
+	}
+}
+
+// Test that staff must set up two-factor authentication before using the
+// back office
+func TestStaffRequireTwoFactor(t *testing.T) {
+	database.DB.Exec("DELETE FROM users")
+	r := newTwoFactorRouter()
+	staff := createSession(t, models.User{Username: "door", Email: "door@cinema.test", Role: models.RoleBoxOffice}, "door-session")
+	database.DB.Model(&staff).UpdateColumn("totp_enabled_at", nil)
+	session := &http.Cookie{Name: sessions.CookieName, Value: "door-session"}
+
+	rec := sessionRequest(r, "GET", "/admin/dashboard", session)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/account/two-factor" {
+		t.Errorf("Expected staff without two-factor authentication to be sent to set it up, got %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+	if rec := sessionRequest(r, "POST", "/api/v1/checkin", session); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected the API to refuse staff without two-factor authentication, got %d", rec.Code)
+	}
+	if rec := sessionRequest(r, "GET", "/account/two-factor", session); rec.Code != http.StatusOK {
+		t.Errorf("Expected staff to reach the two-factor page, got %d", rec.Code)
+	}
+	if rec := postForm(r, "/account/two-factor/start", url.Values{}, session); rec.Code != http.StatusSeeOther {
+		t.Fatalf("Expected staff to start setting up two-factor authentication, got %d", rec.Code)
+	}
+
+	database.DB.First(&staff, staff.ID)
+	code, _ := totp.Code(staff.TOTPSecret, time.Now())
+	if rec := postForm(r, "/account/two-factor/enable", url.Values{"code": {code}}, session); rec.Code != http.StatusOK {
+		t.Fatalf("Expected two-factor authentication to be turned on, got %d", rec.Code)
+	}
+	if rec := sessionRequest(r, "GET", "/admin/dashboard", session); rec.Code != http.StatusOK {
+		t.Errorf("Expected staff with two-factor authentication to use the back office, got %d", rec.Code)
+	}
+}
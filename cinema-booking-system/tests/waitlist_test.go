@@ -0,0 +1,218 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JoeDkhar/cinema-booking-system/internal/database"
+	"github.com/JoeDkhar/cinema-booking-system/internal/handlers"
+	"github.com/JoeDkhar/cinema-booking-system/internal/models"
+	"github.com/gorilla/mux"
+)
+
+// waitlistTestEntry is a waitlist entry as returned by the API
+type waitlistTestEntry struct {
+	Token    string `json:"token"`
+	Status   string `json:"status"`
+	Position int    `json:"position"`
+	Offer    *struct {
+		Reference string       `json:"reference"`
+		Seats     models.Seats `json:"seats"`
+	} `json:"offer"`
+}
+
+// newWaitlistRouter serves the waitlist API and claim links
+func newWaitlistRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/waitlist/{token}/claim", handlers.ClaimWaitlistHandler).Methods("GET")
+	api := r.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/shows/{id:[0-9]+}/waitlist", handlers.APIJoinWaitlistHandler).Methods("POST")
+	api.HandleFunc("/waitlist/{token}", handlers.APIWaitlistDetailHandler).Methods("GET")
+	api.HandleFunc("/waitlist/{token}", handlers.APILeaveWaitlistHandler).Methods("DELETE")
+	return r
+}
+
+// waitlistEntry decodes the waitlist entry of an API response
+func waitlistEntry(t *testing.T, response handlers.APIResponse) waitlistTestEntry {
+	var entry waitlistTestEntry
+	data, _ := json.Marshal(response.Data)
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatalf("Error decoding waitlist entry %s: %v", data, err)
+	}
+	return entry
+}
+
+// joinTestWaitlist puts a customer on the waitlist of a show
+func joinTestWaitlist(t *testing.T, r http.Handler, show models.Show, email string, seats int) waitlistTestEntry {
+	status, response := apiRequest(t, r, "POST", "/api/v1/shows/"+strconv.Itoa(int(show.ID))+"/waitlist", map[string]interface{}{
+		"customer_name": "Waiting " + email,
+		"email":         email,
+		"seats":         seats,
+	})
+	if status != http.StatusCreated {
+		t.Fatalf("Expected %s to join the waitlist, got %d %s", email, status, response.Error)
+	}
+	return waitlistEntry(t, response)
+}
+
+// getWaitlistEntry fetches a waitlist entry through the API
+func getWaitlistEntry(t *testing.T, r http.Handler, token string) waitlistTestEntry {
+	status, response := apiRequest(t, r, "GET", "/api/v1/waitlist/"+token, nil)
+	if status != http.StatusOK {
+		t.Fatalf("Expected the waitlist entry, got %d %s", status, response.Error)
+	}
+	return waitlistEntry(t, response)
+}
+
+// Test that seats freed on a sold-out show are offered down the waitlist
+func TestWaitlistOffers(t *testing.T) {
+	database.DB.Exec("DELETE FROM waitlist_entries")
+	outbox, server, show := setupNotifications(t)
+	r := newWaitlistRouter()
+
+	// Everything but A1 and A2 is sold already
+	var layout models.Hall
+	database.DB.First(&layout, show.HallID)
+	var rest models.Seats
+	for _, seat := range layout.Layout.AllSeats() {
+		if seat.Row != "A" || seat.Number > 2 {
+			rest = append(rest, seat)
+		}
+	}
+	house := models.Booking{
+		ShowID:       show.ID,
+		CustomerName: "Full House",
+		Email:        "house@example.com",
+		Seats:        rest,
+		BookingTime:  time.Now(),
+		TotalAmount:  usd(98000),
+		Status:       models.BookingConfirmed,
+	}
+	if err := database.DB.Create(&house).Error; err != nil {
+		t.Fatalf("Error creating booking: %v", err)
+	}
+
+	// Customers are told to book while enough seats are left
+	status, response := apiRequest(t, r, "POST", "/api/v1/shows/"+strconv.Itoa(int(show.ID))+"/waitlist", map[string]interface{}{
+		"customer_name": "Too Early", "email": "early@example.com", "seats": 2,
+	})
+	if status != http.StatusConflict || errorCode(response) != string(handlers.ErrCodeSeatsAvailable) {
+		t.Errorf("Expected the free seats to be bookable, got %d %v", status, response.Error)
+	}
+
+	pair := submitBooking(handlers.BookingRequest{
+		ShowID:       show.ID,
+		CustomerName: "Pair",
+		Email:        "pair@example.com",
+		Seats:        models.Seats{{Row: "A", Number: 1}, {Row: "A", Number: 2}},
+	})
+	if !pair.Success {
+		t.Fatalf("Expected booking to succeed, got %s", pair.ErrorMessage)
+	}
+	outbox.Flush(context.Background())
+
+	first := joinTestWaitlist(t, r, show, "first@example.com", 3)
+	second := joinTestWaitlist(t, r, show, "second@example.com", 2)
+	third := joinTestWaitlist(t, r, show, "third@example.com", 2)
+	if first.Position != 1 || second.Position != 2 || third.Position != 3 || first.Status != "waiting" {
+		t.Errorf("Expected the entries to queue in order, got %+v %+v %+v", first, second, third)
+	}
+
+	status, response = apiRequest(t, r, "POST", "/api/v1/shows/"+strconv.Itoa(int(show.ID))+"/waitlist", map[string]interface{}{
+		"customer_name": "Again", "email": "FIRST@example.com", "seats": 1,
+	})
+	if status != http.StatusConflict || errorCode(response) != string(handlers.ErrCodeAlreadyWaitlisted) {
+		t.Errorf("Expected a second entry to be refused, got %d %v", status, response.Error)
+	}
+
+	// Freed seats skip customers wanting more than are free
+	if cancelled := submitBooking(handlers.BookingRequest{Action: handlers.ActionCancel, BookingID: pair.BookingID}); !cancelled.Success {
+		t.Fatalf("Expected cancellation to succeed, got %s", cancelled.ErrorMessage)
+	}
+	second = getWaitlistEntry(t, r, second.Token)
+	if second.Status != "offered" || second.Offer == nil || second.Offer.Seats.String() != "A1, A2" {
+		t.Fatalf("Expected A1 and A2 to be offered to the second customer, got %+v", second)
+	}
+	if first = getWaitlistEntry(t, r, first.Token); first.Status != "waiting" || first.Position != 1 {
+		t.Errorf("Expected the first customer to keep waiting, got %+v", first)
+	}
+	if third = getWaitlistEntry(t, r, third.Token); third.Position != 2 {
+		t.Errorf("Expected the third customer to move up, got %+v", third)
+	}
+
+	if sent := outbox.Flush(context.Background()); sent != 2 {
+		t.Fatalf("Expected a cancellation and an offer email, got %d", sent)
+	}
+	offer := parseMail(t, server.messages()[len(server.messages())-1])
+	if !strings.Contains(offer.Subject, "Seats are available") || !strings.Contains(offer.Text, "https://cinema.test/waitlist/"+second.Token+"/claim") {
+		t.Errorf("Unexpected offer email %q:\n%s", offer.Subject, offer.Text)
+	}
+
+	// An unclaimed offer falls through to the next customer
+	var secondOffer models.Booking
+	database.DB.Where("reference = ?", second.Offer.Reference).First(&secondOffer)
+	database.DB.Model(&secondOffer).UpdateColumn("expires_at", time.Now().Add(-time.Minute))
+	if late := submitBooking(handlers.BookingRequest{Action: handlers.ActionConfirm, BookingID: secondOffer.ID}); late.Success {
+		t.Fatalf("Expected the lapsed offer to be refused")
+	}
+	if second = getWaitlistEntry(t, r, second.Token); second.Status != "expired" || second.Offer != nil {
+		t.Errorf("Expected the second customer's offer to expire, got %+v", second)
+	}
+	third = getWaitlistEntry(t, r, third.Token)
+	if third.Status != "offered" || third.Offer == nil || third.Offer.Seats.String() != "A1, A2" {
+		t.Fatalf("Expected the seats to be offered to the third customer, got %+v", third)
+	}
+
+	// The claim link leads to checkout, and confirming claims the seats
+	req := httptest.NewRequest("GET", "/waitlist/"+third.Token+"/claim", nil)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/booking/checkout/"+third.Offer.Reference {
+		t.Errorf("Expected to be sent to checkout, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	var thirdOffer models.Booking
+	database.DB.Where("reference = ?", third.Offer.Reference).First(&thirdOffer)
+	if confirmed := submitBooking(handlers.BookingRequest{Action: handlers.ActionConfirm, BookingID: thirdOffer.ID}); !confirmed.Success {
+		t.Fatalf("Expected the offer to be claimed, got %s", confirmed.ErrorMessage)
+	}
+	if third = getWaitlistEntry(t, r, third.Token); third.Status != "claimed" {
+		t.Errorf("Expected the third customer to have claimed the seats, got %+v", third)
+	}
+
+	// Leaving with an offer frees the seats again
+	if cancelled := submitBooking(handlers.BookingRequest{
+		Action:    handlers.ActionCancel,
+		BookingID: house.ID,
+		Seats:     models.Seats{{Row: "B", Number: 4}, {Row: "B", Number: 5}, {Row: "B", Number: 6}},
+	}); !cancelled.Success {
+		t.Fatalf("Expected cancellation to succeed, got %s", cancelled.ErrorMessage)
+	}
+	first = getWaitlistEntry(t, r, first.Token)
+	if first.Status != "offered" || first.Offer == nil || first.Offer.Seats.String() != "B4, B5, B6" {
+		t.Fatalf("Expected B4 to B6 to be offered to the first customer, got %+v", first)
+	}
+
+	status, response = apiRequest(t, r, "DELETE", "/api/v1/waitlist/"+first.Token, nil)
+	if status != http.StatusOK || waitlistEntry(t, response).Status != "left" {
+		t.Fatalf("Expected the first customer to leave, got %d %v", status, response.Error)
+	}
+	var firstOffer models.Booking
+	database.DB.Where("reference = ?", first.Offer.Reference).First(&firstOffer)
+	if firstOffer.Status != models.BookingReleased {
+		t.Errorf("Expected the offered seats to be released, got %s", firstOffer.Status)
+	}
+
+	status, response = apiRequest(t, r, "DELETE", "/api/v1/waitlist/"+first.Token, nil)
+	if status != http.StatusConflict {
+		t.Errorf("Expected leaving twice to be refused, got %d", status)
+	}
+	if status, _ := apiRequest(t, r, "GET", "/api/v1/waitlist/unknown", nil); status != http.StatusNotFound {
+		t.Errorf("Expected an unknown entry to be missing, got %d", status)
+	}
+}